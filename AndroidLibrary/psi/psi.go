@@ -25,6 +25,7 @@ package psi
 // Start/Stop interface on top of a single Controller instance.
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -34,6 +35,7 @@ import (
 type PsiphonProvider interface {
 	Notice(noticeJSON string)
 	HasNetworkConnectivity() int
+	GetNetworkID() string
 	BindToDevice(fileDescriptor int) error
 	GetPrimaryDnsServer() string
 	GetSecondaryDnsServer() string
@@ -61,6 +63,7 @@ func Start(
 		return fmt.Errorf("error loading configuration file: %s", err)
 	}
 	config.NetworkConnectivityChecker = provider
+	config.NetworkIDGetter = provider
 
 	if useDeviceBinder {
 		config.DeviceBinder = provider
@@ -123,6 +126,33 @@ func Stop() {
 	}
 }
 
+// This is a passthrough to Controller.SetSplitTunnelRules. rulesJson is a
+// JSON encoded psiphon.SplitTunnelRules; an empty string clears the rules.
+// Note: should only be called after Start() and before Stop(); otherwise,
+// will silently take no action.
+func SetSplitTunnelRules(rulesJson string) error {
+
+	var rules *psiphon.SplitTunnelRules
+	if rulesJson != "" {
+		rules = new(psiphon.SplitTunnelRules)
+		err := json.Unmarshal([]byte(rulesJson), rules)
+		if err != nil {
+			return fmt.Errorf("error decoding split tunnel rules: %s", err)
+		}
+	}
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		err := controller.SetSplitTunnelRules(rules)
+		if err != nil {
+			return fmt.Errorf("error setting split tunnel rules: %s", err)
+		}
+	}
+	return nil
+}
+
 // This is a passthrough to Controller.SetClientVerificationPayload.
 // Note: should only be called after Start() and before Stop(); otherwise,
 // will silently take no action.
@@ -295,6 +295,11 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return hasConnectivity ? 1 : 0;
     }
 
+    @Override
+    public String GetNetworkID() {
+        return getNetworkID(mHostService.getContext());
+    }
+
     @Override
     public String GetPrimaryDnsServer() {
         String dnsResolver = null;
@@ -646,6 +651,23 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return networkInfo != null && networkInfo.isConnected();
     }
 
+    private static String getNetworkID(Context context) {
+        // The network ID is the active network type and, when available, the
+        // Wi-Fi SSID or mobile APN. The ID is only used to keep connection
+        // state separate for each network; a blank value is "unknown".
+        ConnectivityManager connectivityManager =
+                (ConnectivityManager)context.getSystemService(Context.CONNECTIVITY_SERVICE);
+        NetworkInfo networkInfo = connectivityManager.getActiveNetworkInfo();
+        if (networkInfo == null) {
+            return "";
+        }
+        String networkID = networkInfo.getTypeName();
+        if (networkInfo.getExtraInfo() != null) {
+            networkID += "-" + networkInfo.getExtraInfo();
+        }
+        return networkID;
+    }
+
     private static class PrivateAddress {
         final public String mIpAddress;
         final public String mSubnet;
@@ -140,6 +140,11 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return hasConnectivity ? 1 : 0;
     }
 
+    @Override
+    public String GetNetworkID() {
+        return getNetworkID(mTunneledApp.getContext());
+    }
+
     private static boolean hasNetworkConnectivity(Context context) {
         ConnectivityManager connectivityManager =
                 (ConnectivityManager)context.getSystemService(Context.CONNECTIVITY_SERVICE);
@@ -147,6 +152,23 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return networkInfo != null && networkInfo.isConnected();
     }
 
+    private static String getNetworkID(Context context) {
+        // The network ID is the active network type and, when available, the
+        // Wi-Fi SSID or mobile APN. The ID is only used to keep connection
+        // state separate for each network; a blank value is "unknown".
+        ConnectivityManager connectivityManager =
+                (ConnectivityManager)context.getSystemService(Context.CONNECTIVITY_SERVICE);
+        NetworkInfo networkInfo = connectivityManager.getActiveNetworkInfo();
+        if (networkInfo == null) {
+            return "";
+        }
+        String networkID = networkInfo.getTypeName();
+        if (networkInfo.getExtraInfo() != null) {
+            networkID += "-" + networkInfo.getExtraInfo();
+        }
+        return networkID;
+    }
+
     @Override
     public String GetPrimaryDnsServer() {
         // This PsiphonProvider function is only called in TunnelWholeDevice mode
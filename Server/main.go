@@ -20,10 +20,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -35,9 +37,12 @@ func main() {
 
 	var generateServerIPaddress, generateServerNetworkInterface string
 	var generateConfigFilename, generateServerEntryFilename string
-	var generateWebServerPort int
+	var generateServerListFilename, generateClientConfigFilename string
+	var generateServerListURL string
+	var generateWebServerPort, generateServerCount, generatePortStride int
 	var generateProtocolPorts stringListFlag
 	var runConfigFilenames stringListFlag
+	var rulesCountry, rulesTunnelProtocol string
 
 	flag.StringVar(
 		&generateConfigFilename,
@@ -51,6 +56,36 @@ func main() {
 		server.SERVER_ENTRY_FILENAME,
 		"generate new server entry with this `filename`")
 
+	flag.StringVar(
+		&generateServerListFilename,
+		"newServerList",
+		server.SERVER_LIST_FILENAME,
+		"generate new signed remote server list with this `filename`")
+
+	flag.StringVar(
+		&generateClientConfigFilename,
+		"newClientConfig",
+		server.CLIENT_CONFIG_FILENAME,
+		"generate new client config with this `filename`")
+
+	flag.StringVar(
+		&generateServerListURL,
+		"serverListURL",
+		"",
+		"generate client config with this remote server list `URL`; the generated server list must be hosted at this URL")
+
+	flag.IntVar(
+		&generateServerCount,
+		"servers",
+		1,
+		"generate this `number` of servers; config and server entry filenames are numbered when greater than 1")
+
+	flag.IntVar(
+		&generatePortStride,
+		"portStride",
+		server.DEFAULT_SERVER_PORT_STRIDE,
+		"generate each additional server with ports offset by this `number`")
+
 	flag.StringVar(
 		&generateServerNetworkInterface,
 		"interface",
@@ -79,12 +114,29 @@ func main() {
 		"config",
 		"run with this config `filename`; flag may be repeated to load multiple config files")
 
+	flag.StringVar(
+		&rulesCountry,
+		"country",
+		"",
+		"show rules for clients in this `country` (ISO 3166-1 alpha-2 code)")
+
+	flag.StringVar(
+		&rulesTunnelProtocol,
+		"tunnelProtocol",
+		"",
+		"show rules for clients using this `tunnel protocol`")
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
 			"Usage:\n\n"+
-				"%s <flags> generate    generates a configuration and server entry\n"+
-				"%s <flags> run         runs configured services\n\n",
-			os.Args[0], os.Args[0])
+				"%s <flags> generate    generates server configurations and server entries,\n"+
+				"                       a signed remote server list, and a client configuration\n"+
+				"%s <flags> run         runs configured services\n"+
+				"%s <flags> validate    checks configuration files and reports all problems\n"+
+				"%s <flags> show        prints the effective configuration, with secrets redacted\n"+
+				"%s <flags> rules       prints the effective traffic rules and rate limits\n"+
+				"                       for -country and -tunnelProtocol\n\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 
@@ -102,8 +154,10 @@ func main() {
 		if generateServerNetworkInterface != "" {
 			var err error
 			serverIPaddress, err = psiphon.GetInterfaceIPAddress(generateServerNetworkInterface)
-			fmt.Printf("generate failed: %s\n", err)
-			os.Exit(1)
+			if err != nil {
+				fmt.Printf("generate failed: %s\n", err)
+				os.Exit(1)
+			}
 		}
 
 		tunnelProtocolPorts := make(map[string]int)
@@ -119,52 +173,153 @@ func main() {
 			}
 		}
 
-		configFileContents, serverEntryFileContents, err :=
-			server.GenerateConfig(
-				serverIPaddress,
-				generateWebServerPort,
-				tunnelProtocolPorts)
+		bundle, err := server.GenerateBundle(
+			&server.BundleParams{
+				ServerIPAddress:     serverIPaddress,
+				WebServerPort:       generateWebServerPort,
+				TunnelProtocolPorts: tunnelProtocolPorts,
+				ServerCount:         generateServerCount,
+				PortStride:          generatePortStride,
+				RemoteServerListURL: generateServerListURL,
+			})
 		if err != nil {
 			fmt.Printf("generate failed: %s\n", err)
 			os.Exit(1)
 		}
 
-		err = ioutil.WriteFile(generateConfigFilename, configFileContents, 0600)
+		for i, configFileContents := range bundle.ServerConfigs {
+			filename := generateConfigFilename
+			if len(bundle.ServerConfigs) > 1 {
+				filename = numberedFilename(filename, i+1)
+			}
+			err = ioutil.WriteFile(filename, configFileContents, 0600)
+			if err != nil {
+				fmt.Printf("error writing configuration file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		for i, serverEntryFileContents := range bundle.ServerEntries {
+			filename := generateServerEntryFilename
+			if len(bundle.ServerEntries) > 1 {
+				filename = numberedFilename(filename, i+1)
+			}
+			err = ioutil.WriteFile(filename, serverEntryFileContents, 0600)
+			if err != nil {
+				fmt.Printf("error writing server entry file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		err = ioutil.WriteFile(generateServerListFilename, bundle.RemoteServerListPackage, 0600)
 		if err != nil {
-			fmt.Printf("error writing configuration file: %s\n", err)
+			fmt.Printf("error writing server list file: %s\n", err)
 			os.Exit(1)
 		}
 
-		err = ioutil.WriteFile(generateServerEntryFilename, serverEntryFileContents, 0600)
+		err = ioutil.WriteFile(generateClientConfigFilename, bundle.ClientConfig, 0600)
 		if err != nil {
-			fmt.Printf("error writing server entry file: %s\n", err)
+			fmt.Printf("error writing client configuration file: %s\n", err)
 			os.Exit(1)
 		}
 
 	} else if args[0] == "run" {
 
-		if len(runConfigFilenames) == 0 {
-			runConfigFilenames = []string{server.SERVER_CONFIG_FILENAME}
+		configFileContents := loadConfigFiles(runConfigFilenames)
+
+		err := server.RunServices(configFileContents)
+		if err != nil {
+			fmt.Printf("run failed: %s\n", err)
+			os.Exit(1)
 		}
 
-		var configFileContents [][]byte
+	} else if args[0] == "validate" {
 
-		for _, configFilename := range runConfigFilenames {
-			contents, err := ioutil.ReadFile(configFilename)
-			if err != nil {
-				fmt.Printf("error loading configuration file: %s\n", err)
-				os.Exit(1)
-			}
+		configFileContents := loadConfigFiles(runConfigFilenames)
 
-			configFileContents = append(configFileContents, contents)
+		_, errs := server.ValidateConfig(configFileContents)
+		for _, err := range errs {
+			fmt.Printf("invalid configuration: %s\n", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
 		}
 
-		err := server.RunServices(configFileContents)
+	} else if args[0] == "show" {
+
+		config, err := server.LoadConfig(loadConfigFiles(runConfigFilenames))
 		if err != nil {
-			fmt.Printf("run failed: %s\n", err)
+			fmt.Printf("error loading configuration: %s\n", err)
+			os.Exit(1)
+		}
+
+		redactedConfig, err := config.RedactedJSON()
+		if err != nil {
+			fmt.Printf("show failed: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s\n", redactedConfig)
+
+	} else if args[0] == "rules" {
+
+		config, err := server.LoadConfig(loadConfigFiles(runConfigFilenames))
+		if err != nil {
+			fmt.Printf("error loading configuration: %s\n", err)
+			os.Exit(1)
+		}
+
+		trafficRules := config.GetTrafficRules(rulesCountry)
+
+		rules, err := json.MarshalIndent(
+			struct {
+				TrafficRules server.TrafficRules
+				RateLimits   server.RateLimits
+			}{
+				TrafficRules: trafficRules,
+				RateLimits:   trafficRules.GetRateLimits(rulesTunnelProtocol),
+			}, "", "    ")
+		if err != nil {
+			fmt.Printf("rules failed: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s\n", rules)
+
+	} else {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// loadConfigFiles reads the specified config files, or the default config
+// file when none are specified. The process exits when a file can't be read.
+func loadConfigFiles(configFilenames []string) [][]byte {
+
+	if len(configFilenames) == 0 {
+		configFilenames = []string{server.SERVER_CONFIG_FILENAME}
+	}
+
+	var configFileContents [][]byte
+
+	for _, configFilename := range configFilenames {
+		contents, err := ioutil.ReadFile(configFilename)
+		if err != nil {
+			fmt.Printf("error loading configuration file: %s\n", err)
 			os.Exit(1)
 		}
+
+		configFileContents = append(configFileContents, contents)
 	}
+
+	return configFileContents
+}
+
+// numberedFilename inserts a number before the filename extension, for
+// example "psiphon-server.config" becomes "psiphon-server-2.config".
+func numberedFilename(filename string, number int) string {
+	extension := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(filename, extension), number, extension)
 }
 
 type stringListFlag []string
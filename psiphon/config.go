@@ -23,7 +23,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"time"
 )
@@ -34,6 +37,8 @@ const (
 	LEGACY_DATA_STORE_FILENAME                           = "psiphon.db"
 	DATA_STORE_FILENAME                                  = "psiphon.boltdb"
 	CONNECTION_WORKER_POOL_SIZE                          = 10
+	ESTABLISH_TUNNEL_CANDIDATES_PER_SERVER_ENTRY         = 1
+	ESTABLISH_TUNNEL_RACE_SIZE                           = 3
 	TUNNEL_POOL_SIZE                                     = 1
 	TUNNEL_CONNECT_TIMEOUT_SECONDS                       = 20
 	TUNNEL_OPERATE_SHUTDOWN_TIMEOUT                      = 1 * time.Second
@@ -45,10 +50,22 @@ const (
 	TUNNEL_SSH_KEEP_ALIVE_PERIODIC_INACTIVE_PERIOD       = 10 * time.Second
 	TUNNEL_SSH_KEEP_ALIVE_PROBE_TIMEOUT_SECONDS          = 5
 	TUNNEL_SSH_KEEP_ALIVE_PROBE_INACTIVE_PERIOD          = 10 * time.Second
+	TUNNEL_HANDOVER_DEGRADED_RTT_MILLISECONDS            = 2000
+	TUNNEL_HANDOVER_DRAIN_TIMEOUT_SECONDS                = 300
+	TUNNEL_HANDOVER_DRAIN_CHECK_PERIOD                   = 1 * time.Second
 	ESTABLISH_TUNNEL_TIMEOUT_SECONDS                     = 300
 	ESTABLISH_TUNNEL_WORK_TIME                           = 60 * time.Second
 	ESTABLISH_TUNNEL_PAUSE_PERIOD_SECONDS                = 5
 	ESTABLISH_TUNNEL_SERVER_AFFINITY_GRACE_PERIOD        = 1 * time.Second
+	SOCKS_PROXY_HANDSHAKE_TIMEOUT                        = 30 * time.Second
+	SOCKS_PROXY_UDP_IDLE_TIMEOUT_SECONDS                 = 60
+	LOCAL_PROXY_USER_BYTES_TRANSFERRED_NOTICE_PERIOD     = 5 * time.Minute
+	DNS_PROXY_QUERY_TIMEOUT                              = 10 * time.Second
+	DNS_PROXY_TCP_IDLE_TIMEOUT                           = 30 * time.Second
+	DNS_PROXY_UDP_WORKER_POOL_SIZE                       = 10
+	DNS_PROXY_CACHE_MAX_ENTRIES                          = 1000
+	DNS_PROXY_CACHE_MAX_TTL                              = 1 * time.Hour
+	DNS_PROXY_UNTUNNELED_TTL                             = 1 * time.Minute
 	HTTP_PROXY_ORIGIN_SERVER_TIMEOUT_SECONDS             = 15
 	HTTP_PROXY_MAX_IDLE_CONNECTIONS_PER_HOST             = 50
 	FETCH_REMOTE_SERVER_LIST_TIMEOUT_SECONDS             = 30
@@ -67,12 +84,20 @@ const (
 	PSIPHON_API_TUNNEL_STATS_MAX_COUNT                   = 1000
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_RETRY_PERIOD = 5 * time.Second
 	FETCH_ROUTES_TIMEOUT_SECONDS                         = 60
+	SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES        = 10000
+	SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_TTL            = 1 * time.Hour
+	SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL       = 30 * time.Second
+	SPLIT_TUNNEL_CLASSIFICATION_CACHE_SWEEP_PERIOD       = 1 * time.Minute
+	SPLIT_TUNNEL_CLASSIFICATION_CACHE_NOTICE_PERIOD      = 5 * time.Minute
 	DOWNLOAD_UPGRADE_TIMEOUT                             = 15 * time.Minute
 	DOWNLOAD_UPGRADE_RETRY_PERIOD_SECONDS                = 30
 	DOWNLOAD_UPGRADE_STALE_PERIOD                        = 6 * time.Hour
 	IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION            = 2 * time.Minute
 	IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD           = 3
+	IMPAIRED_PROTOCOL_CLASSIFICATION_DECAY               = 30 * time.Minute
 	TOTAL_BYTES_TRANSFERRED_NOTICE_PERIOD                = 5 * time.Minute
+	UNKNOWN_NETWORK_ID                                   = "UNKNOWN"
+	REPLAY_DIAL_PARAMETERS_TTL                           = 24 * time.Hour
 )
 
 // To distinguish omitted timeout params from explicit 0 value timeout
@@ -177,21 +202,125 @@ type Config struct {
 	// port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// UdpgwServerAddress specifies the udpgw server address, in host:port
+	// form, to which the local SOCKS proxy relays UDP ASSOCIATE datagrams.
+	// Datagrams are relayed through a tunneled port forward to this address,
+	// which must match the Psiphon server's UDPInterceptUdpgwServerAddress;
+	// e.g., "127.0.0.1:7300". When blank, UDP ASSOCIATE is not supported.
+	UdpgwServerAddress string
+
+	// LocalSocksProxyUDPIdleTimeoutSeconds specifies how long a SOCKS UDP
+	// association may be idle, with no datagrams relayed in either
+	// direction, before it's closed. The default, 0, uses
+	// SOCKS_PROXY_UDP_IDLE_TIMEOUT_SECONDS.
+	LocalSocksProxyUDPIdleTimeoutSeconds int
+
+	// LocalProxyUsers is a list of users which may authenticate to the local
+	// SOCKS and HTTP proxies. When set, the proxies require authentication,
+	// which is recommended when ListenInterface is not the loopback
+	// interface. SOCKS4 clients, which can't authenticate, are refused. See
+	// LocalProxyUser for the per-user options.
+	LocalProxyUsers []*LocalProxyUser
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a free
 	// port (a notice reporting the selected port is emitted).
 	LocalHttpProxyPort int
 
+	// LocalTransparentProxyPort specifies a port number for the local
+	// transparent TCP proxy, which accepts connections redirected by
+	// iptables REDIRECT or TPROXY rules and relays each connection to its
+	// original destination, subject to split tunnel classification. The
+	// proxy listens on ListenInterface. The default, 0, disables the
+	// transparent proxy, which is only supported on Linux.
+	// The iptables rules must exclude the client's own connections,
+	// including untunneled split tunnel connections, to avoid redirect
+	// loops; e.g., using an owner match.
+	LocalTransparentProxyPort int
+
+	// LocalTransparentProxyTPROXY sets IP_TRANSPARENT on the transparent
+	// proxy listener, which is required to accept connections redirected
+	// by iptables TPROXY rules. This requires CAP_NET_ADMIN.
+	LocalTransparentProxyTPROXY bool
+
+	// LocalDnsProxyPort specifies a port number for the local DNS proxy,
+	// which accepts UDP and TCP DNS queries and forwards them through the
+	// tunnel, over TCP, to LocalDnsProxyServer. Responses are cached
+	// according to their TTLs. When split tunnel is enabled, A and AAAA
+	// queries for domains classified as untunneled by domain suffix are
+	// resolved with an untunneled lookup. The proxy listens on
+	// LocalDnsProxyListenInterface. The default, 0, disables the DNS proxy.
+	LocalDnsProxyPort int
+
+	// LocalDnsProxyListenInterface specifies which interface the local DNS
+	// proxy listens on, as for ListenInterface. The DNS proxy doesn't
+	// authenticate clients, so, unlike the other local proxies, it listens
+	// on 127.0.0.1, and not ListenInterface, when this is blank.
+	LocalDnsProxyListenInterface string
+
+	// LocalDnsProxyServer specifies the IP address of the DNS server to
+	// which the local DNS proxy forwards queries. The DNS server must
+	// support TCP requests. When blank, SplitTunnelDnsServer is used. Not
+	// used when TunneledDnsOverHttpsUrl is configured.
+	LocalDnsProxyServer string
+
 	// ConnectionWorkerPoolSize specifies how many connection attempts to attempt
 	// in parallel. The default, 0, uses CONNECTION_WORKER_POOL_SIZE which is
 	// recommended.
 	ConnectionWorkerPoolSize int
 
+	// EstablishTunnelCandidatesPerServerEntry specifies the maximum number of
+	// connection attempts, each with a different protocol, fronting address or
+	// SNI, to make to a single server in one round of establishment. The
+	// default, 0, uses ESTABLISH_TUNNEL_CANDIDATES_PER_SERVER_ENTRY, which
+	// makes one attempt per server. Negative values are invalid.
+	EstablishTunnelCandidatesPerServerEntry int
+
+	// EstablishTunnelRaceStaggerMilliseconds enables racing mode when set.
+	// In racing mode, at the start of each round of establishment, the top-
+	// ranked candidates with distinct protocols are started one after another,
+	// with this delay in between, and the first to complete its SSH handshake
+	// wins. This reduces the time to connect on networks where a protocol is
+	// silently blackholed. The default, 0, disables racing.
+	EstablishTunnelRaceStaggerMilliseconds int
+
+	// EstablishTunnelRaceSize specifies the maximum number of candidates to
+	// race in racing mode. The default, 0, uses ESTABLISH_TUNNEL_RACE_SIZE.
+	EstablishTunnelRaceSize int
+
 	// TunnelPoolSize specifies how many tunnels to run in parallel. Port forwards
 	// are multiplexed over multiple tunnels. The default, 0, uses TUNNEL_POOL_SIZE
 	// which is recommended.
 	TunnelPoolSize int
 
+	// TunnelPoolLoadBalancingPolicy specifies how port forwards are distributed
+	// across the tunnels in the pool, when TunnelPoolSize is greater than 1. See
+	// SupportedLoadBalancingPolicies and selectTunnel. The default, "", uses
+	// ROUND-ROBIN.
+	TunnelPoolLoadBalancingPolicy string
+
+	// EnableTunnelHandover enables handover mode. In handover mode, a standby
+	// tunnel, to another server, is established in addition to the pool of
+	// active tunnels. When an active tunnel degrades -- an SSH keep alive
+	// exceeds TunnelHandoverDegradedRTTMilliseconds -- the standby tunnel
+	// replaces it in the pool. New port forwards use the replacement, while
+	// existing port forwards continue on the degraded tunnel until they close
+	// or TunnelHandoverDrainTimeoutSeconds elapses. When an active tunnel
+	// fails, including when a keep alive probe fails, it's closed and the
+	// standby tunnel replaces it immediately. A new standby tunnel is then
+	// established.
+	EnableTunnelHandover bool
+
+	// TunnelHandoverDegradedRTTMilliseconds is the SSH keep alive round trip
+	// time above which a tunnel is considered degraded in handover mode. The
+	// default, 0, uses TUNNEL_HANDOVER_DEGRADED_RTT_MILLISECONDS.
+	TunnelHandoverDegradedRTTMilliseconds int
+
+	// TunnelHandoverDrainTimeoutSeconds is the maximum time a degraded tunnel
+	// is kept open, after handover, for existing port forwards to complete.
+	// The default, 0, uses TUNNEL_HANDOVER_DRAIN_TIMEOUT_SECONDS.
+	TunnelHandoverDrainTimeoutSeconds int
+
 	// UpstreamProxyUrl is a URL specifying an upstream proxy to use for all
 	// outbound connections. The URL should include proxy type and authentication
 	// information, as required. See example URLs here:
@@ -203,6 +332,15 @@ type Config struct {
 	// only applicable to library deployments.
 	NetworkConnectivityChecker NetworkConnectivityChecker
 
+	// NetworkIDGetter is an interface that enables the core tunnel to call
+	// into the host application to identify the current network. Server
+	// candidate ranking, impaired protocol classification, and server
+	// affinity are all kept separately for each network, as blocking can be
+	// very different between, say, a Wi-Fi network and a mobile network.
+	// When not set, all networks share one state. This parameter is only
+	// applicable to library deployments.
+	NetworkIDGetter NetworkIDGetter
+
 	// DeviceBinder is an interface that enables the core tunnel to call
 	// into the host application to bind sockets to specific devices. This is used
 	// for VPN routing exclusion. This parameter is only applicable to library
@@ -251,6 +389,28 @@ type Config struct {
 	// server must support TCP requests.
 	SplitTunnelDnsServer string
 
+	// TunneledDnsOverHttpsUrl specifies a DNS over HTTPS (RFC 8484) server
+	// URL; e.g., "https://dns.example.com/dns-query". When set, tunneled DNS
+	// requests, made for split tunnel classification and by the local DNS
+	// proxy, are sent to this server, through the tunnel, in place of
+	// SplitTunnelDnsServer and LocalDnsProxyServer.
+	TunneledDnsOverHttpsUrl string
+
+	// TunneledDnsOverHttpsBootstrapIP specifies an IP address at which to
+	// connect to the TunneledDnsOverHttpsUrl server. When blank, the URL
+	// hostname is resolved by the Psiphon server. The URL hostname is always
+	// used for TLS certificate verification.
+	TunneledDnsOverHttpsBootstrapIP string
+
+	// SplitTunnelRules specifies user-defined split tunnel rules: domain
+	// suffixes, CIDRs and ports which are always tunneled or never tunneled.
+	// These rules are evaluated before the region routes, and apply even when
+	// the other SplitTunnel parameters are not supplied; CIDR rules for
+	// hostname destinations require SplitTunnelDnsServer or
+	// TunneledDnsOverHttpsUrl. The rules may be replaced at runtime with
+	// Controller.SetSplitTunnelRules.
+	SplitTunnelRules *SplitTunnelRules
+
 	// UpgradeDownloadUrl specifies a URL from which to download a host client upgrade
 	// file, when one is available. The core tunnel controller provides a resumable
 	// download facility which downloads this resource and emits a notice when complete.
@@ -376,6 +536,42 @@ type Config struct {
 	// and for asynchronous operations such as fetch remote server list to complete.
 	// If omitted, the default value is ESTABLISH_TUNNEL_PAUSE_PERIOD_SECONDS.
 	EstablishTunnelPausePeriodSeconds *int
+
+	// ImpairedProtocolClassificationThreshold is the number of early tunnel
+	// failures after which a protocol is classified as impaired and skipped
+	// during establishment. See Controller.classifyImpairedProtocol.
+	// The default, 0, uses IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD.
+	ImpairedProtocolClassificationThreshold int
+
+	// ImpairedProtocolClassificationDurationSeconds is the window, from the
+	// start of a tunnel, within which a tunnel failure counts towards
+	// classifying its protocol as impaired. A tunnel which fails after this
+	// window resets its protocol's classification.
+	// The default, 0, uses IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION.
+	ImpairedProtocolClassificationDurationSeconds int
+
+	// ImpairedProtocolClassificationDecaySeconds is the period after which
+	// each early tunnel failure counted towards a protocol's classification
+	// is forgotten. Classifications are persisted, so this decay is what
+	// eventually restores an impaired protocol, including across restarts.
+	// The default, 0, uses IMPAIRED_PROTOCOL_CLASSIFICATION_DECAY.
+	ImpairedProtocolClassificationDecaySeconds int
+
+	// ImpairedProtocolClassificationOverrides specifies, for individual
+	// tunnel protocols, classification parameters which override the
+	// general values above.
+	ImpairedProtocolClassificationOverrides map[string]ImpairedProtocolClassificationParameters
+}
+
+// ImpairedProtocolClassificationParameters are the impaired protocol
+// classification parameters for one tunnel protocol. Omitted (0) values use
+// the general Config values. When Disabled is set, the protocol is never
+// classified as impaired.
+type ImpairedProtocolClassificationParameters struct {
+	Threshold       int
+	DurationSeconds int
+	DecaySeconds    int
+	Disabled        bool
 }
 
 // LoadConfig parses and validates a JSON format Psiphon config JSON
@@ -439,10 +635,123 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.TunnelPoolSize = TUNNEL_POOL_SIZE
 	}
 
+	if config.TunnelPoolLoadBalancingPolicy != "" &&
+		!Contains(SupportedLoadBalancingPolicies, config.TunnelPoolLoadBalancingPolicy) {
+		return nil, ContextError(errors.New("invalid tunnel pool load balancing policy"))
+	}
+
+	if config.TunnelHandoverDegradedRTTMilliseconds == 0 {
+		config.TunnelHandoverDegradedRTTMilliseconds = TUNNEL_HANDOVER_DEGRADED_RTT_MILLISECONDS
+	}
+
+	if config.TunnelHandoverDrainTimeoutSeconds == 0 {
+		config.TunnelHandoverDrainTimeoutSeconds = TUNNEL_HANDOVER_DRAIN_TIMEOUT_SECONDS
+	}
+
+	err = validateLocalProxyUsers(config.LocalProxyUsers)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if config.LocalTransparentProxyPort != 0 && runtime.GOOS != "linux" {
+		return nil, ContextError(errors.New("LocalTransparentProxyPort is only supported on Linux"))
+	}
+
+	if config.TunneledDnsOverHttpsUrl != "" {
+		dohUrl, err := url.Parse(config.TunneledDnsOverHttpsUrl)
+		if err != nil || dohUrl.Scheme != "https" || dohUrl.Host == "" {
+			return nil, ContextError(errors.New("invalid TunneledDnsOverHttpsUrl"))
+		}
+	}
+
+	if config.TunneledDnsOverHttpsBootstrapIP != "" &&
+		net.ParseIP(config.TunneledDnsOverHttpsBootstrapIP) == nil {
+		return nil, ContextError(errors.New("invalid TunneledDnsOverHttpsBootstrapIP"))
+	}
+
+	if config.LocalDnsProxyPort != 0 && config.TunneledDnsOverHttpsUrl == "" {
+		dnsServer := config.LocalDnsProxyServer
+		if dnsServer == "" {
+			dnsServer = config.SplitTunnelDnsServer
+		}
+		if net.ParseIP(dnsServer) == nil {
+			return nil, ContextError(errors.New(
+				"LocalDnsProxyPort requires LocalDnsProxyServer, SplitTunnelDnsServer or TunneledDnsOverHttpsUrl"))
+		}
+	}
+
+	if config.UdpgwServerAddress != "" {
+		_, _, err := net.SplitHostPort(config.UdpgwServerAddress)
+		if err != nil {
+			return nil, ContextError(fmt.Errorf("invalid UdpgwServerAddress: %s", err))
+		}
+	}
+
+	if config.LocalSocksProxyUDPIdleTimeoutSeconds == 0 {
+		config.LocalSocksProxyUDPIdleTimeoutSeconds = SOCKS_PROXY_UDP_IDLE_TIMEOUT_SECONDS
+	}
+
+	if config.SplitTunnelRules != nil {
+		err := config.SplitTunnelRules.Validate()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	if config.EstablishTunnelCandidatesPerServerEntry < 0 {
+		return nil, ContextError(errors.New("invalid EstablishTunnelCandidatesPerServerEntry"))
+	}
+
+	if config.EstablishTunnelCandidatesPerServerEntry == 0 {
+		config.EstablishTunnelCandidatesPerServerEntry = ESTABLISH_TUNNEL_CANDIDATES_PER_SERVER_ENTRY
+	}
+
+	if config.EstablishTunnelRaceSize == 0 {
+		config.EstablishTunnelRaceSize = ESTABLISH_TUNNEL_RACE_SIZE
+	}
+
+	if config.ImpairedProtocolClassificationThreshold == 0 {
+		config.ImpairedProtocolClassificationThreshold = IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD
+	}
+
+	if config.ImpairedProtocolClassificationDurationSeconds == 0 {
+		config.ImpairedProtocolClassificationDurationSeconds =
+			int(IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION / time.Second)
+	}
+
+	if config.ImpairedProtocolClassificationDecaySeconds == 0 {
+		config.ImpairedProtocolClassificationDecaySeconds =
+			int(IMPAIRED_PROTOCOL_CLASSIFICATION_DECAY / time.Second)
+	}
+
+	if config.ImpairedProtocolClassificationThreshold < 0 ||
+		config.ImpairedProtocolClassificationDurationSeconds < 0 ||
+		config.ImpairedProtocolClassificationDecaySeconds < 0 {
+		return nil, ContextError(
+			errors.New("invalid impaired protocol classification parameters"))
+	}
+
+	for protocol, parameters := range config.ImpairedProtocolClassificationOverrides {
+		if !Contains(SupportedTunnelProtocols, protocol) {
+			return nil, ContextError(
+				fmt.Errorf("invalid impaired protocol classification override protocol: %s", protocol))
+		}
+		if parameters.Threshold < 0 ||
+			parameters.DurationSeconds < 0 ||
+			parameters.DecaySeconds < 0 {
+			return nil, ContextError(
+				fmt.Errorf("invalid impaired protocol classification override parameters: %s", protocol))
+		}
+	}
+
 	if config.NetworkConnectivityChecker != nil {
 		return nil, ContextError(errors.New("NetworkConnectivityChecker interface must be set at runtime"))
 	}
 
+	if config.NetworkIDGetter != nil {
+		return nil, ContextError(errors.New("NetworkIDGetter interface must be set at runtime"))
+	}
+
 	if config.DeviceBinder != nil {
 		return nil, ContextError(errors.New("DeviceBinder interface must be set at runtime"))
 	}
@@ -157,3 +157,26 @@ func (suite *ConfigTestSuite) Test_LoadConfig_GoodJson() {
 	_, err = LoadConfig(testObjJSON)
 	suite.Nil(err, "JSON with null for optional values should succeed")
 }
+
+// Tests the EstablishTunnelCandidatesPerServerEntry default and bounds
+func (suite *ConfigTestSuite) Test_LoadConfig_EstablishTunnelCandidatesPerServerEntry() {
+	var testObj map[string]interface{}
+
+	for _, count := range []int{0, 1, 3, -1} {
+		json.Unmarshal(suite.confStubBlob, &testObj)
+		testObj["EstablishTunnelCandidatesPerServerEntry"] = count
+		testObjJSON, _ := json.Marshal(testObj)
+		config, err := LoadConfig(testObjJSON)
+
+		switch {
+		case count < 0:
+			suite.NotNil(err, "negative EstablishTunnelCandidatesPerServerEntry should fail")
+		case count == 0:
+			suite.Nil(err, "default EstablishTunnelCandidatesPerServerEntry should succeed")
+			suite.Equal(1, config.EstablishTunnelCandidatesPerServerEntry)
+		default:
+			suite.Nil(err, "positive EstablishTunnelCandidatesPerServerEntry should succeed")
+			suite.Equal(count, config.EstablishTunnelCandidatesPerServerEntry)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"errors"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -57,17 +58,130 @@ type Controller struct {
 	splitTunnelClassifier          *SplitTunnelClassifier
 	signalFetchRemoteServerList    chan struct{}
 	signalDownloadUpgrade          chan string
-	impairedProtocolClassification map[string]int
+	impairedProtocolClassification map[string]ImpairedProtocolClassification
 	signalReportConnected          chan struct{}
+	signalServerEntriesUpdated     chan struct{}
 	serverAffinityDoneBroadcast    chan struct{}
 	newClientVerificationPayload   chan string
+
+	// impairedProtocolClassificationMutex guards impairedProtocolClassification,
+	// which is keyed by network ID and caches the persisted classifications.
+	impairedProtocolClassificationMutex sync.Mutex
+
+	// establishInFlight is the set of candidates, identified by server and
+	// candidate key, which have a connection attempt in progress. It's used
+	// to avoid concurrent, duplicate attempts.
+	establishInFlightMutex sync.Mutex
+	establishInFlight      map[string]bool
+
+	// serverAffinityPending counts the server affinity candidates which
+	// are outstanding. serverAffinitySealed is set once all server affinity
+	// candidates have been generated. serverAffinityDoneBroadcast is closed
+	// when both conditions are met. These are guarded by serverAffinityMutex.
+	serverAffinityMutex   sync.Mutex
+	serverAffinityPending int
+	serverAffinitySealed  bool
+	serverAffinityClosed  bool
+
+	// serverEntryCount caches the number of stored server entries which
+	// match the EgressRegion and TunnelProtocol filters, for
+	// getAchievableTunnelCount. It's refreshed when runTunnels starts and
+	// on signalServerEntriesUpdated. achievableTunnelCount is the last
+	// reported achievable tunnel count. These are accessed only by
+	// runTunnels.
+	serverEntryCount      int
+	achievableTunnelCount int
+
+	// establishWorkTime is the time spent sending candidates before starting
+	// over with a new iteration. It's ESTABLISH_TUNNEL_WORK_TIME, except in
+	// tests.
+	establishWorkTime time.Duration
+
+	// establishTunnel is called by the establish workers to establish each
+	// candidate tunnel. It's EstablishTunnel, except in tests.
+	establishTunnel func(
+		config *Config,
+		untunneledDialConfig *DialConfig,
+		sessionId string,
+		pendingConns *Conns,
+		serverEntry *ServerEntry,
+		dialParams *DialParameters,
+		tunnelOwner TunnelOwner) (*Tunnel, error)
+
+	// In tunnel handover mode, standbyTunnel is an established tunnel which
+	// isn't used for port forwards, and which replaces the next active tunnel
+	// to degrade. drainingTunnels are degraded tunnels which have been
+	// replaced and which remain open for their existing port forwards. These
+	// are guarded by handoverMutex, which is never held while closing a
+	// tunnel; when both locks are required, tunnelMutex is locked first.
+	handoverMutex   sync.Mutex
+	standbyTunnel   *Tunnel
+	drainingTunnels map[*Tunnel]bool
+	tunnelHandovers chan *tunnelHandover
+}
+
+// tunnelHandover is a request, to runTunnels, to replace the degraded
+// active tunnel with the standby tunnel.
+type tunnelHandover struct {
+	degradedTunnel *Tunnel
+	standbyTunnel  *Tunnel
+	reason         string
 }
 
 type candidateServerEntry struct {
 	serverEntry               *ServerEntry
+	dialParams                *DialParameters
+	networkID                 string
 	isServerAffinityCandidate bool
 }
 
+// establishRace selects the candidates which are raced at the start of an
+// establish round. Race candidates are the top-ranked candidates with
+// distinct protocols, taken from the first few server entries; the other
+// candidates from those server entries are deferred until the race
+// candidates have all been sent.
+type establishRace struct {
+	size          int
+	serverEntries int
+	protocols     map[string]bool
+	deferred      []*candidateServerEntry
+}
+
+func newEstablishRace(config *Config) *establishRace {
+	size := 0
+	if config.EstablishTunnelRaceStaggerMilliseconds > 0 {
+		size = config.EstablishTunnelRaceSize
+	}
+	return &establishRace{
+		size:      size,
+		protocols: make(map[string]bool),
+	}
+}
+
+// isActive indicates if candidates are still being selected for the race.
+func (race *establishRace) isActive() bool {
+	return race.serverEntries < race.size && len(race.protocols) < race.size
+}
+
+// add selects the candidate for the race when its protocol isn't already
+// being raced; otherwise the candidate is deferred.
+func (race *establishRace) add(candidate *candidateServerEntry) bool {
+	protocol := candidate.dialParams.Protocol
+	if race.protocols[protocol] {
+		race.deferred = append(race.deferred, candidate)
+		return false
+	}
+	race.protocols[protocol] = true
+	return true
+}
+
+// takeDeferred returns and clears the deferred candidates.
+func (race *establishRace) takeDeferred() []*candidateServerEntry {
+	deferred := race.deferred
+	race.deferred = nil
+	return deferred
+}
+
 // NewController initializes a new controller.
 func NewController(config *Config) (controller *Controller, err error) {
 
@@ -114,8 +228,11 @@ func NewController(config *Config) (controller *Controller, err error) {
 		runWaitGroup:           new(sync.WaitGroup),
 		// establishedTunnels and failedTunnels buffer sizes are large enough to
 		// receive full pools of tunnels without blocking. Senders should not block.
+		// In handover mode, the standby tunnel and draining tunnels may also fail;
+		// failedTunnels allows for the standby tunnel and one draining tunnel per
+		// active tunnel.
 		establishedTunnels:             make(chan *Tunnel, config.TunnelPoolSize),
-		failedTunnels:                  make(chan *Tunnel, config.TunnelPoolSize),
+		failedTunnels:                  make(chan *Tunnel, 2*config.TunnelPoolSize+1),
 		tunnels:                        make([]*Tunnel, 0),
 		establishedOnce:                false,
 		startedConnectedReporter:       false,
@@ -123,13 +240,23 @@ func NewController(config *Config) (controller *Controller, err error) {
 		establishPendingConns:          new(Conns),
 		untunneledPendingConns:         untunneledPendingConns,
 		untunneledDialConfig:           untunneledDialConfig,
-		impairedProtocolClassification: make(map[string]int),
+		impairedProtocolClassification: make(map[string]ImpairedProtocolClassification),
+		establishInFlight:              make(map[string]bool),
+		drainingTunnels:                make(map[*Tunnel]bool),
+		establishWorkTime:              ESTABLISH_TUNNEL_WORK_TIME,
+		establishTunnel:                EstablishTunnel,
+		// Buffer allows each active tunnel to request a handover without
+		// blocking. Senders should not block.
+		tunnelHandovers: make(chan *tunnelHandover, config.TunnelPoolSize),
 		// TODO: Add a buffer of 1 so we don't miss a signal while receiver is
 		// starting? Trade-off is potential back-to-back fetch remotes. As-is,
 		// establish will eventually signal another fetch remote.
 		signalFetchRemoteServerList: make(chan struct{}),
 		signalDownloadUpgrade:       make(chan string),
 		signalReportConnected:       make(chan struct{}),
+		// Buffer allows an update to be signaled while runTunnels is busy;
+		// multiple updates are coalesced.
+		signalServerEntriesUpdated: make(chan struct{}, 1),
 		// Buffer allows SetClientVerificationPayload to submit one new payload
 		// without blocking or dropping it.
 		newClientVerificationPayload: make(chan string, 1),
@@ -149,6 +276,8 @@ func NewController(config *Config) (controller *Controller, err error) {
 // - the tunnel manager
 // - a local SOCKS proxy that port forwards through the pool of tunnels
 // - a local HTTP proxy that port forwards through the pool of tunnels
+// - an optional local transparent proxy that port forwards through the pool of tunnels
+// - an optional local DNS proxy that resolves through the pool of tunnels
 func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 	ReportAvailableRegions()
 
@@ -175,6 +304,34 @@ func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 	}
 	defer httpProxy.Close()
 
+	if controller.config.LocalTransparentProxyPort != 0 {
+		transparentProxy, err := NewTransparentProxy(controller.config, controller, listenIP)
+		if err != nil {
+			NoticeAlert("error initializing local transparent proxy: %s", err)
+			return
+		}
+		defer transparentProxy.Close()
+	}
+
+	if controller.config.LocalDnsProxyPort != 0 {
+		dnsListenIP, err := GetInterfaceIPAddress(controller.config.LocalDnsProxyListenInterface)
+		if err != nil {
+			NoticeError("error getting DNS proxy listener IP: %s", err)
+			return
+		}
+		dnsProxy, err := NewDnsProxy(
+			controller.config,
+			controller.untunneledDialConfig,
+			controller,
+			controller.splitTunnelClassifier,
+			dnsListenIP)
+		if err != nil {
+			NoticeAlert("error initializing local DNS proxy: %s", err)
+			return
+		}
+		defer dnsProxy.Close()
+	}
+
 	if !controller.config.DisableRemoteServerListFetcher {
 		controller.runWaitGroup.Add(1)
 		go controller.remoteServerListFetcher()
@@ -187,6 +344,10 @@ func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 		go controller.upgradeDownloader()
 	}
 
+	// Split tunnel routes cached for the last known region are used until
+	// the first tunnel reports the current region.
+	controller.splitTunnelClassifier.InstallCachedRoutes()
+
 	/// Note: the connected reporter isn't started until a tunnel is
 	// established
 
@@ -324,6 +485,11 @@ fetcherLoop:
 
 			if err == nil {
 				lastFetchTime = time.Now()
+
+				// New server entries may allow more tunnels to be
+				// established.
+				controller.signalServerEntriesUpdate()
+
 				break retryLoop
 			}
 
@@ -524,6 +690,17 @@ downloadLoop:
 //
 // When a tunnel fails, it's removed from the pool and the establish process is
 // restarted to fill the pool.
+//
+// The pool may not be filled when there are fewer server entries, for the target
+// region/protocol, than TunnelPoolSize, since each tunnel must connect to a
+// different server. Establishing stops once the achievable number of tunnels is
+// reached and resumes when more server entries are stored, by a remote server
+// list fetch or by handshake discovery.
+//
+// In handover mode, a standby tunnel is established once the pool is full.
+// When an active tunnel degrades, the standby tunnel replaces it and the
+// degraded tunnel is drained; then establishing resumes to obtain a new
+// standby tunnel.
 func (controller *Controller) runTunnels() {
 	defer controller.runWaitGroup.Done()
 
@@ -531,6 +708,7 @@ func (controller *Controller) runTunnels() {
 
 	// Start running
 
+	controller.refreshServerEntryCount()
 	controller.startEstablishing()
 loop:
 	for {
@@ -538,6 +716,8 @@ loop:
 		case failedTunnel := <-controller.failedTunnels:
 			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
 			controller.terminateTunnel(failedTunnel)
+			controller.terminateHandoverTunnel(failedTunnel)
+			controller.promoteStandbyTunnel(failedTunnel)
 
 			// Note: we make this extra check to ensure the shutdown signal takes priority
 			// and that we do not start establishing. Critically, startEstablishing() calls
@@ -556,13 +736,16 @@ loop:
 
 			// Concurrency note: only this goroutine may call startEstablishing/stopEstablishing
 			// and access isEstablishing.
-			if !controller.isEstablishing {
+			// Note: the failed tunnel may be a draining tunnel, in which case
+			// the pool may still be full.
+			if !controller.isEstablishing && !controller.isFullyEstablished() {
 				controller.startEstablishing()
 			}
 
 		case establishedTunnel := <-controller.establishedTunnels:
 
-			if controller.isImpairedProtocol(establishedTunnel.protocol) {
+			if controller.isImpairedProtocol(
+				establishedTunnel.protocol, establishedTunnel.networkID) {
 
 				NoticeAlert("established tunnel with impaired protocol: %s", establishedTunnel.protocol)
 
@@ -581,6 +764,25 @@ loop:
 
 			tunnelCount, registered := controller.registerTunnel(establishedTunnel)
 			if !registered {
+
+				// In handover mode, hold the tunnel in reserve when there's no
+				// standby tunnel.
+				if controller.config.EnableTunnelHandover &&
+					controller.registerStandbyTunnel(establishedTunnel) {
+
+					if clientVerificationPayload != "" {
+						establishedTunnel.SetClientVerificationPayload(clientVerificationPayload)
+					}
+
+					NoticeStandbyTunnel(
+						establishedTunnel.serverEntry.IpAddress, establishedTunnel.protocol)
+
+					if controller.isFullyEstablished() {
+						controller.stopEstablishing()
+					}
+					break
+				}
+
 				// Already fully established, so discard.
 				controller.discardTunnel(establishedTunnel)
 				break
@@ -604,7 +806,8 @@ loop:
 				// We assume that when regions change, the host network will also
 				// change, and so all tunnels will fail and be re-established. Under
 				// that assumption, the classifier will be re-Start()-ed here when
-				// the region has changed.
+				// the region has changed. Start() compares the handshake region
+				// with the current region and discards routes for an old region.
 				controller.splitTunnelClassifier.Start(establishedTunnel)
 
 				// Signal a connected request on each 1st tunnel establishment. For
@@ -626,10 +829,35 @@ loop:
 				}
 			}
 
-			// TODO: design issue -- might not be enough server entries with region/caps to ever fill tunnel slots;
-			// possible solution is establish target MIN(CountServerEntries(region, protocol), TunnelPoolSize)
+			// Note: the achievable pool size is recalculated here, after the
+			// tunnel's handshake, so that server entries obtained by handshake
+			// discovery are counted.
 			if controller.isFullyEstablished() {
 				controller.stopEstablishing()
+
+				// When the pool is short of TunnelPoolSize, try to obtain more
+				// server entries. Don't block sending signal, since this signal
+				// may have already been sent.
+				if tunnelCount < controller.config.TunnelPoolSize {
+					select {
+					case controller.signalFetchRemoteServerList <- *new(struct{}):
+					default:
+					}
+				}
+			}
+
+		case handover := <-controller.tunnelHandovers:
+			controller.handoverTunnel(handover)
+
+			// Establish a new standby tunnel.
+			if !controller.isEstablishing && !controller.isFullyEstablished() {
+				controller.startEstablishing()
+			}
+
+		case <-controller.signalServerEntriesUpdated:
+			controller.refreshServerEntryCount()
+			if !controller.isEstablishing && !controller.isFullyEstablished() {
+				controller.startEstablishing()
 			}
 
 		case clientVerificationPayload = <-controller.newClientVerificationPayload:
@@ -645,6 +873,18 @@ loop:
 	controller.stopEstablishing()
 	controller.terminateAllTunnels()
 
+	// Close standby tunnels from pending handovers. No new handovers may be
+	// requested, as terminateAllTunnels has cleared the standby tunnel.
+drain:
+	for {
+		select {
+		case handover := <-controller.tunnelHandovers:
+			controller.discardTunnel(handover.standbyTunnel)
+		default:
+			break drain
+		}
+	}
+
 	// Drain tunnel channels
 	close(controller.establishedTunnels)
 	for tunnel := range controller.establishedTunnels {
@@ -661,7 +901,7 @@ loop:
 // classifyImpairedProtocol tracks "impaired" protocol classifications for failed
 // tunnels. A protocol is classified as impaired if a tunnel using that protocol
 // fails, repeatedly, shortly after the start of the connection. During tunnel
-// establishment, impaired protocols are briefly skipped.
+// establishment, impaired protocols are skipped until the classification decays.
 //
 // One purpose of this measure is to defend against an attack where the adversary,
 // for example, tags an OSSH TCP connection as an "unidentified" protocol; allows
@@ -669,43 +909,116 @@ loop:
 // Since OSSH has less latency than other protocols that may bypass an "unidentified"
 // filter, these other protocols might never be selected for use.
 //
-// Concurrency note: only the runTunnels() goroutine may call classifyImpairedProtocol
+// Classifications are kept separately for each network, and a failed tunnel is
+// classified under the network it was established on. The threshold, window and
+// decay are configurable, per protocol; see Config.ImpairedProtocolClassificationThreshold.
+// Classifications are persisted in the data store, so that a restart doesn't
+// immediately retry impaired protocols.
 func (controller *Controller) classifyImpairedProtocol(failedTunnel *Tunnel) {
-	if failedTunnel.startTime.Add(IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION).After(time.Now()) {
-		controller.impairedProtocolClassification[failedTunnel.protocol] += 1
-	} else {
-		controller.impairedProtocolClassification[failedTunnel.protocol] = 0
+	controller.impairedProtocolClassificationMutex.Lock()
+	defer controller.impairedProtocolClassificationMutex.Unlock()
+
+	now := time.Now()
+	networkID := failedTunnel.networkID
+
+	classification := controller.getImpairedProtocolClassification(networkID)
+	if !classification.classify(
+		controller.config, failedTunnel.protocol, failedTunnel.startTime, now) {
+		return
 	}
-	if len(controller.getImpairedProtocols()) == len(SupportedTunnelProtocols) {
+
+	if len(classification.impairedProtocols(controller.config, now)) == len(SupportedTunnelProtocols) {
 		// Reset classification if all protocols are classified as impaired as
 		// the network situation (or attack) may not be protocol-specific.
 		// TODO: compare against count of distinct supported protocols for
 		// current known server entries.
-		controller.impairedProtocolClassification = make(map[string]int)
+		classification = make(ImpairedProtocolClassification)
+		controller.impairedProtocolClassification[networkID] = classification
+	}
+
+	err := SetImpairedProtocolClassification(networkID, classification)
+	if err != nil {
+		NoticeAlert("failed to store impaired protocol classification: %s", err)
 	}
+
+	NoticeImpairedProtocolClassification(
+		networkID,
+		classification.counts(controller.config, now),
+		classification.impairedProtocols(controller.config, now))
 }
 
 // getImpairedProtocols returns a list of protocols that have sufficient
-// classifications to be considered impaired protocols.
-//
-// Concurrency note: only the runTunnels() goroutine may call getImpairedProtocols
-func (controller *Controller) getImpairedProtocols() []string {
-	NoticeImpairedProtocolClassification(controller.impairedProtocolClassification)
-	impairedProtocols := make([]string, 0)
-	for protocol, count := range controller.impairedProtocolClassification {
-		if count >= IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD {
-			impairedProtocols = append(impairedProtocols, protocol)
+// classifications, on the specified network, to be considered impaired
+// protocols.
+func (controller *Controller) getImpairedProtocols(networkID string) []string {
+	controller.impairedProtocolClassificationMutex.Lock()
+	defer controller.impairedProtocolClassificationMutex.Unlock()
+
+	now := time.Now()
+	classification := controller.getImpairedProtocolClassification(networkID)
+	impairedProtocols := classification.impairedProtocols(controller.config, now)
+	NoticeImpairedProtocolClassification(
+		networkID, classification.counts(controller.config, now), impairedProtocols)
+	return impairedProtocols
+}
+
+// isImpairedProtocol checks if the specified protocol is classified as impaired
+// on the specified network.
+func (controller *Controller) isImpairedProtocol(protocol, networkID string) bool {
+	controller.impairedProtocolClassificationMutex.Lock()
+	defer controller.impairedProtocolClassificationMutex.Unlock()
+
+	return controller.getImpairedProtocolClassification(networkID).isImpaired(
+		controller.config, protocol, time.Now())
+}
+
+// GetImpairedProtocols returns the protocols which are currently classified
+// as impaired on the current network, and the current classification counts
+// for all protocols with recent early tunnel failures on the network.
+func (controller *Controller) GetImpairedProtocols() (
+	impairedProtocols []string, classification map[string]int) {
+
+	controller.impairedProtocolClassificationMutex.Lock()
+	defer controller.impairedProtocolClassificationMutex.Unlock()
+
+	now := time.Now()
+	networkClassification := controller.getImpairedProtocolClassification(
+		controller.getNetworkID())
+	return networkClassification.impairedProtocols(controller.config, now),
+		networkClassification.counts(controller.config, now)
+}
+
+// getImpairedProtocolClassification returns the classification for the
+// specified network, loading the persisted classification on first use.
+// The caller must hold impairedProtocolClassificationMutex.
+func (controller *Controller) getImpairedProtocolClassification(
+	networkID string) ImpairedProtocolClassification {
+
+	classification, ok := controller.impairedProtocolClassification[networkID]
+	if !ok {
+		var err error
+		classification, err = GetImpairedProtocolClassification(networkID)
+		if err != nil {
+			NoticeAlert("failed to get impaired protocol classification: %s", err)
+			classification = make(ImpairedProtocolClassification)
 		}
+		controller.impairedProtocolClassification[networkID] = classification
 	}
-	return impairedProtocols
+	return classification
 }
 
-// isImpairedProtocol checks if the specified protocol is classified as impaired.
-//
-// Concurrency note: only the runTunnels() goroutine may call isImpairedProtocol
-func (controller *Controller) isImpairedProtocol(protocol string) bool {
-	count, ok := controller.impairedProtocolClassification[protocol]
-	return ok && count >= IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD
+// getNetworkID returns the identifier for the current network, as provided
+// by the host's NetworkIDGetter. When there's no NetworkIDGetter, or the
+// network can't be identified, UNKNOWN_NETWORK_ID is returned.
+func (controller *Controller) getNetworkID() string {
+	if controller.config.NetworkIDGetter == nil {
+		return UNKNOWN_NETWORK_ID
+	}
+	networkID := controller.config.NetworkIDGetter.GetNetworkID()
+	if networkID == "" {
+		return UNKNOWN_NETWORK_ID
+	}
+	return networkID
 }
 
 // SignalTunnelFailure implements the TunnelOwner interface. This function
@@ -713,24 +1026,28 @@ func (controller *Controller) isImpairedProtocol(protocol string) bool {
 // has failed. The Controller will signal runTunnels to create a new
 // tunnel and/or remove the tunnel from the list of active tunnels.
 func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
+	// Mark the tunnel as failed so that, while the signal is pending, a
+	// failed standby tunnel isn't promoted or handed over to.
+	tunnel.markFailed()
+
 	// Don't block. Assumes the receiver has a buffer large enough for
 	// the typical number of operated tunnels. In case there's no room,
 	// terminate the tunnel (runTunnels won't get a signal in this case,
-	// but the tunnel will be removed from the list of active tunnels).
+	// but the tunnel will be removed from the list of active tunnels, or
+	// from the standby and draining tunnels).
 	select {
 	case controller.failedTunnels <- tunnel:
 	default:
 		controller.terminateTunnel(tunnel)
+		controller.terminateHandoverTunnel(tunnel)
 	}
 }
 
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
-	// TODO: not calling PromoteServerEntry, since that would rank the
-	// discarded tunnel before fully active tunnels. Can a discarded tunnel
-	// be promoted (since it connects), but with lower rank than all active
-	// tunnels?
+	// Note: a discarded tunnel did connect, and that success is already
+	// recorded in the server entry connection history.
 	tunnel.Close(true)
 }
 
@@ -755,14 +1072,6 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) (int, bool) {
 	controller.tunnels = append(controller.tunnels, tunnel)
 	NoticeTunnels(len(controller.tunnels))
 
-	// Promote this successful tunnel to first rank so it's one
-	// of the first candidates next time establish runs.
-	// Connecting to a TargetServerEntry does not change the
-	// ranking.
-	if controller.config.TargetServerEntry == "" {
-		PromoteServerEntry(tunnel.serverEntry.IpAddress)
-	}
-
 	return len(controller.tunnels), true
 }
 
@@ -776,10 +1085,77 @@ func (controller *Controller) hasEstablishedOnce() bool {
 }
 
 // isFullyEstablished indicates if the pool of active tunnels is full.
+// The pool is considered full when the number of active tunnels reaches the
+// achievable pool size. In handover mode, a standby tunnel is also required,
+// when there's a server entry available for it.
 func (controller *Controller) isFullyEstablished() bool {
+
+	tunnelCount := controller.config.TunnelPoolSize
+	if controller.config.EnableTunnelHandover {
+		tunnelCount += 1
+	}
+	achievableCount := controller.getAchievableTunnelCount(tunnelCount)
+	achievablePoolSize := achievableCount
+	if achievablePoolSize > controller.config.TunnelPoolSize {
+		achievablePoolSize = controller.config.TunnelPoolSize
+	}
+
 	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	activeCount := len(controller.tunnels)
+	controller.tunnelMutex.Unlock()
+
+	if activeCount < achievablePoolSize {
+		return false
+	}
+	return achievableCount == achievablePoolSize || controller.hasStandbyTunnel()
+}
+
+// getAchievableTunnelCount returns the number of tunnels which may be
+// established, up to tunnelCount. This is tunnelCount unless there are fewer
+// server entries which match the EgressRegion and TunnelProtocol filters, as
+// each tunnel must connect to a different server. The result is at least 1,
+// so that establishing continues while there are no matching server entries.
+func (controller *Controller) getAchievableTunnelCount(tunnelCount int) int {
+	poolSize := tunnelCount
+	if poolSize <= 1 {
+		return poolSize
+	}
+	if controller.config.TargetServerEntry != "" {
+		return 1
+	}
+	count := controller.serverEntryCount
+	if count < 1 {
+		count = 1
+	}
+	if count < poolSize {
+		poolSize = count
+	}
+	if poolSize != controller.achievableTunnelCount {
+		controller.achievableTunnelCount = poolSize
+		if poolSize < tunnelCount {
+			NoticeInfo("achievable tunnel pool size: %d", poolSize)
+		}
+	}
+	return poolSize
+}
+
+// refreshServerEntryCount updates the cached count of server entries used
+// by getAchievableTunnelCount.
+func (controller *Controller) refreshServerEntryCount() {
+	if controller.config.TargetServerEntry != "" {
+		return
+	}
+	controller.serverEntryCount = CountServerEntries(
+		controller.config.EgressRegion, controller.config.TunnelProtocol)
+}
+
+// signalServerEntriesUpdate signals runTunnels that server entries have been
+// stored, which may allow more tunnels to be established. Does not block.
+func (controller *Controller) signalServerEntriesUpdate() {
+	select {
+	case controller.signalServerEntriesUpdated <- *new(struct{}):
+	default:
+	}
 }
 
 // terminateTunnel removes a tunnel from the pool of active tunnels
@@ -806,16 +1182,32 @@ func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 }
 
 // terminateAllTunnels empties the tunnel pool, closing all active tunnels.
+// The standby tunnel and draining tunnels are also closed.
 // This is used when shutting down the controller.
 func (controller *Controller) terminateAllTunnels() {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
+
+	closeTunnels := make([]*Tunnel, len(controller.tunnels))
+	copy(closeTunnels, controller.tunnels)
+
+	controller.handoverMutex.Lock()
+	if controller.standbyTunnel != nil {
+		closeTunnels = append(closeTunnels, controller.standbyTunnel)
+		controller.standbyTunnel = nil
+	}
+	for drainingTunnel := range controller.drainingTunnels {
+		closeTunnels = append(closeTunnels, drainingTunnel)
+	}
+	controller.drainingTunnels = make(map[*Tunnel]bool)
+	controller.handoverMutex.Unlock()
+
 	// Closing all tunnels in parallel. In an orderly shutdown, each tunnel
 	// may take a few seconds to send a final status request. We only want
 	// to wait as long as the single slowest tunnel.
 	closeWaitGroup := new(sync.WaitGroup)
-	closeWaitGroup.Add(len(controller.tunnels))
-	for _, activeTunnel := range controller.tunnels {
+	closeWaitGroup.Add(len(closeTunnels))
+	for _, activeTunnel := range closeTunnels {
 		tunnel := activeTunnel
 		go func() {
 			defer closeWaitGroup.Done()
@@ -828,6 +1220,218 @@ func (controller *Controller) terminateAllTunnels() {
 	NoticeTunnels(len(controller.tunnels))
 }
 
+// registerStandbyTunnel holds the connected tunnel in reserve, in handover
+// mode. Returns true if there was no standby tunnel and false otherwise
+// (caller should discard the tunnel).
+func (controller *Controller) registerStandbyTunnel(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	for _, activeTunnel := range controller.tunnels {
+		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
+			return false
+		}
+	}
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+	if controller.standbyTunnel != nil {
+		return false
+	}
+	controller.standbyTunnel = tunnel
+	return true
+}
+
+// hasStandbyTunnel indicates if there's a standby tunnel.
+func (controller *Controller) hasStandbyTunnel() bool {
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+	return controller.standbyTunnel != nil
+}
+
+// SignalTunnelDegraded implements the TunnelOwner interface. This function
+// is called by Tunnel.operateTunnel, in handover mode, when an SSH keep
+// alive indicates that the tunnel has degraded. When there's a standby
+// tunnel, the degraded tunnel is marked as draining, runTunnels is signaled
+// to hand over to the standby tunnel, and true is returned.
+func (controller *Controller) SignalTunnelDegraded(tunnel *Tunnel, reason string) bool {
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+
+	if controller.standbyTunnel == nil ||
+		controller.standbyTunnel == tunnel ||
+		controller.standbyTunnel.IsFailed() ||
+		tunnel.IsDraining() {
+		return false
+	}
+
+	handover := &tunnelHandover{
+		degradedTunnel: tunnel,
+		standbyTunnel:  controller.standbyTunnel,
+		reason:         reason,
+	}
+
+	// Don't block. Assumes the receiver has a buffer large enough for
+	// the number of active tunnels.
+	select {
+	case controller.tunnelHandovers <- handover:
+	default:
+		return false
+	}
+
+	controller.standbyTunnel = nil
+	tunnel.startDraining()
+	return true
+}
+
+// handoverTunnel replaces the degraded tunnel, in the pool of active
+// tunnels, with the standby tunnel, and starts draining the degraded
+// tunnel. When the degraded tunnel has already been removed from the pool,
+// the standby tunnel is added to the pool, or, if the pool is full, held
+// in reserve again.
+func (controller *Controller) handoverTunnel(handover *tunnelHandover) {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+
+	// The standby tunnel may have failed after the handover was signaled,
+	// when it was neither the standby tunnel nor in the pool, so its failure
+	// didn't close it. The degraded tunnel remains active.
+	if handover.standbyTunnel.IsFailed() {
+		handover.degradedTunnel.stopDraining()
+		go handover.standbyTunnel.Close(false)
+		return
+	}
+
+	replaced := false
+	for index, activeTunnel := range controller.tunnels {
+		if activeTunnel == handover.degradedTunnel {
+			controller.tunnels[index] = handover.standbyTunnel
+			replaced = true
+			break
+		}
+	}
+
+	if !replaced {
+		if len(controller.tunnels) < controller.config.TunnelPoolSize {
+			controller.tunnels = append(controller.tunnels, handover.standbyTunnel)
+			NoticeTunnels(len(controller.tunnels))
+		} else if controller.standbyTunnel == nil {
+			controller.standbyTunnel = handover.standbyTunnel
+			return
+		} else {
+			go controller.discardTunnel(handover.standbyTunnel)
+			return
+		}
+	} else {
+		controller.drainingTunnels[handover.degradedTunnel] = true
+		controller.runWaitGroup.Add(1)
+		go controller.drainTunnel(handover.degradedTunnel)
+	}
+
+	NoticeTunnelHandover(
+		handover.degradedTunnel.serverEntry.IpAddress,
+		handover.standbyTunnel.serverEntry.IpAddress,
+		handover.reason)
+	NoticeActiveTunnel(
+		handover.standbyTunnel.serverEntry.IpAddress, handover.standbyTunnel.protocol)
+}
+
+// promoteStandbyTunnel adds the standby tunnel to the pool of active tunnels,
+// in place of the failed tunnel, when the pool isn't full. There are no port
+// forwards to drain on a failed tunnel. A standby tunnel which has itself
+// failed isn't promoted; its pending failure signal closes it.
+func (controller *Controller) promoteStandbyTunnel(failedTunnel *Tunnel) {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+
+	standbyTunnel := controller.standbyTunnel
+	if standbyTunnel == nil ||
+		standbyTunnel.IsFailed() ||
+		len(controller.tunnels) >= controller.config.TunnelPoolSize {
+		return
+	}
+
+	controller.standbyTunnel = nil
+	controller.tunnels = append(controller.tunnels, standbyTunnel)
+
+	NoticeTunnelHandover(
+		failedTunnel.serverEntry.IpAddress,
+		standbyTunnel.serverEntry.IpAddress,
+		"tunnel failed")
+	NoticeActiveTunnel(standbyTunnel.serverEntry.IpAddress, standbyTunnel.protocol)
+	NoticeTunnels(len(controller.tunnels))
+}
+
+// drainTunnel keeps the degraded tunnel open until its existing port
+// forwards have all closed, or until TunnelHandoverDrainTimeoutSeconds
+// elapses, and then closes the tunnel.
+func (controller *Controller) drainTunnel(tunnel *Tunnel) {
+	defer controller.runWaitGroup.Done()
+
+	NoticeInfo("draining tunnel: %s", tunnel.serverEntry.IpAddress)
+
+	timer := time.NewTimer(
+		time.Duration(controller.config.TunnelHandoverDrainTimeoutSeconds) * time.Second)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(TUNNEL_HANDOVER_DRAIN_CHECK_PERIOD)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			controller.handoverMutex.Lock()
+			isDraining := controller.drainingTunnels[tunnel]
+			controller.handoverMutex.Unlock()
+			if !isDraining {
+				// The tunnel failed and was terminated.
+				return
+			}
+			if tunnel.load.getOpenConns() == 0 {
+				break loop
+			}
+		case <-timer.C:
+			NoticeInfo("drain timeout for %s with %d open port forwards",
+				tunnel.serverEntry.IpAddress, tunnel.load.getOpenConns())
+			break loop
+		case <-controller.shutdownBroadcast:
+			// terminateAllTunnels closes the tunnel.
+			return
+		}
+	}
+
+	controller.handoverMutex.Lock()
+	isDraining := controller.drainingTunnels[tunnel]
+	delete(controller.drainingTunnels, tunnel)
+	controller.handoverMutex.Unlock()
+
+	if isDraining {
+		NoticeInfo("drained tunnel: %s", tunnel.serverEntry.IpAddress)
+		tunnel.Close(false)
+	}
+}
+
+// terminateHandoverTunnel closes the tunnel when it's the standby tunnel
+// or a draining tunnel.
+func (controller *Controller) terminateHandoverTunnel(tunnel *Tunnel) {
+	controller.handoverMutex.Lock()
+	isHandoverTunnel := controller.standbyTunnel == tunnel || controller.drainingTunnels[tunnel]
+	if controller.standbyTunnel == tunnel {
+		controller.standbyTunnel = nil
+	}
+	delete(controller.drainingTunnels, tunnel)
+	controller.handoverMutex.Unlock()
+
+	if isHandoverTunnel {
+		tunnel.Close(false)
+	}
+}
+
 // getNextActiveTunnel returns the next tunnel from the pool of active
 // tunnels. Currently, tunnel selection order is simple round-robin.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
@@ -842,8 +1446,29 @@ func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	return nil
 }
 
+// getTunnelForDial returns the active tunnel to use for a port forward to
+// the specified host, as selected by the configured load balancing policy.
+func (controller *Controller) getTunnelForDial(host string) *Tunnel {
+
+	policy := controller.config.TunnelPoolLoadBalancingPolicy
+	if policy == "" || policy == LOAD_BALANCING_POLICY_ROUND_ROBIN {
+		return controller.getNextActiveTunnel()
+	}
+
+	controller.tunnelMutex.Lock()
+	tunnels := make([]*Tunnel, len(controller.tunnels))
+	copy(tunnels, controller.tunnels)
+	controller.tunnelMutex.Unlock()
+
+	if len(tunnels) == 0 {
+		return nil
+	}
+	return selectTunnel(policy, tunnels, host)
+}
+
 // isActiveTunnelServerEntry is used to check if there's already
-// an existing tunnel to a candidate server.
+// an existing tunnel to a candidate server. This includes the standby
+// tunnel in handover mode.
 func (controller *Controller) isActiveTunnelServerEntry(serverEntry *ServerEntry) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
@@ -852,7 +1477,10 @@ func (controller *Controller) isActiveTunnelServerEntry(serverEntry *ServerEntry
 			return true
 		}
 	}
-	return false
+	controller.handoverMutex.Lock()
+	defer controller.handoverMutex.Unlock()
+	return controller.standbyTunnel != nil &&
+		controller.standbyTunnel.serverEntry.IpAddress == serverEntry.IpAddress
 }
 
 // setClientVerificationPayloadForActiveTunnels triggers the client verification
@@ -874,19 +1502,27 @@ func (controller *Controller) setClientVerificationPayloadForActiveTunnels(
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
-	tunnel := controller.getNextActiveTunnel()
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	tunnel := controller.getTunnelForDial(host)
 	if tunnel == nil {
 		return nil, ContextError(errors.New("no active tunnels"))
 	}
 
 	// Perform split tunnel classification when feature is enabled, and if the remote
-	// address is classified as untunneled, dial directly.
-	if !alwaysTunnel && controller.config.SplitTunnelDnsServer != "" {
-
-		host, _, err := net.SplitHostPort(remoteAddr)
-		if err != nil {
-			return nil, ContextError(err)
-		}
+	// address is classified as untunneled, dial directly. The feature is enabled by
+	// either the region routes or user-defined split tunnel rules.
+	if !alwaysTunnel &&
+		(controller.config.SplitTunnelDnsServer != "" ||
+			controller.config.TunneledDnsOverHttpsUrl != "" ||
+			controller.splitTunnelClassifier.hasRules()) {
 
 		// Note: a possible optimization, when split tunnel is active and IsUntunneled performs
 		// a DNS resolution in order to make its classification, is to reuse that IP address in
@@ -894,7 +1530,7 @@ func (controller *Controller) Dial(
 		// way this is currently implemented ensures that, e.g., DNS geo load balancing occurs
 		// relative to the outbound network.
 
-		if controller.splitTunnelClassifier.IsUntunneled(host) {
+		if controller.splitTunnelClassifier.IsUntunneled(host, port) {
 			// TODO: track downstreamConn and close it when the DialTCP conn closes, as with tunnel.Dial conns?
 			return DialTCP(remoteAddr, controller.untunneledDialConfig)
 		}
@@ -908,6 +1544,18 @@ func (controller *Controller) Dial(
 	return tunneledConn, nil
 }
 
+// SetSplitTunnelRules replaces the user-defined split tunnel rules, which
+// apply to all subsequent port forwards. When rules is nil, the rules are
+// cleared. An error is returned, and the rules are not changed, when the
+// rules are invalid.
+func (controller *Controller) SetSplitTunnelRules(rules *SplitTunnelRules) error {
+	err := controller.splitTunnelClassifier.SetRules(rules)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
 // startEstablishing creates a pool of worker goroutines which will
 // attempt to establish tunnels to candidate servers. The candidates
 // are generated by another goroutine.
@@ -928,26 +1576,33 @@ func (controller *Controller) startEstablishing() {
 	// example, a web site which prompts for additional user
 	// authentication when the IP address changes).
 	//
-	// Only the very first server, as determined by
-	// datastore.PromoteServerEntry(), is the server affinity candidate.
-	// Concurrent connections attempts to many servers are launched
-	// without delay, in case the affinity server connection fails.
-	// While the affinity server connection is outstanding, when any
-	// other connection is established, there is a short grace period
+	// The first TunnelPoolSize servers, as determined by the server
+	// entry connection history ranking, are the server affinity servers;
+	// in single tunnel mode, this is only the very first server. The
+	// first candidate for each of these servers is a server affinity
+	// candidate. Concurrent connections attempts to many servers are
+	// launched without delay, in case the affinity server connections
+	// fail. While any affinity server connection is outstanding, when
+	// any other connection is established, there is a short grace period
 	// delay before delivering the established tunnel; this allows some
-	// time for the affinity server connection to succeed first.
-	// When the affinity server connection fails, any other established
+	// time for the affinity server connections to succeed first. The
+	// affinity servers share the one grace period, in parallel. When all
+	// affinity server connections have completed, any other established
 	// tunnel is registered without delay.
 	//
-	// Note: the establishTunnelWorker that receives the affinity
-	// candidate is solely resonsible for closing
-	// controller.serverAffinityDoneBroadcast.
+	// Note: controller.serverAffinityDoneBroadcast is closed only by
+	// serverAffinityCandidateDone and sealServerAffinityCandidates.
 	//
 	// Note: if config.EgressRegion or config.TunnelProtocol has changed
-	// since the top server was promoted, the first server may not actually
-	// be the last connected server.
+	// since the last connection, the first server may not actually be the
+	// last connected server.
 	// TODO: should not favor the first server in this case
+	controller.serverAffinityMutex.Lock()
 	controller.serverAffinityDoneBroadcast = make(chan struct{})
+	controller.serverAffinityPending = 0
+	controller.serverAffinitySealed = false
+	controller.serverAffinityClosed = false
+	controller.serverAffinityMutex.Unlock()
 
 	for i := 0; i < controller.config.ConnectionWorkerPoolSize; i++ {
 		controller.establishWaitGroup.Add(1)
@@ -955,8 +1610,7 @@ func (controller *Controller) startEstablishing() {
 	}
 
 	controller.establishWaitGroup.Add(1)
-	go controller.establishCandidateGenerator(
-		controller.getImpairedProtocols())
+	go controller.establishCandidateGenerator()
 }
 
 // stopEstablishing signals the establish goroutines to stop and waits
@@ -983,27 +1637,45 @@ func (controller *Controller) stopEstablishing() {
 }
 
 // establishCandidateGenerator populates the candidate queue with server entries
-// from the data store. Server entries are iterated in rank order, so that promoted
-// servers with higher rank are priority candidates.
-func (controller *Controller) establishCandidateGenerator(impairedProtocols []string) {
+// from the data store. Server entries are iterated in rank order, so that servers
+// with a better connection history are priority candidates.
+//
+// Ranking and impaired protocols are specific to the current network. When the
+// network changes, the generator starts over with the state for the new network.
+func (controller *Controller) establishCandidateGenerator() {
 	defer controller.establishWaitGroup.Done()
 	defer close(controller.candidateServerEntries)
 
-	iterator, err := NewServerEntryIterator(controller.config)
+	networkID := controller.getNetworkID()
+	impairedProtocols := controller.getImpairedProtocols(networkID)
+
+	iterator, err := NewServerEntryIterator(controller.config, networkID)
 	if err != nil {
 		NoticeAlert("failed to iterate over candidates: %s", err)
 		controller.SignalComponentFailure()
 		return
 	}
-	defer iterator.Close()
-
-	isServerAffinityCandidate := true
-
-	// TODO: reconcile server affinity scheme with multi-tunnel mode
-	if controller.config.TunnelPoolSize > 1 {
-		isServerAffinityCandidate = false
-		close(controller.serverAffinityDoneBroadcast)
-	}
+	// Note: iterator is replaced on network change, and is nil when the
+	// replacement fails.
+	defer func() {
+		if iterator != nil {
+			iterator.Close()
+		}
+	}()
+
+	// In multi-tunnel mode, there's a server affinity server for each
+	// tunnel in the pool.
+	serverAffinityCount := controller.config.TunnelPoolSize
+	defer controller.sealServerAffinityCandidates()
+
+	// Candidates deferred by the current race are dropped when establishing
+	// stops before they're sent.
+	var race *establishRace
+	defer func() {
+		if race != nil {
+			controller.dropCandidates(race.takeDeferred()...)
+		}
+	}()
 
 loop:
 	// Repeat until stopped
@@ -1016,6 +1688,39 @@ loop:
 			break loop
 		}
 
+		// Check for a network change, which may have happened while waiting for
+		// connectivity, or during a previous iteration. Start over using the new
+		// network's ranking and impaired protocols. This counts as a first
+		// iteration, for the purposes of disabling impaired protocols.
+		// The network ID is checked once per iteration, as the NetworkIDGetter
+		// may call into the host application.
+		// Note: the server affinity candidate, if not yet sent, remains the first
+		// server for the new network.
+		if currentNetworkID := controller.getNetworkID(); currentNetworkID != networkID {
+			NoticeInfo("network changed")
+			networkID = currentNetworkID
+			impairedProtocols = controller.getImpairedProtocols(networkID)
+			iterator.Close()
+			iterator, err = NewServerEntryIterator(controller.config, networkID)
+			if err != nil {
+				NoticeAlert("failed to iterate over candidates: %s", err)
+				controller.SignalComponentFailure()
+				break loop
+			}
+			i = 0
+		}
+
+		// When racing is enabled, the top-ranked candidates with distinct
+		// protocols are started first, each after a short stagger delay,
+		// in the manner of "happy eyeballs". When one protocol is silently
+		// blackholed, another protocol is started after only a short delay,
+		// rather than after a full connect timeout. The first race candidate
+		// to complete its SSH handshake is delivered, subject to the same
+		// server affinity grace period as any other candidate; when this
+		// fully establishes, stopEstablishing interrupts the remaining
+		// attempts via establishPendingConns.
+		race = newEstablishRace(controller.config)
+
 		// Send each iterator server entry to the establish workers
 		startTime := time.Now()
 		for {
@@ -1026,7 +1731,10 @@ loop:
 				break loop
 			}
 			if serverEntry == nil {
-				// Completed this iteration
+				// Completed this iteration. When there are fewer server
+				// entries than affinity servers, there are no more
+				// affinity candidates to wait for.
+				controller.sealServerAffinityCandidates()
 				break
 			}
 
@@ -1050,28 +1758,74 @@ loop:
 				}
 			}
 
-			// Note: there must be only one server affinity candidate, as it
-			// closes the serverAffinityDoneBroadcast channel.
-			candidate := &candidateServerEntry{serverEntry, isServerAffinityCandidate}
-			isServerAffinityCandidate = false
+			// Expand the server entry into multiple candidates, each with
+			// different dial parameters, so that a server with, for example,
+			// many MeekFrontingAddresses, is tried thoroughly.
+			dialParamsList := controller.makeCandidateDialParameters(serverEntry, networkID)
+
+			isRacing := race.isActive()
+
+			// Only the first candidate for each affinity server is a server
+			// affinity candidate. Each server affinity candidate must be
+			// completed, by the worker, with serverAffinityCandidateDone.
+			isServerAffinityCandidate := serverAffinityCount > 0 && len(dialParamsList) > 0
+			if isServerAffinityCandidate {
+				serverAffinityCount -= 1
+				controller.addServerAffinityCandidate()
+				if serverAffinityCount == 0 {
+					controller.sealServerAffinityCandidates()
+				}
+			}
 
-			// TODO: here we could generate multiple candidates from the
-			// server entry when there are many MeekFrontingAddresses.
+			for _, dialParams := range dialParamsList {
 
-			select {
-			case controller.candidateServerEntries <- candidate:
-			case <-controller.stopEstablishingBroadcast:
-				break loop
-			case <-controller.shutdownBroadcast:
-				break loop
+				candidate := &candidateServerEntry{
+					serverEntry:               serverEntry,
+					dialParams:                dialParams,
+					networkID:                 networkID,
+					isServerAffinityCandidate: isServerAffinityCandidate,
+				}
+				isServerAffinityCandidate = false
+
+				if race.isActive() {
+					if !race.add(candidate) {
+						continue
+					}
+					if !controller.sendCandidate(candidate) {
+						break loop
+					}
+					if !controller.waitRaceStagger() {
+						break loop
+					}
+					continue
+				}
+
+				if !controller.sendCandidate(candidate) {
+					break loop
+				}
+			}
+
+			if isRacing {
+				race.serverEntries += 1
+				if !race.isActive() && !controller.sendDeferredCandidates(race) {
+					break loop
+				}
 			}
 
-			if time.Now().After(startTime.Add(ESTABLISH_TUNNEL_WORK_TIME)) {
+			if time.Now().After(startTime.Add(controller.establishWorkTime)) {
 				// Start over, after a brief pause, with a new shuffle of the server
 				// entries, and potentially some newly fetched server entries.
 				break
 			}
 		}
+
+		// Candidates deferred by a race which is still active, when the
+		// iteration completes or the work time is exhausted, are sent now
+		// rather than dropped.
+		if !controller.sendDeferredCandidates(race) {
+			break loop
+		}
+
 		// Free up resources now, but don't reset until after the pause.
 		iterator.Close()
 
@@ -1117,6 +1871,100 @@ loop:
 	NoticeInfo("stopped candidate generator")
 }
 
+// addServerAffinityCandidate records a new outstanding server affinity
+// candidate.
+func (controller *Controller) addServerAffinityCandidate() {
+	controller.serverAffinityMutex.Lock()
+	defer controller.serverAffinityMutex.Unlock()
+	controller.serverAffinityPending += 1
+}
+
+// serverAffinityCandidateDone records that a server affinity candidate
+// has failed, was skipped, or has delivered its established tunnel.
+func (controller *Controller) serverAffinityCandidateDone() {
+	controller.serverAffinityMutex.Lock()
+	defer controller.serverAffinityMutex.Unlock()
+	controller.serverAffinityPending -= 1
+	controller.checkServerAffinityDone()
+}
+
+// sealServerAffinityCandidates records that no more server affinity
+// candidates will be generated in this establishment.
+func (controller *Controller) sealServerAffinityCandidates() {
+	controller.serverAffinityMutex.Lock()
+	defer controller.serverAffinityMutex.Unlock()
+	controller.serverAffinitySealed = true
+	controller.checkServerAffinityDone()
+}
+
+// checkServerAffinityDone closes serverAffinityDoneBroadcast, once, when
+// there are no outstanding server affinity candidates. The caller must
+// hold serverAffinityMutex.
+func (controller *Controller) checkServerAffinityDone() {
+	if controller.serverAffinitySealed &&
+		controller.serverAffinityPending <= 0 &&
+		!controller.serverAffinityClosed {
+
+		close(controller.serverAffinityDoneBroadcast)
+		controller.serverAffinityClosed = true
+	}
+}
+
+// sendCandidate sends a candidate to the establish workers, blocking
+// until a worker receives it. It returns false if establishing is
+// stopped first, in which case the candidate is dropped.
+func (controller *Controller) sendCandidate(candidate *candidateServerEntry) bool {
+	select {
+	case controller.candidateServerEntries <- candidate:
+		return true
+	case <-controller.stopEstablishingBroadcast:
+	case <-controller.shutdownBroadcast:
+	}
+	controller.dropCandidates(candidate)
+	return false
+}
+
+// sendDeferredCandidates sends the candidates deferred by the race. It
+// returns false if establishing is stopped first, in which case the
+// unsent candidates are dropped.
+func (controller *Controller) sendDeferredCandidates(race *establishRace) bool {
+	deferred := race.takeDeferred()
+	for i, candidate := range deferred {
+		if !controller.sendCandidate(candidate) {
+			controller.dropCandidates(deferred[i+1:]...)
+			return false
+		}
+	}
+	return true
+}
+
+// dropCandidates discards candidates which won't be attempted. A dropped
+// server affinity candidate is completed, so that the server affinity
+// accounting remains balanced.
+func (controller *Controller) dropCandidates(candidates ...*candidateServerEntry) {
+	for _, candidate := range candidates {
+		if candidate.isServerAffinityCandidate {
+			controller.serverAffinityCandidateDone()
+		}
+	}
+}
+
+// waitRaceStagger waits for the race stagger delay, before starting
+// the next race candidate. It returns false if establishing is stopped
+// first, which is the case when a race candidate wins.
+func (controller *Controller) waitRaceStagger() bool {
+	timer := time.NewTimer(
+		time.Duration(controller.config.EstablishTunnelRaceStaggerMilliseconds) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-controller.stopEstablishingBroadcast:
+	case <-controller.shutdownBroadcast:
+	}
+	return false
+}
+
 // establishTunnelWorker pulls candidates from the candidate queue, establishes
 // a connection to the tunnel server, and delivers the established tunnel to a channel.
 func (controller *Controller) establishTunnelWorker() {
@@ -1126,27 +1974,63 @@ loop:
 		// Note: don't receive from candidateServerEntries and stopEstablishingBroadcast
 		// in the same select, since we want to prioritize receiving the stop signal
 		if controller.isStopEstablishingBroadcast() {
+			controller.dropCandidates(candidateServerEntry)
 			break loop
 		}
 
 		// There may already be a tunnel to this candidate. If so, skip it.
 		if controller.isActiveTunnelServerEntry(candidateServerEntry.serverEntry) {
+			if candidateServerEntry.isServerAffinityCandidate {
+				controller.serverAffinityCandidateDone()
+			}
+			continue
+		}
+
+		serverEntry := candidateServerEntry.serverEntry
+		dialParams := candidateServerEntry.dialParams
+		networkID := candidateServerEntry.networkID
+
+		// Skip the candidate if the same candidate is already being
+		// attempted, as may happen when a new round of establishment
+		// starts while slow attempts from the previous round are
+		// still in progress.
+		inFlightKey := serverEntry.IpAddress + "/" + dialParams.candidateKey()
+		if !controller.startInFlight(inFlightKey) {
+			if candidateServerEntry.isServerAffinityCandidate {
+				controller.serverAffinityCandidateDone()
+			}
 			continue
 		}
 
-		tunnel, err := EstablishTunnel(
+		// Connection history and dial parameters are updated with the
+		// result. A TargetServerEntry, which may not be in the data
+		// store, has no history.
+		recordHistory := controller.config.TargetServerEntry == ""
+
+		// Recording the attempt doesn't delay the establishment.
+		if recordHistory {
+			go RecordServerEntryAttempt(serverEntry.IpAddress, dialParams.Protocol)
+		}
+
+		establishStartTime := time.Now()
+
+		tunnel, err := controller.establishTunnel(
 			controller.config,
 			controller.untunneledDialConfig,
 			controller.sessionId,
 			controller.establishPendingConns,
-			candidateServerEntry.serverEntry,
+			serverEntry,
+			dialParams,
 			controller) // TunnelOwner
+
+		controller.stopInFlight(inFlightKey)
+
 		if err != nil {
 
 			// Unblock other candidates immediately when
 			// server affinity candidate fails.
 			if candidateServerEntry.isServerAffinityCandidate {
-				close(controller.serverAffinityDoneBroadcast)
+				controller.serverAffinityCandidateDone()
 			}
 
 			// Before emitting error, check if establish interrupted, in which
@@ -1154,11 +2038,47 @@ loop:
 			if controller.isStopEstablishingBroadcast() {
 				break loop
 			}
+			if recordHistory {
+				RecordServerEntryFailure(serverEntry.IpAddress, dialParams.Protocol)
+
+				// Fall back to fresh dial parameters after a replay fails.
+				if dialParams.IsReplay {
+					DeleteDialParameters(serverEntry.IpAddress, networkID)
+				}
+			}
 			NoticeInfo("failed to connect to %s: %s", candidateServerEntry.serverEntry.IpAddress, err)
 			continue
 		}
 
-		// Block for server affinity grace period before delivering.
+		if recordHistory {
+			RecordServerEntrySuccess(
+				serverEntry.IpAddress,
+				dialParams.Protocol,
+				networkID,
+				time.Since(establishStartTime))
+
+			// Store the dial parameters for replay. A replay is stored
+			// again, which retains its original CreatedTime.
+			err := SetDialParameters(serverEntry.IpAddress, networkID, dialParams)
+			if err != nil {
+				NoticeAlert("failed to store dial parameters: %s", err)
+			}
+		}
+
+		// Record the network the tunnel was established on, so a subsequent
+		// failure is classified under that network.
+		tunnel.networkID = networkID
+
+		// Server entries discovered by the handshake may allow more tunnels
+		// to be established. Note: serverContext is nil when DisableApi is set
+		if tunnel.serverContext != nil &&
+			tunnel.serverContext.discoveredServerEntryCount > 0 {
+			controller.signalServerEntriesUpdate()
+		}
+
+		// Block for server affinity grace period before delivering. This
+		// includes race candidates, so that racing doesn't bypass server
+		// affinity.
 		if !candidateServerEntry.isServerAffinityCandidate {
 			timer := time.NewTimer(ESTABLISH_TUNNEL_SERVER_AFFINITY_GRACE_PERIOD)
 			select {
@@ -1181,12 +2101,101 @@ loop:
 		// Unblock other candidates only after delivering when
 		// server affinity candidate succeeds.
 		if candidateServerEntry.isServerAffinityCandidate {
-			close(controller.serverAffinityDoneBroadcast)
+			controller.serverAffinityCandidateDone()
 		}
 	}
 	NoticeInfo("stopped establish worker")
 }
 
+// makeCandidateDialParameters returns the dial parameters for each of the
+// candidate connection attempts to the server entry on the specified network.
+// When there are stored dial parameters from a previous successful connection,
+// and the parameters are still replayable, these are the first candidate.
+// The remaining candidates use protocols ordered by the server's connection
+// history and, for fronted protocols, distinct fronting addresses. At most
+// config.EstablishTunnelCandidatesPerServerEntry candidates are returned.
+//
+// A TargetServerEntry, which may not be in the data store, has no stored
+// dial parameters or history.
+func (controller *Controller) makeCandidateDialParameters(
+	serverEntry *ServerEntry, networkID string) []*DialParameters {
+
+	maxCount := controller.config.EstablishTunnelCandidatesPerServerEntry
+	useDataStore := controller.config.TargetServerEntry == ""
+
+	var replayDialParams *DialParameters
+	var history *ServerEntryHistory
+
+	if useDataStore {
+		dialParams, err := GetDialParameters(serverEntry.IpAddress, networkID)
+		if err != nil {
+			NoticeAlert("failed to get dial parameters: %s", err)
+		} else if dialParams != nil && dialParams.IsReplayable(controller.config, serverEntry) {
+			dialParams.IsReplay = true
+			replayDialParams = dialParams
+		}
+
+		history, err = GetServerEntryHistory(serverEntry.IpAddress)
+		if err != nil {
+			NoticeAlert("failed to get server entry history: %s", err)
+		}
+	}
+
+	var dialParamsList []*DialParameters
+
+	protocols, err := selectProtocols(controller.config, serverEntry, history, networkID)
+	if err == nil {
+		dialParamsList, err = MakeCandidateDialParameters(
+			controller.config, serverEntry, protocols, maxCount)
+	}
+	if err != nil {
+		NoticeAlert("failed to make candidates for %s: %s", serverEntry.IpAddress, err)
+	}
+
+	// The replay candidate counts towards maxCount. A new candidate that
+	// duplicates it is dropped, so up to maxCount new candidates are made
+	// and the list is truncated after merging.
+
+	if replayDialParams != nil {
+		candidates := []*DialParameters{replayDialParams}
+		for _, dialParams := range dialParamsList {
+			if dialParams.candidateKey() != replayDialParams.candidateKey() {
+				candidates = append(candidates, dialParams)
+			}
+		}
+		dialParamsList = candidates
+	}
+
+	if len(dialParamsList) > maxCount {
+		dialParamsList = dialParamsList[:maxCount]
+	}
+
+	return dialParamsList
+}
+
+// startInFlight records that a connection attempt for the candidate
+// identified by key is in progress. It returns false when an attempt
+// for the same candidate is already in progress.
+func (controller *Controller) startInFlight(key string) bool {
+	controller.establishInFlightMutex.Lock()
+	defer controller.establishInFlightMutex.Unlock()
+
+	if controller.establishInFlight[key] {
+		return false
+	}
+	controller.establishInFlight[key] = true
+	return true
+}
+
+// stopInFlight records that the connection attempt for the candidate
+// identified by key is complete.
+func (controller *Controller) stopInFlight(key string) {
+	controller.establishInFlightMutex.Lock()
+	defer controller.establishInFlightMutex.Unlock()
+
+	delete(controller.establishInFlight, key)
+}
+
 func (controller *Controller) isStopEstablishingBroadcast() bool {
 	select {
 	case <-controller.stopEstablishingBroadcast:
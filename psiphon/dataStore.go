@@ -49,14 +49,20 @@ type dataStore struct {
 
 const (
 	serverEntriesBucket         = "serverEntries"
-	rankedServerEntriesBucket   = "rankedServerEntries"
-	rankedServerEntriesKey      = "rankedServerEntries"
+	serverEntryHistoryBucket    = "serverEntryHistory"
+	dialParametersBucket        = "dialParameters"
+	impairedProtocolsBucket     = "impairedProtocols"
 	splitTunnelRouteETagsBucket = "splitTunnelRouteETags"
 	splitTunnelRouteDataBucket  = "splitTunnelRouteData"
 	urlETagsBucket              = "urlETags"
 	keyValueBucket              = "keyValues"
 	tunnelStatsBucket           = "tunnelStats"
-	rankedServerEntryCount      = 100
+
+	// The rankedServerEntries bucket, which held a single server ranking
+	// list, is superseded by serverEntryHistory. The ranking is migrated
+	// to serverEntryHistory and the bucket is deleted.
+	legacyRankedServerEntriesBucket = "rankedServerEntries"
+	legacyRankedServerEntriesKey    = "rankedServerEntries"
 )
 
 var singleton dataStore
@@ -96,7 +102,9 @@ func InitDataStore(config *Config) (err error) {
 		err = db.Update(func(tx *bolt.Tx) error {
 			requiredBuckets := []string{
 				serverEntriesBucket,
-				rankedServerEntriesBucket,
+				serverEntryHistoryBucket,
+				dialParametersBucket,
+				impairedProtocolsBucket,
 				splitTunnelRouteETagsBucket,
 				splitTunnelRouteDataBucket,
 				urlETagsBucket,
@@ -109,7 +117,11 @@ func InitDataStore(config *Config) (err error) {
 					return err
 				}
 			}
-			return nil
+			err := migrateLegacyRankedServerEntries(tx)
+			if err != nil {
+				return err
+			}
+			return pruneDialParameters(tx)
 		})
 		if err != nil {
 			err = fmt.Errorf("initDataStore failed to create buckets: %s", err)
@@ -141,6 +153,50 @@ func InitDataStore(config *Config) (err error) {
 	return err
 }
 
+// migrateLegacyRankedServerEntries seeds the server entry history from the
+// legacy server ranking list, and then deletes the legacy bucket. Each
+// ranked server entry is promoted, with promotion times spaced in rank
+// order, so that the previous ranking, including the server affinity
+// server at the head of the list, is retained on every network.
+func migrateLegacyRankedServerEntries(tx *bolt.Tx) error {
+
+	bucket := tx.Bucket([]byte(legacyRankedServerEntriesBucket))
+	if bucket == nil {
+		return nil
+	}
+
+	var rankedServerEntryIds []string
+	data := bucket.Get([]byte(legacyRankedServerEntriesKey))
+	if data != nil {
+		err := json.Unmarshal(data, &rankedServerEntryIds)
+		if err != nil {
+			// In case of data corruption, the ranking is discarded.
+			NoticeAlert("migrateLegacyRankedServerEntries: %s", ContextError(err))
+			rankedServerEntryIds = nil
+		}
+	}
+
+	now := time.Now()
+	for i, serverEntryId := range rankedServerEntryIds {
+		promoted := now.Add(-time.Duration(i) * time.Second)
+		err := updateServerEntryHistoryTx(tx, serverEntryId, func(history *ServerEntryHistory) {
+			if history.LastPromoted.Before(promoted) {
+				history.LastPromoted = promoted
+			}
+		})
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	err := tx.DeleteBucket([]byte(legacyRankedServerEntriesBucket))
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
+
 func checkInitDataStore() {
 	if singleton.db == nil {
 		panic("checkInitDataStore: datastore not initialized")
@@ -148,10 +204,7 @@ func checkInitDataStore() {
 }
 
 // StoreServerEntry adds the server entry to the data store.
-// A newly stored (or re-stored) server entry is assigned the next-to-top
-// rank for iteration order (the previous top ranked entry is promoted). The
-// purpose of inserting at next-to-top is to keep the last selected server
-// as the top ranked server.
+// Any existing connection history for the server entry is retained.
 // When replaceIfExists is true, an existing server entry record is
 // overwritten; otherwise, the existing record is unchanged.
 // If the server entry data is malformed, an alert notice is issued and
@@ -206,11 +259,6 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			return ContextError(err)
 		}
 
-		err = insertRankedServerEntry(tx, serverEntry.IpAddress, 1)
-		if err != nil {
-			return ContextError(err)
-		}
-
 		NoticeInfo("updated server %s", serverEntry.IpAddress)
 
 		return nil
@@ -248,110 +296,309 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 	return nil
 }
 
-// PromoteServerEntry assigns the top rank (one more than current
-// max rank) to the specified server entry. Server candidates are
-// iterated in decending rank order, so this server entry will be
-// the first candidate in a subsequent tunnel establishment.
+// PromoteServerEntry marks the specified server entry as recently
+// successful, on any network and for any protocol, so that it will be
+// one of the first candidates in a subsequent tunnel establishment.
+// This is used when there's no connection history to record, as when
+// migrating a legacy data store.
 func PromoteServerEntry(ipAddress string) error {
 	checkInitDataStore()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := updateServerEntryHistory(ipAddress, func(history *ServerEntryHistory) {
+		history.LastPromoted = time.Now()
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
-		// Ensure the corresponding entry exists before
-		// inserting into rank.
-		bucket := tx.Bucket([]byte(serverEntriesBucket))
-		data := bucket.Get([]byte(ipAddress))
-		if data == nil {
-			NoticeAlert(
-				"PromoteServerEntry: ignoring unknown server entry: %s",
-				ipAddress)
-			return nil
-		}
+// RecordServerEntryAttempt records the start of a tunnel establishment
+// to the specified server using the specified protocol. Since many
+// establishments start concurrently, concurrent attempts are recorded
+// together, in a single batched transaction.
+func RecordServerEntryAttempt(ipAddress, protocol string) error {
+	checkInitDataStore()
 
-		return insertRankedServerEntry(tx, ipAddress, 0)
+	err := singleton.db.Batch(func(tx *bolt.Tx) error {
+		return updateServerEntryHistoryTx(tx, ipAddress, func(history *ServerEntryHistory) {
+			history.getProtocolHistory(protocol).Attempts += 1
+		})
 	})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
+// RecordServerEntrySuccess records a successful tunnel establishment to
+// the specified server, using the specified protocol, on the specified
+// network. establishDuration is the time taken to establish the tunnel.
+func RecordServerEntrySuccess(
+	ipAddress, protocol, networkID string, establishDuration time.Duration) error {
+	checkInitDataStore()
+
+	err := updateServerEntryHistory(ipAddress, func(history *ServerEntryHistory) {
+		history.getProtocolHistory(protocol).recordSuccess(networkID, establishDuration)
+	})
 	if err != nil {
 		return ContextError(err)
 	}
 	return nil
 }
 
-func getRankedServerEntries(tx *bolt.Tx) ([]string, error) {
-	bucket := tx.Bucket([]byte(rankedServerEntriesBucket))
-	data := bucket.Get([]byte(rankedServerEntriesKey))
+// RecordServerEntryFailure records a failed tunnel establishment to the
+// specified server using the specified protocol.
+func RecordServerEntryFailure(ipAddress, protocol string) error {
+	checkInitDataStore()
 
-	if data == nil {
-		return []string{}, nil
+	err := updateServerEntryHistory(ipAddress, func(history *ServerEntryHistory) {
+		history.getProtocolHistory(protocol).recordFailure()
+	})
+	if err != nil {
+		return ContextError(err)
 	}
+	return nil
+}
+
+// GetServerEntryHistory returns the connection history for the specified
+// server. When there is no history, an empty history is returned.
+func GetServerEntryHistory(ipAddress string) (*ServerEntryHistory, error) {
+	checkInitDataStore()
 
-	rankedServerEntries := make([]string, 0)
-	err := json.Unmarshal(data, &rankedServerEntries)
+	history := newServerEntryHistory()
+	err := singleton.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(serverEntryHistoryBucket))
+		data := bucket.Get([]byte(ipAddress))
+		if data == nil {
+			return nil
+		}
+		return decodeServerEntryHistory(data, history)
+	})
 	if err != nil {
 		return nil, ContextError(err)
 	}
-	return rankedServerEntries, nil
+	return history, nil
 }
 
-func setRankedServerEntries(tx *bolt.Tx, rankedServerEntries []string) error {
-	data, err := json.Marshal(rankedServerEntries)
+// updateServerEntryHistory applies the update function to the stored
+// history for the specified server entry, in a single transaction.
+func updateServerEntryHistory(
+	ipAddress string, update func(history *ServerEntryHistory)) error {
+
+	return singleton.db.Update(func(tx *bolt.Tx) error {
+		return updateServerEntryHistoryTx(tx, ipAddress, update)
+	})
+}
+
+// updateServerEntryHistoryTx is updateServerEntryHistory within an existing
+// transaction.
+func updateServerEntryHistoryTx(
+	tx *bolt.Tx, ipAddress string, update func(history *ServerEntryHistory)) error {
+
+	// Ensure the corresponding entry exists before
+	// recording history.
+	serverEntries := tx.Bucket([]byte(serverEntriesBucket))
+	if serverEntries.Get([]byte(ipAddress)) == nil {
+		NoticeAlert(
+			"updateServerEntryHistory: ignoring unknown server entry: %s",
+			ipAddress)
+		return nil
+	}
+
+	bucket := tx.Bucket([]byte(serverEntryHistoryBucket))
+	history := newServerEntryHistory()
+	data := bucket.Get([]byte(ipAddress))
+	if data != nil {
+		// In case of data corruption, start over with a new history.
+		err := decodeServerEntryHistory(data, history)
+		if err != nil {
+			NoticeAlert("updateServerEntryHistory: %s", ContextError(err))
+			history = newServerEntryHistory()
+		}
+	}
+
+	update(history)
+
+	data, err := json.Marshal(history)
 	if err != nil {
 		return ContextError(err)
 	}
+	err = bucket.Put([]byte(ipAddress), data)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
-	bucket := tx.Bucket([]byte(rankedServerEntriesBucket))
-	err = bucket.Put([]byte(rankedServerEntriesKey), data)
+func decodeServerEntryHistory(data []byte, history *ServerEntryHistory) error {
+	err := json.Unmarshal(data, history)
 	if err != nil {
 		return ContextError(err)
 	}
+	if history.Protocols == nil {
+		history.Protocols = make(map[string]*ProtocolHistory)
+	}
+	for _, protocolHistory := range history.Protocols {
+		if protocolHistory.LastSuccess == nil {
+			protocolHistory.LastSuccess = make(map[string]time.Time)
+		}
+	}
+	return nil
+}
+
+// makeDialParametersKey makes the dial parameters key for the server
+// entry and network. Dial parameters are stored separately for each
+// network, since parameters which work on one network may be blocked
+// on another.
+func makeDialParametersKey(ipAddress, networkID string) []byte {
+	return []byte(ipAddress + "/" + networkID)
+}
+
+// pruneDialParameters deletes stored dial parameters which will never be
+// replayed: parameters older than REPLAY_DIAL_PARAMETERS_TTL, and parameters
+// for server entries which are no longer in the data store. Without pruning,
+// the bucket would grow with every new network.
+func pruneDialParameters(tx *bolt.Tx) error {
+
+	serverEntries := tx.Bucket([]byte(serverEntriesBucket))
+	bucket := tx.Bucket([]byte(dialParametersBucket))
+
+	var deleteKeys [][]byte
+	cursor := bucket.Cursor()
+	for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+
+		ipAddress := strings.SplitN(string(key), "/", 2)[0]
+
+		var dialParams DialParameters
+		err := json.Unmarshal(value, &dialParams)
+
+		if err != nil ||
+			serverEntries.Get([]byte(ipAddress)) == nil ||
+			time.Now().After(dialParams.CreatedTime.Add(REPLAY_DIAL_PARAMETERS_TTL)) {
+
+			deleteKeys = append(deleteKeys, append([]byte(nil), key...))
+		}
+	}
+
+	for _, key := range deleteKeys {
+		err := bucket.Delete(key)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
 
 	return nil
 }
 
-func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) error {
-	rankedServerEntries, err := getRankedServerEntries(tx)
+// SetDialParameters stores the dial parameters for a successful tunnel
+// to the specified server entry on the specified network, replacing any
+// existing dial parameters.
+func SetDialParameters(ipAddress, networkID string, dialParams *DialParameters) error {
+	checkInitDataStore()
+
+	data, err := json.Marshal(dialParams)
 	if err != nil {
 		return ContextError(err)
 	}
 
-	// BoltDB implementation note:
-	// For simplicity, we store the ranked server ids in an array serialized to
-	// a single key value. To ensure this value doesn't grow without bound,
-	// it's capped at rankedServerEntryCount. For now, this cap should be large
-	// enough to meet the shuffleHeadLength = config.TunnelPoolSize criteria, for
-	// any reasonable configuration of config.TunnelPoolSize.
+	err = singleton.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dialParametersBucket))
+		return bucket.Put(makeDialParametersKey(ipAddress, networkID), data)
+	})
 
-	// Using: https://github.com/golang/go/wiki/SliceTricks
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
-	// When serverEntryId is already ranked, remove it first to avoid duplicates
+// GetDialParameters retrieves the stored dial parameters for the
+// specified server entry and network. If not found, it returns nil.
+func GetDialParameters(ipAddress, networkID string) (*DialParameters, error) {
+	checkInitDataStore()
 
-	for i, rankedServerEntryId := range rankedServerEntries {
-		if rankedServerEntryId == serverEntryId {
-			rankedServerEntries = append(
-				rankedServerEntries[:i], rankedServerEntries[i+1:]...)
-			break
+	var dialParams *DialParameters
+	err := singleton.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dialParametersBucket))
+		data := bucket.Get(makeDialParametersKey(ipAddress, networkID))
+		if data == nil {
+			return nil
 		}
+		dialParams = new(DialParameters)
+		return json.Unmarshal(data, dialParams)
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
 	}
+	return dialParams, nil
+}
+
+// DeleteDialParameters deletes any stored dial parameters for the
+// specified server entry and network.
+func DeleteDialParameters(ipAddress, networkID string) error {
+	checkInitDataStore()
 
-	// SliceTricks insert, with length cap enforced
+	err := singleton.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dialParametersBucket))
+		return bucket.Delete(makeDialParametersKey(ipAddress, networkID))
+	})
 
-	if len(rankedServerEntries) < rankedServerEntryCount {
-		rankedServerEntries = append(rankedServerEntries, "")
-	}
-	if position >= len(rankedServerEntries) {
-		position = len(rankedServerEntries) - 1
+	if err != nil {
+		return ContextError(err)
 	}
-	copy(rankedServerEntries[position+1:], rankedServerEntries[position:])
-	rankedServerEntries[position] = serverEntryId
+	return nil
+}
+
+// SetImpairedProtocolClassification stores the impaired protocol
+// classification for the specified network, replacing any existing
+// classification.
+func SetImpairedProtocolClassification(
+	networkID string, classification ImpairedProtocolClassification) error {
+
+	checkInitDataStore()
 
-	err = setRankedServerEntries(tx, rankedServerEntries)
+	data, err := json.Marshal(classification)
 	if err != nil {
 		return ContextError(err)
 	}
 
+	err = singleton.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(impairedProtocolsBucket))
+		return bucket.Put([]byte(networkID), data)
+	})
+
+	if err != nil {
+		return ContextError(err)
+	}
 	return nil
 }
 
+// GetImpairedProtocolClassification retrieves the stored impaired protocol
+// classification for the specified network. If not found, it returns an
+// empty classification.
+func GetImpairedProtocolClassification(
+	networkID string) (ImpairedProtocolClassification, error) {
+
+	checkInitDataStore()
+
+	classification := make(ImpairedProtocolClassification)
+	err := singleton.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(impairedProtocolsBucket))
+		data := bucket.Get([]byte(networkID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &classification)
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return classification, nil
+}
+
 func serverEntrySupportsProtocol(serverEntry *ServerEntry, protocol string) bool {
 	// Note: for meek, the capabilities are FRONTED-MEEK and UNFRONTED-MEEK
 	// and the additonal OSSH service is assumed to be available internally.
@@ -364,6 +611,7 @@ func serverEntrySupportsProtocol(serverEntry *ServerEntry, protocol string) bool
 type ServerEntryIterator struct {
 	region                      string
 	protocol                    string
+	networkID                   string
 	shuffleHeadLength           int
 	serverEntryIds              []string
 	serverEntryIndex            int
@@ -372,8 +620,11 @@ type ServerEntryIterator struct {
 	targetServerEntry           *ServerEntry
 }
 
-// NewServerEntryIterator creates a new ServerEntryIterator
-func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err error) {
+// NewServerEntryIterator creates a new ServerEntryIterator. Server
+// entries are ranked using their connection history on the network
+// identified by networkID.
+func NewServerEntryIterator(
+	config *Config, networkID string) (iterator *ServerEntryIterator, err error) {
 
 	// When configured, this target server entry is the only candidate
 	if config.TargetServerEntry != "" {
@@ -384,6 +635,7 @@ func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err
 	iterator = &ServerEntryIterator{
 		region:                      config.EgressRegion,
 		protocol:                    config.TunnelProtocol,
+		networkID:                   networkID,
 		shuffleHeadLength:           config.TunnelPoolSize,
 		isTargetServerEntryIterator: false,
 	}
@@ -434,9 +686,12 @@ func (iterator *ServerEntryIterator) Reset() error {
 	NoticeCandidateServers(iterator.region, iterator.protocol, count)
 
 	// This query implements the Psiphon server candidate selection
-	// algorithm: the first TunnelPoolSize server candidates are in rank
-	// (priority) order, to favor previously successful servers; then the
-	// remaining long tail is shuffled to raise up less recent candidates.
+	// algorithm: up to TunnelPoolSize server candidates which recently
+	// connected on the current network are first, in score order; then
+	// the remaining long tail is in a random order weighted by score, to
+	// favor previously successful servers and protocols while still
+	// raising up less recent and untried candidates. See
+	// rankServerEntries.
 
 	// BoltDB implementation note:
 	// We don't keep a transaction open for the duration of the iterator
@@ -453,27 +708,27 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// list is built.
 
 	var serverEntryIds []string
+	histories := make(map[string]*ServerEntryHistory)
 
 	err := singleton.db.View(func(tx *bolt.Tx) error {
-		var err error
-		serverEntryIds, err = getRankedServerEntries(tx)
-		if err != nil {
-			return err
-		}
-
-		skipServerEntryIds := make(map[string]bool)
-		for _, serverEntryId := range serverEntryIds {
-			skipServerEntryIds[serverEntryId] = true
-		}
 
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
 		cursor := bucket.Cursor()
-		for key, _ := cursor.Last(); key != nil; key, _ = cursor.Prev() {
-			serverEntryId := string(key)
-			if _, ok := skipServerEntryIds[serverEntryId]; ok {
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			serverEntryIds = append(serverEntryIds, string(key))
+		}
+
+		bucket = tx.Bucket([]byte(serverEntryHistoryBucket))
+		cursor = bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			history := newServerEntryHistory()
+			err := decodeServerEntryHistory(value, history)
+			if err != nil {
+				// In case of data corruption, rank as if there's no history.
+				NoticeAlert("ServerEntryIterator.Reset: %s", ContextError(err))
 				continue
 			}
-			serverEntryIds = append(serverEntryIds, serverEntryId)
+			histories[string(key)] = history
 		}
 		return nil
 	})
@@ -481,12 +736,12 @@ func (iterator *ServerEntryIterator) Reset() error {
 		return ContextError(err)
 	}
 
-	for i := len(serverEntryIds) - 1; i > iterator.shuffleHeadLength-1; i-- {
-		j := rand.Intn(i+1-iterator.shuffleHeadLength) + iterator.shuffleHeadLength
-		serverEntryIds[i], serverEntryIds[j] = serverEntryIds[j], serverEntryIds[i]
-	}
-
-	iterator.serverEntryIds = serverEntryIds
+	iterator.serverEntryIds = rankServerEntries(
+		serverEntryIds,
+		histories,
+		iterator.protocol,
+		iterator.networkID,
+		iterator.shuffleHeadLength)
 	iterator.serverEntryIndex = 0
 
 	return nil
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/bolt"
+)
+
+// openTestDataStore opens a new bolt database, separate from the data store
+// singleton. The returned function closes and deletes the database.
+func openTestDataStore(t *testing.T) (*bolt.DB, func()) {
+
+	dir, err := ioutil.TempDir("", "psiphon-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dir, DATA_STORE_FILENAME), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open failed: %s", err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrateLegacyRankedServerEntries(t *testing.T) {
+
+	db, closeDataStore := openTestDataStore(t)
+	defer closeDataStore()
+
+	// The legacy ranking includes a server entry which no longer exists
+
+	rankedServerEntryIds := []string{"192.0.2.3", "192.0.2.1", "192.0.2.4", "192.0.2.2"}
+	storedServerEntryIds := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.5"}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{
+			serverEntriesBucket, serverEntryHistoryBucket, legacyRankedServerEntriesBucket} {
+			_, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		for _, serverEntryId := range storedServerEntryIds {
+			err := tx.Bucket([]byte(serverEntriesBucket)).Put([]byte(serverEntryId), []byte("{}"))
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(rankedServerEntryIds)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(legacyRankedServerEntriesBucket)).Put(
+			[]byte(legacyRankedServerEntriesKey), data)
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+
+	err = db.Update(migrateLegacyRankedServerEntries)
+	if err != nil {
+		t.Fatalf("migrateLegacyRankedServerEntries failed: %s", err)
+	}
+
+	histories := make(map[string]*ServerEntryHistory)
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(legacyRankedServerEntriesBucket)) != nil {
+			t.Fatalf("unexpected legacy bucket")
+		}
+		return tx.Bucket([]byte(serverEntryHistoryBucket)).ForEach(
+			func(key, value []byte) error {
+				history := newServerEntryHistory()
+				err := decodeServerEntryHistory(value, history)
+				histories[string(key)] = history
+				return err
+			})
+	})
+	if err != nil {
+		t.Fatalf("View failed: %s", err)
+	}
+
+	if len(histories) != 3 || histories["192.0.2.5"] != nil {
+		t.Fatalf("unexpected histories: %+v", histories)
+	}
+
+	// The legacy ranking order, with the affinity server first, is retained
+
+	now := time.Now()
+	rankedServerEntryIds = []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}
+	for i, serverEntryId := range rankedServerEntryIds {
+		history := histories[serverEntryId]
+		if history == nil || !history.hasRecentSuccess("", "network", now) {
+			t.Fatalf("missing promotion for %s", serverEntryId)
+		}
+		if i > 0 && !histories[rankedServerEntryIds[i-1]].LastPromoted.After(history.LastPromoted) {
+			t.Fatalf("unexpected promotion order for %s", serverEntryId)
+		}
+	}
+
+	// Migration is a no-op once the legacy bucket is deleted
+
+	err = db.Update(migrateLegacyRankedServerEntries)
+	if err != nil {
+		t.Fatalf("migrateLegacyRankedServerEntries failed: %s", err)
+	}
+}
+
+func TestPruneDialParameters(t *testing.T) {
+
+	db, closeDataStore := openTestDataStore(t)
+	defer closeDataStore()
+
+	now := time.Now()
+	expired := now.Add(-REPLAY_DIAL_PARAMETERS_TTL - time.Minute)
+
+	testCases := []struct {
+		ipAddress   string
+		networkID   string
+		createdTime time.Time
+		isRetained  bool
+	}{
+		{"192.0.2.1", "network-A", now, true},
+		{"192.0.2.1", "network/B", now, true},
+		{"192.0.2.1", "network-C", expired, false},
+		{"192.0.2.2", "network-A", now, false},
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{serverEntriesBucket, dialParametersBucket} {
+			_, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Bucket([]byte(serverEntriesBucket)).Put([]byte("192.0.2.1"), []byte("{}"))
+		if err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte(dialParametersBucket))
+		for _, testCase := range testCases {
+			data, err := json.Marshal(&DialParameters{
+				Protocol:    TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+				CreatedTime: testCase.createdTime,
+			})
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(makeDialParametersKey(testCase.ipAddress, testCase.networkID), data)
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Put(makeDialParametersKey("192.0.2.1", "network-D"), []byte("{"))
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+
+	err = db.Update(pruneDialParameters)
+	if err != nil {
+		t.Fatalf("pruneDialParameters failed: %s", err)
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(dialParametersBucket))
+		for _, testCase := range testCases {
+			data := bucket.Get(makeDialParametersKey(testCase.ipAddress, testCase.networkID))
+			if (data != nil) != testCase.isRetained {
+				t.Fatalf("unexpected pruning for %s %s", testCase.ipAddress, testCase.networkID)
+			}
+		}
+		if bucket.Get(makeDialParametersKey("192.0.2.1", "network-D")) != nil {
+			t.Fatalf("malformed dial parameters not pruned")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View failed: %s", err)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DialParameters are the choices made when dialing a tunnel to a server:
+// the tunnel protocol; for meek protocols, the fronting address, dial
+// address, TLS SNI and HTTP Host header, including the result of any
+// HostNameTransformer; and the obfuscation padding lengths. All random
+// selection is done in MakeCandidateDialParameters, so a tunnel dialed with
+// the same DialParameters presents the same parameters to the network.
+//
+// DialParameters for successful tunnels are stored, for each server and
+// network, and replayed on the next establishment. Replay makes
+// reconnecting fast and stable, since parameters which are known to work
+// on the current network are tried first.
+type DialParameters struct {
+	Protocol string
+
+	// CreatedTime is when the parameters were selected. Parameters are
+	// replayed only until REPLAY_DIAL_PARAMETERS_TTL after this time, after
+	// which fresh parameters are selected.
+	CreatedTime time.Time
+
+	UseIndistinguishableTLS bool
+
+	MeekFrontingAddress     string
+	MeekDialAddress         string
+	MeekUseHTTPS            bool
+	MeekSNIServerName       string
+	MeekHostHeader          string
+	MeekTransformedHostName bool
+	MeekCookiePaddingLength int
+
+	ObfuscatorPaddingLength int
+
+	// IsReplay indicates that the parameters were loaded from the data
+	// store. This value is not stored.
+	IsReplay bool `json:"-"`
+}
+
+// MakeCandidateDialParameters expands the server entry into a list of
+// distinct dial parameters to try, each with a different combination of
+// protocol, fronting address and SNI. protocols is the list of protocols
+// to use, in order of preference. Fronted meek protocols yield a candidate
+// for each fronting address, so that a server with many fronts may be
+// tried thoroughly.
+//
+// The candidates are interleaved by protocol: the first candidate for each
+// protocol, in order, then the second for each protocol, and so on. This
+// ensures that each protocol is tried before a fronted protocol's many
+// fronting addresses are exhausted. At most maxCount candidates are
+// returned.
+func MakeCandidateDialParameters(
+	config *Config,
+	serverEntry *ServerEntry,
+	protocols []string,
+	maxCount int) ([]*DialParameters, error) {
+
+	protocolCandidates := make([][]*DialParameters, 0, len(protocols))
+
+	for _, protocol := range protocols {
+
+		if !TunnelProtocolUsesFrontedMeek(protocol) {
+			dialParams, err := makeDialParameters(config, serverEntry, protocol, "")
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			protocolCandidates = append(
+				protocolCandidates, []*DialParameters{dialParams})
+			continue
+		}
+
+		frontingAddresses, err := selectFrontingAddresses(serverEntry, maxCount)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		candidates := make([]*DialParameters, 0, len(frontingAddresses))
+		for _, frontingAddress := range frontingAddresses {
+			dialParams, err := makeDialParameters(
+				config, serverEntry, protocol, frontingAddress)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			candidates = append(candidates, dialParams)
+		}
+		protocolCandidates = append(protocolCandidates, candidates)
+	}
+
+	var dialParamsList []*DialParameters
+	keys := make(map[string]bool)
+	for i := 0; len(dialParamsList) < maxCount; i++ {
+		added := false
+		for _, candidates := range protocolCandidates {
+			if i >= len(candidates) {
+				continue
+			}
+			added = true
+			key := candidates[i].candidateKey()
+			if keys[key] {
+				continue
+			}
+			keys[key] = true
+			dialParamsList = append(dialParamsList, candidates[i])
+			if len(dialParamsList) >= maxCount {
+				break
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	return dialParamsList, nil
+}
+
+// candidateKey identifies the distinguishing dial parameters: protocol,
+// fronting address and SNI. Candidates with the same key, for the same
+// server, are duplicates.
+func (dialParams *DialParameters) candidateKey() string {
+	return fmt.Sprintf("%s/%s/%s",
+		dialParams.Protocol, dialParams.MeekFrontingAddress, dialParams.MeekSNIServerName)
+}
+
+// makeDialParameters makes new dial parameters using the specified
+// protocol and, for fronted meek protocols, fronting address.
+func makeDialParameters(
+	config *Config,
+	serverEntry *ServerEntry,
+	protocol string,
+	frontingAddress string) (*DialParameters, error) {
+
+	dialParams := &DialParameters{
+		Protocol:                protocol,
+		CreatedTime:             time.Now(),
+		UseIndistinguishableTLS: config.UseIndistinguishableTLS,
+	}
+
+	var err error
+	dialParams.ObfuscatorPaddingLength, err = MakeSecureRandomInt(OBFUSCATE_MAX_PADDING + 1)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if !TunnelProtocolUsesMeek(protocol) {
+		return dialParams, nil
+	}
+
+	dialParams.MeekCookiePaddingLength, err = MakeSecureRandomInt(MEEK_COOKIE_MAX_PADDING + 1)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	switch protocol {
+	case TUNNEL_PROTOCOL_FRONTED_MEEK:
+		frontingHost, err := selectFrontingHost(serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		dialParams.MeekFrontingAddress = frontingAddress
+		dialParams.MeekDialAddress = fmt.Sprintf("%s:443", frontingAddress)
+		dialParams.MeekUseHTTPS = true
+		if !serverEntry.MeekFrontingDisableSNI {
+			dialParams.MeekSNIServerName, dialParams.MeekTransformedHostName =
+				config.HostNameTransformer.TransformHostName(frontingAddress)
+		}
+		dialParams.MeekHostHeader = frontingHost
+
+	case TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+		frontingHost, err := selectFrontingHost(serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		dialParams.MeekFrontingAddress = frontingAddress
+		dialParams.MeekDialAddress = fmt.Sprintf("%s:80", frontingAddress)
+		dialParams.MeekHostHeader = frontingHost
+
+	case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+		dialParams.MeekDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		hostname := serverEntry.IpAddress
+		hostname, dialParams.MeekTransformedHostName =
+			config.HostNameTransformer.TransformHostName(hostname)
+		if serverEntry.MeekServerPort == 80 {
+			dialParams.MeekHostHeader = hostname
+		} else {
+			dialParams.MeekHostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
+		}
+
+	case TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS:
+		dialParams.MeekDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		dialParams.MeekUseHTTPS = true
+		dialParams.MeekSNIServerName, dialParams.MeekTransformedHostName =
+			config.HostNameTransformer.TransformHostName(serverEntry.IpAddress)
+		if serverEntry.MeekServerPort == 443 {
+			dialParams.MeekHostHeader = serverEntry.IpAddress
+		} else {
+			dialParams.MeekHostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		}
+
+	default:
+		return nil, ContextError(errors.New("unexpected protocol"))
+	}
+
+	// The unnderlying TLS will automatically disable SNI for IP address server name
+	// values; we have this explicit check here so we record the correct value for stats.
+	if net.ParseIP(dialParams.MeekSNIServerName) != nil {
+		dialParams.MeekSNIServerName = ""
+	}
+
+	return dialParams, nil
+}
+
+// IsReplayable checks that stored dial parameters may be replayed for the
+// server entry: the parameters must not have expired, and must still be
+// consistent with the config and with the server entry, which may have been
+// updated since the parameters were stored. serverEntry should reflect any
+// impaired protocols which are disabled.
+func (dialParams *DialParameters) IsReplayable(
+	config *Config, serverEntry *ServerEntry) bool {
+
+	if time.Now().After(dialParams.CreatedTime.Add(REPLAY_DIAL_PARAMETERS_TTL)) {
+		return false
+	}
+
+	if !serverEntry.SupportsProtocol(dialParams.Protocol) ||
+		(config.TunnelProtocol != "" && config.TunnelProtocol != dialParams.Protocol) {
+		return false
+	}
+
+	if dialParams.UseIndistinguishableTLS != config.UseIndistinguishableTLS {
+		return false
+	}
+
+	switch dialParams.Protocol {
+	case TUNNEL_PROTOCOL_FRONTED_MEEK, TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+		// A fronting address generated from MeekFrontingAddressesRegex can't be
+		// checked against the server entry.
+		if serverEntry.MeekFrontingAddressesRegex == "" &&
+			!Contains(serverEntry.MeekFrontingAddresses, dialParams.MeekFrontingAddress) {
+			return false
+		}
+		if dialParams.MeekHostHeader != serverEntry.MeekFrontingHost &&
+			!Contains(serverEntry.MeekFrontingHosts, dialParams.MeekHostHeader) {
+			return false
+		}
+
+	case TUNNEL_PROTOCOL_UNFRONTED_MEEK, TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS:
+		if dialParams.MeekDialAddress !=
+			fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+)
+
+func makeTestDialParametersServerEntry() *ServerEntry {
+	return &ServerEntry{
+		IpAddress:             "192.0.2.1",
+		SshObfuscatedPort:     443,
+		MeekServerPort:        8080,
+		MeekFrontingAddresses: []string{"a.example.com", "b.example.com", "c.example.com"},
+		MeekFrontingHosts:     []string{"host.example.com"},
+		Capabilities: []string{
+			GetCapability(TUNNEL_PROTOCOL_FRONTED_MEEK),
+			GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+			GetCapability(TUNNEL_PROTOCOL_UNFRONTED_MEEK),
+			GetCapability(TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS),
+		},
+	}
+}
+
+func TestMakeCandidateDialParameters(t *testing.T) {
+
+	config := &Config{HostNameTransformer: &IdentityHostNameTransformer{}}
+	serverEntry := makeTestDialParametersServerEntry()
+	protocols := []string{
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+	}
+
+	dialParamsList, err := MakeCandidateDialParameters(config, serverEntry, protocols, 10)
+	if err != nil {
+		t.Fatalf("MakeCandidateDialParameters failed: %s", err)
+	}
+
+	// Candidates are interleaved by protocol, and each fronting address is
+	// a distinct candidate.
+
+	expectedProtocols := []string{
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+	}
+
+	if len(dialParamsList) != len(expectedProtocols) {
+		t.Fatalf("unexpected candidate count: %d", len(dialParamsList))
+	}
+
+	frontingAddresses := make(map[string]bool)
+
+	for i, dialParams := range dialParamsList {
+
+		if dialParams.Protocol != expectedProtocols[i] {
+			t.Fatalf("unexpected protocol for candidate %d: %s", i, dialParams.Protocol)
+		}
+
+		if dialParams.ObfuscatorPaddingLength < 0 ||
+			dialParams.ObfuscatorPaddingLength > OBFUSCATE_MAX_PADDING ||
+			dialParams.MeekCookiePaddingLength < 0 ||
+			dialParams.MeekCookiePaddingLength > MEEK_COOKIE_MAX_PADDING {
+			t.Fatalf("unexpected padding lengths for candidate %d: %+v", i, dialParams)
+		}
+
+		if !dialParams.IsReplayable(config, serverEntry) {
+			t.Fatalf("new candidate %d not replayable: %+v", i, dialParams)
+		}
+
+		var expected DialParameters
+		switch dialParams.Protocol {
+		case TUNNEL_PROTOCOL_FRONTED_MEEK:
+			frontingAddress := dialParams.MeekFrontingAddress
+			if !Contains(serverEntry.MeekFrontingAddresses, frontingAddress) ||
+				frontingAddresses[frontingAddress] {
+				t.Fatalf("unexpected fronting address: %s", frontingAddress)
+			}
+			frontingAddresses[frontingAddress] = true
+			expected = DialParameters{
+				MeekFrontingAddress: frontingAddress,
+				MeekDialAddress:     frontingAddress + ":443",
+				MeekUseHTTPS:        true,
+				MeekSNIServerName:   frontingAddress,
+				MeekHostHeader:      "host.example.com",
+			}
+		case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+			expected = DialParameters{
+				MeekDialAddress: "192.0.2.1:8080",
+				MeekHostHeader:  "192.0.2.1:8080",
+			}
+		case TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS:
+			// SNI isn't sent for an IP address
+			expected = DialParameters{
+				MeekDialAddress: "192.0.2.1:8080",
+				MeekUseHTTPS:    true,
+				MeekHostHeader:  "192.0.2.1:8080",
+			}
+		}
+
+		if dialParams.MeekFrontingAddress != expected.MeekFrontingAddress ||
+			dialParams.MeekDialAddress != expected.MeekDialAddress ||
+			dialParams.MeekUseHTTPS != expected.MeekUseHTTPS ||
+			dialParams.MeekSNIServerName != expected.MeekSNIServerName ||
+			dialParams.MeekHostHeader != expected.MeekHostHeader {
+			t.Fatalf("unexpected dial parameters for candidate %d: %+v", i, dialParams)
+		}
+	}
+
+	// The candidate count is limited to maxCount, dropping the lowest
+	// priority candidates.
+
+	dialParamsList, err = MakeCandidateDialParameters(config, serverEntry, protocols, 3)
+	if err != nil {
+		t.Fatalf("MakeCandidateDialParameters failed: %s", err)
+	}
+	if len(dialParamsList) != 3 ||
+		dialParamsList[0].Protocol != TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		dialParamsList[1].Protocol != TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+		dialParamsList[2].Protocol != TUNNEL_PROTOCOL_UNFRONTED_MEEK {
+		t.Fatalf("unexpected limited candidates: %+v", dialParamsList)
+	}
+
+	// A fronting address regex which can't yield maxCount distinct fronting
+	// addresses yields fewer candidates. SNI may be disabled.
+
+	serverEntry.MeekFrontingAddressesRegex = "[ab]\\.example\\.com"
+	serverEntry.MeekFrontingDisableSNI = true
+
+	dialParamsList, err = MakeCandidateDialParameters(
+		config, serverEntry, []string{TUNNEL_PROTOCOL_FRONTED_MEEK}, 10)
+	if err != nil {
+		t.Fatalf("MakeCandidateDialParameters failed: %s", err)
+	}
+	if len(dialParamsList) > 2 {
+		t.Fatalf("unexpected regex candidate count: %d", len(dialParamsList))
+	}
+	for _, dialParams := range dialParamsList {
+		if dialParams.MeekSNIServerName != "" {
+			t.Fatalf("unexpected SNI: %s", dialParams.MeekSNIServerName)
+		}
+	}
+}
+
+func TestIsReplayable(t *testing.T) {
+
+	config := &Config{HostNameTransformer: &IdentityHostNameTransformer{}}
+
+	makeDialParams := func(protocol string) *DialParameters {
+		dialParamsList, err := MakeCandidateDialParameters(
+			config, makeTestDialParametersServerEntry(), []string{protocol}, 1)
+		if err != nil || len(dialParamsList) != 1 {
+			t.Fatalf("MakeCandidateDialParameters failed: %v", err)
+		}
+		return dialParamsList[0]
+	}
+
+	testCases := []struct {
+		description  string
+		protocol     string
+		modify       func(*Config, *ServerEntry, *DialParameters)
+		isReplayable bool
+	}{
+		{
+			"unmodified",
+			TUNNEL_PROTOCOL_FRONTED_MEEK,
+			func(*Config, *ServerEntry, *DialParameters) {},
+			true,
+		},
+		{
+			"matching config protocol",
+			TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			func(config *Config, _ *ServerEntry, _ *DialParameters) {
+				config.TunnelProtocol = TUNNEL_PROTOCOL_OBFUSCATED_SSH
+			},
+			true,
+		},
+		{
+			"expired",
+			TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			func(_ *Config, _ *ServerEntry, dialParams *DialParameters) {
+				dialParams.CreatedTime = time.Now().Add(-REPLAY_DIAL_PARAMETERS_TTL - time.Minute)
+			},
+			false,
+		},
+		{
+			"protocol not supported",
+			TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			func(_ *Config, serverEntry *ServerEntry, _ *DialParameters) {
+				serverEntry.DisableImpairedProtocols([]string{TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+			},
+			false,
+		},
+		{
+			"different config protocol",
+			TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			func(config *Config, _ *ServerEntry, _ *DialParameters) {
+				config.TunnelProtocol = TUNNEL_PROTOCOL_UNFRONTED_MEEK
+			},
+			false,
+		},
+		{
+			"different TLS",
+			TUNNEL_PROTOCOL_FRONTED_MEEK,
+			func(config *Config, _ *ServerEntry, _ *DialParameters) {
+				config.UseIndistinguishableTLS = true
+			},
+			false,
+		},
+		{
+			"fronting address removed",
+			TUNNEL_PROTOCOL_FRONTED_MEEK,
+			func(_ *Config, serverEntry *ServerEntry, _ *DialParameters) {
+				serverEntry.MeekFrontingAddresses = []string{"d.example.com"}
+			},
+			false,
+		},
+		{
+			"fronting address regex",
+			TUNNEL_PROTOCOL_FRONTED_MEEK,
+			func(_ *Config, serverEntry *ServerEntry, _ *DialParameters) {
+				serverEntry.MeekFrontingAddresses = nil
+				serverEntry.MeekFrontingAddressesRegex = "[d-f]\\.example\\.com"
+			},
+			true,
+		},
+		{
+			"fronting host removed",
+			TUNNEL_PROTOCOL_FRONTED_MEEK,
+			func(_ *Config, serverEntry *ServerEntry, _ *DialParameters) {
+				serverEntry.MeekFrontingHosts = []string{"other.example.com"}
+			},
+			false,
+		},
+		{
+			"meek port changed",
+			TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			func(_ *Config, serverEntry *ServerEntry, _ *DialParameters) {
+				serverEntry.MeekServerPort = 80
+			},
+			false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testConfig := *config
+		serverEntry := makeTestDialParametersServerEntry()
+		dialParams := makeDialParams(testCase.protocol)
+
+		testCase.modify(&testConfig, serverEntry, dialParams)
+
+		if dialParams.IsReplayable(&testConfig, serverEntry) != testCase.isReplayable {
+			t.Fatalf("unexpected IsReplayable result for %s", testCase.description)
+		}
+	}
+}
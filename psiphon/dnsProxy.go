@@ -0,0 +1,499 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// DnsProxy is a DNS server that accepts local UDP and TCP DNS queries
+// and forwards them through the tunnel, over TCP, to a DNS server, or to
+// a DNS over HTTPS server when TunneledDnsOverHttpsUrl is configured. This
+// allows applications which resolve hostnames locally, including SOCKS
+// clients which don't send hostnames to the proxy, to avoid sending DNS
+// queries to the network's resolver.
+//
+// Responses are cached according to their TTLs. When split tunnel is
+// enabled, A and AAAA queries for domains which are classified as
+// untunneled by domain suffix are resolved with an untunneled lookup, so
+// that domestic destinations resolve as they would without the tunnel.
+type DnsProxy struct {
+	tunneler               Tunneler
+	untunneledDialConfig   *DialConfig
+	classifier             *SplitTunnelClassifier
+	resolver               *tunneledDnsResolver
+	cache                  *dnsCache
+	listener               net.Listener
+	udpConn                *net.UDPConn
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *Conns
+	stopListeningBroadcast chan struct{}
+}
+
+var _DNS_PROXY_TYPE = "DNS"
+
+// NewDnsProxy initializes a new DNS proxy. It begins listening for UDP
+// and TCP queries, starts goroutines that run the receive and accept
+// loops, and returns leaving those loops running. classifier may be nil,
+// in which case all queries are tunneled.
+func NewDnsProxy(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	tunneler Tunneler,
+	classifier *SplitTunnelClassifier,
+	listenIP string) (proxy *DnsProxy, err error) {
+
+	listener, err := net.Listen(
+		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalDnsProxyPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			NoticeDnsProxyPortInUse(config.LocalDnsProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	// The UDP listener uses the same port as the TCP listener, as DNS
+	// clients retry truncated UDP responses over TCP on the same port.
+	listenAddr := listener.Addr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP(
+		"udp", &net.UDPAddr{IP: listenAddr.IP, Port: listenAddr.Port})
+	if err != nil {
+		listener.Close()
+		if IsAddressInUseError(err) {
+			NoticeDnsProxyPortInUse(config.LocalDnsProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	dnsServerAddress := config.LocalDnsProxyServer
+	if dnsServerAddress == "" {
+		dnsServerAddress = config.SplitTunnelDnsServer
+	}
+	// Note: a DNS server or DoH server is required by LoadConfig
+	resolver := newTunneledDnsResolver(config, tunneler, dnsServerAddress)
+
+	proxy = &DnsProxy{
+		tunneler:               tunneler,
+		untunneledDialConfig:   untunneledDialConfig,
+		classifier:             classifier,
+		resolver:               resolver,
+		cache:                  newDnsCache(),
+		listener:               listener,
+		udpConn:                udpConn,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              new(Conns),
+		stopListeningBroadcast: make(chan struct{}),
+	}
+	proxy.serveWaitGroup.Add(2)
+	go proxy.serveTCP()
+	go proxy.serveUDP()
+	NoticeListeningDnsProxyPort(listenAddr.Port)
+	return proxy, nil
+}
+
+// Close terminates the listeners and waits for the receive and accept
+// loop goroutines to complete.
+func (proxy *DnsProxy) Close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.listener.Close()
+	proxy.udpConn.Close()
+	proxy.serveWaitGroup.Wait()
+	proxy.openConns.CloseAll()
+}
+
+// handleQuery returns the response to a query. Failures are reported to
+// the client as SERVFAIL responses.
+func (proxy *DnsProxy) handleQuery(query *dns.Msg) *dns.Msg {
+
+	if query.Response || query.Opcode != dns.OpcodeQuery {
+		return new(dns.Msg).SetRcode(query, dns.RcodeNotImplemented)
+	}
+	if len(query.Question) != 1 {
+		return new(dns.Msg).SetRcodeFormatError(query)
+	}
+	question := query.Question[0]
+
+	cacheKey := dnsCacheKey(query)
+	response := proxy.cache.get(cacheKey, time.Now())
+	if response != nil {
+		response.Id = query.Id
+		return response
+	}
+
+	var err error
+	if proxy.isUntunneledQuestion(question) {
+		response, err = proxy.resolveUntunneled(query)
+	} else {
+		response, err = proxy.resolver.exchange(query)
+	}
+	if err != nil {
+		NoticeLocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+		return new(dns.Msg).SetRcode(query, dns.RcodeServerFailure)
+	}
+
+	proxy.cache.set(cacheKey, response, time.Now())
+
+	return response
+}
+
+func (proxy *DnsProxy) isUntunneledQuestion(question dns.Question) bool {
+	return proxy.classifier != nil &&
+		question.Qclass == dns.ClassINET &&
+		(question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA) &&
+		proxy.classifier.IsUntunneledDomain(question.Name)
+}
+
+// resolveUntunneled answers an A or AAAA query with an untunneled lookup.
+// As the lookup doesn't report TTLs, the answers use
+// DNS_PROXY_UNTUNNELED_TTL.
+func (proxy *DnsProxy) resolveUntunneled(query *dns.Msg) (*dns.Msg, error) {
+
+	question := query.Question[0]
+
+	ipAddrs, err := LookupIP(
+		strings.TrimSuffix(question.Name, "."), proxy.untunneledDialConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	response := new(dns.Msg).SetReply(query)
+	response.RecursionAvailable = true
+
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(DNS_PROXY_UNTUNNELED_TTL / time.Second),
+	}
+	for _, ipAddr := range ipAddrs {
+		ipv4Addr := ipAddr.To4()
+		if question.Qtype == dns.TypeA && ipv4Addr != nil {
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ipv4Addr})
+		} else if question.Qtype == dns.TypeAAAA && ipv4Addr == nil {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ipAddr})
+		}
+	}
+
+	return response, nil
+}
+
+func (proxy *DnsProxy) serveUDP() {
+	defer proxy.serveWaitGroup.Done()
+
+	// UDP queries are handled by a fixed number of workers, bounding the
+	// number of concurrent tunneled queries a client can cause.
+	udpQueries := make(chan *udpDnsQuery)
+	defer close(udpQueries)
+	for i := 0; i < DNS_PROXY_UDP_WORKER_POOL_SIZE; i++ {
+		go proxy.udpQueryWorker(udpQueries)
+	}
+
+	buffer := make([]byte, dns.MaxMsgSize)
+	for {
+		// Note: will be interrupted by udpConn.Close() call made by proxy.Close()
+		n, clientAddr, err := proxy.udpConn.ReadFromUDP(buffer)
+		select {
+		case <-proxy.stopListeningBroadcast:
+			NoticeInfo("DNS proxy stopped")
+			return
+		default:
+		}
+		if err != nil {
+			NoticeAlert("DNS proxy receive error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			return
+		}
+
+		query := new(dns.Msg)
+		err = query.Unpack(buffer[:n])
+		if err != nil {
+			NoticeLocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+			continue
+		}
+
+		// When all workers are busy, receiving stalls and further queries
+		// queue, and are eventually dropped, in the socket receive buffer.
+		select {
+		case udpQueries <- &udpDnsQuery{query: query, clientAddr: clientAddr}:
+		case <-proxy.stopListeningBroadcast:
+			NoticeInfo("DNS proxy stopped")
+			return
+		}
+	}
+}
+
+type udpDnsQuery struct {
+	query      *dns.Msg
+	clientAddr *net.UDPAddr
+}
+
+// udpQueryWorker handles UDP queries until udpQueries is closed.
+func (proxy *DnsProxy) udpQueryWorker(udpQueries <-chan *udpDnsQuery) {
+	for udpQuery := range udpQueries {
+		response := proxy.handleQuery(udpQuery.query)
+		packedResponse, err := packUdpDnsResponse(udpQuery.query, response)
+		if err == nil {
+			_, err = proxy.udpConn.WriteToUDP(packedResponse, udpQuery.clientAddr)
+		}
+		if err != nil {
+			NoticeLocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+		}
+	}
+}
+
+// packUdpDnsResponse packs a response for a UDP client. When the response
+// exceeds the client's UDP payload size, the records are omitted and the
+// truncated flag is set, so that the client retries over TCP.
+func packUdpDnsResponse(query, response *dns.Msg) ([]byte, error) {
+
+	maxSize := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > maxSize {
+		maxSize = int(opt.UDPSize())
+	}
+
+	packedResponse, err := response.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(packedResponse) <= maxSize {
+		return packedResponse, nil
+	}
+
+	truncatedResponse := new(dns.Msg).SetReply(query)
+	truncatedResponse.Rcode = response.Rcode
+	truncatedResponse.RecursionAvailable = response.RecursionAvailable
+	truncatedResponse.Truncated = true
+	packedResponse, err = truncatedResponse.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return packedResponse, nil
+}
+
+func (proxy *DnsProxy) serveTCP() {
+	defer proxy.serveWaitGroup.Done()
+loop:
+	for {
+		// Note: will be interrupted by listener.Close() call made by proxy.Close()
+		conn, err := proxy.listener.Accept()
+		// Can't check for the exact error that Close() will cause in Accept(),
+		// (see: https://code.google.com/p/go/issues/detail?id=4373). So using an
+		// explicit stop signal to stop gracefully.
+		select {
+		case <-proxy.stopListeningBroadcast:
+			break loop
+		default:
+		}
+		if err != nil {
+			NoticeAlert("DNS proxy accept error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			break loop
+		}
+		go func() {
+			err := proxy.tcpConnectionHandler(conn)
+			if err != nil {
+				NoticeLocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+			}
+		}()
+	}
+}
+
+// tcpConnectionHandler handles queries received on a TCP connection, in
+// turn, until the client closes the connection or it's idle for
+// DNS_PROXY_TCP_IDLE_TIMEOUT.
+func (proxy *DnsProxy) tcpConnectionHandler(conn net.Conn) error {
+	defer conn.Close()
+	defer proxy.openConns.Remove(conn)
+	proxy.openConns.Add(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(DNS_PROXY_TCP_IDLE_TIMEOUT))
+		query, err := ReadDnsStreamMessage(conn)
+		if err != nil {
+			// The client closed the connection, or it's idle.
+			return nil
+		}
+
+		response := proxy.handleQuery(query)
+
+		conn.SetWriteDeadline(time.Now().Add(DNS_PROXY_QUERY_TIMEOUT))
+		err = WriteDnsStreamMessage(conn, response)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+}
+
+// dnsCache is a cache of DNS responses, keyed by question. Entries expire
+// according to the response TTLs.
+type dnsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	response *dns.Msg
+	stored   time.Time
+	expiry   time.Time
+}
+
+func newDnsCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]*dnsCacheEntry),
+	}
+}
+
+// dnsCacheKey returns the cache key for a query. The key includes the
+// query's DO and CD bits, as the upstream response, with or without DNSSEC
+// records and validation, depends on them.
+func dnsCacheKey(query *dns.Msg) string {
+	question := query.Question[0]
+	dnssecOK := false
+	if opt := query.IsEdns0(); opt != nil {
+		dnssecOK = opt.Do()
+	}
+	return fmt.Sprintf(
+		"%s/%d/%d/%t/%t",
+		strings.ToLower(question.Name), question.Qtype, question.Qclass,
+		dnssecOK, query.CheckingDisabled)
+}
+
+// get returns a copy of the cached response, with its TTLs reduced by the
+// time elapsed since it was cached, or nil when there's no unexpired
+// response.
+func (cache *dnsCache) get(key string, now time.Time) *dns.Msg {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(entry.expiry) {
+		delete(cache.entries, key)
+		return nil
+	}
+
+	response := entry.response.Copy()
+	decrementDnsTTLs(response, uint32(now.Sub(entry.stored)/time.Second))
+	return response
+}
+
+// decrementDnsTTLs reduces the TTLs of the message's records by elapsed
+// seconds, to a minimum of 0.
+func decrementDnsTTLs(message *dns.Msg, elapsed uint32) {
+	for _, records := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			// The OPT pseudo-record TTL field holds EDNS flags.
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+}
+
+// set caches a copy of the response, when it's cacheable. When the cache
+// is full, expired entries are removed, and the response isn't cached if
+// that doesn't make room.
+func (cache *dnsCache) set(key string, response *dns.Msg, now time.Time) {
+
+	ttl, err := dnsResponseTTL(response)
+	if err != nil {
+		return
+	}
+	if ttl > DNS_PROXY_CACHE_MAX_TTL {
+		ttl = DNS_PROXY_CACHE_MAX_TTL
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if len(cache.entries) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+		for entryKey, entry := range cache.entries {
+			if !now.Before(entry.expiry) {
+				delete(cache.entries, entryKey)
+			}
+		}
+		if len(cache.entries) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+			return
+		}
+	}
+
+	cache.entries[key] = &dnsCacheEntry{
+		response: response.Copy(),
+		stored:   now,
+		expiry:   now.Add(ttl),
+	}
+}
+
+// dnsResponseTTL returns how long a response may be cached: the minimum TTL
+// of its answer and authority records, where a SOA record's TTL is also
+// limited by its minimum field, as for negative caching (RFC 2308). Only
+// complete NOERROR and NXDOMAIN responses with records are cacheable.
+func dnsResponseTTL(response *dns.Msg) (time.Duration, error) {
+
+	if response.Truncated ||
+		(response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0, ContextError(errors.New("response not cacheable"))
+	}
+
+	var ttl uint32
+	hasRecords := false
+	for _, records := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, record := range records {
+			recordTTL := record.Header().Ttl
+			if soa, ok := record.(*dns.SOA); ok && soa.Minttl < recordTTL {
+				recordTTL = soa.Minttl
+			}
+			if !hasRecords || recordTTL < ttl {
+				ttl = recordTTL
+			}
+			hasRecords = true
+		}
+	}
+	if !hasRecords || ttl == 0 {
+		return 0, ContextError(errors.New("response not cacheable"))
+	}
+
+	return time.Duration(ttl) * time.Second, nil
+}
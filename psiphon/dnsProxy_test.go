@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// testDnsTunneler is a Tunneler which, in place of port forwards, runs a
+// DNS over TCP server which answers every A query with testDnsAnswer.
+type testDnsTunneler struct {
+	queryCount int32
+}
+
+var testDnsAnswer = net.ParseIP("192.0.2.1").To4()
+
+func (tunneler *testDnsTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+		for {
+			query, err := ReadDnsStreamMessage(serverConn)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&tunneler.queryCount, 1)
+			response := new(dns.Msg).SetReply(query)
+			question := query.Question[0]
+			if question.Qtype == dns.TypeA {
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A: testDnsAnswer,
+				})
+			}
+			err = WriteDnsStreamMessage(serverConn, response)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return clientConn, nil
+}
+
+func (tunneler *testDnsTunneler) SignalComponentFailure() {
+}
+
+func testDnsQuery(t *testing.T, conn net.Conn, name string, queryType uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), queryType)
+	query.RecursionDesired = true
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	response, err := ExchangeDnsMessage(conn, query)
+	if err != nil {
+		t.Fatalf("ExchangeDnsMessage failed: %s", err)
+	}
+	return response
+}
+
+func TestDnsProxy(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "LocalDnsProxyServer" : "192.0.2.53",
+        "SplitTunnelRules" : {"NeverTunnel" : {"DomainSuffixes" : ["localhost"]}}
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	tunneler := new(testDnsTunneler)
+	classifier := NewSplitTunnelClassifier(config, tunneler)
+
+	proxy, err := NewDnsProxy(config, new(DialConfig), tunneler, classifier, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDnsProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxyAddress := proxy.listener.Addr().String()
+
+	udpConn, err := net.Dial("udp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer udpConn.Close()
+
+	tcpConn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer tcpConn.Close()
+
+	// Tunneled queries, with the second answered from the cache
+
+	for _, conn := range []net.Conn{udpConn, tcpConn} {
+		response := testDnsQuery(t, conn, "example.com", dns.TypeA)
+		if len(response.Answer) != 1 ||
+			!response.Answer[0].(*dns.A).A.Equal(testDnsAnswer) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+		if atomic.LoadInt32(&tunneler.queryCount) != 1 {
+			t.Fatalf("unexpected query count: %d", atomic.LoadInt32(&tunneler.queryCount))
+		}
+	}
+
+	// Not cacheable, as there are no records
+
+	for i := 0; i < 2; i++ {
+		response := testDnsQuery(t, udpConn, "example.com", dns.TypeMX)
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+			t.Fatalf("unexpected response: %s", response)
+		}
+	}
+	if atomic.LoadInt32(&tunneler.queryCount) != 3 {
+		t.Fatalf("unexpected query count: %d", atomic.LoadInt32(&tunneler.queryCount))
+	}
+
+	// Untunneled domain
+
+	response := testDnsQuery(t, udpConn, "localhost", dns.TypeA)
+	if len(response.Answer) == 0 ||
+		!response.Answer[0].(*dns.A).A.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected response: %s", response)
+	}
+	if atomic.LoadInt32(&tunneler.queryCount) != 3 {
+		t.Fatalf("unexpected query count: %d", atomic.LoadInt32(&tunneler.queryCount))
+	}
+
+	// Concurrent UDP queries, in excess of the worker pool size, are all
+	// answered
+
+	queryCount := 2 * DNS_PROXY_UDP_WORKER_POOL_SIZE
+	errs := make(chan error, queryCount)
+	for i := 0; i < queryCount; i++ {
+		go func(i int) {
+			conn, err := net.Dial("udp", proxyAddress)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			query := new(dns.Msg)
+			query.SetQuestion(fmt.Sprintf("%d.example.com.", i), dns.TypeA)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			response, err := ExchangeDnsMessage(conn, query)
+			if err == nil && len(response.Answer) != 1 {
+				err = fmt.Errorf("unexpected response: %s", response)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < queryCount; i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatalf("concurrent query failed: %s", err)
+		}
+	}
+}
+
+func TestDnsCache(t *testing.T) {
+
+	cache := newDnsCache()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	key := dnsCacheKey(query)
+
+	// Queries with the DO or CD bits set have distinct keys
+
+	dnssecQuery := query.Copy()
+	dnssecQuery.SetEdns0(4096, true)
+	checkingDisabledQuery := query.Copy()
+	checkingDisabledQuery.CheckingDisabled = true
+	if dnsCacheKey(dnssecQuery) == key ||
+		dnsCacheKey(checkingDisabledQuery) == key ||
+		dnsCacheKey(dnssecQuery) == dnsCacheKey(checkingDisabledQuery) {
+		t.Fatalf("unexpected matching cache keys")
+	}
+
+	response := new(dns.Msg).SetReply(query)
+	response.Answer = append(response.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   testDnsAnswer,
+	})
+
+	now := time.Now()
+	cache.set(key, response, now)
+
+	cachedResponse := cache.get(key, now.Add(10*time.Second))
+	if cachedResponse == nil || cachedResponse.Answer[0].Header().Ttl != 50 {
+		t.Fatalf("unexpected cached response: %s", cachedResponse)
+	}
+
+	if cache.get(key, now.Add(60*time.Second)) != nil {
+		t.Fatalf("unexpected unexpired response")
+	}
+
+	// Negative responses are cached for the SOA minimum TTL
+
+	negativeResponse := new(dns.Msg).SetRcode(query, dns.RcodeNameError)
+	negativeResponse.Ns = append(negativeResponse.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+		Ns:     "ns.com.",
+		Mbox:   "mbox.com.",
+		Minttl: 30,
+	})
+
+	ttl, err := dnsResponseTTL(negativeResponse)
+	if err != nil || ttl != 30*time.Second {
+		t.Fatalf("unexpected negative response TTL: %s, %v", ttl, err)
+	}
+
+	_, err = dnsResponseTTL(new(dns.Msg).SetRcode(query, dns.RcodeServerFailure))
+	if err == nil {
+		t.Fatalf("unexpected cacheable SERVFAIL response")
+	}
+}
@@ -0,0 +1,851 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// These tests run the controller's establishment against a fake tunneler,
+// which establishes tunnels without any network connections.
+//
+// Test case notes: these tests store test server entries in the shared data
+// store, so they must run after the controller_test.go tests, which expect
+// to start with no server entries.
+
+// testNetworkIDGetter is a NetworkIDGetter which counts its calls.
+type testNetworkIDGetter struct {
+	mutex     sync.Mutex
+	networkID string
+	calls     int
+}
+
+func (getter *testNetworkIDGetter) GetNetworkID() string {
+	getter.mutex.Lock()
+	defer getter.mutex.Unlock()
+	getter.calls += 1
+	return getter.networkID
+}
+
+func (getter *testNetworkIDGetter) setNetworkID(networkID string) {
+	getter.mutex.Lock()
+	defer getter.mutex.Unlock()
+	getter.networkID = networkID
+}
+
+func (getter *testNetworkIDGetter) getCalls() int {
+	getter.mutex.Lock()
+	defer getter.mutex.Unlock()
+	return getter.calls
+}
+
+// testTunneler is a fake establishTunnel. Each attempt succeeds when
+// isEstablishable returns true for the candidate; otherwise it fails
+// immediately. When discoveredServerEntryCount is set, each tunnel has a
+// server context reporting that number of server entries discovered by the
+// handshake.
+type testTunneler struct {
+	mutex                      sync.Mutex
+	attempts                   []*DialParameters
+	attemptServers             []string
+	isEstablishable            func(serverEntry *ServerEntry, dialParams *DialParameters) bool
+	discoveredServerEntryCount int
+}
+
+func (tunneler *testTunneler) establishTunnel(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	sessionId string,
+	pendingConns *Conns,
+	serverEntry *ServerEntry,
+	dialParams *DialParameters,
+	tunnelOwner TunnelOwner) (*Tunnel, error) {
+
+	tunneler.mutex.Lock()
+	tunneler.attempts = append(tunneler.attempts, dialParams)
+	tunneler.attemptServers = append(tunneler.attemptServers, serverEntry.IpAddress)
+	isEstablishable := tunneler.isEstablishable
+	discoveredServerEntryCount := tunneler.discoveredServerEntryCount
+	tunneler.mutex.Unlock()
+
+	if isEstablishable == nil || !isEstablishable(serverEntry, dialParams) {
+		return nil, errors.New("test tunnel failed")
+	}
+
+	tunnel := newTestTunnel(config, serverEntry, dialParams)
+	if discoveredServerEntryCount > 0 {
+		tunnel.serverContext = &ServerContext{
+			discoveredServerEntryCount: discoveredServerEntryCount,
+		}
+	}
+	return tunnel, nil
+}
+
+func (tunneler *testTunneler) setEstablishable(
+	isEstablishable func(serverEntry *ServerEntry, dialParams *DialParameters) bool) {
+
+	tunneler.mutex.Lock()
+	defer tunneler.mutex.Unlock()
+	tunneler.isEstablishable = isEstablishable
+}
+
+func (tunneler *testTunneler) getAttemptCount() int {
+	tunneler.mutex.Lock()
+	defer tunneler.mutex.Unlock()
+	return len(tunneler.attempts)
+}
+
+// getAttempts returns the dial parameters and server IP address for each
+// attempt, in order.
+func (tunneler *testTunneler) getAttempts() ([]*DialParameters, []string) {
+	tunneler.mutex.Lock()
+	defer tunneler.mutex.Unlock()
+	return append([]*DialParameters(nil), tunneler.attempts...),
+		append([]string(nil), tunneler.attemptServers...)
+}
+
+// testSSHConn is a fake SSH connection, which supports only Close and Wait.
+// Opening a channel, as for a port forward, always fails, and is counted.
+type testSSHConn struct {
+	ssh.Conn
+	closeOnce    sync.Once
+	closed       chan struct{}
+	openChannels int32
+}
+
+func (conn *testSSHConn) OpenChannel(
+	name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+
+	atomic.AddInt32(&conn.openChannels, 1)
+	return nil, nil, errors.New("test SSH conn has no channels")
+}
+
+func (conn *testSSHConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return nil
+}
+
+func (conn *testSSHConn) Wait() error {
+	<-conn.closed
+	return nil
+}
+
+// newTestTunnel makes an established tunnel with no network connection and
+// no running operateTunnel. The tunnel may be closed as usual.
+func newTestTunnel(
+	config *Config, serverEntry *ServerEntry, dialParams *DialParameters) *Tunnel {
+
+	conn, _ := net.Pipe()
+
+	chans := make(chan ssh.NewChannel)
+	reqs := make(chan *ssh.Request)
+	sshConn := &testSSHConn{closed: make(chan struct{})}
+	go func() {
+		<-sshConn.closed
+		close(chans)
+		close(reqs)
+	}()
+
+	return &Tunnel{
+		mutex:                        new(sync.Mutex),
+		config:                       config,
+		serverEntry:                  serverEntry,
+		protocol:                     dialParams.Protocol,
+		dialParams:                   dialParams,
+		conn:                         conn,
+		sshClient:                    ssh.NewClient(sshConn, chans, reqs),
+		operateWaitGroup:             new(sync.WaitGroup),
+		shutdownOperateBroadcast:     make(chan struct{}),
+		signalPortForwardFailure:     make(chan struct{}, 1),
+		startTime:                    time.Now(),
+		newClientVerificationPayload: make(chan string, 1),
+		load:                         new(tunnelLoad),
+	}
+}
+
+// makeTestServerEntries stores count test server entries in the specified
+// region, each supporting the specified protocols. Each test uses its own
+// region, so that it establishes only to its own server entries.
+func makeTestServerEntries(
+	t *testing.T, region, prefix string, count int, protocols []string) []*ServerEntry {
+
+	var serverEntries []*ServerEntry
+	for i := 0; i < count; i++ {
+		serverEntry := &ServerEntry{
+			IpAddress:         fmt.Sprintf("%s.%d", prefix, i+1),
+			SshPort:           22,
+			SshObfuscatedPort: 443,
+			MeekServerPort:    80,
+			MeekFrontingAddresses: []string{
+				"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"},
+			MeekFrontingHosts: []string{"host.example.com"},
+			Capabilities:      makeTestCapabilities(protocols),
+			Region:            region,
+		}
+		err := StoreServerEntry(serverEntry, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+		serverEntries = append(serverEntries, serverEntry)
+	}
+	return serverEntries
+}
+
+func makeTestCapabilities(protocols []string) []string {
+	capabilities := []string{"handshake"}
+	for _, protocol := range protocols {
+		capabilities = append(capabilities, GetCapability(protocol))
+	}
+	return capabilities
+}
+
+// newTestController makes a controller, using the fake tunneler, which
+// establishes only to servers in the specified region.
+func newTestController(
+	t *testing.T,
+	region string,
+	tunnelPoolSize int,
+	networkIDGetter NetworkIDGetter,
+	tunneler *testTunneler) *Controller {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "ClientPlatform" : "test",
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "DisableApi" : true,
+        "DisableRemoteServerListFetcher" : true
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.EgressRegion = region
+	config.TunnelPoolSize = tunnelPoolSize
+	config.NetworkIDGetter = networkIDGetter
+	establishTunnelPausePeriodSeconds := 0
+	config.EstablishTunnelPausePeriodSeconds = &establishTunnelPausePeriodSeconds
+
+	SetNoticeOutput(ioutil.Discard)
+
+	err = InitDataStore(config)
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	controller.establishTunnel = tunneler.establishTunnel
+
+	return controller
+}
+
+// waitForTestCondition polls condition until it's true, failing the test
+// after a timeout.
+func waitForTestCondition(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receiveTestTunnel receives the next established tunnel, failing the test
+// after a timeout.
+func receiveTestTunnel(t *testing.T, controller *Controller) *Tunnel {
+	select {
+	case tunnel := <-controller.establishedTunnels:
+		return tunnel
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for established tunnel")
+	}
+	return nil
+}
+
+func TestEstablishNetworkChange(t *testing.T) {
+
+	networkIDGetter := &testNetworkIDGetter{networkID: "network-A"}
+	tunneler := &testTunneler{}
+	controller := newTestController(t, "XA", 1, networkIDGetter, tunneler)
+
+	serverEntryCount := 10
+	makeTestServerEntries(
+		t, "XA", "192.0.2", serverEntryCount, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+
+	// All attempts fail on the first network, and the candidate generator
+	// repeatedly iterates over the server entries.
+
+	controller.startEstablishing()
+	defer controller.stopEstablishing()
+
+	waitForTestCondition(t, "attempts", func() bool {
+		return tunneler.getAttemptCount() > 5*serverEntryCount
+	})
+
+	// The network ID is checked once per iteration, not once per candidate.
+	// Each completed iteration attempts every server entry; one call is made
+	// at the start and one call is made by the iteration in progress.
+
+	calls := networkIDGetter.getCalls()
+	attempts := tunneler.getAttemptCount()
+	if calls-2 > (attempts+controller.config.ConnectionWorkerPoolSize)/serverEntryCount {
+		t.Fatalf("unexpected network ID calls: %d for %d attempts", calls, attempts)
+	}
+
+	// Without stopping establishment, the network changes and attempts on
+	// the new network succeed. Tunnels from attempts which started on the
+	// first network may still be delivered, and are ignored.
+
+	networkIDGetter.setNetworkID("network-B")
+	tunneler.setEstablishable(
+		func(_ *ServerEntry, _ *DialParameters) bool { return true })
+
+	for {
+		tunnel := receiveTestTunnel(t, controller)
+		tunnel.Close(true)
+		if tunnel.networkID == "network-B" {
+
+			// The dial parameters are stored for replay under the new network.
+			dialParams, err := GetDialParameters(tunnel.serverEntry.IpAddress, "network-B")
+			if err != nil || dialParams == nil {
+				t.Fatalf("missing dial parameters for new network: %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestEstablishCandidatesPerServerEntry(t *testing.T) {
+
+	controller := newTestController(t, "XB", 1, nil, &testTunneler{})
+
+	protocols := []string{
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		TUNNEL_PROTOCOL_SSH,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+	}
+	serverEntry := makeTestServerEntries(t, "XB", "198.51.100", 1, protocols)[0]
+
+	// The candidate count is limited by EstablishTunnelCandidatesPerServerEntry
+	// and by the distinct candidates for the server entry.
+
+	testCases := []struct {
+		candidatesPerServerEntry int
+		expectedCount            int
+	}{
+		{1, 1},
+		{2, 2},
+		{5, 3},
+	}
+
+	for _, testCase := range testCases {
+		controller.config.EstablishTunnelCandidatesPerServerEntry = testCase.candidatesPerServerEntry
+		dialParamsList := controller.makeCandidateDialParameters(serverEntry, "network")
+		if len(dialParamsList) != testCase.expectedCount {
+			t.Fatalf("unexpected candidate count for %d: %d",
+				testCase.candidatesPerServerEntry, len(dialParamsList))
+		}
+		for _, dialParams := range dialParamsList {
+			if dialParams.IsReplay {
+				t.Fatalf("unexpected replay candidate")
+			}
+		}
+	}
+
+	// A replay candidate is first, and counts towards the limit
+
+	replayDialParams, err := MakeCandidateDialParameters(
+		controller.config, serverEntry, []string{TUNNEL_PROTOCOL_UNFRONTED_MEEK}, 1)
+	if err != nil {
+		t.Fatalf("MakeCandidateDialParameters failed: %s", err)
+	}
+	err = SetDialParameters(serverEntry.IpAddress, "network", replayDialParams[0])
+	if err != nil {
+		t.Fatalf("SetDialParameters failed: %s", err)
+	}
+
+	for _, testCase := range testCases {
+		controller.config.EstablishTunnelCandidatesPerServerEntry = testCase.candidatesPerServerEntry
+		dialParamsList := controller.makeCandidateDialParameters(serverEntry, "network")
+		if len(dialParamsList) != testCase.expectedCount ||
+			!dialParamsList[0].IsReplay ||
+			dialParamsList[0].MeekCookiePaddingLength != replayDialParams[0].MeekCookiePaddingLength {
+			t.Fatalf("unexpected replay candidates for %d: %+v",
+				testCase.candidatesPerServerEntry, dialParamsList)
+		}
+		for _, dialParams := range dialParamsList[1:] {
+			if dialParams.Protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK {
+				t.Fatalf("unexpected duplicate of replay candidate")
+			}
+		}
+	}
+}
+
+func TestEstablishRaceDeferredCandidates(t *testing.T) {
+
+	tunneler := &testTunneler{}
+	controller := newTestController(t, "XC", 1, nil, tunneler)
+
+	// With one worker, candidates are attempted in the order they're sent.
+	controller.config.ConnectionWorkerPoolSize = 1
+	controller.config.EstablishTunnelRaceStaggerMilliseconds = 1
+	controller.config.EstablishTunnelCandidatesPerServerEntry = 5
+
+	// The work time is exhausted after the first server entry, while the
+	// race is still active.
+	controller.establishWorkTime = 0
+
+	makeTestServerEntries(t, "XC", "203.0.113", 1, []string{TUNNEL_PROTOCOL_FRONTED_MEEK})
+
+	controller.startEstablishing()
+	defer controller.stopEstablishing()
+
+	waitForTestCondition(t, "attempts", func() bool {
+		return tunneler.getAttemptCount() >= 5
+	})
+
+	// The first candidate is raced, and the other fronting addresses, which
+	// are deferred, are still attempted before the next iteration.
+
+	attempts, _ := tunneler.getAttempts()
+	frontingAddresses := make(map[string]bool)
+	for _, dialParams := range attempts[:5] {
+		frontingAddresses[dialParams.MeekFrontingAddress] = true
+	}
+	if len(frontingAddresses) != 5 {
+		t.Fatalf("unexpected fronting addresses: %v", frontingAddresses)
+	}
+}
+
+func TestEstablishRaceServerAffinity(t *testing.T) {
+
+	tunneler := &testTunneler{}
+	controller := newTestController(t, "XD", 1, nil, tunneler)
+	controller.config.EstablishTunnelRaceStaggerMilliseconds = 1
+
+	// The affinity server and the next server use different protocols, so
+	// both are race candidates.
+
+	affinityServer := makeTestServerEntries(
+		t, "XD", "203.0.113", 1, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH})[0]
+	otherServer := makeTestServerEntries(
+		t, "XD", "198.51.100", 1, []string{TUNNEL_PROTOCOL_SSH})[0]
+
+	err := PromoteServerEntry(affinityServer.IpAddress)
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	// The affinity server attempt is slow, and fails. The other server
+	// attempt succeeds immediately.
+
+	releaseAffinityServer := make(chan struct{})
+	var releaseOnce sync.Once
+	release := func() { releaseOnce.Do(func() { close(releaseAffinityServer) }) }
+
+	tunneler.setEstablishable(
+		func(serverEntry *ServerEntry, _ *DialParameters) bool {
+			if serverEntry.IpAddress == affinityServer.IpAddress {
+				<-releaseAffinityServer
+				return false
+			}
+			return true
+		})
+
+	controller.startEstablishing()
+	defer controller.stopEstablishing()
+	defer release()
+
+	waitForTestCondition(t, "other server attempt", func() bool {
+		_, attemptServers := tunneler.getAttempts()
+		return Contains(attemptServers, otherServer.IpAddress)
+	})
+
+	// The other server's tunnel, although a race candidate, isn't delivered
+	// while the affinity server attempt is pending.
+
+	select {
+	case tunnel := <-controller.establishedTunnels:
+		t.Fatalf("unexpected tunnel during affinity grace period: %s", tunnel.serverEntry.IpAddress)
+	case <-time.After(ESTABLISH_TUNNEL_SERVER_AFFINITY_GRACE_PERIOD / 4):
+	}
+
+	release()
+
+	tunnel := receiveTestTunnel(t, controller)
+	tunnel.Close(true)
+	if tunnel.serverEntry.IpAddress != otherServer.IpAddress {
+		t.Fatalf("unexpected tunnel: %s", tunnel.serverEntry.IpAddress)
+	}
+}
+
+func TestEstablishAchievableTunnelCount(t *testing.T) {
+
+	controller := newTestController(t, "XE", 3, nil, &testTunneler{})
+
+	var notices []string
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			if bytes.Contains(notice, []byte("achievable tunnel pool size")) {
+				notices = append(notices, string(notice))
+			}
+		}))
+	defer SetNoticeOutput(ioutil.Discard)
+	SetEmitDiagnosticNotices(true)
+	defer SetEmitDiagnosticNotices(false)
+
+	// The achievable count is at least 1, even with no server entries
+
+	controller.refreshServerEntryCount()
+	if count := controller.getAchievableTunnelCount(3); count != 1 {
+		t.Fatalf("unexpected achievable count: %d", count)
+	}
+
+	// Newly stored server entries aren't counted until the cached count
+	// is refreshed, and the notice is emitted only when the achievable count
+	// changes.
+
+	makeTestServerEntries(t, "XE", "203.0.113", 2, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+
+	for i := 0; i < 3; i++ {
+		if count := controller.getAchievableTunnelCount(3); count != 1 {
+			t.Fatalf("unexpected achievable count before refresh: %d", count)
+		}
+	}
+
+	controller.refreshServerEntryCount()
+	for i := 0; i < 3; i++ {
+		if count := controller.getAchievableTunnelCount(3); count != 2 {
+			t.Fatalf("unexpected achievable count after refresh: %d", count)
+		}
+	}
+
+	if len(notices) != 2 {
+		t.Fatalf("unexpected notices: %v", notices)
+	}
+
+	// Server entries discovered by a handshake signal an update
+
+	tunneler := &testTunneler{discoveredServerEntryCount: 1}
+	tunneler.setEstablishable(
+		func(_ *ServerEntry, _ *DialParameters) bool { return true })
+	controller = newTestController(t, "XE", 1, nil, tunneler)
+
+	controller.startEstablishing()
+	defer controller.stopEstablishing()
+
+	tunnel := receiveTestTunnel(t, controller)
+	tunnel.serverContext = nil
+	tunnel.Close(true)
+
+	select {
+	case <-controller.signalServerEntriesUpdated:
+	default:
+		t.Fatalf("missing server entries updated signal")
+	}
+}
+
+func TestEstablishServerAffinityAccounting(t *testing.T) {
+
+	tunneler := &testTunneler{}
+	controller := newTestController(t, "XF", 2, nil, tunneler)
+
+	// Both servers are server affinity servers, with the same protocol, so
+	// the second server's candidate is deferred by the race. With one busy
+	// worker, the deferred candidate can't be sent.
+	controller.config.ConnectionWorkerPoolSize = 1
+	controller.config.EstablishTunnelRaceStaggerMilliseconds = 1
+
+	makeTestServerEntries(t, "XF", "203.0.113", 2, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+
+	releaseAttempt := make(chan struct{})
+	tunneler.setEstablishable(
+		func(_ *ServerEntry, _ *DialParameters) bool {
+			<-releaseAttempt
+			return false
+		})
+
+	controller.startEstablishing()
+
+	waitForTestCondition(t, "first attempt", func() bool {
+		return tunneler.getAttemptCount() >= 1
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	controller.serverAffinityMutex.Lock()
+	pending := controller.serverAffinityPending
+	sealed := controller.serverAffinitySealed
+	controller.serverAffinityMutex.Unlock()
+	if pending != 2 || !sealed {
+		t.Fatalf("unexpected server affinity state: %d %v", pending, sealed)
+	}
+
+	// Stopping establishment drops the deferred server affinity candidate,
+	// and the failed attempt completes the other one.
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(releaseAttempt)
+	}()
+	controller.stopEstablishing()
+
+	controller.serverAffinityMutex.Lock()
+	pending = controller.serverAffinityPending
+	closed := controller.serverAffinityClosed
+	controller.serverAffinityMutex.Unlock()
+	if pending != 0 || !closed {
+		t.Fatalf("unexpected server affinity state after stop: %d %v", pending, closed)
+	}
+}
+
+// isTestTunnelClosed indicates if the tunnel has been closed.
+func isTestTunnelClosed(tunnel *Tunnel) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isClosed
+}
+
+func TestTunnelHandover(t *testing.T) {
+
+	controller := newTestController(t, "XG", 1, nil, &testTunneler{})
+	controller.config.EnableTunnelHandover = true
+	controller.config.TunnelHandoverDrainTimeoutSeconds = 1
+
+	makeTunnel := func(ipAddress string) *Tunnel {
+		return newTestTunnel(
+			controller.config,
+			&ServerEntry{IpAddress: ipAddress},
+			&DialParameters{Protocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+	}
+
+	// Handover: a degraded active tunnel is replaced by the standby tunnel
+	// and drains its open port forward until the drain timeout.
+
+	degradedTunnel := makeTunnel("192.0.2.101")
+	if _, registered := controller.registerTunnel(degradedTunnel); !registered {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if controller.SignalTunnelDegraded(degradedTunnel, "test") {
+		t.Fatalf("unexpected handover without a standby tunnel")
+	}
+
+	standbyTunnel := makeTunnel("192.0.2.102")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+
+	degradedTunnel.load.addConn()
+
+	if !controller.SignalTunnelDegraded(degradedTunnel, "test") ||
+		!degradedTunnel.IsDraining() ||
+		controller.hasStandbyTunnel() {
+		t.Fatalf("unexpected handover state")
+	}
+
+	// A draining tunnel isn't replaced again
+	if controller.SignalTunnelDegraded(degradedTunnel, "test") {
+		t.Fatalf("unexpected handover of draining tunnel")
+	}
+
+	controller.handoverTunnel(<-controller.tunnelHandovers)
+
+	if controller.getNextActiveTunnel() != standbyTunnel {
+		t.Fatalf("standby tunnel not active")
+	}
+
+	startTime := time.Now()
+	waitForTestCondition(t, "drain timeout", func() bool {
+		return isTestTunnelClosed(degradedTunnel)
+	})
+	if time.Since(startTime) < time.Second {
+		t.Fatalf("unexpected drain before timeout")
+	}
+	controller.runWaitGroup.Wait()
+
+	// Terminate: a draining tunnel which fails is closed and no longer
+	// draining, and the replacement remains active.
+
+	activeTunnel := standbyTunnel
+	standbyTunnel = makeTunnel("192.0.2.103")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+	activeTunnel.load.addConn()
+	if !controller.SignalTunnelDegraded(activeTunnel, "test") {
+		t.Fatalf("SignalTunnelDegraded failed")
+	}
+	controller.handoverTunnel(<-controller.tunnelHandovers)
+
+	controller.terminateTunnel(activeTunnel)
+	controller.terminateHandoverTunnel(activeTunnel)
+	controller.promoteStandbyTunnel(activeTunnel)
+
+	controller.handoverMutex.Lock()
+	isDraining := controller.drainingTunnels[activeTunnel]
+	controller.handoverMutex.Unlock()
+	if isDraining || !isTestTunnelClosed(activeTunnel) {
+		t.Fatalf("failed draining tunnel not terminated")
+	}
+	controller.runWaitGroup.Wait()
+
+	if controller.getNextActiveTunnel() != standbyTunnel {
+		t.Fatalf("replacement tunnel not active")
+	}
+
+	// A failed active tunnel is replaced immediately by the standby tunnel.
+
+	failedTunnel := standbyTunnel
+	standbyTunnel = makeTunnel("192.0.2.104")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+
+	controller.terminateTunnel(failedTunnel)
+	controller.terminateHandoverTunnel(failedTunnel)
+	controller.promoteStandbyTunnel(failedTunnel)
+
+	if !isTestTunnelClosed(failedTunnel) ||
+		controller.getNextActiveTunnel() != standbyTunnel ||
+		controller.hasStandbyTunnel() {
+		t.Fatalf("standby tunnel not promoted")
+	}
+
+	controller.terminateAllTunnels()
+	if !isTestTunnelClosed(standbyTunnel) {
+		t.Fatalf("active tunnel not closed")
+	}
+}
+
+func TestTunnelHandoverFailedStandby(t *testing.T) {
+
+	controller := newTestController(t, "XH", 1, nil, &testTunneler{})
+	controller.config.EnableTunnelHandover = true
+
+	makeTunnel := func(ipAddress string) *Tunnel {
+		return newTestTunnel(
+			controller.config,
+			&ServerEntry{IpAddress: ipAddress},
+			&DialParameters{Protocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+	}
+
+	activeTunnel := makeTunnel("192.0.2.111")
+	if _, registered := controller.registerTunnel(activeTunnel); !registered {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	// The failed tunnels buffer holds failures of the active, standby and
+	// draining tunnels.
+
+	if cap(controller.failedTunnels) != 3 {
+		t.Fatalf("unexpected failed tunnels buffer size: %d", cap(controller.failedTunnels))
+	}
+
+	// A standby tunnel which fails while its failure signal is pending isn't
+	// promoted or handed over to.
+
+	standbyTunnel := makeTunnel("192.0.2.112")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+	controller.SignalTunnelFailure(standbyTunnel)
+
+	if controller.SignalTunnelDegraded(activeTunnel, "test") {
+		t.Fatalf("unexpected handover to failed standby tunnel")
+	}
+
+	controller.terminateTunnel(activeTunnel)
+	controller.promoteStandbyTunnel(activeTunnel)
+	if controller.getNextActiveTunnel() != nil {
+		t.Fatalf("failed standby tunnel promoted")
+	}
+
+	failedTunnel := <-controller.failedTunnels
+	controller.terminateTunnel(failedTunnel)
+	controller.terminateHandoverTunnel(failedTunnel)
+	if failedTunnel != standbyTunnel ||
+		!isTestTunnelClosed(standbyTunnel) ||
+		controller.hasStandbyTunnel() {
+		t.Fatalf("failed standby tunnel not terminated")
+	}
+
+	// When runTunnels is busy and the failed tunnels buffer is full, a
+	// failed standby tunnel is terminated immediately.
+
+	activeTunnel = makeTunnel("192.0.2.113")
+	if _, registered := controller.registerTunnel(activeTunnel); !registered {
+		t.Fatalf("registerTunnel failed")
+	}
+	standbyTunnel = makeTunnel("192.0.2.114")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+
+	for i := 0; i < cap(controller.failedTunnels); i++ {
+		controller.failedTunnels <- makeTunnel("192.0.2.115")
+	}
+
+	controller.SignalTunnelFailure(standbyTunnel)
+
+	if !isTestTunnelClosed(standbyTunnel) || controller.hasStandbyTunnel() {
+		t.Fatalf("failed standby tunnel not terminated")
+	}
+
+	for i := 0; i < cap(controller.failedTunnels); i++ {
+		<-controller.failedTunnels
+	}
+
+	// A standby tunnel which fails after a handover is signaled doesn't
+	// replace the degraded tunnel.
+
+	standbyTunnel = makeTunnel("192.0.2.116")
+	if !controller.registerStandbyTunnel(standbyTunnel) {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+	if !controller.SignalTunnelDegraded(activeTunnel, "test") {
+		t.Fatalf("SignalTunnelDegraded failed")
+	}
+	controller.SignalTunnelFailure(standbyTunnel)
+	controller.handoverTunnel(<-controller.tunnelHandovers)
+
+	waitForTestCondition(t, "standby tunnel closed", func() bool {
+		return isTestTunnelClosed(standbyTunnel)
+	})
+	if controller.getNextActiveTunnel() != activeTunnel || activeTunnel.IsDraining() {
+		t.Fatalf("degraded tunnel not active")
+	}
+
+	<-controller.failedTunnels
+	controller.terminateAllTunnels()
+}
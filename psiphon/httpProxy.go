@@ -20,6 +20,7 @@
 package psiphon
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -53,17 +54,24 @@ import (
 // Origin URLs must include the scheme prefix ("http://" or "https://") and must be
 // URL encoded.
 //
+// When LocalProxyUsers is configured, requests must include a Proxy-Authorization
+// Basic header with valid user credentials, and each user's policy is applied.
+//
 type HttpProxy struct {
-	tunneler               Tunneler
-	listener               net.Listener
-	serveWaitGroup         *sync.WaitGroup
-	httpProxyTunneledRelay *http.Transport
-	urlProxyTunneledRelay  *http.Transport
-	urlProxyTunneledClient *http.Client
-	urlProxyDirectRelay    *http.Transport
-	urlProxyDirectClient   *http.Client
-	openConns              *Conns
-	stopListeningBroadcast chan struct{}
+	tunneler                     Tunneler
+	listener                     net.Listener
+	serveWaitGroup               *sync.WaitGroup
+	users                        *localProxyUsers
+	httpProxyTunneledRelay       *http.Transport
+	httpProxyAlwaysTunneledRelay *http.Transport
+	urlProxyTunneledRelay        *http.Transport
+	urlProxyTunneledClient       *http.Client
+	urlProxyAlwaysTunneledRelay  *http.Transport
+	urlProxyAlwaysTunneledClient *http.Client
+	urlProxyDirectRelay          *http.Transport
+	urlProxyDirectClient         *http.Client
+	openConns                    *Conns
+	stopListeningBroadcast       chan struct{}
 }
 
 var _HTTP_PROXY_TYPE = "HTTP"
@@ -91,6 +99,9 @@ func NewHttpProxy(
 		// TODO: connect timeout?
 		return tunneler.Dial(addr, false, nil)
 	}
+	alwaysTunneledDialer := func(_, addr string) (conn net.Conn, err error) {
+		return tunneler.Dial(addr, true, nil)
+	}
 	directDialer := func(_, addr string) (conn net.Conn, err error) {
 		return DialTCP(addr, untunneledDialConfig)
 	}
@@ -104,6 +115,14 @@ func NewHttpProxy(
 		ResponseHeaderTimeout: responseHeaderTimeout,
 	}
 
+	// Users with AlwaysTunnel set use distinct transports, as the split
+	// tunnel decision is made when the transport dials.
+	httpProxyAlwaysTunneledRelay := &http.Transport{
+		Dial:                  alwaysTunneledDialer,
+		MaxIdleConnsPerHost:   HTTP_PROXY_MAX_IDLE_CONNECTIONS_PER_HOST,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+
 	// Note: URL proxy relays use http.Client for upstream requests, so
 	// redirects will be followed. HTTP proxy should not follow redirects
 	// and simply uses http.Transport directly.
@@ -122,6 +141,16 @@ func NewHttpProxy(
 		//Timeout:   HTTP_PROXY_ORIGIN_SERVER_TIMEOUT,
 	}
 
+	urlProxyAlwaysTunneledRelay := &http.Transport{
+		Dial:                  alwaysTunneledDialer,
+		MaxIdleConnsPerHost:   HTTP_PROXY_MAX_IDLE_CONNECTIONS_PER_HOST,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+	urlProxyAlwaysTunneledClient := &http.Client{
+		Transport: urlProxyAlwaysTunneledRelay,
+		Jar:       nil,
+	}
+
 	urlProxyDirectRelay := &http.Transport{
 		Dial:                  directDialer,
 		MaxIdleConnsPerHost:   HTTP_PROXY_MAX_IDLE_CONNECTIONS_PER_HOST,
@@ -133,19 +162,28 @@ func NewHttpProxy(
 	}
 
 	proxy = &HttpProxy{
-		tunneler:               tunneler,
-		listener:               listener,
-		serveWaitGroup:         new(sync.WaitGroup),
-		httpProxyTunneledRelay: httpProxyTunneledRelay,
-		urlProxyTunneledRelay:  urlProxyTunneledRelay,
-		urlProxyTunneledClient: urlProxyTunneledClient,
-		urlProxyDirectRelay:    urlProxyDirectRelay,
-		urlProxyDirectClient:   urlProxyDirectClient,
-		openConns:              new(Conns),
-		stopListeningBroadcast: make(chan struct{}),
+		tunneler:                     tunneler,
+		listener:                     listener,
+		serveWaitGroup:               new(sync.WaitGroup),
+		users:                        newLocalProxyUsers(config),
+		httpProxyTunneledRelay:       httpProxyTunneledRelay,
+		httpProxyAlwaysTunneledRelay: httpProxyAlwaysTunneledRelay,
+		urlProxyTunneledRelay:        urlProxyTunneledRelay,
+		urlProxyTunneledClient:       urlProxyTunneledClient,
+		urlProxyAlwaysTunneledRelay:  urlProxyAlwaysTunneledRelay,
+		urlProxyAlwaysTunneledClient: urlProxyAlwaysTunneledClient,
+		urlProxyDirectRelay:          urlProxyDirectRelay,
+		urlProxyDirectClient:         urlProxyDirectClient,
+		openConns:                    new(Conns),
+		stopListeningBroadcast:       make(chan struct{}),
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
+	if proxy.users != nil {
+		proxy.serveWaitGroup.Add(1)
+		go proxy.users.runBytesTransferredReporter(
+			_HTTP_PROXY_TYPE, proxy.stopListeningBroadcast, proxy.serveWaitGroup)
+	}
 
 	// TODO: NoticeListeningHttpProxyPort is emitted after net.Listen
 	// but before go proxy.server() and httpServer.Serve(), and this
@@ -173,7 +211,9 @@ func (proxy *HttpProxy) Close() {
 	// Close idle proxy->origin persistent connections
 	// TODO: also close active connections
 	proxy.httpProxyTunneledRelay.CloseIdleConnections()
+	proxy.httpProxyAlwaysTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyTunneledRelay.CloseIdleConnections()
+	proxy.urlProxyAlwaysTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyDirectRelay.CloseIdleConnections()
 }
 
@@ -194,7 +234,21 @@ func (proxy *HttpProxy) Close() {
 // license that can be found in the LICENSE file.
 //
 func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	var user *localProxyUser
+	if proxy.users != nil {
+		user = proxy.authenticateUser(request)
+		if user == nil {
+			responseWriter.Header().Set("Proxy-Authenticate", "Basic realm=\"Psiphon\"")
+			http.Error(responseWriter, "", http.StatusProxyAuthRequired)
+			return
+		}
+	}
 	if request.Method == "CONNECT" {
+		if user != nil && !user.isTargetPermitted(request.URL.Host) {
+			NoticeAlert("%s", ContextError(fmt.Errorf("destination not permitted: %s", request.URL.Host)))
+			http.Error(responseWriter, "", http.StatusForbidden)
+			return
+		}
 		hijacker, _ := responseWriter.(http.Hijacker)
 		conn, _, err := hijacker.Hijack()
 		if err != nil {
@@ -203,26 +257,62 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 			return
 		}
 		go func() {
-			err := proxy.httpConnectHandler(conn, request.URL.Host)
+			err := proxy.httpConnectHandler(conn, request.URL.Host, user)
 			if err != nil {
 				NoticeAlert("%s", ContextError(err))
 			}
 		}()
 	} else if request.URL.IsAbs() {
-		proxy.httpProxyHandler(responseWriter, request)
+		proxy.httpProxyHandler(responseWriter, request, user)
 	} else {
-		proxy.urlProxyHandler(responseWriter, request)
+		proxy.urlProxyHandler(responseWriter, request, user)
+	}
+}
+
+// authenticateUser returns the user identified by the request's
+// Proxy-Authorization Basic credentials, or nil when the credentials
+// are missing or invalid.
+func (proxy *HttpProxy) authenticateUser(request *http.Request) *localProxyUser {
+	const prefix = "Basic "
+	authorization := request.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(authorization, prefix) {
+		return nil
+	}
+	credentials, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return nil
+	}
+	index := strings.IndexByte(string(credentials), ':')
+	if index == -1 {
+		return nil
+	}
+	return proxy.users.authenticate(string(credentials[:index]), string(credentials[index+1:]))
+}
+
+// urlTarget returns the host:port destination of an absolute HTTP or
+// HTTPS URL, applying the scheme's default port.
+func urlTarget(url *url.URL) string {
+	if _, _, err := net.SplitHostPort(url.Host); err == nil {
+		return url.Host
+	}
+	port := "80"
+	if url.Scheme == "https" {
+		port = "443"
 	}
+	return net.JoinHostPort(strings.Trim(url.Host, "[]"), port)
 }
 
-func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (err error) {
+func (proxy *HttpProxy) httpConnectHandler(
+	localConn net.Conn, target string, user *localProxyUser) (err error) {
+
 	defer localConn.Close()
 	defer proxy.openConns.Remove(localConn)
 	proxy.openConns.Add(localConn)
+	alwaysTunnel := user != nil && user.config.AlwaysTunnel
 	// Setting downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(target, false, localConn)
+	remoteConn, err := proxy.tunneler.Dial(target, alwaysTunnel, localConn)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -231,12 +321,28 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	if err != nil {
 		return ContextError(err)
 	}
+	if user != nil {
+		localConn = user.wrapConn(localConn)
+	}
 	LocalProxyRelay(_HTTP_PROXY_TYPE, localConn, remoteConn)
 	return nil
 }
 
-func (proxy *HttpProxy) httpProxyHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	relayHttpRequest(nil, proxy.httpProxyTunneledRelay, request, responseWriter)
+func (proxy *HttpProxy) httpProxyHandler(
+	responseWriter http.ResponseWriter, request *http.Request, user *localProxyUser) {
+
+	transport := proxy.httpProxyTunneledRelay
+	if user != nil {
+		if !user.isTargetPermitted(urlTarget(request.URL)) {
+			NoticeAlert("%s", ContextError(fmt.Errorf("destination not permitted: %s", request.URL.Host)))
+			http.Error(responseWriter, "", http.StatusForbidden)
+			return
+		}
+		if user.config.AlwaysTunnel {
+			transport = proxy.httpProxyAlwaysTunneledRelay
+		}
+	}
+	relayHttpRequest(nil, transport, request, responseWriter, user)
 }
 
 const (
@@ -244,19 +350,30 @@ const (
 	URL_PROXY_DIRECT_REQUEST_PATH   = "/direct/"
 )
 
-func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, request *http.Request) {
+func (proxy *HttpProxy) urlProxyHandler(
+	responseWriter http.ResponseWriter, request *http.Request, user *localProxyUser) {
 
 	var client *http.Client
 	var originUrl string
 	var err error
 
+	alwaysTunnel := user != nil && user.config.AlwaysTunnel
+
 	// Request URL should be "/tunneled/<origin URL>" or  "/direct/<origin URL>" and the
 	// origin URL must be URL encoded.
 	switch {
 	case strings.HasPrefix(request.URL.Path, URL_PROXY_TUNNELED_REQUEST_PATH):
 		originUrl, err = url.QueryUnescape(request.URL.Path[len(URL_PROXY_TUNNELED_REQUEST_PATH):])
 		client = proxy.urlProxyTunneledClient
+		if alwaysTunnel {
+			client = proxy.urlProxyAlwaysTunneledClient
+		}
 	case strings.HasPrefix(request.URL.Path, URL_PROXY_DIRECT_REQUEST_PATH):
+		if alwaysTunnel {
+			NoticeAlert("%s", ContextError(errors.New("direct request not permitted")))
+			http.Error(responseWriter, "", http.StatusForbidden)
+			return
+		}
 		originUrl, err = url.QueryUnescape(request.URL.Path[len(URL_PROXY_DIRECT_REQUEST_PATH):])
 		client = proxy.urlProxyDirectClient
 	default:
@@ -281,18 +398,29 @@ func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, requ
 		return
 	}
 
+	// Note: redirects followed by the client are not subject to the user's
+	// port restrictions.
+	if user != nil && !user.isTargetPermitted(urlTarget(url)) {
+		NoticeAlert("%s", ContextError(fmt.Errorf("destination not permitted: %s", url.Host)))
+		http.Error(responseWriter, "", http.StatusForbidden)
+		return
+	}
+
 	// Transform received request to directly reference the origin URL
 	request.Host = url.Host
 	request.URL = url
 
-	relayHttpRequest(client, nil, request, responseWriter)
+	relayHttpRequest(client, nil, request, responseWriter, user)
 }
 
+// relayHttpRequest relays the request and its response. When user is not
+// nil, the request and response body bytes are accounted to the user.
 func relayHttpRequest(
 	client *http.Client,
 	transport *http.Transport,
 	request *http.Request,
-	responseWriter http.ResponseWriter) {
+	responseWriter http.ResponseWriter,
+	user *localProxyUser) {
 
 	// Transform received request struct before using as input to relayed request
 	request.Close = false
@@ -300,6 +428,9 @@ func relayHttpRequest(
 	for _, key := range hopHeaders {
 		request.Header.Del(key)
 	}
+	if user != nil && request.Body != nil {
+		request.Body = user.wrapRequestBody(request.Body)
+	}
 
 	// Relay the HTTP request and get the response. Use a client when supplied,
 	// otherwise a transport. A client handles cookies and redirects, and a
@@ -334,7 +465,10 @@ func relayHttpRequest(
 
 	// Relay the response code and body
 	responseWriter.WriteHeader(response.StatusCode)
-	_, err = io.Copy(responseWriter, response.Body)
+	n, err := io.Copy(responseWriter, response.Body)
+	if user != nil {
+		user.addBytes(0, n)
+	}
 	if err != nil {
 		NoticeAlert("%s", ContextError(err))
 		forceClose(responseWriter)
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sort"
+	"time"
+)
+
+// ImpairedProtocolClassification is the impaired protocol classification
+// for a single network, keyed by tunnel protocol. Classifications are
+// persisted in the data store, so that impaired protocols continue to be
+// skipped after a restart.
+type ImpairedProtocolClassification map[string]*ImpairedProtocolRecord
+
+// ImpairedProtocolRecord counts the early tunnel failures for a protocol.
+// LastClassified is the time of the most recent counted failure. Count
+// decays: one failure is forgotten for each full decay period since
+// LastClassified.
+type ImpairedProtocolRecord struct {
+	Count          int
+	LastClassified time.Time
+}
+
+// getImpairedProtocolClassificationParameters returns the classification
+// parameters for the specified protocol, which are the general parameters
+// with any override for the protocol applied.
+func (config *Config) getImpairedProtocolClassificationParameters(
+	protocol string) ImpairedProtocolClassificationParameters {
+
+	parameters := ImpairedProtocolClassificationParameters{
+		Threshold:       config.ImpairedProtocolClassificationThreshold,
+		DurationSeconds: config.ImpairedProtocolClassificationDurationSeconds,
+		DecaySeconds:    config.ImpairedProtocolClassificationDecaySeconds,
+	}
+
+	if override, ok := config.ImpairedProtocolClassificationOverrides[protocol]; ok {
+		if override.Threshold != 0 {
+			parameters.Threshold = override.Threshold
+		}
+		if override.DurationSeconds != 0 {
+			parameters.DurationSeconds = override.DurationSeconds
+		}
+		if override.DecaySeconds != 0 {
+			parameters.DecaySeconds = override.DecaySeconds
+		}
+		parameters.Disabled = override.Disabled
+	}
+
+	return parameters
+}
+
+// count returns the protocol's classification count after decay.
+func (classification ImpairedProtocolClassification) count(
+	config *Config, protocol string, now time.Time) int {
+
+	record, ok := classification[protocol]
+	if !ok {
+		return 0
+	}
+
+	parameters := config.getImpairedProtocolClassificationParameters(protocol)
+	if parameters.DecaySeconds <= 0 {
+		return record.Count
+	}
+
+	decayed := int(now.Sub(record.LastClassified) /
+		(time.Duration(parameters.DecaySeconds) * time.Second))
+	if decayed < 0 {
+		decayed = 0
+	}
+	if decayed >= record.Count {
+		return 0
+	}
+	return record.Count - decayed
+}
+
+// classify updates the classification for a failed tunnel that used the
+// specified protocol and started at tunnelStartTime. When the tunnel
+// failed within the classification window, the failure is counted;
+// otherwise, the protocol's classification is reset. Fully decayed records
+// are also removed. It returns true when the classification changed.
+func (classification ImpairedProtocolClassification) classify(
+	config *Config, protocol string, tunnelStartTime, now time.Time) bool {
+
+	pruned := classification.prune(config, now)
+
+	parameters := config.getImpairedProtocolClassificationParameters(protocol)
+	if parameters.Disabled {
+		return pruned
+	}
+
+	window := time.Duration(parameters.DurationSeconds) * time.Second
+	if tunnelStartTime.Add(window).After(now) {
+		classification[protocol] = &ImpairedProtocolRecord{
+			Count:          classification.count(config, protocol, now) + 1,
+			LastClassified: now,
+		}
+		return true
+	}
+
+	if _, ok := classification[protocol]; ok {
+		delete(classification, protocol)
+		return true
+	}
+	return pruned
+}
+
+// prune removes fully decayed records. It returns true when any record was
+// removed.
+func (classification ImpairedProtocolClassification) prune(
+	config *Config, now time.Time) bool {
+
+	pruned := false
+	for protocol := range classification {
+		if classification.count(config, protocol, now) == 0 {
+			delete(classification, protocol)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// isImpaired checks if the protocol is classified as impaired.
+func (classification ImpairedProtocolClassification) isImpaired(
+	config *Config, protocol string, now time.Time) bool {
+
+	parameters := config.getImpairedProtocolClassificationParameters(protocol)
+	if parameters.Disabled {
+		return false
+	}
+	count := classification.count(config, protocol, now)
+	return count > 0 && count >= parameters.Threshold
+}
+
+// impairedProtocols returns the protocols, in sorted order, which are
+// classified as impaired.
+func (classification ImpairedProtocolClassification) impairedProtocols(
+	config *Config, now time.Time) []string {
+
+	impairedProtocols := make([]string, 0)
+	for protocol := range classification {
+		if classification.isImpaired(config, protocol, now) {
+			impairedProtocols = append(impairedProtocols, protocol)
+		}
+	}
+	sort.Strings(impairedProtocols)
+	return impairedProtocols
+}
+
+// counts returns a copy of the classification counts, after decay, omitting
+// fully decayed protocols. The classification isn't modified, so the result
+// may be used after the caller releases any lock on the classification.
+func (classification ImpairedProtocolClassification) counts(
+	config *Config, now time.Time) map[string]int {
+
+	counts := make(map[string]int)
+	for protocol := range classification {
+		count := classification.count(config, protocol, now)
+		if count > 0 {
+			counts[protocol] = count
+		}
+	}
+	return counts
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestImpairedProtocolClassification(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "ImpairedProtocolClassificationThreshold" : 2,
+        "ImpairedProtocolClassificationDurationSeconds" : 60,
+        "ImpairedProtocolClassificationDecaySeconds" : 600,
+        "ImpairedProtocolClassificationOverrides" : {
+            "SSH" : {"Threshold" : 4},
+            "UNFRONTED-MEEK-OSSH" : {"Disabled" : true}
+        }
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	classification := make(ImpairedProtocolClassification)
+	now := time.Now()
+
+	// Early failures are counted up to the threshold
+
+	for i := 0; i < 2; i++ {
+		classification.classify(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, now.Add(-10*time.Second), now)
+		classification.classify(config, TUNNEL_PROTOCOL_SSH, now.Add(-10*time.Second), now)
+		classification.classify(config, TUNNEL_PROTOCOL_UNFRONTED_MEEK, now.Add(-10*time.Second), now)
+	}
+
+	impaired := classification.impairedProtocols(config, now)
+	if len(impaired) != 1 || impaired[0] != TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Fatalf("unexpected impaired protocols: %v", impaired)
+	}
+
+	// Per-protocol overrides
+
+	counts := classification.counts(config, now)
+	if counts[TUNNEL_PROTOCOL_SSH] != 2 || classification.isImpaired(config, TUNNEL_PROTOCOL_SSH, now) {
+		t.Fatalf("unexpected SSH classification: %v", counts)
+	}
+	if _, ok := counts[TUNNEL_PROTOCOL_UNFRONTED_MEEK]; ok {
+		t.Fatalf("unexpected disabled protocol classification: %v", counts)
+	}
+
+	// Decay
+
+	later := now.Add(11 * time.Minute)
+	if classification.isImpaired(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, later) {
+		t.Fatalf("unexpected impaired protocol after decay")
+	}
+	classification.classify(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, later.Add(-10*time.Second), later)
+	if !classification.isImpaired(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, later) {
+		t.Fatalf("expected impaired protocol after decay and failure")
+	}
+
+	// counts returns a copy, and doesn't modify the classification
+
+	counts = classification.counts(config, later)
+	counts[TUNNEL_PROTOCOL_OBFUSCATED_SSH] = 100
+	if classification.count(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, later) == 100 {
+		t.Fatalf("unexpected classification modified through counts")
+	}
+
+	muchLater := later.Add(time.Hour)
+	if len(classification.counts(config, muchLater)) != 0 || len(classification) == 0 {
+		t.Fatalf("unexpected classification after full decay: %v", classification)
+	}
+
+	// Fully decayed records are removed by classify
+
+	if !classification.classify(
+		config, TUNNEL_PROTOCOL_FRONTED_MEEK, muchLater.Add(-time.Hour), muchLater) ||
+		len(classification) != 0 {
+		t.Fatalf("unexpected classification after pruning: %v", classification)
+	}
+
+	// A failure outside the window resets the classification
+
+	classification.classify(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, now.Add(-10*time.Second), now)
+	classification.classify(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, now.Add(-10*time.Minute), now)
+	if classification.count(config, TUNNEL_PROTOCOL_OBFUSCATED_SSH, now) != 0 {
+		t.Fatalf("unexpected classification after late failure")
+	}
+
+	// Invalid override
+
+	_, err = LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "ImpairedProtocolClassificationOverrides" : {"INVALID" : {"Threshold" : 1}}
+    }`))
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly succeeded")
+	}
+}
+
+func TestImpairedProtocolClassificationNotice(t *testing.T) {
+
+	var notices [][]byte
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			notices = append(notices, append([]byte(nil), notice...))
+		}))
+	defer SetNoticeOutput(ioutil.Discard)
+
+	networkIDs := []string{"Home Wi-Fi", "Office Wi-Fi"}
+	for _, networkID := range networkIDs {
+		NoticeImpairedProtocolClassification(
+			networkID, map[string]int{TUNNEL_PROTOCOL_OBFUSCATED_SSH: 1}, []string{})
+	}
+
+	// The network ID isn't reported, but networks are still distinguishable
+
+	if len(notices) != len(networkIDs) {
+		t.Fatalf("unexpected notice count: %d", len(notices))
+	}
+
+	var hashes []interface{}
+	for i, notice := range notices {
+		if bytes.Contains(notice, []byte(networkIDs[i])) {
+			t.Fatalf("unexpected network ID in notice: %s", notice)
+		}
+		noticeType, payload, err := GetNotice(notice)
+		if err != nil || noticeType != "ImpairedProtocolClassification" {
+			t.Fatalf("unexpected notice: %s", notice)
+		}
+		hashes = append(hashes, payload["networkIDHash"])
+	}
+
+	if hashes[0] == nil || hashes[0] == hashes[1] {
+		t.Fatalf("unexpected network ID hashes: %v", hashes)
+	}
+}
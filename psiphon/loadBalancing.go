@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LOAD_BALANCING_POLICY_ROUND_ROBIN         = "ROUND-ROBIN"
+	LOAD_BALANCING_POLICY_LEAST_CONNECTIONS   = "LEAST-CONNECTIONS"
+	LOAD_BALANCING_POLICY_LOWEST_RTT          = "LOWEST-RTT"
+	LOAD_BALANCING_POLICY_STICKY_HOST         = "STICKY-HOST"
+	LOAD_BALANCING_POLICY_WEIGHTED_THROUGHPUT = "WEIGHTED-THROUGHPUT"
+
+	LOAD_BALANCING_MIN_THROUGHPUT_WEIGHT          = 1024.0
+	LOAD_BALANCING_MIN_RELATIVE_THROUGHPUT_WEIGHT = 0.1
+	LOAD_BALANCING_EWMA_WEIGHT                    = 0.125
+)
+
+var SupportedLoadBalancingPolicies = []string{
+	LOAD_BALANCING_POLICY_ROUND_ROBIN,
+	LOAD_BALANCING_POLICY_LEAST_CONNECTIONS,
+	LOAD_BALANCING_POLICY_LOWEST_RTT,
+	LOAD_BALANCING_POLICY_STICKY_HOST,
+	LOAD_BALANCING_POLICY_WEIGHTED_THROUGHPUT,
+}
+
+// tunnelLoad tracks the metrics of a tunnel which are used by the load
+// balancing policies: the number of open port forwards; the round trip
+// time, as measured by SSH keep alives; and the recent throughput.
+// RTT and throughput are exponentially weighted moving averages.
+type tunnelLoad struct {
+	openConns  int32
+	mutex      sync.Mutex
+	rtt        time.Duration
+	throughput float64
+}
+
+func (load *tunnelLoad) addConn() {
+	atomic.AddInt32(&load.openConns, 1)
+}
+
+func (load *tunnelLoad) removeConn() {
+	atomic.AddInt32(&load.openConns, -1)
+}
+
+func (load *tunnelLoad) getOpenConns() int {
+	return int(atomic.LoadInt32(&load.openConns))
+}
+
+// recordRTT adds an RTT sample. The first sample initializes the average.
+func (load *tunnelLoad) recordRTT(rtt time.Duration) {
+	load.mutex.Lock()
+	defer load.mutex.Unlock()
+	if load.rtt == 0 {
+		load.rtt = rtt
+	} else {
+		load.rtt = time.Duration(
+			(1.0-LOAD_BALANCING_EWMA_WEIGHT)*float64(load.rtt) +
+				LOAD_BALANCING_EWMA_WEIGHT*float64(rtt))
+	}
+}
+
+// getRTT returns the average RTT, or 0 when there's no sample yet.
+func (load *tunnelLoad) getRTT() time.Duration {
+	load.mutex.Lock()
+	defer load.mutex.Unlock()
+	return load.rtt
+}
+
+// recordBytes adds a throughput sample of bytes transferred over period.
+func (load *tunnelLoad) recordBytes(bytes int64, period time.Duration) {
+	if period <= 0 {
+		return
+	}
+	sample := float64(bytes) / period.Seconds()
+	load.mutex.Lock()
+	defer load.mutex.Unlock()
+	load.throughput =
+		(1.0-LOAD_BALANCING_EWMA_WEIGHT)*load.throughput +
+			LOAD_BALANCING_EWMA_WEIGHT*sample
+}
+
+// getThroughput returns the average throughput, in bytes per second.
+func (load *tunnelLoad) getThroughput() float64 {
+	load.mutex.Lock()
+	defer load.mutex.Unlock()
+	return load.throughput
+}
+
+// selectTunnel selects, from the active tunnels, the tunnel to use for a
+// port forward to host according to the load balancing policy. tunnels
+// must not be empty. ROUND-ROBIN is handled by the caller, which keeps the
+// round robin state.
+//
+// LEAST-CONNECTIONS selects the tunnel with the fewest open port forwards.
+//
+// LOWEST-RTT selects the tunnel with the lowest SSH keep alive round trip
+// time. Tunnels which have no RTT measurement yet are selected only when no
+// tunnel has a measurement, in which case LEAST-CONNECTIONS is applied.
+//
+// STICKY-HOST always selects the same tunnel for the same host, so that a
+// site sees a consistent egress IP address. This uses rendezvous hashing,
+// so only the hosts assigned to a failed tunnel move to another tunnel.
+//
+// WEIGHTED-THROUGHPUT selects a tunnel at random, weighted by the recent
+// throughput of each tunnel, favoring tunnels which are moving data fastest.
+// A minimum weight, relative to the fastest tunnel, ensures idle tunnels
+// continue to receive port forwards, so their throughput is re-measured.
+func selectTunnel(policy string, tunnels []*Tunnel, host string) *Tunnel {
+
+	switch policy {
+
+	case LOAD_BALANCING_POLICY_LOWEST_RTT:
+		var selected *Tunnel
+		for _, tunnel := range tunnels {
+			rtt := tunnel.load.getRTT()
+			if rtt == 0 {
+				continue
+			}
+			if selected == nil || rtt < selected.load.getRTT() {
+				selected = tunnel
+			}
+		}
+		if selected != nil {
+			return selected
+		}
+		return selectLeastConnectionsTunnel(tunnels)
+
+	case LOAD_BALANCING_POLICY_STICKY_HOST:
+		var selected *Tunnel
+		var selectedHash uint64
+		for _, tunnel := range tunnels {
+			hash := fnv.New64a()
+			hash.Write([]byte(host))
+			hash.Write([]byte(tunnel.serverEntry.IpAddress))
+			if selected == nil || hash.Sum64() > selectedHash {
+				selected = tunnel
+				selectedHash = hash.Sum64()
+			}
+		}
+		return selected
+
+	case LOAD_BALANCING_POLICY_WEIGHTED_THROUGHPUT:
+		weights := make([]float64, len(tunnels))
+		minWeight := LOAD_BALANCING_MIN_THROUGHPUT_WEIGHT
+		for i, tunnel := range tunnels {
+			weights[i] = tunnel.load.getThroughput()
+			if weights[i]*LOAD_BALANCING_MIN_RELATIVE_THROUGHPUT_WEIGHT > minWeight {
+				minWeight = weights[i] * LOAD_BALANCING_MIN_RELATIVE_THROUGHPUT_WEIGHT
+			}
+		}
+		total := 0.0
+		for i := range weights {
+			if weights[i] < minWeight {
+				weights[i] = minWeight
+			}
+			total += weights[i]
+		}
+		value := rand.Float64() * total
+		for i, tunnel := range tunnels {
+			value -= weights[i]
+			if value < 0 {
+				return tunnel
+			}
+		}
+		return tunnels[len(tunnels)-1]
+	}
+
+	return selectLeastConnectionsTunnel(tunnels)
+}
+
+func selectLeastConnectionsTunnel(tunnels []*Tunnel) *Tunnel {
+	selected := tunnels[0]
+	for _, tunnel := range tunnels[1:] {
+		if tunnel.load.getOpenConns() < selected.load.getOpenConns() {
+			selected = tunnel
+		}
+	}
+	return selected
+}
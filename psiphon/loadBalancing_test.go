@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func makeLoadBalancingTestTunnels(count int) []*Tunnel {
+	tunnels := make([]*Tunnel, count)
+	for i := 0; i < count; i++ {
+		tunnels[i] = &Tunnel{
+			serverEntry: &ServerEntry{IpAddress: fmt.Sprintf("192.0.2.%d", i)},
+			load:        new(tunnelLoad),
+		}
+	}
+	return tunnels
+}
+
+func TestLeastConnectionsPolicy(t *testing.T) {
+	tunnels := makeLoadBalancingTestTunnels(3)
+	for i := 0; i < 30; i++ {
+		selectTunnel(LOAD_BALANCING_POLICY_LEAST_CONNECTIONS, tunnels, "").load.addConn()
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.load.getOpenConns() != 10 {
+			t.Fatalf("unexpected open connections: %d", tunnel.load.getOpenConns())
+		}
+	}
+}
+
+func TestLowestRTTPolicy(t *testing.T) {
+	tunnels := makeLoadBalancingTestTunnels(3)
+
+	// With no measurements, falls back to least connections
+	tunnels[0].load.addConn()
+	if selectTunnel(LOAD_BALANCING_POLICY_LOWEST_RTT, tunnels, "") != tunnels[1] {
+		t.Fatalf("unexpected tunnel with no RTT measurements")
+	}
+
+	tunnels[0].load.recordRTT(100 * time.Millisecond)
+	tunnels[2].load.recordRTT(50 * time.Millisecond)
+	if selectTunnel(LOAD_BALANCING_POLICY_LOWEST_RTT, tunnels, "") != tunnels[2] {
+		t.Fatalf("unexpected tunnel for lowest RTT")
+	}
+
+	for i := 0; i < 20; i++ {
+		tunnels[2].load.recordRTT(500 * time.Millisecond)
+	}
+	if selectTunnel(LOAD_BALANCING_POLICY_LOWEST_RTT, tunnels, "") != tunnels[0] {
+		t.Fatalf("unexpected tunnel after RTT increase")
+	}
+}
+
+func TestStickyHostPolicy(t *testing.T) {
+	tunnels := makeLoadBalancingTestTunnels(4)
+
+	assignments := make(map[string]*Tunnel)
+	used := make(map[*Tunnel]bool)
+	for i := 0; i < 100; i++ {
+		host := fmt.Sprintf("host%d.example.com", i)
+		tunnel := selectTunnel(LOAD_BALANCING_POLICY_STICKY_HOST, tunnels, host)
+		if selectTunnel(LOAD_BALANCING_POLICY_STICKY_HOST, tunnels, host) != tunnel {
+			t.Fatalf("unexpected tunnel change for host: %s", host)
+		}
+		assignments[host] = tunnel
+		used[tunnel] = true
+	}
+	if len(used) != len(tunnels) {
+		t.Fatalf("unexpected tunnel distribution: %d", len(used))
+	}
+
+	// Removing a tunnel only moves the hosts assigned to that tunnel
+	remaining := tunnels[1:]
+	for host, tunnel := range assignments {
+		if tunnel != tunnels[0] &&
+			selectTunnel(LOAD_BALANCING_POLICY_STICKY_HOST, remaining, host) != tunnel {
+			t.Fatalf("unexpected tunnel change for host: %s", host)
+		}
+	}
+}
+
+func TestWeightedThroughputPolicy(t *testing.T) {
+	tunnels := makeLoadBalancingTestTunnels(2)
+	for i := 0; i < 50; i++ {
+		tunnels[0].load.recordBytes(1000000, 1*time.Second)
+	}
+
+	counts := make(map[*Tunnel]int)
+	for i := 0; i < 1000; i++ {
+		counts[selectTunnel(LOAD_BALANCING_POLICY_WEIGHTED_THROUGHPUT, tunnels, "")] += 1
+	}
+	if counts[tunnels[0]] <= counts[tunnels[1]] || counts[tunnels[1]] == 0 {
+		t.Fatalf("unexpected tunnel selection: %d, %d", counts[tunnels[0]], counts[tunnels[1]])
+	}
+}
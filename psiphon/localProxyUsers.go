@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LocalProxyUser is a user which may authenticate to the local SOCKS and
+// HTTP proxies. Users authenticate with SOCKS5 username/password
+// authentication (RFC 1929) or with a HTTP Proxy-Authorization Basic header.
+//
+// When AlwaysTunnel is set, all of the user's traffic is tunneled,
+// regardless of split tunnel classification, and URL proxy direct requests
+// are refused.
+//
+// When AllowedPorts is not empty, the user may only connect to the listed
+// destination ports.
+type LocalProxyUser struct {
+	Username     string
+	Password     string
+	AlwaysTunnel bool
+	AllowedPorts []int
+}
+
+// validateLocalProxyUsers checks that each user has a valid and unique
+// username, and valid ports.
+func validateLocalProxyUsers(users []*LocalProxyUser) error {
+	usernames := make(map[string]bool)
+	for _, user := range users {
+		// RFC 1929 limits usernames and passwords to 255 bytes.
+		if user.Username == "" || len(user.Username) > 255 || len(user.Password) > 255 {
+			return ContextError(errors.New("invalid local proxy username or password"))
+		}
+		if usernames[user.Username] {
+			return ContextError(fmt.Errorf("duplicate local proxy user: %s", user.Username))
+		}
+		usernames[user.Username] = true
+		for _, port := range user.AllowedPorts {
+			if port <= 0 || port > 65535 {
+				return ContextError(fmt.Errorf("invalid local proxy user port: %d", port))
+			}
+		}
+	}
+	return nil
+}
+
+// localProxyUsers authenticates local proxy users and accounts for the
+// bytes each user transfers through a local proxy.
+type localProxyUsers struct {
+	users map[string]*localProxyUser
+}
+
+type localProxyUser struct {
+	// Note: bytesSent and bytesReceived are first, for 64-bit alignment
+	// with atomic operations.
+	bytesSent             int64
+	bytesReceived         int64
+	config                *LocalProxyUser
+	allowedPorts          map[int]bool
+	reportedBytesSent     int64
+	reportedBytesReceived int64
+}
+
+// newLocalProxyUsers returns nil when no users are configured, in which
+// case authentication is not required.
+func newLocalProxyUsers(config *Config) *localProxyUsers {
+	if len(config.LocalProxyUsers) == 0 {
+		return nil
+	}
+	users := &localProxyUsers{
+		users: make(map[string]*localProxyUser),
+	}
+	for _, userConfig := range config.LocalProxyUsers {
+		user := &localProxyUser{
+			config:       userConfig,
+			allowedPorts: make(map[int]bool),
+		}
+		for _, port := range userConfig.AllowedPorts {
+			user.allowedPorts[port] = true
+		}
+		users.users[userConfig.Username] = user
+	}
+	return users
+}
+
+// authenticate returns the user with the specified credentials, or nil if
+// authentication fails.
+func (users *localProxyUsers) authenticate(username, password string) *localProxyUser {
+	user, ok := users.users[username]
+	if !ok {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(user.config.Password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// isTargetPermitted checks that the user may connect to the target, in
+// host:port form.
+func (user *localProxyUser) isTargetPermitted(target string) bool {
+	if len(user.allowedPorts) == 0 {
+		return true
+	}
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	return user.allowedPorts[port]
+}
+
+// isPortPermitted checks that the user may send to the destination port.
+func (user *localProxyUser) isPortPermitted(port int) bool {
+	return len(user.allowedPorts) == 0 || user.allowedPorts[port]
+}
+
+func (user *localProxyUser) addBytes(sent, received int64) {
+	if sent > 0 {
+		atomic.AddInt64(&user.bytesSent, sent)
+	}
+	if received > 0 {
+		atomic.AddInt64(&user.bytesReceived, received)
+	}
+}
+
+// wrapConn returns a conn which accounts for the bytes read from, sent by
+// the user, and written to, received by the user, the local conn.
+func (user *localProxyUser) wrapConn(localConn net.Conn) net.Conn {
+	return &localProxyUserConn{Conn: localConn, user: user}
+}
+
+type localProxyUserConn struct {
+	net.Conn
+	user *localProxyUser
+}
+
+func (conn *localProxyUserConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	conn.user.addBytes(int64(n), 0)
+	return n, err
+}
+
+func (conn *localProxyUserConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	conn.user.addBytes(0, int64(n))
+	return n, err
+}
+
+// wrapRequestBody returns a request body which accounts for the bytes
+// read from it as sent by the user.
+func (user *localProxyUser) wrapRequestBody(body io.ReadCloser) io.ReadCloser {
+	return &localProxyUserRequestBody{ReadCloser: body, user: user}
+}
+
+type localProxyUserRequestBody struct {
+	io.ReadCloser
+	user *localProxyUser
+}
+
+func (body *localProxyUserRequestBody) Read(buffer []byte) (int, error) {
+	n, err := body.ReadCloser.Read(buffer)
+	body.user.addBytes(int64(n), 0)
+	return n, err
+}
+
+// reportBytesTransferred emits a notice with the total bytes transferred
+// by each user who has transferred bytes since the last report. Each proxy
+// has its own localProxyUsers, and only its reporter calls this function.
+func (users *localProxyUsers) reportBytesTransferred(proxyType string) {
+	for username, user := range users.users {
+		sent := atomic.LoadInt64(&user.bytesSent)
+		received := atomic.LoadInt64(&user.bytesReceived)
+		if sent == user.reportedBytesSent && received == user.reportedBytesReceived {
+			continue
+		}
+		user.reportedBytesSent = sent
+		user.reportedBytesReceived = received
+		NoticeLocalProxyUserBytesTransferred(proxyType, username, sent, received)
+	}
+}
+
+// runBytesTransferredReporter periodically reports the bytes transferred
+// by each user, until stopBroadcast is closed, when a final report is made.
+func (users *localProxyUsers) runBytesTransferredReporter(
+	proxyType string, stopBroadcast <-chan struct{}, waitGroup *sync.WaitGroup) {
+
+	defer waitGroup.Done()
+
+	ticker := time.NewTicker(LOCAL_PROXY_USER_BYTES_TRANSFERRED_NOTICE_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			users.reportBytesTransferred(proxyType)
+		case <-stopBroadcast:
+			users.reportBytesTransferred(proxyType)
+			return
+		}
+	}
+}
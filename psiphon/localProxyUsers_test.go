@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSocks5Authenticate(t *testing.T, proxyAddress, username, password string, status byte) net.Conn {
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 1, SOCKS5_METHOD_USERNAME_PASSWORD},
+		[]byte{SOCKS_VERSION_5, SOCKS5_METHOD_USERNAME_PASSWORD})
+	request := []byte{SOCKS5_USERNAME_PASSWORD_VERSION, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	testSocksRoundTrip(t, conn, request, []byte{SOCKS5_USERNAME_PASSWORD_VERSION, status})
+	return conn
+}
+
+func TestLocalProxyUsers(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "LocalProxyUsers" : [
+            {"Username" : "user1", "Password" : "password1"},
+            {"Username" : "user2", "Password" : "password2", "AlwaysTunnel" : true, "AllowedPorts" : [443]}
+        ]
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	_, err = LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "LocalProxyUsers" : [{"Username" : "user1", "AllowedPorts" : [65536]}]
+    }`))
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly accepted invalid port")
+	}
+
+	socksProxy, err := NewSocksProxy(config, new(testSocksTunneler), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	proxyAddress := socksProxy.listener.Addr().String()
+
+	// No authentication method offered
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 1, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED},
+		[]byte{SOCKS_VERSION_5, SOCKS5_METHOD_NO_ACCEPTABLE_METHODS})
+	conn.Close()
+
+	// SOCKS4 refused
+
+	conn, err = net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_4, SOCKS_COMMAND_CONNECT, 0, 80, 192, 0, 2, 1, 0},
+		[]byte{SOCKS4_REPLY_VERSION, SOCKS4_REPLY_REJECTED, 0, 0, 0, 0, 0, 0})
+	conn.Close()
+
+	// Invalid password
+
+	conn = testSocks5Authenticate(
+		t, proxyAddress, "user1", "password2", SOCKS5_USERNAME_PASSWORD_FAILURE)
+	conn.Close()
+
+	// Unrestricted user
+
+	conn = testSocks5Authenticate(
+		t, proxyAddress, "user1", "password1", SOCKS5_USERNAME_PASSWORD_SUCCESS)
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, SOCKS_COMMAND_CONNECT, 0, SOCKS5_ADDRESS_TYPE_IPV4, 192, 0, 2, 1, 0, 80},
+		[]byte{SOCKS_VERSION_5, SOCKS5_REPLY_SUCCEEDED, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	testSocksRoundTrip(t, conn, []byte("data"), []byte("data"))
+	conn.Close()
+
+	// The relay accounts for bytes after each write completes, which may be
+	// after the client has read the echo.
+	user := socksProxy.users.users["user1"]
+	for i := 0; i < 100 && atomic.LoadInt64(&user.bytesReceived) != 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&user.bytesSent) != 4 || atomic.LoadInt64(&user.bytesReceived) != 4 {
+		t.Fatalf("unexpected bytes transferred: %d, %d",
+			atomic.LoadInt64(&user.bytesSent), atomic.LoadInt64(&user.bytesReceived))
+	}
+
+	// Port restricted user
+
+	conn = testSocks5Authenticate(
+		t, proxyAddress, "user2", "password2", SOCKS5_USERNAME_PASSWORD_SUCCESS)
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, SOCKS_COMMAND_CONNECT, 0, SOCKS5_ADDRESS_TYPE_IPV4, 192, 0, 2, 1, 0, 80},
+		[]byte{SOCKS_VERSION_5, SOCKS5_REPLY_NOT_ALLOWED, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	conn.Close()
+
+	conn = testSocks5Authenticate(
+		t, proxyAddress, "user2", "password2", SOCKS5_USERNAME_PASSWORD_SUCCESS)
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, SOCKS_COMMAND_CONNECT, 0, SOCKS5_ADDRESS_TYPE_IPV4, 192, 0, 2, 1, 1, 187},
+		[]byte{SOCKS_VERSION_5, SOCKS5_REPLY_SUCCEEDED, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	testSocksRoundTrip(t, conn, []byte("data"), []byte("data"))
+	conn.Close()
+
+	// HTTP proxy
+
+	httpProxy, err := NewHttpProxy(config, new(DialConfig), new(testSocksTunneler), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewHttpProxy failed: %s", err)
+	}
+	defer httpProxy.Close()
+
+	testHttpConnect := func(username, password, target string, expectedStatusCode int) {
+		conn, err := net.Dial("tcp", httpProxy.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		defer conn.Close()
+		request := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Host: target},
+			Host:   target,
+			Header: make(http.Header),
+		}
+		if username != "" {
+			request.SetBasicAuth(username, password)
+			request.Header.Set("Proxy-Authorization", request.Header.Get("Authorization"))
+			request.Header.Del("Authorization")
+		}
+		err = request.Write(conn)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(conn), request)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %s", err)
+		}
+		if response.StatusCode != expectedStatusCode {
+			t.Fatalf("unexpected status code: %d", response.StatusCode)
+		}
+	}
+
+	testHttpConnect("", "", "192.0.2.1:443", http.StatusProxyAuthRequired)
+	testHttpConnect("user2", "password1", "192.0.2.1:443", http.StatusProxyAuthRequired)
+	testHttpConnect("user2", "password2", "192.0.2.1:80", http.StatusForbidden)
+	testHttpConnect("user2", "password2", "192.0.2.1:443", http.StatusOK)
+	testHttpConnect("user1", "password1", "192.0.2.1:80", http.StatusOK)
+}
@@ -88,6 +88,11 @@ type MeekConfig struct {
 	SessionID                     string
 	MeekCookieEncryptionPublicKey string
 	MeekObfuscatedKey             string
+
+	// MeekCookiePaddingLength, when not nil, specifies the exact obfuscation
+	// padding length for the meek cookie. Otherwise, a random length up to
+	// MEEK_COOKIE_MAX_PADDING is used.
+	MeekCookiePaddingLength *int
 }
 
 // MeekConn is a network connection that tunnels TCP over HTTP and supports "fronting". Meek sends
@@ -681,7 +686,11 @@ func makeMeekCookie(meekConfig *MeekConfig) (cookie *http.Cookie, err error) {
 
 	// Obfuscate the encrypted data
 	obfuscator, err := NewClientObfuscator(
-		&ObfuscatorConfig{Keyword: meekConfig.MeekObfuscatedKey, MaxPadding: MEEK_COOKIE_MAX_PADDING})
+		&ObfuscatorConfig{
+			Keyword:       meekConfig.MeekObfuscatedKey,
+			MaxPadding:    MEEK_COOKIE_MAX_PADDING,
+			PaddingLength: meekConfig.MeekCookiePaddingLength,
+		})
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -54,6 +54,7 @@ import (
 	"container/list"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -140,6 +141,15 @@ type NetworkConnectivityChecker interface {
 	HasNetworkConnectivity() int
 }
 
+// NetworkIDGetter defines the interface to the external GetNetworkID
+// provider, which returns an identifier for the host's current active
+// network; for example, a Wi-Fi network name or a mobile network operator
+// code. The value is opaque to the core and is only compared with other
+// network IDs. Return "" when the network can't be identified.
+type NetworkIDGetter interface {
+	GetNetworkID() string
+}
+
 // DeviceBinder defines the interface to the external BindToDevice provider
 type DeviceBinder interface {
 	BindToDevice(fileDescriptor int) error
@@ -370,33 +380,135 @@ func WaitForNetworkConnectivity(
 // that a DNS connection bypasses a VPN interface (BindToDevice) or
 // when we need to ensure that a DNS connection is tunneled.
 // Caller must set timeouts or interruptibility as required for conn.
+// Only IPv4 addresses, A records, are resolved.
 func ResolveIP(host string, conn net.Conn) (addrs []net.IP, ttls []time.Duration, err error) {
+	return resolveIP(host, conn, dns.TypeA)
+}
 
-	// Send the DNS query
-	dnsConn := &dns.Conn{Conn: conn}
-	defer dnsConn.Close()
-	query := new(dns.Msg)
-	query.SetQuestion(dns.Fqdn(host), dns.TypeA)
-	query.RecursionDesired = true
-	dnsConn.WriteMsg(query)
+func resolveIP(
+	host string, conn net.Conn, queryTypes ...uint16) (addrs []net.IP, ttls []time.Duration, err error) {
 
-	// Process the response
-	response, err := dnsConn.ReadMsg()
-	if err != nil {
-		return nil, nil, ContextError(err)
+	defer conn.Close()
+
+	exchange := func(query *dns.Msg) (*dns.Msg, error) {
+		return ExchangeDnsMessage(conn, query)
 	}
+
+	return resolveIPWithExchange(host, exchange, queryTypes...)
+}
+
+// resolveIPWithExchange makes a DNS query of each query type in turn, using
+// exchange to send each query and receive its response. When a query other
+// than the first fails, the addresses resolved so far are returned.
+func resolveIPWithExchange(
+	host string,
+	exchange func(*dns.Msg) (*dns.Msg, error),
+	queryTypes ...uint16) (addrs []net.IP, ttls []time.Duration, err error) {
+
 	addrs = make([]net.IP, 0)
 	ttls = make([]time.Duration, 0)
-	for _, answer := range response.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			addrs = append(addrs, a.A)
-			ttl := time.Duration(a.Hdr.Ttl) * time.Second
-			ttls = append(ttls, ttl)
+
+	for i, queryType := range queryTypes {
+
+		// Send the DNS query and process the response
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(host), queryType)
+		query.RecursionDesired = true
+		response, err := exchange(query)
+		if err != nil {
+			if i > 0 {
+				break
+			}
+			return nil, nil, ContextError(err)
+		}
+		for _, answer := range response.Answer {
+			switch record := answer.(type) {
+			case *dns.A:
+				addrs = append(addrs, record.A)
+				ttls = append(ttls, time.Duration(record.Hdr.Ttl)*time.Second)
+			case *dns.AAAA:
+				addrs = append(addrs, record.AAAA)
+				ttls = append(ttls, time.Duration(record.Hdr.Ttl)*time.Second)
+			}
 		}
 	}
 	return addrs, ttls, nil
 }
 
+// ExchangeDnsMessage sends a DNS query over the given TCP or UDP conn and
+// returns the response. Caller must set timeouts or interruptibility as
+// required for conn.
+func ExchangeDnsMessage(conn net.Conn, query *dns.Msg) (*dns.Msg, error) {
+
+	var response *dns.Msg
+	var err error
+
+	if _, ok := conn.(*net.UDPConn); ok {
+		dnsConn := &dns.Conn{Conn: conn}
+		err = dnsConn.WriteMsg(query)
+		if err == nil {
+			response, err = dnsConn.ReadMsg()
+		}
+	} else {
+		// The dns package frames messages only for *net.TCPConn, and so
+		// would send unframed messages over, e.g., tunneled port forwards.
+		err = WriteDnsStreamMessage(conn, query)
+		if err == nil {
+			response, err = ReadDnsStreamMessage(conn)
+		}
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if response.Id != query.Id {
+		return nil, ContextError(errors.New("unexpected DNS response ID"))
+	}
+
+	return response, nil
+}
+
+// WriteDnsStreamMessage writes a DNS message to a stream conn, prefixed
+// with its 2 byte length, as in DNS over TCP.
+func WriteDnsStreamMessage(conn net.Conn, message *dns.Msg) error {
+	packedMessage, err := message.Pack()
+	if err != nil {
+		return ContextError(err)
+	}
+	if len(packedMessage) > dns.MaxMsgSize {
+		return ContextError(errors.New("DNS message too large"))
+	}
+	buffer := make([]byte, 2, 2+len(packedMessage))
+	binary.BigEndian.PutUint16(buffer, uint16(len(packedMessage)))
+	buffer = append(buffer, packedMessage...)
+	_, err = conn.Write(buffer)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// ReadDnsStreamMessage reads a length prefixed DNS message from a stream
+// conn, as in DNS over TCP.
+func ReadDnsStreamMessage(conn net.Conn) (*dns.Msg, error) {
+	var length [2]byte
+	_, err := io.ReadFull(conn, length[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	packedMessage := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, packedMessage)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	message := new(dns.Msg)
+	err = message.Unpack(packedMessage)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return message, nil
+}
+
 // MakeUntunneledHttpsClient returns a net/http.Client which is
 // configured to use custom dialing features -- including BindToDevice,
 // UseIndistinguishableTLS, etc. -- for a specific HTTPS request URL.
@@ -715,8 +827,14 @@ type HTTPSServer struct {
 // and we avoid that here.
 // tcpKeepAliveListener is used in http.ListenAndServeTLS but not exported,
 // so we use a copy from https://golang.org/src/net/http/server.go.
+// Listeners other than *net.TCPListener, such as wrappers which inspect
+// accepted conns, are used as-is and are responsible for their own TCP
+// keep alive configuration.
 func (server *HTTPSServer) ServeTLS(listener net.Listener) error {
-	tlsListener := tls.NewListener(tcpKeepAliveListener{listener.(*net.TCPListener)}, server.TLSConfig)
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		listener = tcpKeepAliveListener{tcpListener}
+	}
+	tlsListener := tls.NewListener(listener, server.TLSConfig)
 	return server.Serve(tlsListener)
 }
 
@@ -21,6 +21,8 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -143,19 +145,25 @@ func NoticeAvailableEgressRegions(regions []string) {
 		"AvailableEgressRegions", false, false, "regions", sortedRegions)
 }
 
-// NoticeConnectingServer is details on a connection attempt
-func NoticeConnectingServer(ipAddress, region, protocol, directTCPDialAddress string, meekConfig *MeekConfig) {
+// NoticeConnectingServer is details on a connection attempt. isReplay indicates
+// that the dial parameters are replayed from a previous successful connection.
+func NoticeConnectingServer(
+	ipAddress, region, protocol string, isReplay bool,
+	directTCPDialAddress string, meekConfig *MeekConfig) {
+
 	if meekConfig == nil {
 		outputNotice("ConnectingServer", true, false,
 			"ipAddress", ipAddress,
 			"region", region,
 			"protocol", protocol,
+			"isReplay", isReplay,
 			"directTCPDialAddress", directTCPDialAddress)
 	} else {
 		outputNotice("ConnectingServer", true, false,
 			"ipAddress", ipAddress,
 			"region", region,
 			"protocol", protocol,
+			"isReplay", isReplay,
 			"meekDialAddress", meekConfig.DialAddress,
 			"meekUseHTTPS", meekConfig.UseHTTPS,
 			"meekSNIServerName", meekConfig.SNIServerName,
@@ -169,6 +177,22 @@ func NoticeActiveTunnel(ipAddress, protocol string) {
 	outputNotice("ActiveTunnel", true, false, "ipAddress", ipAddress, "protocol", protocol)
 }
 
+// NoticeStandbyTunnel is a successful connection that is held in reserve, in
+// tunnel handover mode, to replace an active tunnel which degrades
+func NoticeStandbyTunnel(ipAddress, protocol string) {
+	outputNotice("StandbyTunnel", true, false, "ipAddress", ipAddress, "protocol", protocol)
+}
+
+// NoticeTunnelHandover reports that the standby tunnel, to ipAddress, has
+// replaced the degraded or failed active tunnel, to degradedIpAddress.
+// Existing port forwards drain on a degraded tunnel.
+func NoticeTunnelHandover(degradedIpAddress, ipAddress, reason string) {
+	outputNotice("TunnelHandover", true, false,
+		"degradedIpAddress", degradedIpAddress,
+		"ipAddress", ipAddress,
+		"reason", reason)
+}
+
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
 	outputNotice("SocksProxyPortInUse", false, true, "port", port)
@@ -189,6 +213,26 @@ func NoticeListeningHttpProxyPort(port int) {
 	outputNotice("ListeningHttpProxyPort", false, false, "port", port)
 }
 
+// NoticeTransparentProxyPortInUse is a failure to use the configured LocalTransparentProxyPort
+func NoticeTransparentProxyPortInUse(port int) {
+	outputNotice("TransparentProxyPortInUse", false, true, "port", port)
+}
+
+// NoticeListeningTransparentProxyPort is the port for the listening local transparent proxy
+func NoticeListeningTransparentProxyPort(port int) {
+	outputNotice("ListeningTransparentProxyPort", false, false, "port", port)
+}
+
+// NoticeDnsProxyPortInUse is a failure to use the configured LocalDnsProxyPort
+func NoticeDnsProxyPortInUse(port int) {
+	outputNotice("DnsProxyPortInUse", false, true, "port", port)
+}
+
+// NoticeListeningDnsProxyPort is the port for the listening local DNS proxy
+func NoticeListeningDnsProxyPort(port int) {
+	outputNotice("ListeningDnsProxyPort", false, false, "port", port)
+}
+
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
@@ -232,19 +276,46 @@ func NoticeSessionId(sessionId string) {
 	outputNotice("SessionId", true, false, "sessionId", sessionId)
 }
 
-func NoticeImpairedProtocolClassification(impairedProtocolClassification map[string]int) {
+// NoticeImpairedProtocolClassification reports the impaired protocol classification
+// for a network. "classification" is the current, decayed, failure count for each
+// protocol and "impairedProtocols" lists the protocols which are skipped when
+// establishing tunnels on the network.
+//
+// Note: the network ID, which may be a Wi-Fi network name, should remain private, so
+// only a hash of the network ID is reported. The hash still distinguishes networks.
+func NoticeImpairedProtocolClassification(
+	networkID string, impairedProtocolClassification map[string]int, impairedProtocols []string) {
+
+	networkIDHash := sha256.Sum256([]byte(networkID))
+
 	outputNotice("ImpairedProtocolClassification", false, false,
-		"classification", impairedProtocolClassification)
+		"networkIDHash", hex.EncodeToString(networkIDHash[:8]),
+		"classification", impairedProtocolClassification,
+		"impairedProtocols", impairedProtocols)
 }
 
 // NoticeUntunneled indicates than an address has been classified as untunneled and is being
-// accessed directly.
+// accessed directly. "rule" is the user-defined split tunnel rule, or the region routes,
+// which matched the address.
 //
 // Note: "address" should remain private; this notice should only be used for alerting
 // users, not for diagnostics logs.
 //
-func NoticeUntunneled(address string) {
-	outputNotice("Untunneled", false, true, "address", address)
+func NoticeUntunneled(address, rule string) {
+	outputNotice("Untunneled", false, true, "address", address, "rule", rule)
+}
+
+// NoticeSplitTunnelCache reports the split tunnel classification cache
+// counters: the number of cached entries; the number of cache hits, of
+// which negativeHits were cached resolution failures; the number of cache
+// misses; and the number of entries evicted to bound the cache size.
+func NoticeSplitTunnelCache(entries int, hits, negativeHits, misses, evictions int64) {
+	outputNotice("SplitTunnelCache", true, false,
+		"entries", entries,
+		"hits", hits,
+		"negativeHits", negativeHits,
+		"misses", misses,
+		"evictions", evictions)
 }
 
 // NoticeSplitTunnelRegion reports that split tunnel is on for the given region.
@@ -281,6 +352,25 @@ func NoticeBytesTransferred(ipAddress string, sent, received int64) {
 	}
 }
 
+// NoticeTunnelLoad reports the load balancing metrics for the tunnel to the
+// server at ipAddress: the number of open port forward connections, the
+// average SSH keep alive round trip time, and the recent throughput in bytes
+// per second.
+func NoticeTunnelLoad(ipAddress string, openConnections int, rtt time.Duration, throughput float64) {
+	outputNotice("TunnelLoad", true, false,
+		"ipAddress", ipAddress,
+		"openConnections", openConnections,
+		"rttMilliseconds", int64(rtt/time.Millisecond),
+		"throughput", int64(throughput))
+}
+
+// NoticeLocalProxyUserBytesTransferred reports how many bytes the local
+// proxy user has sent and received, in total, through the local proxy.
+func NoticeLocalProxyUserBytesTransferred(proxyType, username string, sent, received int64) {
+	outputNotice("LocalProxyUserBytesTransferred", false, false,
+		"proxyType", proxyType, "username", username, "sent", sent, "received", received)
+}
+
 // NoticeTotalBytesTransferred reports how many tunneled bytes have been
 // transferred in total up to this point, for the tunnel to the server
 // at ipAddress.
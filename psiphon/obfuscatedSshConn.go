@@ -102,10 +102,14 @@ const (
 // NewObfuscatedSshConn blocks on reading the client seed message from the
 // underlying conn.
 //
+// In client mode, when obfuscationPaddingLength is not nil, it specifies the
+// exact seed message padding length; otherwise, a random length is used.
+//
 func NewObfuscatedSshConn(
 	mode ObfuscatedSshConnMode,
 	conn net.Conn,
-	obfuscationKeyword string) (*ObfuscatedSshConn, error) {
+	obfuscationKeyword string,
+	obfuscationPaddingLength *int) (*ObfuscatedSshConn, error) {
 
 	var err error
 	var obfuscator *Obfuscator
@@ -113,7 +117,11 @@ func NewObfuscatedSshConn(
 	var writeState ObfuscatedSshWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
-		obfuscator, err = NewClientObfuscator(&ObfuscatorConfig{Keyword: obfuscationKeyword})
+		obfuscator, err = NewClientObfuscator(
+			&ObfuscatorConfig{
+				Keyword:       obfuscationKeyword,
+				PaddingLength: obfuscationPaddingLength,
+			})
 		if err != nil {
 			return nil, ContextError(err)
 		}
@@ -50,6 +50,11 @@ type Obfuscator struct {
 type ObfuscatorConfig struct {
 	Keyword    string
 	MaxPadding int
+
+	// PaddingLength, when not nil, specifies the exact seed message padding
+	// length, which must not exceed the maximum padding. Otherwise, a random
+	// length is selected. Only applies to client obfuscators.
+	PaddingLength *int
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -73,7 +78,21 @@ func NewClientObfuscator(
 		maxPadding = config.MaxPadding
 	}
 
-	seedMessage, err := makeSeedMessage(maxPadding, seed, clientToServerCipher)
+	var paddingLength int
+	if config.PaddingLength != nil {
+		paddingLength = *config.PaddingLength
+		if paddingLength < 0 || paddingLength > maxPadding {
+			return nil, ContextError(errors.New("invalid padding length"))
+		}
+	} else {
+		// paddingLength is integer in range [0, maxPadding]
+		paddingLength, err = MakeSecureRandomInt(maxPadding + 1)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	seedMessage, err := makeSeedMessage(paddingLength, seed, clientToServerCipher)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -161,12 +180,7 @@ func deriveKey(seed, keyword, iv []byte) ([]byte, error) {
 	return digest[0:OBFUSCATE_KEY_LENGTH], nil
 }
 
-func makeSeedMessage(maxPadding int, seed []byte, clientToServerCipher *rc4.Cipher) ([]byte, error) {
-	// paddingLength is integer in range [0, maxPadding]
-	paddingLength, err := MakeSecureRandomInt(maxPadding + 1)
-	if err != nil {
-		return nil, ContextError(err)
-	}
+func makeSeedMessage(paddingLength int, seed []byte, clientToServerCipher *rc4.Cipher) ([]byte, error) {
 	padding, err := MakeSecureRandomBytes(paddingLength)
 	if err != nil {
 		return nil, ContextError(err)
@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From <linux/netfilter_ipv4.h> and <linux/netfilter_ipv6/ip6_tables.h>
+const (
+	SO_ORIGINAL_DST      = 80
+	IP6T_SO_ORIGINAL_DST = 80
+)
+
+// GetOriginalDestination returns the original destination address of a
+// TCP connection which was redirected to a local listener by an iptables
+// REDIRECT or DNAT rule. For connections which weren't redirected, the
+// conn's local address is returned. Connections accepted by a TPROXY
+// listener retain the original destination as their local address.
+func GetOriginalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, ContextError(errors.New("unexpected local address type"))
+	}
+
+	// sockaddr_in6 is the larger of the two possible results
+	var sockaddr [syscall.SizeofSockaddrInet6]byte
+
+	err := controlSocket(conn, func(fd int) error {
+		level, option := syscall.SOL_IP, SO_ORIGINAL_DST
+		if localAddr.IP.To4() == nil {
+			level, option = syscall.SOL_IPV6, IP6T_SO_ORIGINAL_DST
+		}
+		sockaddrLen := uint32(len(sockaddr))
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT,
+			uintptr(fd),
+			uintptr(level),
+			uintptr(option),
+			uintptr(unsafe.Pointer(&sockaddr[0])),
+			uintptr(unsafe.Pointer(&sockaddrLen)),
+			0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err == syscall.ENOENT || err == syscall.ENOPROTOOPT {
+		// There's no connection tracking entry for the conn, or connection
+		// tracking isn't enabled: the conn wasn't redirected.
+		return localAddr, nil
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// The family field is in host byte order; the port is in network byte order.
+	family := *(*uint16)(unsafe.Pointer(&sockaddr[0]))
+	port := int(binary.BigEndian.Uint16(sockaddr[2:4]))
+
+	switch family {
+	case syscall.AF_INET:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sockaddr[4:8])
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case syscall.AF_INET6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sockaddr[8:24])
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+
+	return nil, ContextError(errors.New("unexpected address family"))
+}
+
+// controlSocket calls f with a file descriptor for the socket underlying
+// conn, which is a *net.TCPConn or *net.TCPListener.
+func controlSocket(conn interface {
+	File() (*os.File, error)
+}, f func(fd int) error) error {
+
+	// File returns a duplicate of the socket's file descriptor which shares
+	// the socket's file status flags. File, and Fd, may put the socket into
+	// blocking mode, so non-blocking mode, which the Go runtime network
+	// poller expects, is restored before returning.
+	file, err := conn.File()
+	if err != nil {
+		return ContextError(err)
+	}
+	defer file.Close()
+	fd := int(file.Fd())
+	defer syscall.SetNonblock(fd, true)
+
+	return f(fd)
+}
+
+// From <linux/in6.h>
+const IPV6_TRANSPARENT = 75
+
+// setIPTransparent sets IP_TRANSPARENT, or IPV6_TRANSPARENT, on the
+// listener's socket, as required to accept connections redirected by an
+// iptables TPROXY rule.
+func setIPTransparent(listener *net.TCPListener) error {
+
+	localAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return ContextError(errors.New("unexpected local address type"))
+	}
+
+	err := controlSocket(listener, func(fd int) error {
+		level, option := syscall.SOL_IP, syscall.IP_TRANSPARENT
+		if localAddr.IP.To4() == nil {
+			level, option = syscall.SOL_IPV6, IPV6_TRANSPARENT
+		}
+		return syscall.SetsockoptInt(fd, level, option, 1)
+	})
+	if err != nil {
+		return ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetOriginalDestination(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	defer conn.Close()
+
+	// A conn which wasn't redirected has its local address as the
+	// original destination.
+
+	originalDestination, err := GetOriginalDestination(conn.(*net.TCPConn))
+	if err != nil {
+		t.Fatalf("GetOriginalDestination failed: %s", err)
+	}
+	if originalDestination.String() != listener.Addr().String() {
+		t.Fatalf("unexpected original destination: %s", originalDestination)
+	}
+
+	// The conn remains in non-blocking mode, so deadlines are still
+	// effective.
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	readResult := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readResult <- err
+	}()
+
+	select {
+	case err := <-readResult:
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			t.Fatalf("unexpected read result: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read deadline not effective")
+	}
+}
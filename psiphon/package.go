@@ -21,6 +21,7 @@ package psiphon
 
 import (
 	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -29,6 +30,8 @@ import (
 	"errors"
 )
 
+const AUTHENTICATED_DATA_PACKAGE_KEY_BITS = 4096
+
 // AuthenticatedDataPackage is a JSON record containing some Psiphon data
 // payload, such as list of Psiphon server entries. As it may be downloaded
 // from various sources, it is digitally signed so that the data may be
@@ -42,7 +45,7 @@ type AuthenticatedDataPackage struct {
 func ReadAuthenticatedDataPackage(
 	rawPackage []byte, signingPublicKey string) (data string, err error) {
 
-	var authenticatedDataPackage *AuthenticatedDataPackage
+	var authenticatedDataPackage AuthenticatedDataPackage
 	err = json.Unmarshal(rawPackage, &authenticatedDataPackage)
 	if err != nil {
 		return "", ContextError(err)
@@ -76,3 +79,69 @@ func ReadAuthenticatedDataPackage(
 
 	return authenticatedDataPackage.Data, nil
 }
+
+// WriteAuthenticatedDataPackage creates an AuthenticatedDataPackage containing
+// the specified data and signed by the given key. The output is a JSON record
+// which may be read and authenticated with ReadAuthenticatedDataPackage using
+// the corresponding public key. The keys are in the format generated by
+// GenerateAuthenticatedDataPackageKeys.
+func WriteAuthenticatedDataPackage(
+	data string, signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	derEncodedPrivateKey, err := base64.StdEncoding.DecodeString(signingPrivateKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	rsaPrivateKey, err := x509.ParsePKCS1PrivateKey(derEncodedPrivateKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	derEncodedPublicKey, err := base64.StdEncoding.DecodeString(signingPublicKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	publicKeyDigest := sha256.Sum256(derEncodedPublicKey)
+
+	hash := sha256.New()
+	hash.Write([]byte(data))
+	digest := hash.Sum(nil)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaPrivateKey, crypto.SHA256, digest)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	packageJSON, err := json.Marshal(
+		&AuthenticatedDataPackage{
+			Data:                   data,
+			SigningPublicKeyDigest: base64.StdEncoding.EncodeToString(publicKeyDigest[:]),
+			Signature:              base64.StdEncoding.EncodeToString(signature),
+		})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return packageJSON, nil
+}
+
+// GenerateAuthenticatedDataPackageKeys creates a new RSA key pair for signing
+// AuthenticatedDataPackages. The public key is a base64 encoded, DER encoded
+// PKIX key, the format expected by ReadAuthenticatedDataPackage and used for
+// config values such as RemoteServerListSignaturePublicKey. The private key is
+// a base64 encoded, DER encoded PKCS #1 key.
+func GenerateAuthenticatedDataPackageKeys() (string, string, error) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, AUTHENTICATED_DATA_PACKAGE_KEY_BITS)
+	if err != nil {
+		return "", "", ContextError(err)
+	}
+
+	derEncodedPublicKey, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		return "", "", ContextError(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(derEncodedPublicKey),
+		base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PrivateKey(rsaKey)),
+		nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestAuthenticatedDataPackage(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err := GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	otherSigningPublicKey, _, err := GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	expectedData := "server entry 1\nserver entry 2\n"
+
+	packageJSON, err := WriteAuthenticatedDataPackage(
+		expectedData, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteAuthenticatedDataPackage failed: %s", err)
+	}
+
+	data, err := ReadAuthenticatedDataPackage(packageJSON, signingPublicKey)
+	if err != nil {
+		t.Fatalf("ReadAuthenticatedDataPackage failed: %s", err)
+	}
+	if data != expectedData {
+		t.Fatalf("unexpected data: %s", data)
+	}
+
+	// Tampered and malformed packages are rejected
+
+	var authenticatedDataPackage AuthenticatedDataPackage
+	err = json.Unmarshal(packageJSON, &authenticatedDataPackage)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	tamper := func(modify func(*AuthenticatedDataPackage)) []byte {
+		tamperedPackage := authenticatedDataPackage
+		modify(&tamperedPackage)
+		tamperedJSON, _ := json.Marshal(&tamperedPackage)
+		return tamperedJSON
+	}
+
+	signature, _ := base64.StdEncoding.DecodeString(authenticatedDataPackage.Signature)
+	signature[len(signature)/2] ^= 0x01
+	tamperedSignature := base64.StdEncoding.EncodeToString(signature)
+
+	testCases := []struct {
+		description      string
+		rawPackage       []byte
+		signingPublicKey string
+	}{
+		{"tampered signature", tamper(func(p *AuthenticatedDataPackage) { p.Signature = tamperedSignature }), signingPublicKey},
+		{"truncated signature", tamper(func(p *AuthenticatedDataPackage) { p.Signature = p.Signature[:len(p.Signature)/2] }), signingPublicKey},
+		{"missing signature", tamper(func(p *AuthenticatedDataPackage) { p.Signature = "" }), signingPublicKey},
+		{"tampered data", tamper(func(p *AuthenticatedDataPackage) { p.Data += "server entry 3\n" }), signingPublicKey},
+		{"other key", packageJSON, otherSigningPublicKey},
+		{"invalid key", packageJSON, "invalid"},
+		{"truncated package", packageJSON[:len(packageJSON)/2], signingPublicKey},
+		{"empty package", []byte{}, signingPublicKey},
+		{"null package", []byte("null"), signingPublicKey},
+	}
+
+	for _, testCase := range testCases {
+		_, err := ReadAuthenticatedDataPackage(testCase.rawPackage, testCase.signingPublicKey)
+		if err == nil {
+			t.Fatalf("unexpected success for %s", testCase.description)
+		}
+	}
+
+	// Invalid signing keys are rejected
+
+	_, err = WriteAuthenticatedDataPackage(expectedData, signingPublicKey, signingPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected success with invalid private key")
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+const (
+	SERVER_LIST_FILENAME       = "server_list_compressed"
+	CLIENT_CONFIG_FILENAME     = "psiphon-client.config"
+	DEFAULT_SERVER_PORT_STRIDE = 100
+	MAX_PORT                   = 65535
+)
+
+// BundleParams specifies the servers to generate in a deployment bundle.
+type BundleParams struct {
+
+	// ServerIPAddress is the IP address all servers listen on.
+	ServerIPAddress string
+
+	// WebServerPort is the web server port for the first server. When 0,
+	// no servers run a web server.
+	WebServerPort int
+
+	// TunnelProtocolPorts specifies the tunnel protocols and ports for the
+	// first server.
+	TunnelProtocolPorts map[string]int
+
+	// ServerCount is the number of servers to generate. Servers share the
+	// same IP address and each server after the first listens on ports
+	// offset by PortStride from the previous server. The default, 0, is
+	// treated as 1.
+	ServerCount int
+
+	// PortStride is the port offset between servers. The default, 0, uses
+	// DEFAULT_SERVER_PORT_STRIDE.
+	PortStride int
+
+	// RemoteServerListURL is the location where the remote server list
+	// package will be hosted. This value is set in the client config. When
+	// blank, the client config omits RemoteServerListUrl and it must be
+	// added before the client config is used.
+	RemoteServerListURL string
+}
+
+// Bundle is a complete client and server deployment, for testing. It contains
+// a config and server entry for each server; a remote server list package,
+// signed and compressed as expected by the client's remote server list
+// fetcher, containing all server entries; and a client config which
+// specifies the matching remote server list signature public key.
+type Bundle struct {
+	ServerConfigs           [][]byte
+	ServerEntries           [][]byte
+	RemoteServerListPackage []byte
+	ClientConfig            []byte
+}
+
+// GenerateBundle creates a new deployment bundle. As with GenerateConfig,
+// the generated configs are intended for testing, not production.
+func GenerateBundle(params *BundleParams) (*Bundle, error) {
+
+	serverCount := params.ServerCount
+	if serverCount == 0 {
+		serverCount = 1
+	}
+	portStride := params.PortStride
+	if portStride == 0 {
+		portStride = DEFAULT_SERVER_PORT_STRIDE
+	}
+	if serverCount < 0 || portStride < 0 {
+		return nil, psiphon.ContextError(errors.New("invalid server count or port stride"))
+	}
+
+	// Check that no ports are reused across servers. GenerateConfig checks
+	// for duplicate ports within each server.
+
+	usedPort := make(map[int]bool)
+	checkPort := func(port int) error {
+		if port > MAX_PORT {
+			return errors.New("port out of range")
+		}
+		if usedPort[port] {
+			return errors.New("duplicate listening port across servers")
+		}
+		usedPort[port] = true
+		return nil
+	}
+
+	bundle := &Bundle{}
+
+	for i := 0; i < serverCount; i++ {
+
+		offset := i * portStride
+
+		webServerPort := 0
+		if params.WebServerPort != 0 {
+			webServerPort = params.WebServerPort + offset
+			if err := checkPort(webServerPort); err != nil {
+				return nil, psiphon.ContextError(err)
+			}
+		}
+
+		tunnelProtocolPorts := make(map[string]int)
+		for protocol, port := range params.TunnelProtocolPorts {
+			tunnelProtocolPorts[protocol] = port + offset
+			if err := checkPort(port + offset); err != nil {
+				return nil, psiphon.ContextError(err)
+			}
+		}
+
+		serverConfig, serverEntry, err := GenerateConfig(
+			params.ServerIPAddress, webServerPort, tunnelProtocolPorts)
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+
+		bundle.ServerConfigs = append(bundle.ServerConfigs, serverConfig)
+		bundle.ServerEntries = append(bundle.ServerEntries, serverEntry)
+	}
+
+	// The remote server list is a zlib compressed authenticated data package
+	// containing newline delimited encoded server entries.
+
+	signingPublicKey, signingPrivateKey, err := psiphon.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	encodedServerEntries := make([]string, len(bundle.ServerEntries))
+	for i, serverEntry := range bundle.ServerEntries {
+		encodedServerEntries[i] = string(serverEntry)
+	}
+
+	dataPackage, err := psiphon.WriteAuthenticatedDataPackage(
+		strings.Join(encodedServerEntries, "\n"),
+		signingPublicKey,
+		signingPrivateKey)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	var compressedPackage bytes.Buffer
+	zlibWriter := zlib.NewWriter(&compressedPackage)
+	_, err = zlibWriter.Write(dataPackage)
+	if err == nil {
+		err = zlibWriter.Close()
+	}
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	bundle.RemoteServerListPackage = compressedPackage.Bytes()
+
+	// Client config. As with the server configs, identifiers are sample
+	// values.
+
+	clientConfig := map[string]interface{}{
+		"ClientVersion":                      "0",
+		"PropagationChannelId":               "0",
+		"SponsorId":                          "0",
+		"RemoteServerListSignaturePublicKey": signingPublicKey,
+	}
+
+	if params.RemoteServerListURL != "" {
+		clientConfig["RemoteServerListUrl"] = params.RemoteServerListURL
+	}
+
+	bundle.ClientConfig, err = json.MarshalIndent(clientConfig, "", "    ")
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	return bundle, nil
+}
@@ -0,0 +1,559 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+// TLSCertificates specifies the source of the TLS certificates presented
+// by a TLS listener. Certificates are either loaded from files or generated.
+// When both CertificateFiles and GenerateCommonNames are set, the files are
+// used and generation is ignored.
+type TLSCertificates struct {
+
+	// CertificateFiles is a list of PEM encoded certificate and private key
+	// file pairs. When more than one pair is specified, the certificate
+	// presented to a client is selected by matching the client's SNI
+	// server name against the names in each certificate. When there is no
+	// SNI match, the first certificate is presented.
+	CertificateFiles []TLSCertificateFiles
+
+	// ReloadPeriodSeconds specifies how frequently to check CertificateFiles
+	// for modifications. Modified files are reloaded and the new certificates
+	// are presented to subsequent clients. When reloading fails, the previous
+	// certificates remain in use. The default, 0, disables reloading.
+	ReloadPeriodSeconds int
+
+	// GenerateCommonNames is a list of host names for which to generate
+	// certificates. A certificate is generated for each name, using randomized
+	// but realistic parameters: key type, issuer, validity period, serial
+	// number and extensions vary between certificates. The certificate
+	// presented to a client is selected by SNI, as with CertificateFiles;
+	// when there is no SNI match, a randomly selected certificate is presented.
+	GenerateCommonNames []string
+
+	// GenerateRotationPeriodSeconds specifies how frequently to replace the
+	// generated certificates with newly generated certificates. Each rotation
+	// is scheduled at a random time between one half and the full period. The
+	// default, 0, disables rotation.
+	GenerateRotationPeriodSeconds int
+}
+
+// TLSCertificateFiles specifies a certificate and private key file pair.
+type TLSCertificateFiles struct {
+	CertificateFilename string
+	PrivateKeyFilename  string
+}
+
+// validate checks that the TLSCertificates specifies a certificate source.
+func (certificates *TLSCertificates) validate() error {
+
+	if len(certificates.CertificateFiles) == 0 && len(certificates.GenerateCommonNames) == 0 {
+		return errors.New("CertificateFiles or GenerateCommonNames required")
+	}
+
+	for _, files := range certificates.CertificateFiles {
+		if files.CertificateFilename == "" || files.PrivateKeyFilename == "" {
+			return errors.New("CertificateFilename and PrivateKeyFilename required")
+		}
+	}
+
+	if certificates.ReloadPeriodSeconds < 0 || certificates.GenerateRotationPeriodSeconds < 0 {
+		return errors.New("invalid period")
+	}
+
+	return nil
+}
+
+// tlsCertificateManager maintains the set of certificates presented by a
+// TLS listener. Its getCertificate function is used as the tls.Config
+// GetCertificate callback, so updated certificates take effect for new
+// TLS handshakes without restarting the listener.
+type tlsCertificateManager struct {
+	config        *TLSCertificates
+	stopBroadcast <-chan struct{}
+	mutex         sync.RWMutex
+	certificates  []*tls.Certificate
+	fileModTimes  []time.Time
+	randomDefault bool
+}
+
+// newTLSCertificateManager loads or generates the initial certificates and,
+// when reloading or rotation is configured, starts a goroutine which
+// updates the certificates until stopBroadcast is signaled.
+func newTLSCertificateManager(
+	config *TLSCertificates,
+	stopBroadcast <-chan struct{}) (*tlsCertificateManager, error) {
+
+	err := config.validate()
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	manager := &tlsCertificateManager{
+		config:        config,
+		stopBroadcast: stopBroadcast,
+	}
+
+	if len(config.CertificateFiles) > 0 {
+
+		_, err = manager.loadFiles()
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+
+		if config.ReloadPeriodSeconds > 0 {
+			go manager.reloadFiles(
+				time.Duration(config.ReloadPeriodSeconds) * time.Second)
+		}
+
+	} else {
+
+		manager.randomDefault = true
+
+		err = manager.generate()
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+
+		if config.GenerateRotationPeriodSeconds > 0 {
+			go manager.rotateGenerated(
+				time.Duration(config.GenerateRotationPeriodSeconds) * time.Second)
+		}
+	}
+
+	return manager, nil
+}
+
+// getCertificate implements the tls.Config GetCertificate callback.
+func (manager *tlsCertificateManager) getCertificate(
+	clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+
+	if len(manager.certificates) == 0 {
+		return nil, psiphon.ContextError(errors.New("no certificates"))
+	}
+
+	serverName := strings.ToLower(clientHello.ServerName)
+	if serverName != "" {
+		for _, certificate := range manager.certificates {
+			if certificateMatchesServerName(certificate, serverName) {
+				return certificate, nil
+			}
+		}
+	}
+
+	if manager.randomDefault && len(manager.certificates) > 1 {
+		index, err := psiphon.MakeSecureRandomInt(len(manager.certificates))
+		if err == nil {
+			return manager.certificates[index], nil
+		}
+	}
+
+	return manager.certificates[0], nil
+}
+
+// loadFiles loads all certificate files. The certificates are replaced
+// only when all files load successfully. loadFiles returns true when the
+// certificates were replaced.
+func (manager *tlsCertificateManager) loadFiles() (bool, error) {
+
+	modTimes := make([]time.Time, len(manager.config.CertificateFiles))
+	for i, files := range manager.config.CertificateFiles {
+		for _, filename := range []string{files.CertificateFilename, files.PrivateKeyFilename} {
+			fileInfo, err := os.Stat(filename)
+			if err != nil {
+				return false, psiphon.ContextError(err)
+			}
+			if fileInfo.ModTime().After(modTimes[i]) {
+				modTimes[i] = fileInfo.ModTime()
+			}
+		}
+	}
+
+	manager.mutex.RLock()
+	modified := len(manager.fileModTimes) != len(modTimes)
+	for i := 0; !modified && i < len(modTimes); i++ {
+		modified = !modTimes[i].Equal(manager.fileModTimes[i])
+	}
+	manager.mutex.RUnlock()
+
+	if !modified {
+		return false, nil
+	}
+
+	certificates := make([]*tls.Certificate, 0)
+	for _, files := range manager.config.CertificateFiles {
+
+		certificatePEM, err := ioutil.ReadFile(files.CertificateFilename)
+		if err != nil {
+			return false, psiphon.ContextError(err)
+		}
+
+		privateKeyPEM, err := ioutil.ReadFile(files.PrivateKeyFilename)
+		if err != nil {
+			return false, psiphon.ContextError(err)
+		}
+
+		certificate, err := makeTLSCertificate(certificatePEM, privateKeyPEM)
+		if err != nil {
+			return false, psiphon.ContextError(err)
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	manager.mutex.Lock()
+	manager.certificates = certificates
+	manager.fileModTimes = modTimes
+	manager.mutex.Unlock()
+
+	return true, nil
+}
+
+func (manager *tlsCertificateManager) reloadFiles(period time.Duration) {
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-manager.stopBroadcast:
+			return
+		}
+
+		reloaded, err := manager.loadFiles()
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning("reload certificates failed")
+		} else if reloaded {
+			log.WithContext().Info("reloaded certificates")
+		}
+	}
+}
+
+// generate replaces the certificates with a newly generated certificate
+// for each GenerateCommonNames name.
+func (manager *tlsCertificateManager) generate() error {
+
+	certificates := make([]*tls.Certificate, 0)
+	for _, commonName := range manager.config.GenerateCommonNames {
+
+		certificatePEM, privateKeyPEM, err := GenerateRandomizedCertificate(commonName)
+		if err != nil {
+			return psiphon.ContextError(err)
+		}
+
+		certificate, err := makeTLSCertificate(
+			[]byte(certificatePEM), []byte(privateKeyPEM))
+		if err != nil {
+			return psiphon.ContextError(err)
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	manager.mutex.Lock()
+	manager.certificates = certificates
+	manager.mutex.Unlock()
+
+	return nil
+}
+
+func (manager *tlsCertificateManager) rotateGenerated(period time.Duration) {
+
+	for {
+		timer := time.NewTimer(psiphon.MakeRandomPeriod(period/2, period))
+
+		select {
+		case <-timer.C:
+		case <-manager.stopBroadcast:
+			timer.Stop()
+			return
+		}
+
+		err := manager.generate()
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning("rotate certificates failed")
+		} else {
+			log.WithContext().Info("rotated certificates")
+		}
+	}
+}
+
+// makeTLSCertificate creates a tls.Certificate from PEM encoded data and
+// populates the parsed leaf certificate, which is used for SNI matching.
+func makeTLSCertificate(certificatePEM, privateKeyPEM []byte) (*tls.Certificate, error) {
+
+	certificate, err := tls.X509KeyPair(certificatePEM, privateKeyPEM)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	return &certificate, nil
+}
+
+// certificateMatchesServerName checks if the server name matches the
+// certificate's subject alternative names or, when there are no DNS names,
+// its common name. Wildcard names match a single label.
+func certificateMatchesServerName(certificate *tls.Certificate, serverName string) bool {
+
+	if certificate.Leaf == nil {
+		return false
+	}
+
+	names := certificate.Leaf.DNSNames
+	if len(names) == 0 {
+		names = []string{certificate.Leaf.Subject.CommonName}
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == serverName {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			index := strings.Index(serverName, ".")
+			if index > 0 && serverName[index:] == name[1:] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Sample values used to vary generated certificates. These are loosely
+// modeled on commonly seen commercial and automated CA certificates.
+var (
+	randomizedCertificateIssuerOrganizations = []string{
+		"DigiCert Inc",
+		"GlobalSign nv-sa",
+		"Let's Encrypt",
+		"Sectigo Limited",
+		"GoDaddy.com, Inc.",
+		"Entrust, Inc.",
+	}
+
+	randomizedCertificateIssuerCommonNames = []string{
+		"DigiCert SHA2 Secure Server CA",
+		"GlobalSign Organization Validation CA - SHA256 - G2",
+		"Let's Encrypt Authority X3",
+		"Sectigo RSA Domain Validation Secure Server CA",
+		"Go Daddy Secure Certificate Authority - G2",
+		"Entrust Certification Authority - L1K",
+	}
+
+	randomizedCertificateValidityDays = []int{90, 365, 397, 730}
+)
+
+// GenerateRandomizedCertificate creates a TLS certificate for the specified
+// host name (commonName). Unlike GenerateWebServerCertificate, the
+// certificate isn't self-signed: it's issued by an ephemeral CA key with a
+// randomly selected, realistic issuer name. The key type, validity period,
+// serial number length and subject alternative names are also varied, to
+// mitigate fingerprinting the certificates. The certificate is not expected
+// to validate against any system root store.
+func GenerateRandomizedCertificate(commonName string) (string, string, error) {
+
+	if commonName == "" {
+		return "", "", psiphon.ContextError(errors.New("missing common name"))
+	}
+
+	privateKey, privateKeyPEM, err := generateRandomizedKey()
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+
+	issuerKey, _, err := generateRandomizedKey()
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+
+	issuerIndex, err := psiphon.MakeSecureRandomInt(len(randomizedCertificateIssuerCommonNames))
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+
+	issuer := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			Country:      []string{"US"},
+			Organization: []string{randomizedCertificateIssuerOrganizations[issuerIndex]},
+			CommonName:   randomizedCertificateIssuerCommonNames[issuerIndex],
+		},
+	}
+
+	// Validity period starts some number of days back within the first
+	// half of the total validity period.
+
+	validityIndex, err := psiphon.MakeSecureRandomInt(len(randomizedCertificateValidityDays))
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+	validityDays := randomizedCertificateValidityDays[validityIndex]
+
+	age, err := psiphon.MakeSecureRandomInt(validityDays / 2)
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+	age += 1
+
+	notBefore := time.Now().Add(time.Duration(-age) * 24 * time.Hour).Truncate(time.Second).UTC()
+	notAfter := notBefore.Add(time.Duration(validityDays) * 24 * time.Hour).UTC()
+
+	serialNumberBits, err := psiphon.MakeSecureRandomInt(65)
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), uint(64+serialNumberBits))
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.(crypto.Signer).Public())
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+	subjectKeyID := sha1.Sum(publicKeyBytes)
+
+	issuerPublicKeyBytes, err := x509.MarshalPKIXPublicKey(issuerKey.(crypto.Signer).Public())
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+	authorityKeyID := sha1.Sum(issuerPublicKeyBytes)
+
+	dnsNames := []string{commonName}
+	if !strings.HasPrefix(commonName, "www.") && !strings.HasPrefix(commonName, "*.") && psiphon.FlipCoin() {
+		dnsNames = append(dnsNames, "www."+commonName)
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := privateKey.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              dnsNames,
+		SubjectKeyId:          subjectKeyID[:],
+		AuthorityKeyId:        authorityKeyID[:],
+	}
+
+	derCert, err := x509.CreateCertificate(
+		rand.Reader,
+		&template,
+		&issuer,
+		privateKey.(crypto.Signer).Public(),
+		issuerKey)
+	if err != nil {
+		return "", "", psiphon.ContextError(err)
+	}
+
+	certificatePEM := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: derCert,
+		},
+	)
+
+	return string(certificatePEM), string(privateKeyPEM), nil
+}
+
+// generateRandomizedKey generates either an RSA or an ECDSA private key
+// and returns the key and its PEM encoding.
+func generateRandomizedKey() (interface{}, []byte, error) {
+
+	if psiphon.FlipCoin() {
+
+		bits := 2048
+		if psiphon.FlipCoin() {
+			bits = 3072
+		}
+
+		rsaKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, psiphon.ContextError(err)
+		}
+
+		return rsaKey, pem.EncodeToMemory(
+			&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+			},
+		), nil
+	}
+
+	curve := elliptic.P256()
+	if psiphon.FlipCoin() {
+		curve = elliptic.P384()
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, psiphon.ContextError(err)
+	}
+
+	derKey, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		return nil, nil, psiphon.ContextError(err)
+	}
+
+	return ecdsaKey, pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: derKey,
+		},
+	), nil
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificateFiles(
+	t *testing.T, dir, name, commonName string) TLSCertificateFiles {
+
+	certificatePEM, privateKeyPEM, err := GenerateRandomizedCertificate(commonName)
+	if err != nil {
+		t.Fatalf("GenerateRandomizedCertificate failed: %s", err)
+	}
+
+	files := TLSCertificateFiles{
+		CertificateFilename: filepath.Join(dir, name+".crt"),
+		PrivateKeyFilename:  filepath.Join(dir, name+".key"),
+	}
+	err = ioutil.WriteFile(files.CertificateFilename, []byte(certificatePEM), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(files.PrivateKeyFilename, []byte(privateKeyPEM), 0600)
+	}
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	return files
+}
+
+func getTestCertificate(
+	t *testing.T, manager *tlsCertificateManager, serverName string) *tls.Certificate {
+
+	certificate, err := manager.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatalf("getCertificate failed: %s", err)
+	}
+	return certificate
+}
+
+func TestTLSCertificateFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "psiphon-certificates-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &TLSCertificates{
+		CertificateFiles: []TLSCertificateFiles{
+			writeTestCertificateFiles(t, dir, "a", "a.example.com"),
+			writeTestCertificateFiles(t, dir, "b", "*.b.example.org"),
+		},
+	}
+
+	stopBroadcast := make(chan struct{})
+	defer close(stopBroadcast)
+
+	manager, err := newTLSCertificateManager(config, stopBroadcast)
+	if err != nil {
+		t.Fatalf("newTLSCertificateManager failed: %s", err)
+	}
+
+	first := manager.certificates[0]
+	second := manager.certificates[1]
+
+	// SNI selection, with the first certificate as the default
+
+	testCases := []struct {
+		serverName  string
+		certificate *tls.Certificate
+	}{
+		{"a.example.com", first},
+		{"A.EXAMPLE.COM", first},
+		{"x.b.example.org", second},
+		{"y.x.b.example.org", first},
+		{"b.example.org", first},
+		{"unknown.example.net", first},
+		{"", first},
+	}
+
+	for _, testCase := range testCases {
+		if getTestCertificate(t, manager, testCase.serverName) != testCase.certificate {
+			t.Fatalf("unexpected certificate for server name: %s", testCase.serverName)
+		}
+	}
+
+	// Unmodified files aren't reloaded
+
+	reloaded, err := manager.loadFiles()
+	if err != nil || reloaded {
+		t.Fatalf("unexpected reload: %v, %v", reloaded, err)
+	}
+
+	// Modified files are reloaded
+
+	writeTestCertificateFiles(t, dir, "b", "*.b.example.org")
+	modTime := time.Now().Add(time.Minute)
+	os.Chtimes(config.CertificateFiles[1].CertificateFilename, modTime, modTime)
+
+	reloaded, err = manager.loadFiles()
+	if err != nil || !reloaded {
+		t.Fatalf("unexpected reload: %v, %v", reloaded, err)
+	}
+
+	certificate := getTestCertificate(t, manager, "x.b.example.org")
+	if certificate == second ||
+		certificateMatchesServerName(certificate, "a.example.com") {
+		t.Fatalf("unexpected reloaded certificate")
+	}
+
+	// A failed reload retains the previous certificates
+
+	ioutil.WriteFile(config.CertificateFiles[0].CertificateFilename, []byte("invalid"), 0600)
+	modTime = modTime.Add(time.Minute)
+	os.Chtimes(config.CertificateFiles[0].CertificateFilename, modTime, modTime)
+
+	_, err = manager.loadFiles()
+	if err == nil {
+		t.Fatalf("unexpected reload success")
+	}
+	if getTestCertificate(t, manager, "x.b.example.org") != certificate {
+		t.Fatalf("unexpected certificate after failed reload")
+	}
+}
+
+func TestTLSCertificateGeneration(t *testing.T) {
+
+	config := &TLSCertificates{
+		GenerateCommonNames: []string{"a.example.com", "b.example.org"},
+	}
+
+	stopBroadcast := make(chan struct{})
+	defer close(stopBroadcast)
+
+	manager, err := newTLSCertificateManager(config, stopBroadcast)
+	if err != nil {
+		t.Fatalf("newTLSCertificateManager failed: %s", err)
+	}
+
+	if len(manager.certificates) != 2 {
+		t.Fatalf("unexpected certificate count: %d", len(manager.certificates))
+	}
+
+	for _, serverName := range config.GenerateCommonNames {
+		certificate := getTestCertificate(t, manager, serverName)
+		if !certificateMatchesServerName(certificate, serverName) {
+			t.Fatalf("unexpected certificate for server name: %s", serverName)
+		}
+		if certificate.Leaf.IsCA ||
+			certificate.Leaf.Issuer.CommonName == certificate.Leaf.Subject.CommonName ||
+			!time.Now().After(certificate.Leaf.NotBefore) ||
+			!time.Now().Before(certificate.Leaf.NotAfter) {
+			t.Fatalf("unexpected generated certificate: %+v", certificate.Leaf)
+		}
+	}
+
+	// Rotation replaces the certificates
+
+	previous := getTestCertificate(t, manager, "a.example.com")
+
+	err = manager.generate()
+	if err != nil {
+		t.Fatalf("generate failed: %s", err)
+	}
+
+	certificate := getTestCertificate(t, manager, "a.example.com")
+	if certificate == previous ||
+		!certificateMatchesServerName(certificate, "a.example.com") {
+		t.Fatalf("unexpected rotated certificate")
+	}
+}
+
+func TestTLSCertificatesValidate(t *testing.T) {
+
+	testCases := []struct {
+		description  string
+		certificates TLSCertificates
+		isValid      bool
+	}{
+		{"no source", TLSCertificates{}, false},
+		{"missing filename", TLSCertificates{
+			CertificateFiles: []TLSCertificateFiles{{CertificateFilename: "a.crt"}}}, false},
+		{"negative period", TLSCertificates{
+			GenerateCommonNames: []string{"a.example.com"}, GenerateRotationPeriodSeconds: -1}, false},
+		{"files", TLSCertificates{
+			CertificateFiles: []TLSCertificateFiles{{"a.crt", "a.key"}}}, true},
+		{"generate", TLSCertificates{
+			GenerateCommonNames: []string{"a.example.com"}}, true},
+	}
+
+	for _, testCase := range testCases {
+		err := testCase.certificates.validate()
+		if (err == nil) != testCase.isValid {
+			t.Fatalf("unexpected validate result for %s: %v", testCase.description, err)
+		}
+	}
+
+	// The web server certificate is pinned by clients, so can't be generated
+
+	config := &Config{
+		ServerIPAddress: "127.0.0.1",
+		WebServerPort:   8000,
+		WebServerSecret: "secret",
+		WebServerTLSCertificates: &TLSCertificates{
+			GenerateCommonNames: []string{"a.example.com"},
+		},
+	}
+	if len(config.validate()) == 0 {
+		t.Fatalf("unexpected valid generated web server certificate")
+	}
+
+	config.WebServerTLSCertificates = &TLSCertificates{
+		CertificateFiles: []TLSCertificateFiles{{"a.crt", "a.key"}},
+	}
+	if errs := config.validate(); len(errs) != 0 {
+		t.Fatalf("unexpected invalid web server certificate files: %v", errs)
+	}
+}
@@ -0,0 +1,407 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+const (
+	TLS_RECORD_HEADER_LENGTH          = 5
+	TLS_RECORD_TYPE_HANDSHAKE         = 0x16
+	TLS_HANDSHAKE_TYPE_CLIENT_HELLO   = 0x01
+	TLS_MAX_CLIENT_HELLO_RECORD_BYTES = 16384
+	TLS_EXTENSION_SUPPORTED_GROUPS    = 10
+	TLS_EXTENSION_EC_POINT_FORMATS    = 11
+	TLS_CLIENT_HELLO_LOAD_STATS_MAX   = 20
+	TLS_CLIENT_HELLO_LOAD_STATS_OTHER = "Other"
+)
+
+// ClientHelloFingerprint is a JA3-style fingerprint of a TLS ClientHello.
+// JA3 is the string "SSLVersion,Ciphers,Extensions,EllipticCurves,
+// EllipticCurvePointFormats", where each list is a "-" delimited list of
+// decimal values, in the order sent by the client, omitting GREASE values.
+// Hash is the hex encoded MD5 digest of JA3.
+//
+// See: https://github.com/salesforce/ja3
+type ClientHelloFingerprint struct {
+	JA3  string
+	Hash string
+}
+
+// clientHelloListener wraps a net.Listener and records the raw TLS ClientHello
+// sent on each accepted conn, which is then fingerprinted. The conn bytes are
+// passed through unmodified, so the TLS handshake is not altered.
+//
+// Fingerprints are retrieved by remote address, which corresponds to the
+// http.Request.RemoteAddr for requests made on the conn. A fingerprint is
+// available once the TLS server has read the full ClientHello and remains
+// available until the conn is closed.
+type clientHelloListener struct {
+	net.Listener
+	fingerprintsMutex sync.Mutex
+	fingerprints      map[string]*ClientHelloFingerprint
+}
+
+func newClientHelloListener(listener net.Listener) *clientHelloListener {
+	return &clientHelloListener{
+		Listener:     listener,
+		fingerprints: make(map[string]*ClientHelloFingerprint),
+	}
+}
+
+// Accept accepts a new conn and wraps it in a clientHelloConn.
+func (listener *clientHelloListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// This is the same TCP keep alive configuration that HTTPSServer.ServeTLS
+	// applies to plain TCP listeners.
+	// The conn may be a redirectedConn wrapping a *net.TCPConn.
+	if keepAliveConn, ok := conn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	}); ok {
+		keepAliveConn.SetKeepAlive(true)
+		keepAliveConn.SetKeepAlivePeriod(3 * time.Minute)
+	}
+
+	return &clientHelloConn{
+		Conn:      conn,
+		listener:  listener,
+		recording: true,
+	}, nil
+}
+
+// getFingerprint returns the ClientHello fingerprint for the conn with the
+// specified remote address, or nil when no fingerprint is available.
+func (listener *clientHelloListener) getFingerprint(remoteAddr string) *ClientHelloFingerprint {
+	listener.fingerprintsMutex.Lock()
+	defer listener.fingerprintsMutex.Unlock()
+	return listener.fingerprints[remoteAddr]
+}
+
+func (listener *clientHelloListener) setFingerprint(
+	remoteAddr string, fingerprint *ClientHelloFingerprint) {
+
+	listener.fingerprintsMutex.Lock()
+	defer listener.fingerprintsMutex.Unlock()
+	listener.fingerprints[remoteAddr] = fingerprint
+}
+
+func (listener *clientHelloListener) removeFingerprint(remoteAddr string) {
+	listener.fingerprintsMutex.Lock()
+	defer listener.fingerprintsMutex.Unlock()
+	delete(listener.fingerprints, remoteAddr)
+}
+
+// clientHelloConn records bytes read from the underlying conn until a complete
+// ClientHello is parsed, or until parsing fails. After that, it's a pass
+// through conn.
+// Note: the TLS server makes no concurrent Read calls during the handshake,
+// so recording state isn't synchronized.
+type clientHelloConn struct {
+	net.Conn
+	listener  *clientHelloListener
+	recording bool
+	recorded  []byte
+	closeOnce sync.Once
+}
+
+func (conn *clientHelloConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+
+	if conn.recording && n > 0 {
+		conn.recorded = append(conn.recorded, buffer[:n]...)
+
+		clientHello, complete, parseErr := reassembleClientHello(conn.recorded)
+		if parseErr != nil {
+			conn.stopRecording()
+			log.WithContextFields(
+				LogFields{"error": parseErr}).Debug("ClientHello fingerprint failed")
+		} else if complete {
+			conn.stopRecording()
+			fingerprint, parseErr := fingerprintClientHello(clientHello)
+			if parseErr != nil {
+				log.WithContextFields(
+					LogFields{"error": parseErr}).Debug("ClientHello fingerprint failed")
+			} else {
+				conn.listener.setFingerprint(conn.RemoteAddr().String(), fingerprint)
+			}
+		}
+	}
+
+	return n, err
+}
+
+func (conn *clientHelloConn) stopRecording() {
+	conn.recording = false
+	conn.recorded = nil
+}
+
+func (conn *clientHelloConn) Close() error {
+	conn.closeOnce.Do(func() {
+		conn.listener.removeFingerprint(conn.RemoteAddr().String())
+	})
+	return conn.Conn.Close()
+}
+
+// reassembleClientHello extracts the ClientHello handshake message from the
+// TLS records in data. The ClientHello may span multiple handshake records.
+// When data doesn't yet contain the complete message, reassembleClientHello
+// returns complete false and the caller should retry with more data.
+func reassembleClientHello(data []byte) ([]byte, bool, error) {
+
+	var handshake []byte
+
+	for {
+		if len(data) < TLS_RECORD_HEADER_LENGTH {
+			return nil, false, nil
+		}
+
+		if data[0] != TLS_RECORD_TYPE_HANDSHAKE {
+			return nil, false, psiphon.ContextError(errors.New("unexpected record type"))
+		}
+
+		recordLength := int(binary.BigEndian.Uint16(data[3:5]))
+		if recordLength == 0 || recordLength > TLS_MAX_CLIENT_HELLO_RECORD_BYTES {
+			return nil, false, psiphon.ContextError(errors.New("invalid record length"))
+		}
+
+		if len(data) < TLS_RECORD_HEADER_LENGTH+recordLength {
+			return nil, false, nil
+		}
+
+		handshake = append(
+			handshake, data[TLS_RECORD_HEADER_LENGTH:TLS_RECORD_HEADER_LENGTH+recordLength]...)
+		data = data[TLS_RECORD_HEADER_LENGTH+recordLength:]
+
+		if len(handshake) >= 4 {
+
+			if handshake[0] != TLS_HANDSHAKE_TYPE_CLIENT_HELLO {
+				return nil, false, psiphon.ContextError(errors.New("unexpected handshake type"))
+			}
+
+			messageLength := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if messageLength > TLS_MAX_CLIENT_HELLO_RECORD_BYTES {
+				return nil, false, psiphon.ContextError(errors.New("invalid message length"))
+			}
+
+			if len(handshake) >= 4+messageLength {
+				return handshake[4 : 4+messageLength], true, nil
+			}
+		}
+	}
+}
+
+// fingerprintClientHello parses a ClientHello message body and computes
+// its fingerprint.
+func fingerprintClientHello(clientHello []byte) (*ClientHelloFingerprint, error) {
+
+	reader := &clientHelloReader{data: clientHello}
+
+	version := reader.readUint16()
+	reader.skip(32)                      // random
+	reader.skip(int(reader.readUint8())) // session_id
+
+	var cipherSuites []uint16
+	cipherSuitesReader := reader.readVector(int(reader.readUint16()))
+	for !cipherSuitesReader.empty() {
+		cipherSuites = append(cipherSuites, cipherSuitesReader.readUint16())
+	}
+	if cipherSuitesReader.err != nil {
+		return nil, psiphon.ContextError(cipherSuitesReader.err)
+	}
+
+	reader.skip(int(reader.readUint8())) // compression_methods
+
+	var extensions, curves, pointFormats []uint16
+
+	// Extensions are optional
+	if !reader.empty() {
+		extensionsReader := reader.readVector(int(reader.readUint16()))
+		for !extensionsReader.empty() {
+			extensionType := extensionsReader.readUint16()
+			extensionData := extensionsReader.readVector(int(extensionsReader.readUint16()))
+			extensions = append(extensions, extensionType)
+
+			switch extensionType {
+			case TLS_EXTENSION_SUPPORTED_GROUPS:
+				curvesReader := extensionData.readVector(int(extensionData.readUint16()))
+				for !curvesReader.empty() {
+					curves = append(curves, curvesReader.readUint16())
+				}
+			case TLS_EXTENSION_EC_POINT_FORMATS:
+				pointFormatsReader := extensionData.readVector(int(extensionData.readUint8()))
+				for !pointFormatsReader.empty() {
+					pointFormats = append(pointFormats, uint16(pointFormatsReader.readUint8()))
+				}
+			}
+
+			if extensionData.err != nil {
+				return nil, psiphon.ContextError(extensionData.err)
+			}
+		}
+		if extensionsReader.err != nil {
+			return nil, psiphon.ContextError(extensionsReader.err)
+		}
+	}
+
+	if reader.err != nil {
+		return nil, psiphon.ContextError(reader.err)
+	}
+
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s",
+		version,
+		joinJA3Values(cipherSuites),
+		joinJA3Values(extensions),
+		joinJA3Values(curves),
+		joinJA3Values(pointFormats))
+
+	hash := md5.Sum([]byte(ja3))
+
+	return &ClientHelloFingerprint{
+		JA3:  ja3,
+		Hash: hex.EncodeToString(hash[:]),
+	}, nil
+}
+
+// addClientHelloLoadStats adds "CurrentClients.TLSClientHello.<hash>" load
+// stats for the fingerprint hashes in counts. Since clients control their
+// fingerprints, only the TLS_CLIENT_HELLO_LOAD_STATS_MAX most frequent
+// hashes are reported individually; the remaining counts are combined
+// under "CurrentClients.TLSClientHello.Other".
+func addClientHelloLoadStats(loadStats map[string]int64, counts map[string]int64) {
+
+	hashes := make([]string, 0, len(counts))
+	for hash := range counts {
+		hashes = append(hashes, hash)
+	}
+	sort.Sort(&clientHelloCountSorter{hashes: hashes, counts: counts})
+
+	for i, hash := range hashes {
+		if i >= TLS_CLIENT_HELLO_LOAD_STATS_MAX {
+			hash = TLS_CLIENT_HELLO_LOAD_STATS_OTHER
+		}
+		loadStats["CurrentClients.TLSClientHello."+hash] += counts[hashes[i]]
+	}
+}
+
+// clientHelloCountSorter orders hashes by descending count, then by hash.
+type clientHelloCountSorter struct {
+	hashes []string
+	counts map[string]int64
+}
+
+func (sorter *clientHelloCountSorter) Len() int {
+	return len(sorter.hashes)
+}
+
+func (sorter *clientHelloCountSorter) Less(i, j int) bool {
+	countI, countJ := sorter.counts[sorter.hashes[i]], sorter.counts[sorter.hashes[j]]
+	if countI != countJ {
+		return countI > countJ
+	}
+	return sorter.hashes[i] < sorter.hashes[j]
+}
+
+func (sorter *clientHelloCountSorter) Swap(i, j int) {
+	sorter.hashes[i], sorter.hashes[j] = sorter.hashes[j], sorter.hashes[i]
+}
+
+// isGREASEValue checks for the reserved GREASE values defined in RFC 8701,
+// which clients send randomly and which are excluded from JA3.
+func isGREASEValue(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func joinJA3Values(values []uint16) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if !isGREASEValue(value) {
+			strs = append(strs, fmt.Sprintf("%d", value))
+		}
+	}
+	return strings.Join(strs, "-")
+}
+
+// clientHelloReader is a minimal TLS wire format reader. Once a read runs
+// past the end of the data, err is set and all subsequent reads return
+// zero values.
+type clientHelloReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *clientHelloReader) empty() bool {
+	return reader.err != nil || len(reader.data) == 0
+}
+
+func (reader *clientHelloReader) next(length int) []byte {
+	if reader.err != nil {
+		return nil
+	}
+	if length > len(reader.data) {
+		reader.err = errors.New("unexpected end of ClientHello")
+		reader.data = nil
+		return nil
+	}
+	value := reader.data[:length]
+	reader.data = reader.data[length:]
+	return value
+}
+
+func (reader *clientHelloReader) skip(length int) {
+	reader.next(length)
+}
+
+func (reader *clientHelloReader) readUint8() uint8 {
+	value := reader.next(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (reader *clientHelloReader) readUint16() uint16 {
+	value := reader.next(2)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(value)
+}
+
+func (reader *clientHelloReader) readVector(length int) *clientHelloReader {
+	value := reader.next(length)
+	return &clientHelloReader{data: value, err: reader.err}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// makeTestVector prefixes data with its big endian length, using
+// lengthBytes bytes.
+func makeTestVector(lengthBytes int, data []byte) []byte {
+	length := len(data)
+	prefix := make([]byte, lengthBytes)
+	for i := lengthBytes - 1; i >= 0; i-- {
+		prefix[i] = byte(length)
+		length >>= 8
+	}
+	return append(prefix, data...)
+}
+
+func makeTestUint16s(values ...uint16) []byte {
+	data := make([]byte, 0, 2*len(values))
+	for _, value := range values {
+		data = append(data, byte(value>>8), byte(value))
+	}
+	return data
+}
+
+// makeTestClientHello returns a ClientHello message body with GREASE
+// cipher suite, extension and group values, and the expected JA3.
+func makeTestClientHello() ([]byte, string) {
+
+	var extensions []byte
+	extensions = append(extensions, makeTestUint16s(0x1a1a)...)
+	extensions = append(extensions, makeTestVector(2, nil)...)
+	extensions = append(extensions, makeTestUint16s(0)...)
+	extensions = append(extensions, makeTestVector(2,
+		makeTestVector(2, append([]byte{0}, makeTestVector(2, []byte("example.com"))...)))...)
+	extensions = append(extensions, makeTestUint16s(TLS_EXTENSION_SUPPORTED_GROUPS)...)
+	extensions = append(extensions, makeTestVector(2,
+		makeTestVector(2, makeTestUint16s(0x2a2a, 29, 23)))...)
+	extensions = append(extensions, makeTestUint16s(TLS_EXTENSION_EC_POINT_FORMATS)...)
+	extensions = append(extensions, makeTestVector(2, makeTestVector(1, []byte{0}))...)
+
+	var clientHello []byte
+	clientHello = append(clientHello, makeTestUint16s(0x0303)...)
+	clientHello = append(clientHello, bytes.Repeat([]byte{1}, 32)...)
+	clientHello = append(clientHello, makeTestVector(1, bytes.Repeat([]byte{2}, 32))...)
+	clientHello = append(clientHello, makeTestVector(2, makeTestUint16s(0x0a0a, 4865, 49195))...)
+	clientHello = append(clientHello, makeTestVector(1, []byte{0})...)
+	clientHello = append(clientHello, makeTestVector(2, extensions)...)
+
+	return clientHello, "771,4865-49195,0-10-11,29-23,0"
+}
+
+// makeTestClientHelloRecords wraps the ClientHello message in handshake
+// records, splitting the handshake message at the specified offsets.
+func makeTestClientHelloRecords(clientHello []byte, splits ...int) []byte {
+
+	handshake := append(
+		[]byte{TLS_HANDSHAKE_TYPE_CLIENT_HELLO}, makeTestVector(3, clientHello)...)
+
+	var records []byte
+	offset := 0
+	for _, split := range append(splits, len(handshake)) {
+		records = append(records, TLS_RECORD_TYPE_HANDSHAKE, 0x03, 0x01)
+		records = append(records, makeTestVector(2, handshake[offset:split])...)
+		offset = split
+	}
+	return records
+}
+
+func TestReassembleClientHello(t *testing.T) {
+
+	clientHello, _ := makeTestClientHello()
+	records := makeTestClientHelloRecords(clientHello)
+	fragmentedRecords := makeTestClientHelloRecords(clientHello, 2, 40)
+
+	oversizeMessage := makeTestClientHelloRecords(clientHello)
+	oversizeMessage[6] = 0x01
+
+	testCases := []struct {
+		description string
+		data        []byte
+		isComplete  bool
+		isError     bool
+	}{
+		{"empty", nil, false, false},
+		{"truncated record header", records[:3], false, false},
+		{"truncated record", records[:len(records)-1], false, false},
+		{"complete", records, true, false},
+		{"trailing data", append(append([]byte(nil), records...), 0x17, 0x03), true, false},
+		{"fragmented handshake header", fragmentedRecords[:5+2], false, false},
+		{"fragmented first record", fragmentedRecords[:5+2+5+38], false, false},
+		{"fragmented", fragmentedRecords, true, false},
+		{"unexpected record type", []byte{0x17, 0x03, 0x01, 0x00, 0x01, 0x01}, false, true},
+		{"zero length record", []byte{0x16, 0x03, 0x01, 0x00, 0x00}, false, true},
+		{"oversize record", []byte{0x16, 0x03, 0x01, 0x40, 0x01}, false, true},
+		{"unexpected handshake type", []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00}, false, true},
+		{"oversize message", oversizeMessage, false, true},
+	}
+
+	for _, testCase := range testCases {
+		message, complete, err := reassembleClientHello(testCase.data)
+		if (err != nil) != testCase.isError || complete != testCase.isComplete {
+			t.Fatalf("unexpected result for %s: %v, %v", testCase.description, complete, err)
+		}
+		if complete && !bytes.Equal(message, clientHello) {
+			t.Fatalf("unexpected message for %s", testCase.description)
+		}
+	}
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+
+	clientHello, expectedJA3 := makeTestClientHello()
+
+	fingerprint, err := fingerprintClientHello(clientHello)
+	if err != nil {
+		t.Fatalf("fingerprintClientHello failed: %s", err)
+	}
+	if fingerprint.JA3 != expectedJA3 || len(fingerprint.Hash) != 32 {
+		t.Fatalf("unexpected fingerprint: %+v", fingerprint)
+	}
+
+	// Extensions are optional, so a ClientHello ending after the compression
+	// methods is valid; any other truncation is an error.
+
+	compressionMethodsEnd := 2 + 32 + 33 + 8 + 2
+
+	for length := 0; length < len(clientHello); length++ {
+		fingerprint, err := fingerprintClientHello(clientHello[:length])
+		if length == compressionMethodsEnd {
+			if err != nil || fingerprint.JA3 != "771,4865-49195,,," {
+				t.Fatalf("unexpected fingerprint without extensions: %+v, %v", fingerprint, err)
+			}
+		} else if err == nil {
+			t.Fatalf("unexpected success for truncated length %d", length)
+		}
+	}
+
+	// Oversize vector lengths
+
+	oversizeCipherSuites := append([]byte(nil), clientHello...)
+	oversizeCipherSuites[2+32+33] = 0xff
+
+	oversizeExtension := append([]byte(nil), clientHello...)
+	oversizeExtension[compressionMethodsEnd+2+2] = 0xff
+
+	oversizeGroups := append([]byte(nil), clientHello...)
+	groupsOffset := bytes.Index(oversizeGroups, makeTestUint16s(0x2a2a, 29, 23))
+	oversizeGroups[groupsOffset-2] = 0xff
+
+	for _, data := range [][]byte{oversizeCipherSuites, oversizeExtension, oversizeGroups} {
+		_, err := fingerprintClientHello(data)
+		if err == nil {
+			t.Fatalf("unexpected success for oversize length")
+		}
+	}
+}
+
+func TestGREASEValues(t *testing.T) {
+
+	for i := 0; i < 16; i++ {
+		value := uint16(i<<12 | 0x0a00 | i<<4 | 0x0a)
+		if !isGREASEValue(value) {
+			t.Fatalf("unexpected non-GREASE value: 0x%04x", value)
+		}
+	}
+
+	for _, value := range []uint16{0x0000, 0x0a0b, 0x1a2a, 0x0a1a, 0xabab, 0x1301} {
+		if isGREASEValue(value) {
+			t.Fatalf("unexpected GREASE value: 0x%04x", value)
+		}
+	}
+
+	if joinJA3Values([]uint16{0x0a0a, 1, 0xfafa, 2}) != "1-2" {
+		t.Fatalf("unexpected JA3 values")
+	}
+}
+
+func TestClientHelloListener(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	clientHellos := newClientHelloListener(listener)
+	defer clientHellos.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{InsecureSkipVerify: true, ServerName: "example.com"})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := clientHellos.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	// Read the ClientHello, which may span several reads
+
+	remoteAddr := conn.RemoteAddr().String()
+	buffer := make([]byte, 64)
+	for clientHellos.getFingerprint(remoteAddr) == nil {
+		_, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+	}
+
+	fingerprint := clientHellos.getFingerprint(remoteAddr)
+	if !strings.HasPrefix(fingerprint.JA3, fmt.Sprintf("%d,", tls.VersionTLS12)) {
+		t.Fatalf("unexpected fingerprint: %+v", fingerprint)
+	}
+
+	conn.Close()
+	if clientHellos.getFingerprint(remoteAddr) != nil {
+		t.Fatalf("unexpected fingerprint after close")
+	}
+}
+
+func TestClientHelloLoadStats(t *testing.T) {
+
+	counts := make(map[string]int64)
+	for i := 0; i < TLS_CLIENT_HELLO_LOAD_STATS_MAX+10; i++ {
+		counts[fmt.Sprintf("hash%02d", i)] = int64(100 - i)
+	}
+
+	loadStats := make(map[string]int64)
+	addClientHelloLoadStats(loadStats, counts)
+
+	if len(loadStats) != TLS_CLIENT_HELLO_LOAD_STATS_MAX+1 {
+		t.Fatalf("unexpected load stats count: %d", len(loadStats))
+	}
+	if loadStats["CurrentClients.TLSClientHello.hash00"] != 100 {
+		t.Fatalf("unexpected most frequent count")
+	}
+	if _, ok := loadStats[fmt.Sprintf(
+		"CurrentClients.TLSClientHello.hash%02d", TLS_CLIENT_HELLO_LOAD_STATS_MAX)]; ok {
+		t.Fatalf("unexpected load stat for infrequent hash")
+	}
+
+	var otherCount int64
+	for i := TLS_CLIENT_HELLO_LOAD_STATS_MAX; i < len(counts); i++ {
+		otherCount += int64(100 - i)
+	}
+	if loadStats["CurrentClients.TLSClientHello."+TLS_CLIENT_HELLO_LOAD_STATS_OTHER] != otherCount {
+		t.Fatalf("unexpected other count")
+	}
+}
@@ -22,6 +22,7 @@ package server
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -29,6 +30,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -57,6 +61,8 @@ const (
 	REDIS_POOL_MAX_IDLE                   = 50
 	REDIS_POOL_MAX_ACTIVE                 = 1000
 	REDIS_POOL_IDLE_TIMEOUT               = 5 * time.Minute
+	REDACTED_CONFIG_VALUE                 = "[REDACTED]"
+	MAX_LISTEN_PORT_RANGE                 = 1024
 )
 
 // TODO: break config into sections (sub-structs)
@@ -124,6 +130,14 @@ type Config struct {
 	// authenticate itself to clients.
 	WebServerPrivateKey string
 
+	// WebServerTLSCertificates is an optional source of certificates
+	// for the web server. When set, it's used instead of
+	// WebServerCertificate and WebServerPrivateKey. Since clients
+	// authenticate the web server using the certificate in the server
+	// entry, certificate changes must be coordinated with server entry
+	// updates. For the same reason, GenerateCommonNames is not permitted.
+	WebServerTLSCertificates *TLSCertificates
+
 	// TunnelProtocolPorts specifies which tunnel protocols to run
 	// and which ports to listen on for each protocol. Valid tunnel
 	// protocols include: "SSH", "OSSH", "UNFRONTED-MEEK-OSSH",
@@ -131,6 +145,24 @@ type Config struct {
 	// "FRONTED-MEEK-HTTP-OSSH".
 	TunnelProtocolPorts map[string]int
 
+	// TunnelProtocolListenAddresses specifies additional addresses to
+	// listen on for each tunnel protocol, which is run even when not
+	// in TunnelProtocolPorts. Each address has the form "host:port" or
+	// "host:firstPort-lastPort", where a port range listens on every
+	// port in the range. The host is an IPv4 address, an IPv6 address
+	// in brackets, or blank to listen on all interfaces; for example,
+	// "0.0.0.0:443", "[2001:db8::1]:8443" and ":4000-4010".
+	// TunnelProtocolPorts listen on ServerIPAddress.
+	TunnelProtocolListenAddresses map[string][]string
+
+	// AcceptRedirectedConnections indicates that connections may be
+	// redirected to tunnel protocol listeners by iptables REDIRECT or
+	// DNAT rules. When set, the original destination of each accepted
+	// connection is recovered and logged as the client's destination
+	// port. This allows a listener to serve many ports, which may be
+	// changed without restarting the server. Only supported on Linux.
+	AcceptRedirectedConnections bool
+
 	// SSHPrivateKey is the SSH host key. The same key is used for
 	// all protocols, run by this server instance, which use SSH.
 	SSHPrivateKey string
@@ -171,6 +203,12 @@ type Config struct {
 	// protocols.
 	MeekCertificateCommonName string
 
+	// MeekTLSCertificates is an optional source of certificates for
+	// meek HTTPS modes. When set, it's used instead of the self-signed
+	// certificate generated for MeekCertificateCommonName. The same
+	// certificates are used for all HTTPS meek protocols.
+	MeekTLSCertificates *TLSCertificates
+
 	// MeekProhibitedHeaders is a list of HTTP headers to check for
 	// in client requests. If one of these headers is found, the
 	// request fails. This is used to defend against abuse.
@@ -354,6 +392,53 @@ func (rules *TrafficRules) GetRateLimits(clientTunnelProtocol string) RateLimits
 // in a secondary file that can be paved over on all server hosts.
 func LoadConfig(configJSONs [][]byte) (*Config, error) {
 
+	config, err := mergeConfigs(configJSONs)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	errs := config.validate()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	return config, nil
+}
+
+// ValidateConfig loads and merges JSON encoded server configs, as LoadConfig
+// does, and reports all problems found instead of stopping at the first. In
+// addition to the LoadConfig checks, ValidateConfig reports config fields
+// which are unknown, which LoadConfig silently ignores, and performs stricter
+// checks -- malformed keys, invalid tunnel protocols and port conflicts --
+// which LoadConfig doesn't apply. The merged config is returned when all
+// configs are well-formed JSON, even if there are problems.
+func ValidateConfig(configJSONs [][]byte) (*Config, []error) {
+
+	var errs []error
+
+	for i, configJSON := range configJSONs {
+		unknownFields, err := findUnknownConfigFields(configJSON)
+		if err != nil {
+			return nil, []error{fmt.Errorf("config %d: %s", i+1, err)}
+		}
+		for _, field := range unknownFields {
+			errs = append(errs, fmt.Errorf("config %d: unknown field %s", i+1, field))
+		}
+	}
+
+	config, err := mergeConfigs(configJSONs)
+	if err != nil {
+		return nil, append(errs, err)
+	}
+
+	errs = append(errs, config.validate()...)
+	errs = append(errs, config.validateStrict()...)
+
+	return config, errs
+}
+
+func mergeConfigs(configJSONs [][]byte) (*Config, error) {
+
 	// Note: default values are set in GenerateConfig
 	var config Config
 
@@ -364,55 +449,91 @@ func LoadConfig(configJSONs [][]byte) (*Config, error) {
 		}
 	}
 
+	return &config, nil
+}
+
+// validate checks the config for missing, malformed, and conflicting
+// values and returns all problems found.
+func (config *Config) validate() []error {
+
+	var errs []error
+
 	if config.Fail2BanFormat != "" && strings.Count(config.Fail2BanFormat, "%s") != 1 {
-		return nil, errors.New("Fail2BanFormat must have one '%%s' placeholder")
+		errs = append(errs, errors.New("Fail2BanFormat must have one '%%s' placeholder"))
 	}
 
 	if config.ServerIPAddress == "" {
-		return nil, errors.New("ServerIPAddress is missing from config file")
+		errs = append(errs, errors.New("ServerIPAddress is missing from config file"))
 	}
 
-	if config.WebServerPort > 0 && (config.WebServerSecret == "" || config.WebServerCertificate == "" ||
-		config.WebServerPrivateKey == "") {
+	if config.WebServerPort > 0 && (config.WebServerSecret == "" ||
+		(config.WebServerTLSCertificates == nil &&
+			(config.WebServerCertificate == "" || config.WebServerPrivateKey == ""))) {
 
-		return nil, errors.New(
-			"Web server requires WebServerSecret, WebServerCertificate, WebServerPrivateKey")
+		errs = append(errs, errors.New(
+			"Web server requires WebServerSecret, WebServerCertificate, WebServerPrivateKey"))
 	}
 
-	for tunnelProtocol, _ := range config.TunnelProtocolPorts {
+	if config.WebServerTLSCertificates != nil {
+		if err := config.WebServerTLSCertificates.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("WebServerTLSCertificates is invalid: %s", err))
+		}
+		// Clients pin the web server certificate in the server entry, so
+		// a generated certificate would fail client authentication.
+		if len(config.WebServerTLSCertificates.GenerateCommonNames) > 0 {
+			errs = append(errs, errors.New("WebServerTLSCertificates must not use GenerateCommonNames"))
+		}
+	}
+
+	if config.MeekTLSCertificates != nil {
+		if err := config.MeekTLSCertificates.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("MeekTLSCertificates is invalid: %s", err))
+		}
+	}
+
+	for _, tunnelProtocol := range config.GetTunnelProtocols() {
 		if psiphon.TunnelProtocolUsesSSH(tunnelProtocol) ||
 			psiphon.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
 			if config.SSHPrivateKey == "" || config.SSHServerVersion == "" ||
 				config.SSHUserName == "" || config.SSHPassword == "" {
-				return nil, fmt.Errorf(
+				errs = append(errs, fmt.Errorf(
 					"Tunnel protocol %s requires SSHPrivateKey, SSHServerVersion, SSHUserName, SSHPassword",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 		if psiphon.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
 			if config.ObfuscatedSSHKey == "" {
-				return nil, fmt.Errorf(
+				errs = append(errs, fmt.Errorf(
 					"Tunnel protocol %s requires ObfuscatedSSHKey",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 		if psiphon.TunnelProtocolUsesMeekHTTP(tunnelProtocol) ||
 			psiphon.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
 			if config.MeekCookieEncryptionPrivateKey == "" || config.MeekObfuscatedKey == "" {
-				return nil, fmt.Errorf(
+				errs = append(errs, fmt.Errorf(
 					"Tunnel protocol %s requires MeekCookieEncryptionPrivateKey, MeekObfuscatedKey",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 		if psiphon.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
-			if config.MeekCertificateCommonName == "" {
-				return nil, fmt.Errorf(
+			if config.MeekCertificateCommonName == "" && config.MeekTLSCertificates == nil {
+				errs = append(errs, fmt.Errorf(
 					"Tunnel protocol %s requires MeekCertificateCommonName",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 	}
 
+	_, err := config.GetTunnelProtocolListenAddresses()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.AcceptRedirectedConnections && runtime.GOOS != "linux" {
+		errs = append(errs, errors.New("AcceptRedirectedConnections is only supported on Linux"))
+	}
+
 	validateNetworkAddress := func(address string) error {
 		host, port, err := net.SplitHostPort(address)
 		if err == nil && net.ParseIP(host) == nil {
@@ -426,17 +547,313 @@ func LoadConfig(configJSONs [][]byte) (*Config, error) {
 
 	if config.UDPForwardDNSServerAddress != "" {
 		if err := validateNetworkAddress(config.UDPForwardDNSServerAddress); err != nil {
-			return nil, fmt.Errorf("UDPForwardDNSServerAddress is invalid: %s", err)
+			errs = append(errs, fmt.Errorf("UDPForwardDNSServerAddress is invalid: %s", err))
 		}
 	}
 
 	if config.UDPInterceptUdpgwServerAddress != "" {
 		if err := validateNetworkAddress(config.UDPInterceptUdpgwServerAddress); err != nil {
-			return nil, fmt.Errorf("UDPInterceptUdpgwServerAddress is invalid: %s", err)
+			errs = append(errs, fmt.Errorf("UDPInterceptUdpgwServerAddress is invalid: %s", err))
 		}
 	}
 
-	return &config, nil
+	return errs
+}
+
+// validateStrict performs checks, in addition to validate, which LoadConfig
+// doesn't apply, so that existing configs which run continue to load. These
+// checks are reported by ValidateConfig.
+func (config *Config) validateStrict() []error {
+
+	var errs []error
+
+	if config.WebServerCertificate != "" || config.WebServerPrivateKey != "" {
+		_, err := tls.X509KeyPair(
+			[]byte(config.WebServerCertificate), []byte(config.WebServerPrivateKey))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("WebServerCertificate or WebServerPrivateKey is invalid: %s", err))
+		}
+	}
+
+	for _, tunnelProtocol := range config.GetTunnelProtocols() {
+		if !psiphon.Contains(psiphon.SupportedTunnelProtocols, tunnelProtocol) {
+			errs = append(errs, fmt.Errorf("Tunnel protocol %s is invalid", tunnelProtocol))
+		}
+	}
+
+	// Check for invalid ports and for ports used by more than one listener.
+	// Listeners conflict when they use the same port and either the same
+	// host or when one host is all interfaces.
+
+	type listenAddress struct {
+		host string
+		user string
+	}
+
+	portListeners := make(map[int][]listenAddress)
+	if config.WebServerPort > 0 {
+		portListeners[config.WebServerPort] = append(
+			portListeners[config.WebServerPort],
+			listenAddress{config.ServerIPAddress, "WebServerPort"})
+	}
+
+	// Invalid listen addresses are reported by validate.
+	tunnelProtocolListenAddresses, _ := config.GetTunnelProtocolListenAddresses()
+	for tunnelProtocol, addresses := range tunnelProtocolListenAddresses {
+		for _, address := range addresses {
+			host, portStr, _ := net.SplitHostPort(address)
+			port, _ := strconv.Atoi(portStr)
+			portListeners[port] = append(
+				portListeners[port], listenAddress{host, tunnelProtocol})
+		}
+	}
+
+	isAllInterfaces := func(host string) bool {
+		return host == "" || net.ParseIP(host).IsUnspecified()
+	}
+
+	var ports []int
+	for port, _ := range portListeners {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+
+	for _, port := range ports {
+		listeners := portListeners[port]
+		if port < 1 || port > MAX_PORT {
+			errs = append(errs, fmt.Errorf("Port %d for %s is invalid", port, listeners[0].user))
+		}
+		var users []string
+		for i := 0; i < len(listeners); i++ {
+			for j := i + 1; j < len(listeners); j++ {
+				if listeners[i].host == listeners[j].host ||
+					isAllInterfaces(listeners[i].host) ||
+					isAllInterfaces(listeners[j].host) {
+					if !psiphon.Contains(users, listeners[i].user) {
+						users = append(users, listeners[i].user)
+					}
+					if !psiphon.Contains(users, listeners[j].user) {
+						users = append(users, listeners[j].user)
+					}
+				}
+			}
+		}
+		if len(users) > 0 {
+			sort.Strings(users)
+			errs = append(errs, fmt.Errorf("Port %d is used by %s", port, strings.Join(users, ", ")))
+		}
+	}
+
+	// Check that keys, when present, are well-formed.
+
+	if config.SSHPrivateKey != "" {
+		if _, err := ssh.ParseRawPrivateKey([]byte(config.SSHPrivateKey)); err != nil {
+			errs = append(errs, fmt.Errorf("SSHPrivateKey is invalid: %s", err))
+		}
+	}
+
+	if config.MeekCookieEncryptionPrivateKey != "" {
+		privateKey, err := base64.StdEncoding.DecodeString(config.MeekCookieEncryptionPrivateKey)
+		if err == nil && len(privateKey) != 32 {
+			err = errors.New("unexpected key length")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MeekCookieEncryptionPrivateKey is invalid: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// GetTunnelProtocols returns the tunnel protocols to run, which are those
+// in either TunnelProtocolPorts or TunnelProtocolListenAddresses.
+func (config *Config) GetTunnelProtocols() []string {
+	var tunnelProtocols []string
+	for tunnelProtocol, _ := range config.TunnelProtocolPorts {
+		tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+	}
+	for tunnelProtocol, _ := range config.TunnelProtocolListenAddresses {
+		if !psiphon.Contains(tunnelProtocols, tunnelProtocol) {
+			tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+		}
+	}
+	sort.Strings(tunnelProtocols)
+	return tunnelProtocols
+}
+
+// GetTunnelProtocolListenAddresses returns, for each tunnel protocol to
+// run, the list of "host:port" network addresses to listen on. This list
+// combines TunnelProtocolPorts and TunnelProtocolListenAddresses, with
+// port ranges expanded and duplicate addresses removed.
+func (config *Config) GetTunnelProtocolListenAddresses() (map[string][]string, error) {
+
+	listenAddresses := make(map[string][]string)
+
+	addAddress := func(tunnelProtocol, host string, port int) {
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		if !psiphon.Contains(listenAddresses[tunnelProtocol], address) {
+			listenAddresses[tunnelProtocol] = append(listenAddresses[tunnelProtocol], address)
+		}
+	}
+
+	for tunnelProtocol, port := range config.TunnelProtocolPorts {
+		addAddress(tunnelProtocol, config.ServerIPAddress, port)
+	}
+
+	for tunnelProtocol, addresses := range config.TunnelProtocolListenAddresses {
+		for _, address := range addresses {
+			host, firstPort, lastPort, err := parseListenAddress(address)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"Tunnel protocol %s listen address %s is invalid: %s",
+					tunnelProtocol, address, err)
+			}
+			for port := firstPort; port <= lastPort; port++ {
+				addAddress(tunnelProtocol, host, port)
+			}
+		}
+	}
+
+	for _, addresses := range listenAddresses {
+		sort.Strings(addresses)
+	}
+
+	return listenAddresses, nil
+}
+
+// parseListenAddress parses a TunnelProtocolListenAddresses address.
+func parseListenAddress(address string) (string, int, int, error) {
+
+	host, ports, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, 0, psiphon.ContextError(err)
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		return "", 0, 0, psiphon.ContextError(errors.New("Host must be an IP address"))
+	}
+
+	portRange := strings.SplitN(ports, "-", 2)
+	firstPort, err := strconv.Atoi(portRange[0])
+	if err != nil {
+		return "", 0, 0, psiphon.ContextError(err)
+	}
+	lastPort := firstPort
+	if len(portRange) == 2 {
+		lastPort, err = strconv.Atoi(portRange[1])
+		if err != nil {
+			return "", 0, 0, psiphon.ContextError(err)
+		}
+	}
+
+	if firstPort < 1 || lastPort > MAX_PORT || lastPort < firstPort {
+		return "", 0, 0, psiphon.ContextError(errors.New("invalid port range"))
+	}
+
+	if lastPort-firstPort >= MAX_LISTEN_PORT_RANGE {
+		return "", 0, 0, psiphon.ContextError(errors.New("port range too large"))
+	}
+
+	return host, firstPort, lastPort, nil
+}
+
+// findUnknownConfigFields returns the names of all fields in the JSON config
+// which don't correspond to Config fields, including fields within nested
+// values such as TrafficRules. As with json.Unmarshal, field names are
+// matched case-insensitively.
+func findUnknownConfigFields(configJSON []byte) ([]string, error) {
+
+	var value interface{}
+	err := json.Unmarshal(configJSON, &value)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	var unknownFields []string
+	findUnknownFields(reflect.TypeOf(Config{}), value, "", &unknownFields)
+	sort.Strings(unknownFields)
+
+	return unknownFields, nil
+}
+
+func findUnknownFields(
+	valueType reflect.Type, value interface{}, path string, unknownFields *[]string) {
+
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+
+	switch valueType.Kind() {
+
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for name, fieldValue := range object {
+			field, ok := valueType.FieldByNameFunc(
+				func(fieldName string) bool { return strings.EqualFold(fieldName, name) })
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			if !ok {
+				*unknownFields = append(*unknownFields, fieldPath)
+				continue
+			}
+			findUnknownFields(field.Type, fieldValue, fieldPath, unknownFields)
+		}
+
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, elementValue := range object {
+			findUnknownFields(
+				valueType.Elem(), elementValue, fmt.Sprintf("%s[%q]", path, key), unknownFields)
+		}
+
+	case reflect.Slice:
+		array, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+		for i, elementValue := range array {
+			findUnknownFields(
+				valueType.Elem(), elementValue, fmt.Sprintf("%s[%d]", path, i), unknownFields)
+		}
+	}
+}
+
+// RedactedJSON returns the JSON encoding of the config with secret values,
+// such as private keys and passwords, replaced with a placeholder. This is
+// intended for displaying effective configurations.
+func (config *Config) RedactedJSON() ([]byte, error) {
+
+	redacted := *config
+
+	for _, secret := range []*string{
+		&redacted.DiscoveryValueHMACKey,
+		&redacted.WebServerSecret,
+		&redacted.WebServerPrivateKey,
+		&redacted.SSHPrivateKey,
+		&redacted.SSHPassword,
+		&redacted.ObfuscatedSSHKey,
+		&redacted.MeekCookieEncryptionPrivateKey,
+		&redacted.MeekObfuscatedKey,
+	} {
+		if *secret != "" {
+			*secret = REDACTED_CONFIG_VALUE
+		}
+	}
+
+	encodedConfig, err := json.MarshalIndent(&redacted, "", "    ")
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	return encodedConfig, nil
 }
 
 // GenerateConfig creates a new Psiphon server config. It returns a JSON
@@ -0,0 +1,364 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func generateTestConfig(t *testing.T) []byte {
+	configJSON, _, err := GenerateConfig(
+		"127.0.0.1",
+		8000,
+		map[string]int{"OSSH": 4000, "UNFRONTED-MEEK-OSSH": 4001})
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %s", err)
+	}
+	return configJSON
+}
+
+// modifyTestConfig returns a copy of the JSON config with the specified
+// top level fields replaced.
+func modifyTestConfig(t *testing.T, configJSON []byte, fields map[string]interface{}) []byte {
+	var config map[string]interface{}
+	err := json.Unmarshal(configJSON, &config)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	for name, value := range fields {
+		config[name] = value
+	}
+	configJSON, err = json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	return configJSON
+}
+
+func TestValidateConfig(t *testing.T) {
+
+	configJSON := generateTestConfig(t)
+
+	_, errs := ValidateConfig([][]byte{configJSON})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected invalid generated config: %v", errs)
+	}
+
+	// ValidateConfig reports all problems, including those which LoadConfig
+	// doesn't check, while LoadConfig continues to load the config.
+
+	testCases := []struct {
+		description  string
+		fields       map[string]interface{}
+		errorCount   int
+		isLoadable   bool
+		errorMessage string
+	}{
+		{
+			"missing server IP address",
+			map[string]interface{}{"ServerIPAddress": ""},
+			1, false, "ServerIPAddress",
+		},
+		{
+			"invalid Fail2BanFormat and missing keys",
+			map[string]interface{}{"Fail2BanFormat": "%s %s", "ObfuscatedSSHKey": ""},
+			3, false, "Fail2BanFormat",
+		},
+		{
+			"malformed SSH private key",
+			map[string]interface{}{"SSHPrivateKey": "invalid"},
+			1, true, "SSHPrivateKey",
+		},
+		{
+			"malformed meek cookie encryption key",
+			map[string]interface{}{"MeekCookieEncryptionPrivateKey": "AAAA"},
+			1, true, "MeekCookieEncryptionPrivateKey",
+		},
+		{
+			"invalid tunnel protocol",
+			map[string]interface{}{"TunnelProtocolPorts": map[string]int{"OSSH": 4000, "INVALID": 4001}},
+			1, true, "INVALID",
+		},
+		{
+			"port conflict",
+			map[string]interface{}{"TunnelProtocolPorts": map[string]int{"OSSH": 8000}},
+			1, true, "Port 8000 is used by OSSH, WebServerPort",
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		modifiedConfigJSON := modifyTestConfig(t, configJSON, testCase.fields)
+
+		_, errs := ValidateConfig([][]byte{modifiedConfigJSON})
+		if len(errs) != testCase.errorCount ||
+			!strings.Contains(errs[0].Error(), testCase.errorMessage) {
+			t.Fatalf("unexpected errors for %s: %v", testCase.description, errs)
+		}
+
+		_, err := LoadConfig([][]byte{modifiedConfigJSON})
+		if (err == nil) != testCase.isLoadable {
+			t.Fatalf("unexpected LoadConfig result for %s: %v", testCase.description, err)
+		}
+	}
+
+	// Configs are merged before validation, and unknown fields are reported
+	// for each config.
+
+	_, errs = ValidateConfig([][]byte{
+		modifyTestConfig(t, configJSON, map[string]interface{}{"ServerIPAddress": ""}),
+		[]byte(`{"ServerIPAddress" : "127.0.0.1", "UnknownField" : 1}`),
+	})
+	if len(errs) != 1 || errs[0].Error() != "config 2: unknown field UnknownField" {
+		t.Fatalf("unexpected merged config errors: %v", errs)
+	}
+
+	_, errs = ValidateConfig([][]byte{[]byte(`{`)})
+	if len(errs) != 1 {
+		t.Fatalf("unexpected malformed config errors: %v", errs)
+	}
+}
+
+func TestFindUnknownConfigFields(t *testing.T) {
+
+	configJSON := []byte(`
+    {
+        "serveripaddress" : "127.0.0.1",
+        "UnknownField" : 1,
+        "WebServerTLSCertificates" : {
+            "CertificateFiles" : [
+                {"CertificateFilename" : "a.crt", "PrivateKeyFilename" : "a.key"},
+                {"CertificateFilename" : "b.crt", "UnknownFilename" : "b.key"}
+            ],
+            "UnknownPeriod" : 1
+        },
+        "RegionalTrafficRules" : {
+            "US" : {"DefaultRateLimits" : {}, "UnknownLimits" : {}}
+        }
+    }`)
+
+	unknownFields, err := findUnknownConfigFields(configJSON)
+	if err != nil {
+		t.Fatalf("findUnknownConfigFields failed: %s", err)
+	}
+
+	expectedUnknownFields := []string{
+		`RegionalTrafficRules["US"].UnknownLimits`,
+		"UnknownField",
+		"WebServerTLSCertificates.CertificateFiles[1].UnknownFilename",
+		"WebServerTLSCertificates.UnknownPeriod",
+	}
+
+	if !reflect.DeepEqual(unknownFields, expectedUnknownFields) {
+		t.Fatalf("unexpected unknown fields: %v", unknownFields)
+	}
+
+	_, err = findUnknownConfigFields([]byte(`[`))
+	if err == nil {
+		t.Fatalf("unexpected success for malformed config")
+	}
+}
+
+func TestRedactedJSON(t *testing.T) {
+
+	configJSON := generateTestConfig(t)
+
+	config, err := LoadConfig([][]byte{configJSON})
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	redactedJSON, err := config.RedactedJSON()
+	if err != nil {
+		t.Fatalf("RedactedJSON failed: %s", err)
+	}
+
+	var redactedConfig Config
+	err = json.Unmarshal(redactedJSON, &redactedConfig)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	// Every secret field, including any secret fields added to Config in
+	// the future, must be redacted; and no secret value may appear anywhere
+	// in the output.
+
+	isSecretField := func(name string) bool {
+		return strings.Contains(name, "Secret") ||
+			strings.Contains(name, "Password") ||
+			strings.HasSuffix(name, "Key")
+	}
+
+	configValue := reflect.ValueOf(config).Elem()
+	redactedConfigValue := reflect.ValueOf(&redactedConfig).Elem()
+	configType := configValue.Type()
+
+	secretCount := 0
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.Type.Kind() != reflect.String || !isSecretField(field.Name) {
+			continue
+		}
+		secretValue := configValue.Field(i).String()
+		if secretValue == "" {
+			t.Fatalf("missing generated value for secret field %s", field.Name)
+		}
+		if redactedConfigValue.Field(i).String() != REDACTED_CONFIG_VALUE {
+			t.Fatalf("secret field %s not redacted", field.Name)
+		}
+		if strings.Contains(string(redactedJSON), secretValue) {
+			t.Fatalf("secret value for field %s in redacted JSON", field.Name)
+		}
+		secretCount += 1
+	}
+
+	if secretCount == 0 {
+		t.Fatalf("no secret fields found")
+	}
+
+	// Non-secret values are retained, and the original config isn't modified
+
+	if redactedConfig.ServerIPAddress != config.ServerIPAddress ||
+		!reflect.DeepEqual(redactedConfig.TunnelProtocolPorts, config.TunnelProtocolPorts) {
+		t.Fatalf("unexpected redacted config values")
+	}
+
+	if config.SSHPassword == REDACTED_CONFIG_VALUE {
+		t.Fatalf("original config modified")
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+
+	testCases := []struct {
+		address   string
+		host      string
+		firstPort int
+		lastPort  int
+		isValid   bool
+	}{
+		{"0.0.0.0:443", "0.0.0.0", 443, 443, true},
+		{"[2001:db8::1]:8443", "2001:db8::1", 8443, 8443, true},
+		{":4000-4010", "", 4000, 4010, true},
+		{"127.0.0.1:1-1024", "127.0.0.1", 1, 1024, true},
+		{"127.0.0.1:1-1025", "", 0, 0, false},
+		{"127.0.0.1:0", "", 0, 0, false},
+		{"127.0.0.1:65536", "", 0, 0, false},
+		{"127.0.0.1:4010-4000", "", 0, 0, false},
+		{"127.0.0.1:4000-", "", 0, 0, false},
+		{"127.0.0.1:http", "", 0, 0, false},
+		{"example.com:443", "", 0, 0, false},
+		{"2001:db8::1:443", "", 0, 0, false},
+		{"127.0.0.1", "", 0, 0, false},
+	}
+
+	for _, testCase := range testCases {
+		host, firstPort, lastPort, err := parseListenAddress(testCase.address)
+		if (err == nil) != testCase.isValid {
+			t.Fatalf("unexpected result for %s: %v", testCase.address, err)
+		}
+		if err == nil &&
+			(host != testCase.host ||
+				firstPort != testCase.firstPort ||
+				lastPort != testCase.lastPort) {
+			t.Fatalf("unexpected values for %s: %s, %d, %d",
+				testCase.address, host, firstPort, lastPort)
+		}
+	}
+}
+
+func TestListenPortConflicts(t *testing.T) {
+
+	testCases := []struct {
+		description     string
+		webServerPort   int
+		ports           map[string]int
+		listenAddresses map[string][]string
+		expectedErrors  []string
+	}{
+		{
+			"no conflicts",
+			8000,
+			map[string]int{"OSSH": 4000},
+			map[string][]string{"SSH": {"127.0.0.2:4000", ":4001-4002"}},
+			nil,
+		},
+		{
+			"same host",
+			8000,
+			map[string]int{"OSSH": 4000},
+			map[string][]string{"SSH": {"127.0.0.1:4000"}},
+			[]string{"Port 4000 is used by OSSH, SSH"},
+		},
+		{
+			"all interfaces",
+			8000,
+			map[string]int{"OSSH": 4000},
+			map[string][]string{"SSH": {"[::]:4000"}, "UNFRONTED-MEEK-OSSH": {":7990-8000"}},
+			[]string{
+				"Port 4000 is used by OSSH, SSH",
+				"Port 8000 is used by UNFRONTED-MEEK-OSSH, WebServerPort",
+			},
+		},
+		{
+			"overlapping port ranges",
+			0,
+			nil,
+			map[string][]string{"SSH": {":4000-4001"}, "OSSH": {":4001-4002"}},
+			[]string{"Port 4001 is used by OSSH, SSH"},
+		},
+		{
+			"duplicate address",
+			0,
+			map[string]int{"OSSH": 4000},
+			map[string][]string{"OSSH": {"127.0.0.1:4000"}},
+			nil,
+		},
+		{
+			"invalid port",
+			0,
+			map[string]int{"OSSH": 70000},
+			nil,
+			[]string{"Port 70000 for OSSH is invalid"},
+		},
+	}
+
+	for _, testCase := range testCases {
+
+		config := &Config{
+			ServerIPAddress:               "127.0.0.1",
+			WebServerPort:                 testCase.webServerPort,
+			TunnelProtocolPorts:           testCase.ports,
+			TunnelProtocolListenAddresses: testCase.listenAddresses,
+		}
+
+		var errors []string
+		for _, err := range config.validateStrict() {
+			errors = append(errors, err.Error())
+		}
+
+		if !reflect.DeepEqual(errors, testCase.expectedErrors) {
+			t.Fatalf("unexpected errors for %s: %v", testCase.description, errors)
+		}
+	}
+}
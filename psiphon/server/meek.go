@@ -83,11 +83,13 @@ type MeekServer struct {
 	config        *Config
 	listener      net.Listener
 	tlsConfig     *tls.Config
+	clientHellos  *clientHelloListener
 	clientHandler func(clientConn net.Conn)
 	openConns     *psiphon.Conns
 	stopBroadcast <-chan struct{}
 	sessionsLock  sync.RWMutex
 	sessions      map[string]*meekSession
+	localAddrs    *connLocalAddrs
 }
 
 // NewMeekServer initializes a new meek server.
@@ -105,14 +107,21 @@ func NewMeekServer(
 		openConns:     new(psiphon.Conns),
 		stopBroadcast: stopBroadcast,
 		sessions:      make(map[string]*meekSession),
+		localAddrs:    newConnLocalAddrs(),
 	}
 
 	if useTLS {
-		tlsConfig, err := makeMeekTLSConfig(config)
+		tlsConfig, err := makeMeekTLSConfig(config, stopBroadcast)
 		if err != nil {
 			return nil, psiphon.ContextError(err)
 		}
 		meekServer.tlsConfig = tlsConfig
+
+		// For HTTPS, the TLS ClientHello sent on each connection is
+		// fingerprinted; the fingerprint is associated with meek sessions
+		// created by requests on that connection.
+		meekServer.clientHellos = newClientHelloListener(listener)
+		meekServer.listener = meekServer.clientHellos
 	}
 
 	return meekServer, nil
@@ -344,6 +353,30 @@ func (server *MeekServer) getSession(
 		},
 		clientSessionData.MeekProtocolVersion)
 
+	// The local address of the HTTP connection carrying this request
+	// indicates which port the client, or CDN, connected to.
+
+	clientConn.localAddr = server.localAddrs.get(request.RemoteAddr)
+	if clientConn.localAddr == nil {
+		clientConn.localAddr = server.listener.Addr()
+	}
+
+	// Associate the TLS ClientHello fingerprint for the HTTPS connection
+	// carrying this request. In the fronted case, this is the fingerprint
+	// of the CDN's TLS stack, not the client's.
+
+	if server.clientHellos != nil {
+		clientConn.clientHelloFingerprint = server.clientHellos.getFingerprint(request.RemoteAddr)
+		if clientConn.clientHelloFingerprint != nil {
+			log.WithContextFields(
+				LogFields{
+					"tlsClientHelloFingerprint": clientConn.clientHelloFingerprint.Hash,
+					"tlsClientHelloJA3":         clientConn.clientHelloFingerprint.JA3,
+					"meekProtocolVersion":       clientSessionData.MeekProtocolVersion,
+				}).Info("new meek session")
+		}
+	}
+
 	session = &meekSession{
 		clientConn:          clientConn,
 		meekProtocolVersion: clientSessionData.MeekProtocolVersion,
@@ -411,11 +444,49 @@ func (server *MeekServer) httpConnStateCallback(conn net.Conn, connState http.Co
 	switch connState {
 	case http.StateNew:
 		server.openConns.Add(conn)
+		server.localAddrs.add(conn)
 	case http.StateHijacked, http.StateClosed:
 		server.openConns.Remove(conn)
+		server.localAddrs.remove(conn)
+	}
+}
+
+// connLocalAddrs records the local address of each open HTTP connection,
+// by remote address, which corresponds to the http.Request.RemoteAddr for
+// requests made on the connection. For redirected connections, the local
+// address is the original destination, which may differ from the listener
+// address.
+type connLocalAddrs struct {
+	mutex      sync.Mutex
+	localAddrs map[string]net.Addr
+}
+
+func newConnLocalAddrs() *connLocalAddrs {
+	return &connLocalAddrs{
+		localAddrs: make(map[string]net.Addr),
 	}
 }
 
+func (addrs *connLocalAddrs) add(conn net.Conn) {
+	addrs.mutex.Lock()
+	defer addrs.mutex.Unlock()
+	addrs.localAddrs[conn.RemoteAddr().String()] = conn.LocalAddr()
+}
+
+func (addrs *connLocalAddrs) remove(conn net.Conn) {
+	addrs.mutex.Lock()
+	defer addrs.mutex.Unlock()
+	delete(addrs.localAddrs, conn.RemoteAddr().String())
+}
+
+// get returns the local address for the connection with the specified
+// remote address, or nil when there's no such connection.
+func (addrs *connLocalAddrs) get(remoteAddr string) net.Addr {
+	addrs.mutex.Lock()
+	defer addrs.mutex.Unlock()
+	return addrs.localAddrs[remoteAddr]
+}
+
 // terminateConnection sends a 404 response to a client and also closes
 // a persisitent connection.
 func (server *MeekServer) terminateConnection(
@@ -455,24 +526,47 @@ func (session *meekSession) expired() bool {
 // Currently, this config is optimized for fronted meek where the nature
 // of the connection is non-circumvention; it's optimized for performance
 // assuming the peer is an uncensored CDN.
-func makeMeekTLSConfig(config *Config) (*tls.Config, error) {
+//
+// When MeekTLSCertificates is configured, certificates are obtained from
+// a tlsCertificateManager, which may reload or rotate certificates until
+// stopBroadcast is signaled. Otherwise, a self-signed certificate is
+// generated for MeekCertificateCommonName.
+func makeMeekTLSConfig(
+	config *Config, stopBroadcast <-chan struct{}) (*tls.Config, error) {
 
-	certificate, privateKey, err := GenerateWebServerCertificate(
-		config.MeekCertificateCommonName)
-	if err != nil {
-		return nil, psiphon.ContextError(err)
-	}
+	var certificates []tls.Certificate
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 
-	tlsCertificate, err := tls.X509KeyPair(
-		[]byte(certificate), []byte(privateKey))
-	if err != nil {
-		return nil, psiphon.ContextError(err)
+	if config.MeekTLSCertificates != nil {
+
+		manager, err := newTLSCertificateManager(
+			config.MeekTLSCertificates, stopBroadcast)
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+		getCertificate = manager.getCertificate
+
+	} else {
+
+		certificate, privateKey, err := GenerateWebServerCertificate(
+			config.MeekCertificateCommonName)
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+
+		tlsCertificate, err := tls.X509KeyPair(
+			[]byte(certificate), []byte(privateKey))
+		if err != nil {
+			return nil, psiphon.ContextError(err)
+		}
+		certificates = []tls.Certificate{tlsCertificate}
 	}
 
 	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCertificate},
-		NextProtos:   []string{"http/1.1"},
-		MinVersion:   tls.VersionTLS10,
+		Certificates:   certificates,
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"http/1.1"},
+		MinVersion:     tls.VersionTLS10,
 
 		// This is a reordering of the supported CipherSuites in golang 1.6. Non-ephemeral key
 		// CipherSuites greatly reduce server load, and we try to select these since the meek
@@ -576,16 +670,18 @@ func makeMeekSessionID() (string, error) {
 // meekConn doesn't perform any real I/O, but instead shuttles io.Readers and
 // io.Writers between goroutines blocking on Read()s and Write()s.
 type meekConn struct {
-	remoteAddr      net.Addr
-	protocolVersion int
-	closeBroadcast  chan struct{}
-	closed          int32
-	readLock        sync.Mutex
-	readyReader     chan io.Reader
-	readResult      chan error
-	writeLock       sync.Mutex
-	nextWriteBuffer chan []byte
-	writeResult     chan error
+	remoteAddr             net.Addr
+	localAddr              net.Addr
+	protocolVersion        int
+	clientHelloFingerprint *ClientHelloFingerprint
+	closeBroadcast         chan struct{}
+	closed                 int32
+	readLock               sync.Mutex
+	readyReader            chan io.Reader
+	readResult             chan error
+	writeLock              sync.Mutex
+	nextWriteBuffer        chan []byte
+	writeResult            chan error
 }
 
 func newMeekConn(remoteAddr net.Addr, protocolVersion int) *meekConn {
@@ -753,9 +849,11 @@ func (conn *meekConn) Close() error {
 	return nil
 }
 
-// Stub implementation of net.Conn.LocalAddr
+// LocalAddr returns the local address of the HTTP connection that
+// carried the request which established the meek session, or nil
+// when not known.
 func (conn *meekConn) LocalAddr() net.Addr {
-	return nil
+	return conn.localAddr
 }
 
 // RemoteAddr returns the remoteAddr specified in newMeekConn. This
@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+// redirectedListener wraps a TCP listener that receives connections
+// redirected by iptables REDIRECT or DNAT rules. For each accepted conn,
+// the original destination address is recovered and reported as the
+// conn's local address. When the original destination isn't available,
+// the conn is returned as-is.
+type redirectedListener struct {
+	net.Listener
+}
+
+func newRedirectedListener(listener net.Listener) *redirectedListener {
+	return &redirectedListener{Listener: listener}
+}
+
+// Accept accepts a new conn and wraps it in a redirectedConn.
+func (listener *redirectedListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+
+	originalDestination, err := psiphon.GetOriginalDestination(tcpConn)
+	if err != nil {
+		log.WithContextFields(
+			LogFields{"error": err}).Warning("get original destination failed")
+		return conn, nil
+	}
+
+	return &redirectedConn{
+		TCPConn:             tcpConn,
+		originalDestination: originalDestination,
+	}, nil
+}
+
+// redirectedConn is a *net.TCPConn with the local address replaced by
+// the original destination of the redirected connection.
+type redirectedConn struct {
+	*net.TCPConn
+	originalDestination *net.TCPAddr
+}
+
+// LocalAddr returns the original destination of the redirected connection.
+func (conn *redirectedConn) LocalAddr() net.Addr {
+	return conn.originalDestination
+}
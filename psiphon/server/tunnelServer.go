@@ -106,32 +106,41 @@ func (server *TunnelServer) Run() error {
 
 	var listeners []*sshListener
 
-	for tunnelProtocol, listenPort := range server.config.TunnelProtocolPorts {
+	tunnelProtocolListenAddresses, err :=
+		server.config.GetTunnelProtocolListenAddresses()
+	if err != nil {
+		return psiphon.ContextError(err)
+	}
 
-		localAddress := fmt.Sprintf(
-			"%s:%d", server.config.ServerIPAddress, listenPort)
+	for tunnelProtocol, localAddresses := range tunnelProtocolListenAddresses {
+		for _, localAddress := range localAddresses {
 
-		listener, err := net.Listen("tcp", localAddress)
-		if err != nil {
-			for _, existingListener := range listeners {
-				existingListener.Listener.Close()
+			listener, err := net.Listen("tcp", localAddress)
+			if err != nil {
+				for _, existingListener := range listeners {
+					existingListener.Listener.Close()
+				}
+				return psiphon.ContextError(err)
 			}
-			return psiphon.ContextError(err)
-		}
 
-		log.WithContextFields(
-			LogFields{
-				"localAddress":   localAddress,
-				"tunnelProtocol": tunnelProtocol,
-			}).Info("listening")
+			if server.config.AcceptRedirectedConnections {
+				listener = newRedirectedListener(listener)
+			}
 
-		listeners = append(
-			listeners,
-			&sshListener{
-				Listener:       listener,
-				localAddress:   localAddress,
-				tunnelProtocol: tunnelProtocol,
-			})
+			log.WithContextFields(
+				LogFields{
+					"localAddress":   localAddress,
+					"tunnelProtocol": tunnelProtocol,
+				}).Info("listening")
+
+			listeners = append(
+				listeners,
+				&sshListener{
+					Listener:       listener,
+					localAddress:   localAddress,
+					tunnelProtocol: tunnelProtocol,
+				})
+		}
 	}
 
 	for _, listener := range listeners {
@@ -159,7 +168,6 @@ func (server *TunnelServer) Run() error {
 		}(listener)
 	}
 
-	var err error
 	select {
 	case <-server.shutdownBroadcast:
 	case err = <-server.listenerError:
@@ -317,6 +325,7 @@ func (sshServer *sshServer) getLoadStats() map[string]map[string]int64 {
 	defer sshServer.clientsMutex.Unlock()
 
 	loadStats := make(map[string]map[string]int64)
+	clientHelloCounts := make(map[string]map[string]int64)
 	for _, client := range sshServer.clients {
 		if loadStats[client.tunnelProtocol] == nil {
 			loadStats[client.tunnelProtocol] = make(map[string]int64)
@@ -328,8 +337,17 @@ func (sshServer *sshServer) getLoadStats() map[string]map[string]int64 {
 		loadStats[client.tunnelProtocol]["TotalTCPPortForwards"] += client.tcpTrafficState.totalPortForwardCount
 		loadStats[client.tunnelProtocol]["CurrentUDPPortForwards"] += client.udpTrafficState.concurrentPortForwardCount
 		loadStats[client.tunnelProtocol]["TotalUDPPortForwards"] += client.udpTrafficState.totalPortForwardCount
+		if client.clientHelloFingerprint != nil {
+			if clientHelloCounts[client.tunnelProtocol] == nil {
+				clientHelloCounts[client.tunnelProtocol] = make(map[string]int64)
+			}
+			clientHelloCounts[client.tunnelProtocol][client.clientHelloFingerprint.Hash] += 1
+		}
 		client.Unlock()
 	}
+	for tunnelProtocol, counts := range clientHelloCounts {
+		addClientHelloLoadStats(loadStats[tunnelProtocol], counts)
+	}
 	return loadStats
 }
 
@@ -355,6 +373,19 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 		geoIPData,
 		sshServer.config.GetTrafficRules(geoIPData.Country))
 
+	// For meek HTTPS, the meek server supplies a TLS ClientHello fingerprint.
+
+	if meekConn, ok := clientConn.(*meekConn); ok {
+		sshClient.clientHelloFingerprint = meekConn.clientHelloFingerprint
+	}
+
+	// Record the port the client connected to. With multiple listen ports
+	// or redirected connections, this may differ from the listener port.
+
+	if localAddr, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		sshClient.destinationPort = localAddr.Port
+	}
+
 	// Wrap the base client connection with an ActivityMonitoredConn which will
 	// terminate the connection if no data is received before the deadline. This
 	// timeout is in effect for the entire duration of the SSH connection. Clients
@@ -416,7 +447,8 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 			conn, result.err = psiphon.NewObfuscatedSshConn(
 				psiphon.OBFUSCATION_CONN_MODE_SERVER,
 				clientConn,
-				sshServer.config.ObfuscatedSSHKey)
+				sshServer.config.ObfuscatedSSHKey,
+				nil)
 			if result.err != nil {
 				result.err = psiphon.ContextError(result.err)
 			}
@@ -476,6 +508,8 @@ type sshClient struct {
 	sshConn                 ssh.Conn
 	startTime               time.Time
 	geoIPData               GeoIPData
+	clientHelloFingerprint  *ClientHelloFingerprint
+	destinationPort         int
 	psiphonSessionID        string
 	udpChannel              ssh.Channel
 	trafficRules            TrafficRules
@@ -573,23 +607,29 @@ func (sshClient *sshClient) stop() {
 	sshClient.channelHandlerWaitGroup.Wait()
 
 	sshClient.Lock()
-	log.WithContextFields(
-		LogFields{
-			"startTime":                         sshClient.startTime,
-			"duration":                          time.Now().Sub(sshClient.startTime),
-			"psiphonSessionID":                  sshClient.psiphonSessionID,
-			"country":                           sshClient.geoIPData.Country,
-			"city":                              sshClient.geoIPData.City,
-			"ISP":                               sshClient.geoIPData.ISP,
-			"bytesUpTCP":                        sshClient.tcpTrafficState.bytesUp,
-			"bytesDownTCP":                      sshClient.tcpTrafficState.bytesDown,
-			"peakConcurrentPortForwardCountTCP": sshClient.tcpTrafficState.peakConcurrentPortForwardCount,
-			"totalPortForwardCountTCP":          sshClient.tcpTrafficState.totalPortForwardCount,
-			"bytesUpUDP":                        sshClient.udpTrafficState.bytesUp,
-			"bytesDownUDP":                      sshClient.udpTrafficState.bytesDown,
-			"peakConcurrentPortForwardCountUDP": sshClient.udpTrafficState.peakConcurrentPortForwardCount,
-			"totalPortForwardCountUDP":          sshClient.udpTrafficState.totalPortForwardCount,
-		}).Info("tunnel closed")
+	logFields := LogFields{
+		"startTime":                         sshClient.startTime,
+		"duration":                          time.Now().Sub(sshClient.startTime),
+		"psiphonSessionID":                  sshClient.psiphonSessionID,
+		"country":                           sshClient.geoIPData.Country,
+		"city":                              sshClient.geoIPData.City,
+		"ISP":                               sshClient.geoIPData.ISP,
+		"bytesUpTCP":                        sshClient.tcpTrafficState.bytesUp,
+		"bytesDownTCP":                      sshClient.tcpTrafficState.bytesDown,
+		"peakConcurrentPortForwardCountTCP": sshClient.tcpTrafficState.peakConcurrentPortForwardCount,
+		"totalPortForwardCountTCP":          sshClient.tcpTrafficState.totalPortForwardCount,
+		"bytesUpUDP":                        sshClient.udpTrafficState.bytesUp,
+		"bytesDownUDP":                      sshClient.udpTrafficState.bytesDown,
+		"peakConcurrentPortForwardCountUDP": sshClient.udpTrafficState.peakConcurrentPortForwardCount,
+		"totalPortForwardCountUDP":          sshClient.udpTrafficState.totalPortForwardCount,
+	}
+	if sshClient.clientHelloFingerprint != nil {
+		logFields["tlsClientHelloFingerprint"] = sshClient.clientHelloFingerprint.Hash
+	}
+	if sshClient.destinationPort != 0 {
+		logFields["destinationPort"] = sshClient.destinationPort
+	}
+	log.WithContextFields(logFields).Info("tunnel closed")
 	sshClient.Unlock()
 }
 
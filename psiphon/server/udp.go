@@ -429,7 +429,7 @@ func readUdpgwMessage(
 			copy(remoteIP, buffer[5:21])
 			remotePort = uint16(buffer[21]) + uint16(buffer[22])<<8
 			packetStart = 23
-			packetEnd = 23 + int(size) - 2
+			packetEnd = 2 + int(size)
 
 		} else {
 
@@ -441,7 +441,7 @@ func readUdpgwMessage(
 			copy(remoteIP, buffer[5:9])
 			remotePort = uint16(buffer[9]) + uint16(buffer[10])<<8
 			packetStart = 11
-			packetEnd = 11 + int(size) - 2
+			packetEnd = 2 + int(size)
 		}
 
 		// Assemble message
@@ -481,6 +481,9 @@ func writeUdpgwPreamble(
 
 	// flags
 	buffer[2] = 0
+	if len(remoteIP) == 16 {
+		buffer[2] = udpgwProtocolFlagIPv6
+	}
 
 	// connID
 	buffer[3] = byte(connID & 0xFF)
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUdpgwMessageRoundTrip(t *testing.T) {
+
+	testCases := []struct {
+		connID     uint16
+		remoteIP   net.IP
+		remotePort uint16
+		packetSize int
+	}{
+		{1, net.ParseIP("192.0.2.1").To4(), 53, 1},
+		{2, net.ParseIP("2001:db8::1"), 443, 100},
+		{3, net.ParseIP("192.0.2.2").To4(), 123, udpgwProtocolMaxPayloadSize},
+		{4, net.ParseIP("2001:db8::2"), 65535, udpgwProtocolMaxPayloadSize},
+	}
+
+	// The messages are written back to back, with a keep alive before each
+	// message, so that any misframed message corrupts the next one.
+
+	var stream bytes.Buffer
+	packets := make([][]byte, len(testCases))
+
+	for i, testCase := range testCases {
+
+		stream.Write([]byte{3, 0, udpgwProtocolFlagKeepalive, 0, 0})
+
+		packets[i] = make([]byte, testCase.packetSize)
+		for j := range packets[i] {
+			packets[i][j] = byte(i + j)
+		}
+
+		preambleSize := 7 + len(testCase.remoteIP)
+		buffer := make([]byte, preambleSize+testCase.packetSize)
+		err := writeUdpgwPreamble(
+			preambleSize,
+			testCase.connID,
+			testCase.remoteIP,
+			testCase.remotePort,
+			uint16(testCase.packetSize),
+			buffer)
+		if err != nil {
+			t.Fatalf("writeUdpgwPreamble failed: %s", err)
+		}
+		copy(buffer[preambleSize:], packets[i])
+		stream.Write(buffer)
+	}
+
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+
+	for i, testCase := range testCases {
+
+		message, err := readUdpgwMessage(&stream, buffer)
+		if err != nil {
+			t.Fatalf("readUdpgwMessage failed for message %d: %s", i, err)
+		}
+
+		if message.connID != testCase.connID ||
+			!net.IP(message.remoteIP).Equal(testCase.remoteIP) ||
+			message.remotePort != testCase.remotePort ||
+			message.preambleSize != 7+len(testCase.remoteIP) ||
+			!bytes.Equal(message.packet, packets[i]) {
+			t.Fatalf("unexpected message %d: %d %s %d %d %d",
+				i, message.connID, net.IP(message.remoteIP), message.remotePort,
+				message.preambleSize, len(message.packet))
+		}
+	}
+
+	if stream.Len() != 0 {
+		t.Fatalf("unexpected unread bytes: %d", stream.Len())
+	}
+
+	// A message larger than the buffer is rejected
+
+	stream.Write([]byte{0xff, 0xff})
+	_, err := readUdpgwMessage(&stream, buffer)
+	if err == nil {
+		t.Fatalf("readUdpgwMessage unexpectedly succeeded")
+	}
+}
@@ -56,15 +56,30 @@ func RunWebServer(config *Config, shutdownBroadcast <-chan struct{}) error {
 	serveMux.HandleFunc("/status", webServer.statusHandler)
 	serveMux.HandleFunc("/client_verification", webServer.clientVerificationHandler)
 
-	certificate, err := tls.X509KeyPair(
-		[]byte(config.WebServerCertificate),
-		[]byte(config.WebServerPrivateKey))
-	if err != nil {
-		return psiphon.ContextError(err)
-	}
+	tlsConfig := &tls.Config{}
+
+	// Note: clients authenticate the web server using the certificate in
+	// their server entry, so replacing WebServerTLSCertificates certificates
+	// must be coordinated with server entry updates.
+
+	if config.WebServerTLSCertificates != nil {
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{certificate},
+		manager, err := newTLSCertificateManager(
+			config.WebServerTLSCertificates, shutdownBroadcast)
+		if err != nil {
+			return psiphon.ContextError(err)
+		}
+		tlsConfig.GetCertificate = manager.getCertificate
+
+	} else {
+
+		certificate, err := tls.X509KeyPair(
+			[]byte(config.WebServerCertificate),
+			[]byte(config.WebServerPrivateKey))
+		if err != nil {
+			return psiphon.ContextError(err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
 	}
 
 	// TODO: inherits global log config?
@@ -50,6 +50,10 @@ type ServerContext struct {
 	clientRegion             string
 	clientUpgradeVersion     string
 	serverHandshakeTimestamp string
+
+	// discoveredServerEntryCount is the number of server entries which
+	// were discovered and stored by the handshake.
+	discoveredServerEntryCount int
 }
 
 // MeekStats holds extra stats that are only gathered for meek tunnels.
@@ -191,6 +195,7 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 	if err != nil {
 		return ContextError(err)
 	}
+	serverContext.discoveredServerEntryCount = len(decodedServerEntries)
 
 	// TODO: formally communicate the sponsor and upgrade info to an
 	// outer client via some control interface.
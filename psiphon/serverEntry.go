@@ -108,6 +108,16 @@ func TunnelProtocolUsesMeekHTTPS(protocol string) bool {
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS
 }
 
+func TunnelProtocolUsesMeek(protocol string) bool {
+	return TunnelProtocolUsesMeekHTTP(protocol) ||
+		TunnelProtocolUsesMeekHTTPS(protocol)
+}
+
+func TunnelProtocolUsesFrontedMeek(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP
+}
+
 // GetCapability returns the server capability corresponding
 // to the protocol.
 func GetCapability(protocol string) string {
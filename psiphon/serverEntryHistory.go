@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	SERVER_ENTRY_HISTORY_MAX_ESTABLISH_DURATIONS = 16
+	SERVER_ENTRY_HISTORY_MAX_NETWORKS            = 16
+	SERVER_ENTRY_HISTORY_RECENT_SUCCESS_DECAY    = 24 * time.Hour
+	SERVER_ENTRY_HISTORY_SLOW_ESTABLISH_DURATION = 30 * time.Second
+	SERVER_ENTRY_HISTORY_OTHER_NETWORK_WEIGHT    = 0.25
+	SERVER_ENTRY_HISTORY_MIN_SCORE               = 0.05
+)
+
+// ServerEntryHistory is the connection history for a single server
+// entry. History is recorded separately for each tunnel protocol, as
+// a server may be reachable using one protocol and blocked for
+// another.
+type ServerEntryHistory struct {
+	Protocols map[string]*ProtocolHistory
+
+	// LastPromoted is set by PromoteServerEntry and is treated as a
+	// recent success, on any network, for any protocol.
+	LastPromoted time.Time
+}
+
+// ProtocolHistory is the connection history for one tunnel protocol
+// for a single server entry.
+//
+// Attempts counts every establishment started; Successes and Failures
+// count completed establishments. Attempts which were interrupted, for
+// example when another tunnel established first, are neither successes
+// nor failures.
+//
+// LastSuccess is the time of the most recent successful establishment
+// on each network, keyed by network ID.
+type ProtocolHistory struct {
+	Attempts           int
+	Successes          int
+	Failures           int
+	LastFailure        time.Time
+	LastSuccess        map[string]time.Time
+	EstablishDurations []time.Duration
+}
+
+func newServerEntryHistory() *ServerEntryHistory {
+	return &ServerEntryHistory{
+		Protocols: make(map[string]*ProtocolHistory),
+	}
+}
+
+func (history *ServerEntryHistory) getProtocolHistory(protocol string) *ProtocolHistory {
+	protocolHistory, ok := history.Protocols[protocol]
+	if !ok {
+		protocolHistory = &ProtocolHistory{
+			LastSuccess: make(map[string]time.Time),
+		}
+		history.Protocols[protocol] = protocolHistory
+	}
+	return protocolHistory
+}
+
+func (history *ProtocolHistory) recordSuccess(
+	networkID string, establishDuration time.Duration) {
+
+	history.Successes += 1
+	history.LastSuccess[networkID] = time.Now()
+
+	// Keep only the most recent establish durations, so the median
+	// reflects current conditions.
+	history.EstablishDurations = append(history.EstablishDurations, establishDuration)
+	if len(history.EstablishDurations) > SERVER_ENTRY_HISTORY_MAX_ESTABLISH_DURATIONS {
+		history.EstablishDurations = history.EstablishDurations[1:]
+	}
+
+	// Bound the number of networks, discarding the least recent.
+	for len(history.LastSuccess) > SERVER_ENTRY_HISTORY_MAX_NETWORKS {
+		var oldestNetworkID string
+		var oldestTime time.Time
+		for networkID, lastSuccess := range history.LastSuccess {
+			if oldestNetworkID == "" || lastSuccess.Before(oldestTime) {
+				oldestNetworkID = networkID
+				oldestTime = lastSuccess
+			}
+		}
+		delete(history.LastSuccess, oldestNetworkID)
+	}
+}
+
+func (history *ProtocolHistory) recordFailure() {
+	history.Failures += 1
+	history.LastFailure = time.Now()
+}
+
+// MedianEstablishDuration returns the median of the recent successful
+// establish durations, or 0 when there are none.
+func (history *ProtocolHistory) MedianEstablishDuration() time.Duration {
+	count := len(history.EstablishDurations)
+	if count == 0 {
+		return 0
+	}
+	durations := make([]time.Duration, count)
+	copy(durations, history.EstablishDurations)
+	sort.Sort(durationSlice(durations))
+	if count%2 == 1 {
+		return durations[count/2]
+	}
+	return (durations[count/2-1] + durations[count/2]) / 2
+}
+
+type durationSlice []time.Duration
+
+func (s durationSlice) Len() int           { return len(s) }
+func (s durationSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s durationSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// score returns a preference score for connecting using this protocol
+// on the specified network. The score combines the success rate, which
+// is smoothed so that a protocol with no history has a neutral rate of
+// 0.5 and so that a single result doesn't dominate; a bonus for a recent
+// success, which decays over time and which is reduced when the success
+// was on a different network; and a small bonus for fast establishment.
+// Scores are always positive, so that every candidate retains some
+// chance of selection.
+func (history *ProtocolHistory) score(networkID string, now time.Time) float64 {
+
+	successRate := float64(history.Successes+1) / float64(history.Successes+history.Failures+2)
+
+	recency := 0.0
+	for lastSuccessNetworkID, lastSuccess := range history.LastSuccess {
+		weight := 1.0
+		if lastSuccessNetworkID != networkID {
+			weight = SERVER_ENTRY_HISTORY_OTHER_NETWORK_WEIGHT
+		}
+		recency = math.Max(recency, weight*recencyDecay(lastSuccess, now))
+	}
+
+	// A failure since the last success on this network cancels that
+	// success's recency bonus.
+	if lastSuccess, ok := history.LastSuccess[networkID]; ok &&
+		history.LastFailure.After(lastSuccess) {
+		recency /= 2
+	}
+
+	speed := 0.0
+	median := history.MedianEstablishDuration()
+	if median > 0 && median < SERVER_ENTRY_HISTORY_SLOW_ESTABLISH_DURATION {
+		speed = 0.25 * (1.0 - float64(median)/float64(SERVER_ENTRY_HISTORY_SLOW_ESTABLISH_DURATION))
+	}
+
+	return math.Max(SERVER_ENTRY_HISTORY_MIN_SCORE, successRate+recency+speed)
+}
+
+// hasRecentSuccess indicates if there's a successful establishment on the
+// specified network which hasn't fully decayed.
+func (history *ProtocolHistory) hasRecentSuccess(networkID string, now time.Time) bool {
+	lastSuccess, ok := history.LastSuccess[networkID]
+	return ok && recencyDecay(lastSuccess, now) > 0
+}
+
+// recencyDecay is 1.0 for an event which just happened, decreasing
+// linearly to 0.0 after SERVER_ENTRY_HISTORY_RECENT_SUCCESS_DECAY.
+func recencyDecay(eventTime, now time.Time) float64 {
+	age := now.Sub(eventTime)
+	if age < 0 {
+		age = 0
+	}
+	if age >= SERVER_ENTRY_HISTORY_RECENT_SUCCESS_DECAY {
+		return 0.0
+	}
+	return 1.0 - float64(age)/float64(SERVER_ENTRY_HISTORY_RECENT_SUCCESS_DECAY)
+}
+
+// score returns a preference score for connecting to the server. This is
+// the score of the best protocol; when protocol is not blank, only that
+// protocol is considered. A server with no history has a neutral score.
+func (history *ServerEntryHistory) score(
+	protocol, networkID string, now time.Time) float64 {
+
+	neutral := (&ProtocolHistory{}).score(networkID, now)
+
+	best := 0.0
+	for historyProtocol, protocolHistory := range history.Protocols {
+		if protocol != "" && historyProtocol != protocol {
+			continue
+		}
+		best = math.Max(best, protocolHistory.score(networkID, now))
+	}
+	if best == 0.0 {
+		best = neutral
+	}
+
+	if !history.LastPromoted.IsZero() {
+		best = math.Max(best, neutral+recencyDecay(history.LastPromoted, now))
+	}
+
+	return best
+}
+
+// hasRecentSuccess indicates if the server was recently connected to on
+// the specified network, or promoted.
+func (history *ServerEntryHistory) hasRecentSuccess(
+	protocol, networkID string, now time.Time) bool {
+
+	if !history.LastPromoted.IsZero() && recencyDecay(history.LastPromoted, now) > 0 {
+		return true
+	}
+	for historyProtocol, protocolHistory := range history.Protocols {
+		if protocol != "" && historyProtocol != protocol {
+			continue
+		}
+		if protocolHistory.hasRecentSuccess(networkID, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// rankServerEntries orders server entry IDs for establishment, using
+// each server's history score.
+//
+// The first headLength servers which recently connected on the current
+// network are placed first, in descending score order; this favors the
+// servers most likely to connect immediately, and also maintains server
+// affinity. The remaining servers are in a weighted random order, where
+// higher scoring servers tend to appear earlier but where every server,
+// including the long tail of untried servers, may be selected early. This
+// uses the Efraimidis-Spirakis weighted random sampling scheme.
+func rankServerEntries(
+	serverEntryIds []string,
+	histories map[string]*ServerEntryHistory,
+	protocol, networkID string,
+	headLength int) []string {
+
+	now := time.Now()
+
+	var head, tail rankedServerEntries
+
+	for _, id := range serverEntryIds {
+		history, ok := histories[id]
+		if !ok {
+			history = newServerEntryHistory()
+		}
+		score := history.score(protocol, networkID, now)
+		entry := &rankedServerEntry{
+			id:    id,
+			score: score,
+			key:   math.Pow(rand.Float64(), 1.0/score),
+		}
+		if history.hasRecentSuccess(protocol, networkID, now) {
+			head = append(head, entry)
+		} else {
+			tail = append(tail, entry)
+		}
+	}
+
+	sort.Stable(byScore{head})
+
+	if len(head) > headLength {
+		tail = append(tail, head[headLength:]...)
+		head = head[:headLength]
+	}
+
+	sort.Sort(byKey{tail})
+
+	rankedServerEntryIds := make([]string, 0, len(serverEntryIds))
+	for _, entry := range head {
+		rankedServerEntryIds = append(rankedServerEntryIds, entry.id)
+	}
+	for _, entry := range tail {
+		rankedServerEntryIds = append(rankedServerEntryIds, entry.id)
+	}
+
+	return rankedServerEntryIds
+}
+
+type rankedServerEntry struct {
+	id    string
+	score float64
+	key   float64
+}
+
+type rankedServerEntries []*rankedServerEntry
+
+func (s rankedServerEntries) Len() int      { return len(s) }
+func (s rankedServerEntries) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+type byScore struct{ rankedServerEntries }
+
+func (s byScore) Less(i, j int) bool {
+	return s.rankedServerEntries[i].score > s.rankedServerEntries[j].score
+}
+
+type byKey struct{ rankedServerEntries }
+
+func (s byKey) Less(i, j int) bool {
+	return s.rankedServerEntries[i].key > s.rankedServerEntries[j].key
+}
+
+// rankProtocols orders candidateProtocols by preference using the server's
+// history. As with rankServerEntries, the order is weighted random by
+// protocol score, so that protocols that recently worked on the current
+// network tend to be first while other protocols are still tried.
+func rankProtocols(
+	candidateProtocols []string,
+	history *ServerEntryHistory,
+	networkID string) []string {
+
+	now := time.Now()
+
+	ranked := make(rankedServerEntries, 0, len(candidateProtocols))
+	for _, protocol := range candidateProtocols {
+		score := (&ProtocolHistory{}).score(networkID, now)
+		if history != nil {
+			if protocolHistory, ok := history.Protocols[protocol]; ok {
+				score = protocolHistory.score(networkID, now)
+			}
+		}
+		ranked = append(ranked, &rankedServerEntry{
+			id:    protocol,
+			score: score,
+			key:   math.Pow(rand.Float64(), 1.0/score),
+		})
+	}
+
+	sort.Sort(byKey{ranked})
+
+	rankedProtocols := make([]string, 0, len(ranked))
+	for _, entry := range ranked {
+		rankedProtocols = append(rankedProtocols, entry.id)
+	}
+	return rankedProtocols
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMedianEstablishDuration(t *testing.T) {
+	history := newServerEntryHistory().getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+
+	if history.MedianEstablishDuration() != 0 {
+		t.Error("unexpected median with no durations")
+	}
+
+	for _, seconds := range []int{5, 1, 3, 100} {
+		history.recordSuccess("network", time.Duration(seconds)*time.Second)
+	}
+	if history.MedianEstablishDuration() != 4*time.Second {
+		t.Errorf("unexpected median: %s", history.MedianEstablishDuration())
+	}
+
+	for i := 0; i < SERVER_ENTRY_HISTORY_MAX_ESTABLISH_DURATIONS; i++ {
+		history.recordSuccess("network", 2*time.Second)
+	}
+	if history.MedianEstablishDuration() != 2*time.Second {
+		t.Errorf("unexpected median: %s", history.MedianEstablishDuration())
+	}
+}
+
+func TestRankServerEntries(t *testing.T) {
+
+	var serverEntryIds []string
+	for i := 0; i < 1000; i++ {
+		serverEntryIds = append(serverEntryIds, fmt.Sprintf("192.0.2.%d", i))
+	}
+
+	histories := make(map[string]*ServerEntryHistory)
+
+	// Recently successful on the current network, one faster than the other
+
+	fast := newServerEntryHistory()
+	fast.getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordSuccess("network", 1*time.Second)
+	histories[serverEntryIds[500]] = fast
+
+	slow := newServerEntryHistory()
+	slow.getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordSuccess("network", 20*time.Second)
+	histories[serverEntryIds[100]] = slow
+
+	// Recently successful only on another network
+
+	otherNetwork := newServerEntryHistory()
+	otherNetwork.getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordSuccess("other", 1*time.Second)
+	histories[serverEntryIds[200]] = otherNetwork
+
+	// Repeatedly failing
+
+	failing := newServerEntryHistory()
+	for i := 0; i < 10; i++ {
+		failing.getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordFailure()
+	}
+	histories[serverEntryIds[300]] = failing
+
+	ranked := rankServerEntries(serverEntryIds, histories, "", "network", 2)
+
+	if len(ranked) != len(serverEntryIds) {
+		t.Fatalf("unexpected ranked count: %d", len(ranked))
+	}
+	if ranked[0] != serverEntryIds[500] || ranked[1] != serverEntryIds[100] {
+		t.Fatalf("unexpected head: %v", ranked[0:2])
+	}
+
+	// The head is limited to the head length
+
+	ranked = rankServerEntries(serverEntryIds, histories, "", "network", 1)
+	if ranked[0] != serverEntryIds[500] {
+		t.Fatalf("unexpected head: %v", ranked[0:1])
+	}
+
+	// Over many rankings, the long tail is explored, and the other network
+	// server tends to rank ahead of the failing server
+
+	firstTail := make(map[string]bool)
+	otherNetworkAhead := 0
+	rounds := 200
+	for i := 0; i < rounds; i++ {
+		ranked = rankServerEntries(serverEntryIds, histories, "", "network", 2)
+		firstTail[ranked[2]] = true
+		for _, id := range ranked {
+			if id == serverEntryIds[200] {
+				otherNetworkAhead += 1
+				break
+			}
+			if id == serverEntryIds[300] {
+				break
+			}
+		}
+	}
+	if len(firstTail) < rounds/4 {
+		t.Errorf("insufficient exploration: %d", len(firstTail))
+	}
+	if otherNetworkAhead < rounds/2 {
+		t.Errorf("unexpected other network ranking: %d", otherNetworkAhead)
+	}
+
+	// A protocol filter ignores history for other protocols
+
+	ranked = rankServerEntries(serverEntryIds, histories, TUNNEL_PROTOCOL_SSH, "network", 2)
+	if ranked[0] == serverEntryIds[500] && ranked[1] == serverEntryIds[100] {
+		t.Errorf("unexpected head with protocol filter")
+	}
+}
+
+func TestRankProtocols(t *testing.T) {
+
+	protocols := []string{
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		TUNNEL_PROTOCOL_SSH,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+	}
+
+	history := newServerEntryHistory()
+	history.getProtocolHistory(TUNNEL_PROTOCOL_SSH).recordSuccess("network", 1*time.Second)
+	for i := 0; i < 10; i++ {
+		history.getProtocolHistory(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordFailure()
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		ranked := rankProtocols(protocols, history, "network")
+		if len(ranked) != len(protocols) {
+			t.Fatalf("unexpected ranked protocols: %v", ranked)
+		}
+		counts[ranked[0]] += 1
+	}
+
+	if counts[TUNNEL_PROTOCOL_SSH] <= counts[TUNNEL_PROTOCOL_UNFRONTED_MEEK] ||
+		counts[TUNNEL_PROTOCOL_UNFRONTED_MEEK] <= counts[TUNNEL_PROTOCOL_OBFUSCATED_SSH] ||
+		counts[TUNNEL_PROTOCOL_OBFUSCATED_SSH] == 0 {
+		t.Errorf("unexpected protocol selection: %v", counts)
+	}
+}
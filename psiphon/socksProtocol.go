@@ -0,0 +1,387 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS protocol values from https://www.ietf.org/rfc/rfc1928.txt,
+// https://www.ietf.org/rfc/rfc1929.txt and
+// http://www.openssh.com/txt/socks4.protocol, http://www.openssh.com/txt/socks4a.protocol
+const (
+	SOCKS_VERSION_4 = 0x04
+	SOCKS_VERSION_5 = 0x05
+
+	SOCKS_COMMAND_CONNECT       = 0x01
+	SOCKS_COMMAND_UDP_ASSOCIATE = 0x03
+
+	SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED = 0x00
+	SOCKS5_METHOD_USERNAME_PASSWORD          = 0x02
+	SOCKS5_METHOD_NO_ACCEPTABLE_METHODS      = 0xFF
+
+	SOCKS5_USERNAME_PASSWORD_VERSION = 0x01
+	SOCKS5_USERNAME_PASSWORD_SUCCESS = 0x00
+	SOCKS5_USERNAME_PASSWORD_FAILURE = 0x01
+
+	SOCKS5_ADDRESS_TYPE_IPV4       = 0x01
+	SOCKS5_ADDRESS_TYPE_DOMAINNAME = 0x03
+	SOCKS5_ADDRESS_TYPE_IPV6       = 0x04
+
+	SOCKS5_REPLY_SUCCEEDED                  = 0x00
+	SOCKS5_REPLY_GENERAL_FAILURE            = 0x01
+	SOCKS5_REPLY_NOT_ALLOWED                = 0x02
+	SOCKS5_REPLY_HOST_UNREACHABLE           = 0x04
+	SOCKS5_REPLY_COMMAND_NOT_SUPPORTED      = 0x07
+	SOCKS5_REPLY_ADDRESS_TYPE_NOT_SUPPORTED = 0x08
+
+	SOCKS4_REPLY_VERSION  = 0x00
+	SOCKS4_REPLY_GRANTED  = 0x5A
+	SOCKS4_REPLY_REJECTED = 0x5B
+
+	SOCKS4_MAX_FIELD_LENGTH = 255
+)
+
+// socksRequest is a SOCKS4, SOCKS4a or SOCKS5 request. target is the
+// destination, in host:port form. user is the authenticated user, when
+// authentication is required.
+type socksRequest struct {
+	version byte
+	command byte
+	target  string
+	user    *localProxyUser
+}
+
+// readSocksRequest performs the server side of the SOCKS handshake, up to
+// and including reading the request. SOCKS4, SOCKS4a and SOCKS5 are
+// supported. When users is not nil, SOCKS5 username/password
+// authentication is required, and SOCKS4 requests are refused. The caller
+// must respond with writeSocksReply.
+func readSocksRequest(conn net.Conn, users *localProxyUsers) (*socksRequest, error) {
+
+	// Note: the conn is read without buffering, as the client may send
+	// data, to be relayed, immediately following the request.
+
+	var version [1]byte
+	_, err := io.ReadFull(conn, version[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	switch version[0] {
+	case SOCKS_VERSION_4:
+		request, err := readSocks4Request(conn)
+		if err == nil && users != nil {
+			writeSocksReply(conn, request, SOCKS5_REPLY_NOT_ALLOWED, nil)
+			return nil, ContextError(errors.New("SOCKS4 authentication not supported"))
+		}
+		return request, err
+	case SOCKS_VERSION_5:
+		return readSocks5Request(conn, users)
+	}
+
+	return nil, ContextError(fmt.Errorf("unsupported SOCKS version: %d", version[0]))
+}
+
+func readSocks4Request(conn net.Conn) (*socksRequest, error) {
+
+	// | 1 byte command | 2 byte port | 4 byte IP | user ID | 0x00 | (SOCKS4a: domain | 0x00)
+
+	var header [7]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	port := int(header[1])<<8 | int(header[2])
+	ip := net.IP(header[3:7])
+
+	_, err = readSocks4Field(conn)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	host := ip.String()
+
+	// SOCKS4a: an IP address of 0.0.0.x, with x non-zero, indicates that a
+	// domain name follows the user ID.
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readSocks4Field(conn)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	return &socksRequest{
+		version: SOCKS_VERSION_4,
+		command: header[0],
+		target:  net.JoinHostPort(host, strconv.Itoa(port)),
+	}, nil
+}
+
+// readSocks4Field reads a null terminated SOCKS4 field.
+func readSocks4Field(conn net.Conn) (string, error) {
+	var field []byte
+	var value [1]byte
+	for {
+		_, err := io.ReadFull(conn, value[:])
+		if err != nil {
+			return "", ContextError(err)
+		}
+		if value[0] == 0x00 {
+			return string(field), nil
+		}
+		if len(field) >= SOCKS4_MAX_FIELD_LENGTH {
+			return "", ContextError(errors.New("invalid SOCKS4 field"))
+		}
+		field = append(field, value[0])
+	}
+}
+
+func readSocks5Request(conn net.Conn, users *localProxyUsers) (*socksRequest, error) {
+
+	// Method selection: | 1 byte method count | methods |
+
+	var methodCount [1]byte
+	_, err := io.ReadFull(conn, methodCount[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	methods := make([]byte, methodCount[0])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	requiredMethod := byte(SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED)
+	if users != nil {
+		requiredMethod = SOCKS5_METHOD_USERNAME_PASSWORD
+	}
+
+	method := byte(SOCKS5_METHOD_NO_ACCEPTABLE_METHODS)
+	for _, offeredMethod := range methods {
+		if offeredMethod == requiredMethod {
+			method = offeredMethod
+			break
+		}
+	}
+
+	_, err = conn.Write([]byte{SOCKS_VERSION_5, method})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if method == SOCKS5_METHOD_NO_ACCEPTABLE_METHODS {
+		return nil, ContextError(errors.New("no acceptable SOCKS5 method"))
+	}
+
+	var user *localProxyUser
+	if method == SOCKS5_METHOD_USERNAME_PASSWORD {
+		user, err = readSocks5UsernamePassword(conn, users)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	// Request: | version | command | reserved | address type | address | port |
+
+	var header [3]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if header[0] != SOCKS_VERSION_5 {
+		return nil, ContextError(errors.New("invalid SOCKS5 request version"))
+	}
+
+	request := &socksRequest{
+		version: SOCKS_VERSION_5,
+		command: header[1],
+		user:    user,
+	}
+
+	host, port, err := readSocks5Address(conn)
+	if err != nil {
+		if err == errSocks5AddressTypeNotSupported {
+			writeSocksReply(conn, request, SOCKS5_REPLY_ADDRESS_TYPE_NOT_SUPPORTED, nil)
+		}
+		return nil, ContextError(err)
+	}
+
+	request.target = net.JoinHostPort(host, strconv.Itoa(port))
+
+	return request, nil
+}
+
+// readSocks5UsernamePassword performs SOCKS5 username/password
+// authentication and returns the authenticated user.
+func readSocks5UsernamePassword(conn net.Conn, users *localProxyUsers) (*localProxyUser, error) {
+
+	// | version | username length | username | password length | password |
+
+	var header [2]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if header[0] != SOCKS5_USERNAME_PASSWORD_VERSION {
+		return nil, ContextError(errors.New("invalid SOCKS5 username/password version"))
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	var passwordLength [1]byte
+	_, err = io.ReadFull(conn, passwordLength[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	password := make([]byte, passwordLength[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	user := users.authenticate(string(username), string(password))
+
+	status := byte(SOCKS5_USERNAME_PASSWORD_SUCCESS)
+	if user == nil {
+		status = SOCKS5_USERNAME_PASSWORD_FAILURE
+	}
+	_, err = conn.Write([]byte{SOCKS5_USERNAME_PASSWORD_VERSION, status})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if user == nil {
+		return nil, ContextError(fmt.Errorf("SOCKS5 authentication failed for user: %s", username))
+	}
+
+	return user, nil
+}
+
+var errSocks5AddressTypeNotSupported = errors.New("SOCKS5 address type not supported")
+
+// readSocks5Address reads a SOCKS5 address type, address and port, the
+// format used in requests and in UDP datagram headers.
+func readSocks5Address(reader io.Reader) (host string, port int, err error) {
+
+	var addressType [1]byte
+	_, err = io.ReadFull(reader, addressType[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch addressType[0] {
+	case SOCKS5_ADDRESS_TYPE_IPV4, SOCKS5_ADDRESS_TYPE_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if addressType[0] == SOCKS5_ADDRESS_TYPE_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		if err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+
+	case SOCKS5_ADDRESS_TYPE_DOMAINNAME:
+		var length [1]byte
+		_, err = io.ReadFull(reader, length[:])
+		if err != nil {
+			return "", 0, err
+		}
+		domain := make([]byte, length[0])
+		_, err = io.ReadFull(reader, domain)
+		if err != nil {
+			return "", 0, err
+		}
+		host = string(domain)
+
+	default:
+		return "", 0, errSocks5AddressTypeNotSupported
+	}
+
+	var portBytes [2]byte
+	_, err = io.ReadFull(reader, portBytes[:])
+	if err != nil {
+		return "", 0, err
+	}
+	port = int(portBytes[0])<<8 | int(portBytes[1])
+
+	return host, port, nil
+}
+
+// appendSocks5Address appends a SOCKS5 address type, IP address and port
+// to buffer.
+func appendSocks5Address(buffer []byte, ip net.IP, port int) []byte {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		buffer = append(buffer, SOCKS5_ADDRESS_TYPE_IPV4)
+		buffer = append(buffer, ipv4...)
+	} else if ip.To16() != nil {
+		buffer = append(buffer, SOCKS5_ADDRESS_TYPE_IPV6)
+		buffer = append(buffer, ip.To16()...)
+	} else {
+		buffer = append(buffer, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0)
+	}
+	return append(buffer, byte(port>>8), byte(port))
+}
+
+// writeSocksReply sends the reply to a SOCKS request. reply is a SOCKS5
+// reply code, which is mapped to granted or rejected for SOCKS4. bindAddr
+// is the address reported to the client, and may be nil.
+func writeSocksReply(conn net.Conn, request *socksRequest, reply byte, bindAddr net.Addr) error {
+
+	var ip net.IP
+	var port int
+	switch addr := bindAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+
+	var buffer []byte
+
+	if request.version == SOCKS_VERSION_4 {
+		socks4Reply := byte(SOCKS4_REPLY_GRANTED)
+		if reply != SOCKS5_REPLY_SUCCEEDED {
+			socks4Reply = SOCKS4_REPLY_REJECTED
+		}
+		ipv4 := ip.To4()
+		if ipv4 == nil {
+			ipv4 = net.IPv4zero.To4()
+		}
+		buffer = append(buffer, SOCKS4_REPLY_VERSION, socks4Reply, byte(port>>8), byte(port))
+		buffer = append(buffer, ipv4...)
+	} else {
+		buffer = append(buffer, SOCKS_VERSION_5, reply, 0x00)
+		buffer = appendSocks5Address(buffer, ip, port)
+	}
+
+	_, err := conn.Write(buffer)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
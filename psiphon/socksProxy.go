@@ -23,17 +23,26 @@ import (
 	"fmt"
 	"net"
 	"sync"
-
-	socks "github.com/Psiphon-Inc/goptlib"
+	"time"
 )
 
 // SocksProxy is a SOCKS server that accepts local host connections
 // and, for each connection, establishes a port forward through
 // the tunnel SSH client and relays traffic through the port
 // forward.
+//
+// SOCKS4, SOCKS4a and SOCKS5 CONNECT requests are supported. When
+// UdpgwServerAddress is configured, SOCKS5 UDP ASSOCIATE requests are
+// also supported, and datagrams are relayed through the tunnel using
+// the udpgw protocol.
+//
+// When LocalProxyUsers is configured, SOCKS5 username/password
+// authentication is required and each user's policy is applied.
 type SocksProxy struct {
+	config                 *Config
 	tunneler               Tunneler
-	listener               *socks.SocksListener
+	users                  *localProxyUsers
+	listener               net.Listener
 	serveWaitGroup         *sync.WaitGroup
 	openConns              *Conns
 	stopListeningBroadcast chan struct{}
@@ -49,7 +58,7 @@ func NewSocksProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
-	listener, err := socks.ListenSocks(
+	listener, err := net.Listen(
 		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
 	if err != nil {
 		if IsAddressInUseError(err) {
@@ -58,6 +67,8 @@ func NewSocksProxy(
 		return nil, ContextError(err)
 	}
 	proxy = &SocksProxy{
+		config:                 config,
+		users:                  newLocalProxyUsers(config),
 		tunneler:               tunneler,
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
@@ -66,6 +77,11 @@ func NewSocksProxy(
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
+	if proxy.users != nil {
+		proxy.serveWaitGroup.Add(1)
+		go proxy.users.runBytesTransferredReporter(
+			_SOCKS_PROXY_TYPE, proxy.stopListeningBroadcast, proxy.serveWaitGroup)
+	}
 	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
 	return proxy, nil
 }
@@ -79,22 +95,57 @@ func (proxy *SocksProxy) Close() {
 	proxy.openConns.CloseAll()
 }
 
-func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err error) {
+func (proxy *SocksProxy) socksConnectionHandler(localConn net.Conn) (err error) {
 	defer localConn.Close()
 	defer proxy.openConns.Remove(localConn)
 	proxy.openConns.Add(localConn)
+
+	localConn.SetDeadline(time.Now().Add(SOCKS_PROXY_HANDSHAKE_TIMEOUT))
+	request, err := readSocksRequest(localConn, proxy.users)
+	if err != nil {
+		return ContextError(err)
+	}
+	localConn.SetDeadline(time.Time{})
+
+	switch request.command {
+	case SOCKS_COMMAND_CONNECT:
+		return proxy.handleConnect(localConn, request)
+	case SOCKS_COMMAND_UDP_ASSOCIATE:
+		if request.version == SOCKS_VERSION_5 && proxy.config.UdpgwServerAddress != "" {
+			return proxy.handleUDPAssociate(localConn, request)
+		}
+	}
+
+	writeSocksReply(localConn, request, SOCKS5_REPLY_COMMAND_NOT_SUPPORTED, nil)
+	return ContextError(fmt.Errorf("unsupported SOCKS command: %d", request.command))
+}
+
+func (proxy *SocksProxy) handleConnect(localConn net.Conn, request *socksRequest) error {
+	alwaysTunnel := false
+	if request.user != nil {
+		if !request.user.isTargetPermitted(request.target) {
+			writeSocksReply(localConn, request, SOCKS5_REPLY_NOT_ALLOWED, nil)
+			return ContextError(fmt.Errorf("destination not permitted: %s", request.target))
+		}
+		alwaysTunnel = request.user.config.AlwaysTunnel
+	}
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(localConn.Req.Target, false, localConn)
+	remoteConn, err := proxy.tunneler.Dial(request.target, alwaysTunnel, localConn)
 	if err != nil {
+		writeSocksReply(localConn, request, SOCKS5_REPLY_HOST_UNREACHABLE, nil)
 		return ContextError(err)
 	}
 	defer remoteConn.Close()
-	err = localConn.Grant(&net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
+	err = writeSocksReply(
+		localConn, request, SOCKS5_REPLY_SUCCEEDED, &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
 	if err != nil {
 		return ContextError(err)
 	}
+	if request.user != nil {
+		localConn = request.user.wrapConn(localConn)
+	}
 	LocalProxyRelay(_SOCKS_PROXY_TYPE, localConn, remoteConn)
 	return nil
 }
@@ -105,7 +156,7 @@ func (proxy *SocksProxy) serve() {
 loop:
 	for {
 		// Note: will be interrupted by listener.Close() call made by proxy.Close()
-		socksConnection, err := proxy.listener.AcceptSocks()
+		socksConnection, err := proxy.listener.Accept()
 		// Can't check for the exact error that Close() will cause in Accept(),
 		// (see: https://code.google.com/p/go/issues/detail?id=4373). So using an
 		// explicit stop signal to stop gracefully.
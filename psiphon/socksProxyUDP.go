@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handleUDPAssociate handles a SOCKS5 UDP ASSOCIATE request. A local UDP
+// socket is opened to receive datagrams from the client, and a single
+// tunneled port forward to UdpgwServerAddress carries all of the
+// association's datagrams, multiplexed using the udpgw protocol.
+//
+// The association is closed when the TCP connection on which the request
+// arrived is closed, or after LocalSocksProxyUDPIdleTimeoutSeconds with
+// no datagrams relayed in either direction. The udpgw port forward is
+// always tunneled, so an authenticated user's AlwaysTunnel is implied;
+// the user's AllowedPorts is applied to each datagram.
+func (proxy *SocksProxy) handleUDPAssociate(localConn net.Conn, request *socksRequest) error {
+
+	// Datagrams are accepted only from the host which made the request
+	// and, when the request specifies a port, only from that port.
+	clientIP := localConn.RemoteAddr().(*net.TCPAddr).IP
+	_, clientPortStr, _ := net.SplitHostPort(request.target)
+	clientPort, _ := strconv.Atoi(clientPortStr)
+
+	udpConn, err := net.ListenUDP(
+		"udp", &net.UDPAddr{IP: localConn.LocalAddr().(*net.TCPAddr).IP, Port: 0})
+	if err != nil {
+		writeSocksReply(localConn, request, SOCKS5_REPLY_GENERAL_FAILURE, nil)
+		return ContextError(err)
+	}
+	defer udpConn.Close()
+
+	// The udpgw port forward must always be tunneled, as the udpgw server
+	// address is handled by the Psiphon server.
+	udpgwConn, err := proxy.tunneler.Dial(proxy.config.UdpgwServerAddress, true, localConn)
+	if err != nil {
+		writeSocksReply(localConn, request, SOCKS5_REPLY_HOST_UNREACHABLE, nil)
+		return ContextError(err)
+	}
+	defer udpgwConn.Close()
+
+	err = writeSocksReply(localConn, request, SOCKS5_REPLY_SUCCEEDED, udpConn.LocalAddr())
+	if err != nil {
+		return ContextError(err)
+	}
+
+	association := &socksUDPAssociation{
+		localConn:    localConn,
+		udpConn:      udpConn,
+		udpgwConn:    udpgwConn,
+		clientIP:     clientIP,
+		clientPort:   clientPort,
+		user:         request.user,
+		idleTimeout:  time.Duration(proxy.config.LocalSocksProxyUDPIdleTimeoutSeconds) * time.Second,
+		connIDs:      make(map[string]uint16),
+		destinations: make(map[uint16]string),
+	}
+
+	return association.run()
+}
+
+// socksUDPAssociation relays datagrams for one SOCKS5 UDP association.
+// Each distinct destination address is assigned a udpgw conn ID, and so
+// a distinct UDP port forward on the server.
+type socksUDPAssociation struct {
+	// lastActivity is first, for 64-bit alignment with atomic operations.
+	lastActivity    int64
+	localConn       net.Conn
+	udpConn         *net.UDPConn
+	udpgwConn       net.Conn
+	clientIP        net.IP
+	clientPort      int
+	user            *localProxyUser
+	idleTimeout     time.Duration
+	clientAddrMutex sync.Mutex
+	clientAddr      *net.UDPAddr
+	connIDs         map[string]uint16
+	destinations    map[uint16]string
+	nextConnID      uint16
+	closeOnce       sync.Once
+}
+
+func (association *socksUDPAssociation) run() error {
+
+	association.touch()
+
+	relayWaitGroup := new(sync.WaitGroup)
+	relayWaitGroup.Add(2)
+
+	go func() {
+		defer relayWaitGroup.Done()
+		association.relayDownstream()
+		association.close()
+	}()
+
+	go func() {
+		defer relayWaitGroup.Done()
+		// No further data is expected on the TCP connection, which is read
+		// only to detect when the client closes it.
+		io.Copy(ioutil.Discard, association.localConn)
+		association.close()
+	}()
+
+	err := association.relayUpstream()
+	association.close()
+
+	relayWaitGroup.Wait()
+
+	return err
+}
+
+func (association *socksUDPAssociation) close() {
+	association.closeOnce.Do(func() {
+		association.localConn.Close()
+		association.udpConn.Close()
+		association.udpgwConn.Close()
+	})
+}
+
+func (association *socksUDPAssociation) touch() {
+	atomic.StoreInt64(&association.lastActivity, time.Now().UnixNano())
+}
+
+func (association *socksUDPAssociation) isIdle() bool {
+	lastActivity := time.Unix(0, atomic.LoadInt64(&association.lastActivity))
+	return time.Now().Sub(lastActivity) >= association.idleTimeout
+}
+
+// relayUpstream reads datagrams from the client and sends them through the
+// udpgw port forward. As the udpgw port forward doesn't support deadlines,
+// the idle timeout is checked when the client UDP socket read times out.
+func (association *socksUDPAssociation) relayUpstream() error {
+
+	buffer := make([]byte, 65536)
+	udpgwBuffer := make([]byte, UDPGW_PROTOCOL_MAX_MESSAGE_SIZE)
+
+	for {
+		association.udpConn.SetReadDeadline(time.Now().Add(association.idleTimeout))
+
+		n, addr, err := association.udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if !association.isIdle() {
+					continue
+				}
+				NoticeInfo("SOCKS UDP association idle timeout")
+			}
+			return nil
+		}
+
+		if !addr.IP.Equal(association.clientIP) ||
+			(association.clientPort != 0 && addr.Port != association.clientPort) {
+			continue
+		}
+
+		message, err := association.makeUdpgwMessage(buffer[:n])
+		if err != nil {
+			NoticeLocalProxyError(_SOCKS_PROXY_TYPE, ContextError(err))
+			continue
+		}
+
+		if association.user != nil {
+			if !association.user.isPortPermitted(int(message.remotePort)) {
+				continue
+			}
+			association.user.addBytes(int64(len(message.packet)), 0)
+		}
+
+		association.clientAddrMutex.Lock()
+		association.clientAddr = addr
+		association.clientAddrMutex.Unlock()
+
+		err = writeUdpgwMessage(association.udpgwConn, message, udpgwBuffer)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		association.touch()
+	}
+}
+
+// makeUdpgwMessage converts a SOCKS5 UDP datagram into a udpgw message.
+func (association *socksUDPAssociation) makeUdpgwMessage(datagram []byte) (*udpgwMessage, error) {
+
+	// | 2 byte reserved | 1 byte fragment | address type | address | port | data |
+
+	if len(datagram) < 4 {
+		return nil, ContextError(errors.New("invalid SOCKS UDP datagram"))
+	}
+	if datagram[2] != 0 {
+		return nil, ContextError(errors.New("fragmented SOCKS UDP datagrams not supported"))
+	}
+
+	reader := bytes.NewReader(datagram[3:])
+	host, port, err := readSocks5Address(reader)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	packet := datagram[len(datagram)-reader.Len():]
+
+	// The udpgw protocol requires an IP address destination.
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ContextError(errors.New("SOCKS UDP domain name destinations not supported"))
+	}
+
+	var flags byte
+
+	destination := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	connID, ok := association.connIDs[destination]
+	if !ok {
+		connID = association.nextConnID
+		association.nextConnID += 1
+		if previousDestination, ok := association.destinations[connID]; ok {
+			delete(association.connIDs, previousDestination)
+		}
+		association.connIDs[destination] = connID
+		association.destinations[connID] = destination
+
+		// Rebind replaces any server port forward still using a conn ID
+		// which is being reused.
+		flags |= UDPGW_PROTOCOL_FLAG_REBIND
+	}
+
+	// DNS requests are flagged so that the server may apply its transparent
+	// DNS forwarding.
+	if port == DNS_PORT {
+		flags |= UDPGW_PROTOCOL_FLAG_DNS
+	}
+
+	return &udpgwMessage{
+		flags:      flags,
+		connID:     connID,
+		remoteIP:   ip,
+		remotePort: uint16(port),
+		packet:     packet,
+	}, nil
+}
+
+// relayDownstream reads udpgw messages from the udpgw port forward and sends
+// the packets to the client as SOCKS5 UDP datagrams.
+func (association *socksUDPAssociation) relayDownstream() {
+
+	buffer := make([]byte, UDPGW_PROTOCOL_MAX_MESSAGE_SIZE)
+	var datagram []byte
+
+	for {
+		message, err := readUdpgwMessage(association.udpgwConn, buffer)
+		if err != nil {
+			return
+		}
+
+		association.clientAddrMutex.Lock()
+		clientAddr := association.clientAddr
+		association.clientAddrMutex.Unlock()
+
+		if clientAddr == nil {
+			continue
+		}
+
+		datagram = append(datagram[:0], 0x00, 0x00, 0x00)
+		datagram = appendSocks5Address(datagram, message.remoteIP, int(message.remotePort))
+		datagram = append(datagram, message.packet...)
+
+		_, err = association.udpConn.WriteToUDP(datagram, clientAddr)
+		if err != nil {
+			return
+		}
+
+		if association.user != nil {
+			association.user.addBytes(0, int64(len(message.packet)))
+		}
+
+		association.touch()
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testUdpgwServerAddress = "127.0.0.1:7300"
+
+// testSocksTunneler is a Tunneler which, in place of port forwards, runs an
+// echo server for TCP port forwards and a udpgw echo server for port
+// forwards to the udpgw server address.
+type testSocksTunneler struct {
+}
+
+func (tunneler *testSocksTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	clientConn, serverConn := net.Pipe()
+
+	if remoteAddr == testUdpgwServerAddress {
+		go func() {
+			defer serverConn.Close()
+			readBuffer := make([]byte, UDPGW_PROTOCOL_MAX_MESSAGE_SIZE)
+			writeBuffer := make([]byte, UDPGW_PROTOCOL_MAX_MESSAGE_SIZE)
+			for {
+				message, err := readUdpgwMessage(serverConn, readBuffer)
+				if err != nil {
+					return
+				}
+				message.flags = 0
+				err = writeUdpgwMessage(serverConn, message, writeBuffer)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	} else {
+		go func() {
+			defer serverConn.Close()
+			io.Copy(serverConn, serverConn)
+		}()
+	}
+
+	return clientConn, nil
+}
+
+func (tunneler *testSocksTunneler) SignalComponentFailure() {
+}
+
+func testSocksRoundTrip(t *testing.T, conn net.Conn, request, expectedReply []byte) {
+	_, err := conn.Write(request)
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	reply := make([]byte, len(expectedReply))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if !bytes.Equal(reply, expectedReply) {
+		t.Fatalf("unexpected reply: %x", reply)
+	}
+}
+
+func TestSocksProxy(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "UdpgwServerAddress" : "` + testUdpgwServerAddress + `",
+        "LocalSocksProxyUDPIdleTimeoutSeconds" : 1
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	proxy, err := NewSocksProxy(config, new(testSocksTunneler), "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxyAddress := proxy.listener.Addr().String()
+
+	// SOCKS5 CONNECT
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 1, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED},
+		[]byte{SOCKS_VERSION_5, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED})
+	testSocksRoundTrip(t, conn,
+		append(append([]byte{SOCKS_VERSION_5, SOCKS_COMMAND_CONNECT, 0, SOCKS5_ADDRESS_TYPE_DOMAINNAME, 11},
+			[]byte("example.com")...), 0, 80),
+		[]byte{SOCKS_VERSION_5, SOCKS5_REPLY_SUCCEEDED, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	testSocksRoundTrip(t, conn, []byte("data"), []byte("data"))
+	conn.Close()
+
+	// SOCKS4a CONNECT
+
+	conn, err = net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		append(append([]byte{SOCKS_VERSION_4, SOCKS_COMMAND_CONNECT, 0, 80, 0, 0, 0, 1, 'u', 0},
+			[]byte("example.com")...), 0),
+		[]byte{SOCKS4_REPLY_VERSION, SOCKS4_REPLY_GRANTED, 0, 0, 0, 0, 0, 0})
+	testSocksRoundTrip(t, conn, []byte("data"), []byte("data"))
+	conn.Close()
+
+	// Unsupported command
+
+	conn, err = net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 1, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED},
+		[]byte{SOCKS_VERSION_5, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED})
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 0x02, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0},
+		[]byte{SOCKS_VERSION_5, SOCKS5_REPLY_COMMAND_NOT_SUPPORTED, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	conn.Close()
+
+	// SOCKS5 UDP ASSOCIATE
+
+	conn, err = net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	testSocksRoundTrip(t, conn,
+		[]byte{SOCKS_VERSION_5, 1, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED},
+		[]byte{SOCKS_VERSION_5, SOCKS5_METHOD_NO_AUTHENTICATION_REQUIRED})
+	_, err = conn.Write(
+		[]byte{SOCKS_VERSION_5, SOCKS_COMMAND_UDP_ASSOCIATE, 0, SOCKS5_ADDRESS_TYPE_IPV4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	reply := make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if reply[1] != SOCKS5_REPLY_SUCCEEDED || reply[3] != SOCKS5_ADDRESS_TYPE_IPV4 {
+		t.Fatalf("unexpected UDP ASSOCIATE reply: %x", reply)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	defer udpConn.Close()
+
+	destinations := []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 1234},
+		{IP: net.ParseIP("192.0.2.2"), Port: 5678},
+	}
+
+	for i := 0; i < 10; i++ {
+		destination := destinations[i%len(destinations)]
+		header := appendSocks5Address([]byte{0, 0, 0}, destination.IP, destination.Port)
+		packet := []byte{byte(i)}
+
+		_, err = udpConn.WriteToUDP(append(header, packet...), relayAddr)
+		if err != nil {
+			t.Fatalf("WriteToUDP failed: %s", err)
+		}
+
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buffer := make([]byte, 1024)
+		n, _, err := udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("ReadFromUDP failed: %s", err)
+		}
+		if !bytes.Equal(buffer[:n], append(header, packet...)) {
+			t.Fatalf("unexpected datagram: %x", buffer[:n])
+		}
+	}
+
+	// The association is closed when idle
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected read from UDP association connection")
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatalf("UDP association not closed when idle")
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -47,7 +48,12 @@ import (
 //
 // Classification results (both the hostname resolution and the
 // following IP address classification) are cached for the duration
-// of the DNS record TTL.
+// of the DNS record TTL, up to SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_TTL.
+// Resolutions which fail because the host has no IP address, including
+// NXDOMAIN responses, are cached, as tunneled, for the shorter
+// SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL. Resolutions which fail
+// because the tunneled DNS request failed aren't cached. The cache is
+// bounded to SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES.
 //
 // Classification is by geographical region (country code). When the
 // split tunnel feature is configured to be on, and if the IP
@@ -67,65 +73,200 @@ import (
 // Routes data is fetched asynchronously after Start() is called. Routes
 // data is cached in the data store so it need not be downloaded in full
 // when fresh data is in the cache.
+//
+// The last known region is also stored, and its cached routes data is
+// installed by InstallCachedRoutes() at startup, before any tunnel is
+// established, so that split tunneling is on while fresh routes data is
+// fetched. When the region reported in the handshake differs from the
+// current region, the current routes are discarded and any cached routes
+// for the new region are installed. Fresh routes data replaces the
+// installed routes atomically.
+//
+// Routes data may also include domain suffixes, which are matched directly
+// against hostnames. When a hostname matches, no DNS request is required
+// to classify it; IP address classification is the fallback.
+//
+// User-defined rules, SplitTunnelRules, are evaluated before the routes
+// data. Rules apply even when there is no routes data.
 type SplitTunnelClassifier struct {
 	mutex                    sync.RWMutex
 	fetchRoutesUrlFormat     string
 	routesSignaturePublicKey string
-	dnsServerAddress         string
-	dnsTunneler              Tunneler
+	dnsResolver              *tunneledDnsResolver
 	fetchRoutesWaitGroup     *sync.WaitGroup
+	region                   string
 	isRoutesSet              bool
-	cache                    map[string]*classification
+	cache                    *classificationCache
+	noticedRuleMatches       *classificationCache
 	routes                   networkList
+	routesDomainSuffixes     domainSuffixList
+	rules                    *compiledSplitTunnelRules
 }
 
 type classification struct {
 	isUntunneled bool
+	rule         string
 	expiry       time.Time
+	isNegative   bool
 }
 
 func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelClassifier {
-	return &SplitTunnelClassifier{
+	classifier := &SplitTunnelClassifier{
 		fetchRoutesUrlFormat:     config.SplitTunnelRoutesUrlFormat,
 		routesSignaturePublicKey: config.SplitTunnelRoutesSignaturePublicKey,
-		dnsServerAddress:         config.SplitTunnelDnsServer,
-		dnsTunneler:              tunneler,
+		dnsResolver:              newTunneledDnsResolver(config, tunneler, config.SplitTunnelDnsServer),
 		fetchRoutesWaitGroup:     new(sync.WaitGroup),
 		isRoutesSet:              false,
-		cache:                    make(map[string]*classification),
+		cache:                    newClassificationCache(SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES),
+		noticedRuleMatches:       newClassificationCache(SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES),
+	}
+	if config.SplitTunnelRules != nil {
+		// Note: the rules are validated in LoadConfig
+		err := classifier.SetRules(config.SplitTunnelRules)
+		if err != nil {
+			NoticeAlert("failed to set split tunnel rules: %s", err)
+		}
 	}
+	return classifier
 }
 
-// Start resets the state of the classifier. In the default state,
-// all IP addresses are classified as requiring tunneling. With
-// sufficient configuration and region info, this function starts
-// a goroutine to asynchronously fetch and install the routes data.
-func (classifier *SplitTunnelClassifier) Start(fetchRoutesTunnel *Tunnel) {
+// SetRules replaces the user-defined split tunnel rules. When rules is nil,
+// the rules are cleared. Cached classifications are discarded, so the new
+// rules apply to all subsequent classifications.
+func (classifier *SplitTunnelClassifier) SetRules(rules *SplitTunnelRules) error {
+
+	var compiledRules *compiledSplitTunnelRules
+	if rules != nil {
+		var err error
+		compiledRules, err = compileSplitTunnelRules(rules)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
 
 	classifier.mutex.Lock()
 	defer classifier.mutex.Unlock()
 
-	classifier.isRoutesSet = false
+	classifier.rules = compiledRules
+	classifier.cache.clear()
+	classifier.noticedRuleMatches.clear()
 
-	if classifier.dnsServerAddress == "" ||
-		classifier.routesSignaturePublicKey == "" ||
-		classifier.fetchRoutesUrlFormat == "" {
-		// Split tunnel capability is not configured
+	return nil
+}
+
+// DATA_STORE_SPLIT_TUNNEL_REGION_KEY is the data store key for the last
+// known split tunnel region.
+const DATA_STORE_SPLIT_TUNNEL_REGION_KEY = "splitTunnelRegion"
+
+// InstallCachedRoutes installs the cached routes data for the last known
+// region, if any. This enables split tunneling immediately at startup,
+// before the first tunnel is established and reports the current region.
+func (classifier *SplitTunnelClassifier) InstallCachedRoutes() {
+
+	if !classifier.isConfigured() {
 		return
 	}
 
-	if fetchRoutesTunnel.serverContext == nil {
-		// Tunnel has no serverContext
+	region, err := GetKeyValue(DATA_STORE_SPLIT_TUNNEL_REGION_KEY)
+	if err != nil {
+		NoticeAlert("failed to get split tunnel region: %s", err)
+		return
+	}
+	if region == "" {
 		return
 	}
 
-	if fetchRoutesTunnel.serverContext.clientRegion == "" {
-		// Split tunnel region is unknown
+	classifier.mutex.Lock()
+	classifier.region = region
+	classifier.mutex.Unlock()
+
+	classifier.installCachedRoutes(region)
+}
+
+// Start updates the state of the classifier for the region reported by
+// the tunnel's handshake. When the region is unknown, all IP addresses are
+// classified as requiring tunneling. When the region has changed, the
+// routes for the previous region are discarded and cached routes for the
+// new region, if any, are installed. With sufficient configuration and
+// region info, this function starts a goroutine to asynchronously fetch
+// and install fresh routes data.
+func (classifier *SplitTunnelClassifier) Start(fetchRoutesTunnel *Tunnel) {
+
+	region := ""
+	if fetchRoutesTunnel.serverContext != nil {
+		region = fetchRoutesTunnel.serverContext.clientRegion
+	}
+
+	classifier.mutex.Lock()
+	previousRegion := classifier.region
+	if !classifier.isConfigured() || region != previousRegion {
+		classifier.region = region
+		classifier.isRoutesSet = false
+		classifier.cache.clear()
+		classifier.noticedRuleMatches.clear()
+	}
+	classifier.mutex.Unlock()
+
+	if !classifier.isConfigured() {
+		// Split tunnel capability is not configured
+		return
+	}
+
+	if region == "" {
+		// Split tunnel region is unknown; this includes the case where the
+		// tunnel has no serverContext
 		return
 	}
 
+	if region != previousRegion {
+
+		if previousRegion != "" {
+			NoticeInfo("split tunnel region changed from %s to %s", previousRegion, region)
+		}
+
+		err := SetKeyValue(DATA_STORE_SPLIT_TUNNEL_REGION_KEY, region)
+		if err != nil {
+			NoticeAlert("failed to store split tunnel region: %s", err)
+		}
+
+		classifier.installCachedRoutes(region)
+	}
+
+	classifier.mutex.Lock()
+	defer classifier.mutex.Unlock()
+
 	classifier.fetchRoutesWaitGroup.Add(1)
-	go classifier.setRoutes(fetchRoutesTunnel)
+	go classifier.setRoutes(fetchRoutesTunnel, region)
+}
+
+// isConfigured checks that the split tunnel capability is configured.
+func (classifier *SplitTunnelClassifier) isConfigured() bool {
+	return classifier.dnsResolver != nil &&
+		classifier.routesSignaturePublicKey != "" &&
+		classifier.fetchRoutesUrlFormat != ""
+}
+
+// installCachedRoutes installs the cached routes data for region, if any.
+func (classifier *SplitTunnelClassifier) installCachedRoutes(region string) {
+
+	routesData, err := GetSplitTunnelRoutesData(region)
+	if err != nil {
+		NoticeAlert("failed to get cached split tunnel routes: %s", err)
+		return
+	}
+	if routesData == nil {
+		return
+	}
+
+	installed, err := classifier.installRoutes(region, routesData)
+	if err != nil {
+		NoticeAlert("failed to install cached split tunnel routes: %s", err)
+		return
+	}
+
+	if installed {
+		NoticeSplitTunnelRegion(region)
+	}
 }
 
 // Shutdown waits until the background setRoutes() goroutine is finished.
@@ -144,56 +285,228 @@ func (classifier *SplitTunnelClassifier) Shutdown() {
 	}
 }
 
-// IsUntunneled takes a destination hostname or IP address and determines
-// if it should be accessed through a tunnel. When a hostname is presented, it
-// is first resolved to an IP address which can be matched against the routes data.
+// IsUntunneled takes a destination hostname or IP address, and port, and
+// determines if it should be accessed through a tunnel. The user-defined
+// rules are evaluated first. When a hostname is presented, it is matched
+// against the routes domain suffixes; when there's no match, or when the
+// CIDR rules are required, it is first resolved to an IP address which can
+// be matched against the CIDR rules and routes data.
 // Multiple goroutines may invoke RequiresTunnel simultaneously. Multi-reader
 // locks are used in the implementation to enable concurrent access, with no locks
 // held during network access.
-func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool {
+func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string, port int) bool {
 
-	if !classifier.hasRoutes() {
+	classifier.mutex.RLock()
+	rules := classifier.rules
+	classifier.mutex.RUnlock()
+
+	if rules != nil {
+		if _, ok := rules.alwaysTunnel.matchHostAndPort(targetAddress, port); ok {
+			return false
+		}
+		if rule, ok := rules.neverTunnel.matchHostAndPort(targetAddress, port); ok {
+			classifier.noticeUntunneledRuleMatch(targetAddress, rule)
+			return true
+		}
+	}
+
+	hasRoutes := classifier.hasRoutes()
+	hasNetworkRules := rules != nil && rules.hasNetworks()
+
+	if !hasRoutes && !hasNetworkRules {
 		return false
 	}
 
-	classifier.mutex.RLock()
-	cachedClassification, ok := classifier.cache[targetAddress]
-	classifier.mutex.RUnlock()
-	if ok && cachedClassification.expiry.After(time.Now()) {
+	// When there are user-defined CIDR rules, which take precedence over the
+	// routes, the hostname must be resolved first, and the routes domain
+	// suffixes are instead matched in classifyAddress.
+	if hasRoutes && !hasNetworkRules {
+		if rule, ok := classifier.hostnameInRoutes(targetAddress); ok {
+			classifier.noticeUntunneledRuleMatch(targetAddress, rule)
+			return true
+		}
+	}
+
+	if classifier.dnsResolver == nil && net.ParseIP(targetAddress) == nil {
+		// Can't resolve the hostname to classify it
+		return false
+	}
+
+	now := time.Now()
+	classifier.cache.noticeStats(now)
+
+	cachedClassification, ok := classifier.cache.get(targetAddress, now)
+	if ok {
 		return cachedClassification.isUntunneled
 	}
 
-	ipAddr, ttl, err := tunneledLookupIP(
-		classifier.dnsServerAddress, classifier.dnsTunneler, targetAddress)
+	// When neither the routes nor the rules include any IPv6 networks, an
+	// IPv6 address can't be classified as untunneled, and the host is
+	// classified by its IPv4 addresses only; the AAAA query is skipped.
+	includeIPv6 := classifier.hasIPv6Networks(rules, hasRoutes)
+
+	ipAddrs, ttl, err := tunneledLookupIP(classifier.dnsResolver, targetAddress, includeIPv6)
 	if err != nil {
 		NoticeAlert("failed to resolve address for split tunnel classification: %s", err)
+
+		// When the host has no IP address, cache the failure, so that
+		// destinations which can't be resolved don't incur a tunneled DNS
+		// request on every connection. The destination is tunneled until
+		// the negative entry expires. A failed tunneled DNS request isn't
+		// cached, as it may be transient, for example when no tunnel is
+		// available.
+		if err == errNoIPAddress {
+			classifier.cacheClassification(rules, targetAddress, &classification{
+				expiry:     time.Now().Add(SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL),
+				isNegative: true,
+			})
+		}
 		return false
 	}
+	if ttl > SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_TTL {
+		ttl = SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_TTL
+	}
 	expiry := time.Now().Add(ttl)
 
-	isUntunneled := classifier.ipAddressInRoutes(ipAddr)
-
-	// TODO: garbage collect expired items from cache?
+	// When the hostname resolves to both IPv4 and IPv6 addresses, either may
+	// be used for the untunneled connection, so both must be classified as
+	// untunneled.
+	isUntunneled := false
+	rule := ""
+	for i, ipAddr := range ipAddrs {
+		isAddrUntunneled, addrRule := classifier.classifyAddress(
+			rules, hasRoutes, targetAddress, ipAddr)
+		if !isAddrUntunneled {
+			isUntunneled = false
+			break
+		}
+		if i == 0 {
+			isUntunneled = true
+			rule = addrRule
+		}
+	}
 
-	classifier.mutex.Lock()
-	classifier.cache[targetAddress] = &classification{isUntunneled, expiry}
-	classifier.mutex.Unlock()
+	classifier.cacheClassification(rules, targetAddress, &classification{
+		isUntunneled: isUntunneled,
+		rule:         rule,
+		expiry:       expiry,
+	})
 
 	if isUntunneled {
-		NoticeUntunneled(targetAddress)
+		NoticeUntunneled(targetAddress, rule)
 	}
 
 	return isUntunneled
 }
 
-// setRoutes is a background routine that fetches routes data and installs it,
-// which sets the isRoutesSet flag, indicating that IP addresses may now be classified.
-func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel) {
-	defer classifier.fetchRoutesWaitGroup.Done()
+// IsUntunneledDomain classifies a hostname, without a destination port or a
+// DNS resolution, using the domain suffix rules and the routes domain
+// suffixes. CIDR and port rules, and the routes networks, aren't applied.
+// This is used to select untunneled DNS resolution for domestic domains.
+func (classifier *SplitTunnelClassifier) IsUntunneledDomain(hostname string) bool {
+
+	classifier.mutex.RLock()
+	rules := classifier.rules
+	classifier.mutex.RUnlock()
 
-	// Note: a possible optimization is to install cached routes
-	// before making the request. That would ensure some split
-	// tunneling for the duration of the request.
+	if rules != nil {
+		if _, ok := rules.alwaysTunnel.matchHostAndPort(hostname, 0); ok {
+			return false
+		}
+		if _, ok := rules.neverTunnel.matchHostAndPort(hostname, 0); ok {
+			return true
+		}
+	}
+
+	if classifier.hasRoutes() {
+		_, ok := classifier.hostnameInRoutes(hostname)
+		return ok
+	}
+
+	return false
+}
+
+// hasIPv6Networks indicates if the CIDR rules or, when hasRoutes is set, the
+// routes include any IPv6 networks.
+func (classifier *SplitTunnelClassifier) hasIPv6Networks(
+	rules *compiledSplitTunnelRules, hasRoutes bool) bool {
+
+	if rules != nil && (rules.alwaysTunnel.hasIPv6Networks() || rules.neverTunnel.hasIPv6Networks()) {
+		return true
+	}
+
+	if hasRoutes {
+		classifier.mutex.RLock()
+		defer classifier.mutex.RUnlock()
+		return classifier.routes.hasIPv6Networks()
+	}
+
+	return false
+}
+
+// noticeUntunneledRuleMatch emits NoticeUntunneled for a host which matched
+// a rule, or the routes domain suffixes, before any DNS resolution. These
+// matches are evaluated on every call, and aren't cached as classifications,
+// so the noticed hosts are recorded to emit the notice once per host.
+func (classifier *SplitTunnelClassifier) noticeUntunneledRuleMatch(targetAddress, rule string) {
+	now := time.Now()
+	if _, ok := classifier.noticedRuleMatches.get(targetAddress, now); ok {
+		return
+	}
+	classifier.noticedRuleMatches.set(targetAddress, &classification{
+		isUntunneled: true,
+		rule:         rule,
+		expiry:       now.Add(SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_TTL),
+	}, now)
+	NoticeUntunneled(targetAddress, rule)
+}
+
+// cacheClassification caches a classification made using rules. The
+// classification isn't cached when the rules changed in the meantime.
+func (classifier *SplitTunnelClassifier) cacheClassification(
+	rules *compiledSplitTunnelRules, targetAddress string, value *classification) {
+
+	classifier.mutex.RLock()
+	defer classifier.mutex.RUnlock()
+
+	if classifier.rules == rules {
+		classifier.cache.set(targetAddress, value, time.Now())
+	}
+}
+
+// classifyAddress classifies a hostname, resolved to ipAddr, using the CIDR
+// rules and then, when hasRoutes is set, the routes data. The matched rule
+// is returned, for reporting.
+func (classifier *SplitTunnelClassifier) classifyAddress(
+	rules *compiledSplitTunnelRules, hasRoutes bool, host string, ipAddr net.IP) (bool, string) {
+
+	if rules != nil {
+		if rule, ok := rules.alwaysTunnel.matchIPAddress(ipAddr); ok {
+			return false, rule
+		}
+		if rule, ok := rules.neverTunnel.matchIPAddress(ipAddr); ok {
+			return true, rule
+		}
+	}
+
+	if hasRoutes {
+		if rule, ok := classifier.hostnameInRoutes(host); ok {
+			return true, rule
+		}
+		if classifier.ipAddressInRoutes(ipAddr) {
+			return true, "routes"
+		}
+	}
+
+	return false, ""
+}
+
+// setRoutes is a background routine that fetches routes data for region and
+// installs it, which sets the isRoutesSet flag, indicating that IP addresses
+// may now be classified. Any cached routes data installed for region remains
+// in use until the fetched data replaces it.
+func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel, region string) {
+	defer classifier.fetchRoutesWaitGroup.Done()
 
 	routesData, err := classifier.getRoutes(tunnel)
 	if err != nil {
@@ -201,13 +514,15 @@ func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel) {
 		return
 	}
 
-	err = classifier.installRoutes(routesData)
+	installed, err := classifier.installRoutes(region, routesData)
 	if err != nil {
 		NoticeAlert("failed to install split tunnel routes: %s", err)
 		return
 	}
 
-	NoticeSplitTunnelRegion(tunnel.serverContext.clientRegion)
+	if installed {
+		NoticeSplitTunnelRegion(region)
+	}
 }
 
 // getRoutes makes a web request to download fresh routes data for the
@@ -338,20 +653,47 @@ func (classifier *SplitTunnelClassifier) hasRoutes() bool {
 	return classifier.isRoutesSet
 }
 
+// hasRules checks if the classifier has user-defined rules.
+func (classifier *SplitTunnelClassifier) hasRules() bool {
+	classifier.mutex.RLock()
+	defer classifier.mutex.RUnlock()
+
+	return classifier.rules != nil
+}
+
 // installRoutes parses the raw routes data and creates data structures
-// for fast in-memory classification.
-func (classifier *SplitTunnelClassifier) installRoutes(routesData []byte) (err error) {
+// for fast in-memory classification. The data is parsed before the new
+// routes replace the installed routes, in one step, so classification
+// always uses either the old or the new routes. The routes are installed
+// only when region is still the current region, as the region may change
+// while routes data is fetched; installed indicates whether the routes
+// were installed.
+func (classifier *SplitTunnelClassifier) installRoutes(
+	region string, routesData []byte) (installed bool, err error) {
+
+	// Routes data may contain only networks, only domain suffixes, or both.
+	routes, err := NewNetworkList(routesData)
+	routesDomainSuffixes := NewDomainSuffixList(routesData)
+	if err != nil && len(routesDomainSuffixes) == 0 {
+		return false, ContextError(err)
+	}
+
 	classifier.mutex.Lock()
 	defer classifier.mutex.Unlock()
 
-	classifier.routes, err = NewNetworkList(routesData)
-	if err != nil {
-		return ContextError(err)
+	if region != classifier.region {
+		return false, nil
 	}
 
+	classifier.routes = routes
+	classifier.routesDomainSuffixes = routesDomainSuffixes
 	classifier.isRoutesSet = true
 
-	return nil
+	// Discard classifications made with any previous routes.
+	classifier.cache.clear()
+	classifier.noticedRuleMatches.clear()
+
+	return true, nil
 }
 
 // ipAddressInRoutes searches for a split tunnel candidate IP address in the routes data.
@@ -362,15 +704,155 @@ func (classifier *SplitTunnelClassifier) ipAddressInRoutes(ipAddr net.IP) bool {
 	return classifier.routes.ContainsIpAddress(ipAddr)
 }
 
+// hostnameInRoutes searches for a split tunnel candidate hostname in the
+// routes domain suffixes. The matched rule is returned, for reporting.
+func (classifier *SplitTunnelClassifier) hostnameInRoutes(hostname string) (string, bool) {
+	classifier.mutex.RLock()
+	defer classifier.mutex.RUnlock()
+
+	domainSuffix, ok := classifier.routesDomainSuffixes.ContainsHostname(hostname)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("routes domain suffix %s", domainSuffix), true
+}
+
+// domainSuffixList is a set of domain suffixes. It's used to lookup
+// candidate hostnames for split tunnel classification, without a DNS
+// request.
+type domainSuffixList map[string]bool
+
+// NewDomainSuffixList parses text routes data and produces a
+// domainSuffixList for fast ContainsHostname lookup.
+// Domain suffixes are expected to be text lines of the form
+// "domain\texample.com\n". Other lines, including networks, are
+// ignored. The list is empty when there are no domain suffixes.
+func NewDomainSuffixList(routesData []byte) domainSuffixList {
+
+	list := make(domainSuffixList)
+	scanner := bufio.NewScanner(bytes.NewReader(routesData))
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		s := strings.Split(scanner.Text(), "\t")
+		if len(s) != 2 || s[0] != "domain" {
+			continue
+		}
+		domainSuffix := normalizeDomain(s[1])
+		if domainSuffix == "" || net.ParseIP(domainSuffix) != nil {
+			continue
+		}
+		list[domainSuffix] = true
+	}
+
+	return list
+}
+
+// ContainsHostname checks if the hostname, or any parent domain of the
+// hostname, is in the domainSuffixList. Each lookup is a map lookup per
+// label in the hostname. The matching domain suffix is returned.
+func (list domainSuffixList) ContainsHostname(hostname string) (string, bool) {
+
+	if len(list) == 0 || net.ParseIP(hostname) != nil {
+		return "", false
+	}
+
+	domain := normalizeDomain(hostname)
+	for domain != "" {
+		if list[domain] {
+			return domain, true
+		}
+		index := strings.Index(domain, ".")
+		if index == -1 {
+			break
+		}
+		domain = domain[index+1:]
+	}
+
+	return "", false
+}
+
 // networkList is a sorted list of network ranges. It's used to
 // lookup candidate IP addresses for split tunnel classification.
+// Both IPv4 and IPv6 networks are supported. Each network is stored
+// as a range of 128-bit values, with IPv4 networks in the IPv4-mapped
+// IPv6 address space, so that all lookups are a single binary search.
 // networkList implements Sort.Interface.
-type networkList []net.IPNet
+type networkList []networkRange
+
+// networkRange is the first and last IP address in a network.
+type networkRange struct {
+	first ipValue
+	last  ipValue
+}
+
+// ipValue is an IP address, in 16-byte form, as a 128-bit value.
+type ipValue struct {
+	high uint64
+	low  uint64
+}
+
+func makeIPValue(ip net.IP) (ipValue, bool) {
+	ip = ip.To16()
+	if ip == nil {
+		return ipValue{}, false
+	}
+	return ipValue{
+		high: binary.BigEndian.Uint64(ip[0:8]),
+		low:  binary.BigEndian.Uint64(ip[8:16]),
+	}, true
+}
+
+func (value ipValue) less(other ipValue) bool {
+	return value.high < other.high ||
+		(value.high == other.high && value.low < other.low)
+}
+
+// isIPv4 indicates if the value is in the IPv4-mapped address space.
+func (value ipValue) isIPv4() bool {
+	return value.high == 0 && value.low>>32 == 0xffff
+}
+
+// hasIPv6Networks indicates if the list includes any networks outside of
+// the IPv4-mapped address space.
+func (list networkList) hasIPv6Networks() bool {
+	for _, network := range list {
+		if !network.first.isIPv4() || !network.last.isIPv4() {
+			return true
+		}
+	}
+	return false
+}
+
+func makeNetworkRange(network *net.IPNet) (networkRange, bool) {
+	ip := network.IP.To16()
+	if ip == nil {
+		return networkRange{}, false
+	}
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		// Expand to a mask for the IPv4-mapped address space
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	if len(mask) != net.IPv6len {
+		return networkRange{}, false
+	}
+	first := make(net.IP, net.IPv6len)
+	last := make(net.IP, net.IPv6len)
+	for i := 0; i < net.IPv6len; i++ {
+		first[i] = ip[i] & mask[i]
+		last[i] = ip[i] | ^mask[i]
+	}
+	firstValue, _ := makeIPValue(first)
+	lastValue, _ := makeIPValue(last)
+	return networkRange{first: firstValue, last: lastValue}, true
+}
 
 // NewNetworkList parses text routes data and produces a networkList
 // for fast ContainsIpAddress lookup.
 // The input format is expected to be text lines where each line
-// is, e.g., "1.2.3.0\t255.255.255.0\n"
+// is an IPv4 network and mask, e.g., "1.2.3.0\t255.255.255.0\n"; an
+// IPv4 or IPv6 network and prefix length, e.g., "2001:db8::\t32\n";
+// or a CIDR, e.g., "2001:db8::/32\n".
 func NewNetworkList(routesData []byte) (networkList, error) {
 
 	// Parse text routes data
@@ -378,18 +860,17 @@ func NewNetworkList(routesData []byte) (networkList, error) {
 	scanner := bufio.NewScanner(bytes.NewReader(routesData))
 	scanner.Split(bufio.ScanLines)
 	for scanner.Scan() {
-		s := strings.Split(scanner.Text(), "\t")
-		if len(s) != 2 {
+		network := parseNetwork(scanner.Text())
+		if network == nil {
 			continue
 		}
 
-		ip := parseIPv4(s[0])
-		mask := parseIPv4Mask(s[1])
-		if ip == nil || mask == nil {
+		networkRange, ok := makeNetworkRange(network)
+		if !ok {
 			continue
 		}
 
-		list = append(list, net.IPNet{IP: ip.Mask(mask), Mask: mask})
+		list = append(list, networkRange)
 	}
 	if len(list) == 0 {
 		return nil, ContextError(errors.New("Routes data contains no networks"))
@@ -401,6 +882,46 @@ func NewNetworkList(routesData []byte) (networkList, error) {
 	return list, nil
 }
 
+// parseNetwork parses a single line of routes data. nil is returned
+// for an invalid line.
+func parseNetwork(line string) *net.IPNet {
+
+	s := strings.Split(line, "\t")
+
+	if len(s) == 1 {
+		_, network, err := net.ParseCIDR(s[0])
+		if err != nil {
+			return nil
+		}
+		return network
+	}
+
+	if len(s) != 2 {
+		return nil
+	}
+
+	ip := net.ParseIP(s[0])
+	if ip == nil {
+		return nil
+	}
+
+	var mask net.IPMask
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		mask = parseIPv4Mask(s[1])
+		if mask == nil {
+			mask = parsePrefixLength(s[1], 32)
+		}
+	} else {
+		mask = parsePrefixLength(s[1], 128)
+	}
+	if mask == nil {
+		return nil
+	}
+
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
 func parseIPv4(s string) net.IP {
 	ip := net.ParseIP(s)
 	if ip == nil {
@@ -421,6 +942,14 @@ func parseIPv4Mask(s string) net.IPMask {
 	return mask
 }
 
+func parsePrefixLength(s string, bits int) net.IPMask {
+	prefixLength, err := strconv.Atoi(s)
+	if err != nil || prefixLength <= 0 || prefixLength > bits {
+		return nil
+	}
+	return net.CIDRMask(prefixLength, bits)
+}
+
 // Len implementes Sort.Interface
 func (list networkList) Len() int {
 	return len(list)
@@ -433,7 +962,7 @@ func (list networkList) Swap(i, j int) {
 
 // Less implementes Sort.Interface
 func (list networkList) Less(i, j int) bool {
-	return binary.BigEndian.Uint32(list[i].IP) < binary.BigEndian.Uint32(list[j].IP)
+	return list[i].first.less(list[j].first)
 }
 
 // ContainsIpAddress performs a binary search on the networkList to
@@ -443,12 +972,12 @@ func (list networkList) ContainsIpAddress(addr net.IP) bool {
 	// Search criteria
 	//
 	// The following conditions are satisfied when address_IP is in the network:
-	// 1. address_IP ^ network_mask == network_IP ^ network_mask
-	// 2. address_IP >= network_IP.
+	// 1. address_IP <= network_last_IP
+	// 2. address_IP >= network_first_IP.
 	// We are also assuming that network ranges do not overlap.
 	//
 	// For an ascending array of networks, the sort.Search returns the smallest
-	// index idx for which condition network_IP > address_IP is satisfied, so we
+	// index idx for which condition network_first_IP > address_IP is satisfied, so we
 	// are checking whether or not adrress_IP belongs to the network[idx-1].
 
 	// Edge conditions check
@@ -458,48 +987,60 @@ func (list networkList) ContainsIpAddress(addr net.IP) bool {
 	// idx == array_length means that address_IP is larger than the last (largest)
 	// network_IP so we need to check the last element for condition 1.
 
-	addrValue := binary.BigEndian.Uint32(addr.To4())
+	addrValue, ok := makeIPValue(addr)
+	if !ok {
+		return false
+	}
 	index := sort.Search(len(list), func(i int) bool {
-		networkValue := binary.BigEndian.Uint32(list[i].IP)
-		return networkValue > addrValue
+		return addrValue.less(list[i].first)
 	})
-	return index > 0 && list[index-1].IP.Equal(addr.Mask(list[index-1].Mask))
+	return index > 0 && !list[index-1].last.less(addrValue)
 }
 
+// errNoIPAddress is returned, unwrapped, by tunneledLookupIP when the DNS
+// responses include no IP address for the host.
+var errNoIPAddress = errors.New("no IP address")
+
 // tunneledLookupIP resolves a split tunnel candidate hostname with a tunneled
-// DNS request.
+// DNS request, made to a DNS server or to a DNS over HTTPS server. A records
+// and, when includeIPv6 is set, AAAA records are requested. The first IPv4
+// address and the first IPv6 address, when present, are returned, along with
+// the minimum TTL of those records.
 func tunneledLookupIP(
-	dnsServerAddress string, dnsTunneler Tunneler, host string) (addr net.IP, ttl time.Duration, err error) {
+	dnsResolver *tunneledDnsResolver,
+	host string,
+	includeIPv6 bool) (addrs []net.IP, ttl time.Duration, err error) {
 
 	ipAddr := net.ParseIP(host)
 	if ipAddr != nil {
 		// maxDuration from golang.org/src/time/time.go
-		return ipAddr, time.Duration(1<<63 - 1), nil
-	}
-
-	// dnsServerAddress must be an IP address
-	ipAddr = net.ParseIP(dnsServerAddress)
-	if ipAddr == nil {
-		return nil, 0, ContextError(errors.New("invalid IP address"))
+		return []net.IP{ipAddr}, time.Duration(1<<63 - 1), nil
 	}
 
-	// Dial's alwaysTunnel is set to true to ensure this connection
-	// is tunneled (also ensures this code path isn't circular).
-	// Assumes tunnel dialer conn configures timeouts and interruptibility.
-
-	conn, err := dnsTunneler.Dial(fmt.Sprintf(
-		"%s:%d", dnsServerAddress, DNS_PORT), true, nil)
+	ipAddrs, ttls, err := dnsResolver.lookupIP(host, includeIPv6)
 	if err != nil {
 		return nil, 0, ContextError(err)
 	}
 
-	ipAddrs, ttls, err := ResolveIP(host, conn)
-	if err != nil {
-		return nil, 0, ContextError(err)
+	var ipv4Addr, ipv6Addr net.IP
+	for i, ipAddr := range ipAddrs {
+		isIPv4 := ipAddr.To4() != nil
+		if (isIPv4 && ipv4Addr != nil) || (!isIPv4 && ipv6Addr != nil) {
+			continue
+		}
+		if isIPv4 {
+			ipv4Addr = ipAddr
+		} else {
+			ipv6Addr = ipAddr
+		}
+		addrs = append(addrs, ipAddr)
+		if len(addrs) == 1 || ttls[i] < ttl {
+			ttl = ttls[i]
+		}
 	}
-	if len(ipAddrs) < 1 {
-		return nil, 0, ContextError(errors.New("no IP address"))
+	if len(addrs) < 1 {
+		return nil, 0, errNoIPAddress
 	}
 
-	return ipAddrs[0], ttls[0], nil
+	return addrs, ttl, nil
 }
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// classificationCache is a size-bounded cache of split tunnel
+// classifications, keyed by destination hostname or IP address.
+//
+// Each entry expires at its classification expiry. Expired entries are
+// removed when looked up and, for entries which are never looked up again,
+// by a periodic sweep. When the cache is full, the least recently used
+// entry is evicted. This bounds the memory used by long-running clients
+// which access many distinct hosts.
+//
+// Hit, miss and eviction counters are periodically reported in a
+// diagnostic notice.
+type classificationCache struct {
+	mutex        sync.Mutex
+	maxEntries   int
+	entries      map[string]*list.Element
+	lru          *list.List
+	lastSweep    time.Time
+	lastNotice   time.Time
+	hits         int64
+	negativeHits int64
+	misses       int64
+	evictions    int64
+}
+
+type classificationCacheEntry struct {
+	key            string
+	classification *classification
+}
+
+func newClassificationCache(maxEntries int) *classificationCache {
+	now := time.Now()
+	return &classificationCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		lastSweep:  now,
+		lastNotice: now,
+	}
+}
+
+// get returns the unexpired classification for key, if present.
+func (cache *classificationCache) get(key string, now time.Time) (*classification, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if ok {
+		entry := element.Value.(*classificationCacheEntry)
+		if entry.classification.expiry.After(now) {
+			cache.lru.MoveToFront(element)
+			cache.hits += 1
+			if entry.classification.isNegative {
+				cache.negativeHits += 1
+			}
+			return entry.classification, true
+		}
+		cache.remove(element)
+	}
+
+	cache.misses += 1
+	return nil, false
+}
+
+// set adds or replaces the classification for key, evicting the least
+// recently used entries when the cache is full.
+func (cache *classificationCache) set(key string, value *classification, now time.Time) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if now.Sub(cache.lastSweep) >= SPLIT_TUNNEL_CLASSIFICATION_CACHE_SWEEP_PERIOD {
+		cache.sweep(now)
+	}
+
+	element, ok := cache.entries[key]
+	if ok {
+		element.Value.(*classificationCacheEntry).classification = value
+		cache.lru.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.lru.PushFront(
+		&classificationCacheEntry{key: key, classification: value})
+
+	for cache.maxEntries > 0 && cache.lru.Len() > cache.maxEntries {
+		cache.remove(cache.lru.Back())
+		cache.evictions += 1
+	}
+}
+
+// sweep removes all expired entries. The caller must hold the mutex.
+func (cache *classificationCache) sweep(now time.Time) {
+	var next *list.Element
+	for element := cache.lru.Front(); element != nil; element = next {
+		next = element.Next()
+		if !element.Value.(*classificationCacheEntry).classification.expiry.After(now) {
+			cache.remove(element)
+		}
+	}
+	cache.lastSweep = now
+}
+
+// remove removes the entry. The caller must hold the mutex.
+func (cache *classificationCache) remove(element *list.Element) {
+	cache.lru.Remove(element)
+	delete(cache.entries, element.Value.(*classificationCacheEntry).key)
+}
+
+// clear discards all entries. The counters are retained.
+func (cache *classificationCache) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	cache.entries = make(map[string]*list.Element)
+	cache.lru.Init()
+}
+
+// len returns the number of entries, including any expired entries which
+// have not yet been removed.
+func (cache *classificationCache) len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.lru.Len()
+}
+
+// noticeStats emits a diagnostic notice with the cache counters when
+// SPLIT_TUNNEL_CLASSIFICATION_CACHE_NOTICE_PERIOD has elapsed since the
+// last notice.
+func (cache *classificationCache) noticeStats(now time.Time) {
+	cache.mutex.Lock()
+	if now.Sub(cache.lastNotice) < SPLIT_TUNNEL_CLASSIFICATION_CACHE_NOTICE_PERIOD {
+		cache.mutex.Unlock()
+		return
+	}
+	cache.lastNotice = now
+	entries := cache.lru.Len()
+	hits := cache.hits
+	negativeHits := cache.negativeHits
+	misses := cache.misses
+	evictions := cache.evictions
+	cache.mutex.Unlock()
+
+	NoticeSplitTunnelCache(entries, hits, negativeHits, misses, evictions)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+func TestClassificationCache(t *testing.T) {
+
+	maxEntries := 1000
+	hostCount := 5000
+	cache := newClassificationCache(maxEntries)
+	now := time.Now()
+
+	hostname := func(i int) string {
+		return fmt.Sprintf("host%d.example.com", i)
+	}
+
+	// The cache remains bounded as thousands of distinct hosts are added,
+	// and the least recently used entries are evicted. host0 is looked up
+	// after every insertion, so it's never the least recently used.
+
+	for i := 0; i < hostCount; i++ {
+		cache.set(hostname(i), &classification{expiry: now.Add(time.Hour)}, now)
+		if _, ok := cache.get(hostname(0), now); !ok {
+			t.Fatalf("unexpected eviction of recently used entry")
+		}
+		if cache.len() > maxEntries {
+			t.Fatalf("unexpected cache size: %d", cache.len())
+		}
+	}
+
+	if cache.len() != maxEntries {
+		t.Fatalf("unexpected cache size: %d", cache.len())
+	}
+	if _, ok := cache.get(hostname(1), now); ok {
+		t.Fatalf("unexpected entry for least recently used host")
+	}
+	if _, ok := cache.get(hostname(hostCount-1), now); !ok {
+		t.Fatalf("missing entry for most recently used host")
+	}
+	if cache.evictions != int64(hostCount-maxEntries) {
+		t.Fatalf("unexpected evictions: %d", cache.evictions)
+	}
+
+	// Expired entries are removed when looked up.
+
+	cache.set("expiring.example.com", &classification{expiry: now.Add(time.Second)}, now)
+	if _, ok := cache.get("expiring.example.com", now.Add(2*time.Second)); ok {
+		t.Fatalf("unexpected expired entry")
+	}
+	if _, ok := cache.entries["expiring.example.com"]; ok {
+		t.Fatalf("expired entry not removed")
+	}
+
+	// Expired entries which are never looked up are removed by the sweep.
+
+	cache.clear()
+	for i := 0; i < maxEntries/2; i++ {
+		cache.set(hostname(i), &classification{expiry: now.Add(time.Second)}, now)
+	}
+	cache.set("other.example.com", &classification{expiry: now.Add(time.Hour)},
+		now.Add(SPLIT_TUNNEL_CLASSIFICATION_CACHE_SWEEP_PERIOD))
+	if cache.len() != 1 {
+		t.Fatalf("unexpected cache size after sweep: %d", cache.len())
+	}
+}
+
+type failingTestTunneler struct {
+	dialCount int32
+}
+
+func (tunneler *failingTestTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+	atomic.AddInt32(&tunneler.dialCount, 1)
+	return nil, errors.New("dial failed")
+}
+
+func (tunneler *failingTestTunneler) SignalComponentFailure() {
+}
+
+// nxdomainTestTunneler is a Tunneler which, in place of port forwards, runs
+// a DNS over TCP server which answers every query with NXDOMAIN.
+type nxdomainTestTunneler struct {
+	queryCount int32
+}
+
+func (tunneler *nxdomainTestTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+		for {
+			query, err := ReadDnsStreamMessage(serverConn)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&tunneler.queryCount, 1)
+			err = WriteDnsStreamMessage(
+				serverConn, new(dns.Msg).SetRcode(query, dns.RcodeNameError))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return clientConn, nil
+}
+
+func (tunneler *nxdomainTestTunneler) SignalComponentFailure() {
+}
+
+func TestSplitTunnelClassificationCache(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelDnsServer" : "192.0.2.1"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	tunneler := new(failingTestTunneler)
+	classifier := NewSplitTunnelClassifier(config, tunneler)
+	_, err = classifier.installRoutes("", []byte("10.0.0.0\t255.0.0.0\n"))
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+
+	// Classifying many more distinct hosts than the cache size doesn't grow
+	// the cache beyond its bound.
+
+	hostCount := 2 * SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES
+	for i := 0; i < hostCount; i++ {
+		ipAddress := fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+		if !classifier.IsUntunneled(ipAddress, 443) {
+			t.Fatalf("unexpected classification for %s", ipAddress)
+		}
+	}
+	if classifier.cache.len() != SPLIT_TUNNEL_CLASSIFICATION_CACHE_MAX_ENTRIES {
+		t.Fatalf("unexpected cache size: %d", classifier.cache.len())
+	}
+
+	// Failed tunneled DNS requests aren't cached, so each classification of
+	// the same host retries the tunneled DNS request.
+
+	for i := 0; i < 10; i++ {
+		if classifier.IsUntunneled("unresolvable.example.com", 443) {
+			t.Fatalf("unexpected classification for unresolvable host")
+		}
+	}
+	if atomic.LoadInt32(&tunneler.dialCount) != 10 {
+		t.Fatalf("unexpected DNS request count: %d", tunneler.dialCount)
+	}
+	if _, ok := classifier.cache.get("unresolvable.example.com", time.Now()); ok {
+		t.Fatalf("unexpected cached classification for unresolvable host")
+	}
+
+	// Changing the rules discards the cached classifications.
+
+	err = classifier.SetRules(&SplitTunnelRules{})
+	if err != nil {
+		t.Fatalf("SetRules failed: %s", err)
+	}
+	if classifier.cache.len() != 0 {
+		t.Fatalf("unexpected cache size after rules change: %d", classifier.cache.len())
+	}
+
+	// Resolutions which yield no IP address are cached, so repeated
+	// classifications of the same host don't repeat the tunneled DNS
+	// request.
+
+	nxdomainTunneler := new(nxdomainTestTunneler)
+	classifier = NewSplitTunnelClassifier(config, nxdomainTunneler)
+	_, err = classifier.installRoutes("", []byte("10.0.0.0\t255.0.0.0\n"))
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if classifier.IsUntunneled("unresolvable.example.com", 443) {
+			t.Fatalf("unexpected classification for unresolvable host")
+		}
+	}
+	if atomic.LoadInt32(&nxdomainTunneler.queryCount) != 1 {
+		t.Fatalf("unexpected DNS request count: %d", nxdomainTunneler.queryCount)
+	}
+	if classifier.cache.negativeHits != 9 {
+		t.Fatalf("unexpected negative hits: %d", classifier.cache.negativeHits)
+	}
+
+	// The negative entry expires after SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL.
+
+	cachedClassification, ok := classifier.cache.get("unresolvable.example.com", time.Now())
+	if !ok ||
+		!cachedClassification.isNegative ||
+		cachedClassification.expiry.After(
+			time.Now().Add(SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL)) {
+		t.Fatalf("unexpected negative classification: %+v", cachedClassification)
+	}
+	_, ok = classifier.cache.get(
+		"unresolvable.example.com", time.Now().Add(SPLIT_TUNNEL_CLASSIFICATION_CACHE_NEGATIVE_TTL))
+	if ok {
+		t.Fatalf("unexpected unexpired negative classification")
+	}
+	classifier.IsUntunneled("unresolvable.example.com", 443)
+	if atomic.LoadInt32(&nxdomainTunneler.queryCount) != 2 {
+		t.Fatalf("unexpected DNS request count: %d", nxdomainTunneler.queryCount)
+	}
+}
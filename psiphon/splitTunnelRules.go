@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SplitTunnelRules are user-defined split tunnel rules. Destinations which
+// match AlwaysTunnel are always tunneled and destinations which match
+// NeverTunnel are always accessed directly, regardless of the region routes.
+//
+// Rules are evaluated in the following order, and the first match applies:
+// AlwaysTunnel domain suffixes and ports; NeverTunnel domain suffixes and
+// ports; AlwaysTunnel CIDRs; NeverTunnel CIDRs; and finally the region
+// routes. CIDRs are matched against the destination IP address, which, for
+// a hostname destination, requires a tunneled DNS resolution.
+type SplitTunnelRules struct {
+	AlwaysTunnel SplitTunnelRuleList
+	NeverTunnel  SplitTunnelRuleList
+}
+
+// SplitTunnelRuleList is a list of split tunnel rules.
+//
+// DomainSuffixes match the destination hostname and its subdomains; for
+// example, "example.com" matches "example.com" and "www.example.com", but
+// not "badexample.com". Matching is case insensitive.
+//
+// CIDRs, e.g., "192.168.0.0/16", match destination IP addresses.
+//
+// Ports match the destination port.
+type SplitTunnelRuleList struct {
+	DomainSuffixes []string
+	CIDRs          []string
+	Ports          []int
+}
+
+// splitTunnelRuleSet is a compiled SplitTunnelRuleList.
+type splitTunnelRuleSet struct {
+	name           string
+	domainSuffixes []string
+	networks       []*net.IPNet
+	ports          map[int]bool
+}
+
+// compiledSplitTunnelRules is a compiled SplitTunnelRules.
+type compiledSplitTunnelRules struct {
+	alwaysTunnel *splitTunnelRuleSet
+	neverTunnel  *splitTunnelRuleSet
+}
+
+// Validate checks that the rules are well-formed.
+func (rules *SplitTunnelRules) Validate() error {
+	_, err := compileSplitTunnelRules(rules)
+	return err
+}
+
+func compileSplitTunnelRules(rules *SplitTunnelRules) (*compiledSplitTunnelRules, error) {
+
+	alwaysTunnel, err := compileSplitTunnelRuleList("always-tunnel", &rules.AlwaysTunnel)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	neverTunnel, err := compileSplitTunnelRuleList("never-tunnel", &rules.NeverTunnel)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return &compiledSplitTunnelRules{
+		alwaysTunnel: alwaysTunnel,
+		neverTunnel:  neverTunnel,
+	}, nil
+}
+
+func compileSplitTunnelRuleList(
+	name string, list *SplitTunnelRuleList) (*splitTunnelRuleSet, error) {
+
+	ruleSet := &splitTunnelRuleSet{
+		name:  name,
+		ports: make(map[int]bool),
+	}
+
+	for _, domainSuffix := range list.DomainSuffixes {
+		domainSuffix = normalizeDomain(domainSuffix)
+		if domainSuffix == "" {
+			return nil, ContextError(errors.New("invalid domain suffix"))
+		}
+		ruleSet.domainSuffixes = append(ruleSet.domainSuffixes, domainSuffix)
+	}
+
+	for _, cidr := range list.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		ruleSet.networks = append(ruleSet.networks, network)
+	}
+
+	for _, port := range list.Ports {
+		if port <= 0 || port > 65535 {
+			return nil, ContextError(fmt.Errorf("invalid port: %d", port))
+		}
+		ruleSet.ports[port] = true
+	}
+
+	return ruleSet, nil
+}
+
+// normalizeDomain lower cases the domain and strips any leading or
+// trailing dots.
+func normalizeDomain(domain string) string {
+	return strings.Trim(strings.ToLower(domain), ".")
+}
+
+// matchHostAndPort checks the domain suffix and port rules. host may be a
+// hostname or an IP address. A port of 0 matches no port rule. The matched
+// rule is returned, for reporting.
+func (ruleSet *splitTunnelRuleSet) matchHostAndPort(host string, port int) (string, bool) {
+
+	if ruleSet.ports[port] {
+		return fmt.Sprintf("%s port %d", ruleSet.name, port), true
+	}
+
+	if net.ParseIP(host) != nil {
+		return "", false
+	}
+
+	host = normalizeDomain(host)
+	for _, domainSuffix := range ruleSet.domainSuffixes {
+		if host == domainSuffix || strings.HasSuffix(host, "."+domainSuffix) {
+			return fmt.Sprintf("%s domain suffix %s", ruleSet.name, domainSuffix), true
+		}
+	}
+
+	return "", false
+}
+
+// matchIPAddress checks the CIDR rules. The matched rule is returned, for
+// reporting.
+func (ruleSet *splitTunnelRuleSet) matchIPAddress(ipAddr net.IP) (string, bool) {
+	for _, network := range ruleSet.networks {
+		if network.Contains(ipAddr) {
+			return fmt.Sprintf("%s CIDR %s", ruleSet.name, network.String()), true
+		}
+	}
+	return "", false
+}
+
+// hasIPv6Networks indicates if the rule set includes any IPv6 networks.
+func (ruleSet *splitTunnelRuleSet) hasIPv6Networks() bool {
+	for _, network := range ruleSet.networks {
+		if network.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNetworks indicates if there are any CIDR rules, which require the
+// destination IP address.
+func (rules *compiledSplitTunnelRules) hasNetworks() bool {
+	return len(rules.alwaysTunnel.networks) > 0 || len(rules.neverTunnel.networks) > 0
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSplitTunnelRules(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelRules" : {
+            "AlwaysTunnel" : {
+                "DomainSuffixes" : ["secure.example.com"],
+                "CIDRs" : ["10.1.0.0/16"],
+                "Ports" : [22]
+            },
+            "NeverTunnel" : {
+                "DomainSuffixes" : [".Example.com"],
+                "CIDRs" : ["10.0.0.0/8", "fd00::/8"],
+                "Ports" : [8080]
+            }
+        }
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	classifier := NewSplitTunnelClassifier(config, nil)
+
+	testCases := []struct {
+		host         string
+		port         int
+		isUntunneled bool
+	}{
+		{"example.com", 443, true},
+		{"www.EXAMPLE.com", 443, true},
+		{"badexample.com", 443, false},
+		{"secure.example.com", 443, false},
+		{"www.secure.example.com", 443, false},
+		{"example.com", 22, false},
+		{"other.org", 8080, true},
+		{"10.2.3.4", 443, true},
+		{"10.1.2.3", 443, false},
+		{"10.2.3.4", 22, false},
+		{"192.168.0.1", 443, false},
+		{"fd00::1", 443, true},
+		{"2001:db8::1", 443, false},
+	}
+
+	for _, testCase := range testCases {
+		if classifier.IsUntunneled(testCase.host, testCase.port) != testCase.isUntunneled {
+			t.Fatalf("unexpected classification for %s:%d", testCase.host, testCase.port)
+		}
+	}
+
+	// Runtime update
+
+	err = classifier.SetRules(&SplitTunnelRules{
+		NeverTunnel: SplitTunnelRuleList{CIDRs: []string{"invalid"}},
+	})
+	if err == nil {
+		t.Fatalf("SetRules unexpectedly succeeded")
+	}
+	if !classifier.IsUntunneled("example.com", 443) {
+		t.Fatalf("unexpected rules change after failed update")
+	}
+
+	err = classifier.SetRules(&SplitTunnelRules{
+		NeverTunnel: SplitTunnelRuleList{DomainSuffixes: []string{"example.org"}},
+	})
+	if err != nil {
+		t.Fatalf("SetRules failed: %s", err)
+	}
+	if classifier.IsUntunneled("example.com", 443) ||
+		!classifier.IsUntunneled("www.example.org", 443) {
+		t.Fatalf("unexpected classification after update")
+	}
+
+	err = classifier.SetRules(nil)
+	if err != nil {
+		t.Fatalf("SetRules failed: %s", err)
+	}
+	if classifier.IsUntunneled("www.example.org", 443) {
+		t.Fatalf("unexpected classification after clearing rules")
+	}
+
+	// Invalid rules
+
+	_, err = LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelRules" : {"AlwaysTunnel" : {"Ports" : [70000]}}
+    }`))
+	if err == nil {
+		t.Fatalf("LoadConfig unexpectedly succeeded")
+	}
+}
+
+func TestSplitTunnelRuleNotices(t *testing.T) {
+
+	classifier := NewSplitTunnelClassifier(&Config{}, nil)
+	err := classifier.SetRules(&SplitTunnelRules{
+		NeverTunnel: SplitTunnelRuleList{DomainSuffixes: []string{"example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("SetRules failed: %s", err)
+	}
+
+	noticeCount := 0
+	SetNoticeOutput(NewNoticeReceiver(
+		func(notice []byte) {
+			if bytes.Contains(notice, []byte(`"noticeType":"Untunneled"`)) {
+				noticeCount += 1
+			}
+		}))
+	defer SetNoticeOutput(ioutil.Discard)
+
+	// Rule matches are noticed once per host
+
+	for i := 0; i < 3; i++ {
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			if !classifier.IsUntunneled(host, 443) {
+				t.Fatalf("unexpected classification for %s", host)
+			}
+		}
+	}
+	if noticeCount != 2 {
+		t.Fatalf("unexpected notice count: %d", noticeCount)
+	}
+
+	// Changing the rules resets the noticed hosts
+
+	err = classifier.SetRules(&SplitTunnelRules{
+		NeverTunnel: SplitTunnelRuleList{DomainSuffixes: []string{"a.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("SetRules failed: %s", err)
+	}
+	classifier.IsUntunneled("a.example.com", 443)
+	if noticeCount != 3 {
+		t.Fatalf("unexpected notice count after rules change: %d", noticeCount)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 )
 
@@ -36,3 +37,253 @@ func Benchmark_containsRandomAddr(b *testing.B) {
 		isLocalAddr = netList.ContainsIpAddress(net.IP(ip))
 	}
 }
+
+func TestNetworkList(t *testing.T) {
+
+	routesData := []byte(
+		"1.2.3.0\t255.255.255.0\n" +
+			"10.0.0.0\t8\n" +
+			"192.168.0.0/16\n" +
+			"2001:db8::\t32\n" +
+			"2001:db9:1::/48\n" +
+			"invalid\n" +
+			"3.0.0.0\t0.0.0.0\n")
+
+	list, err := NewNetworkList(routesData)
+	if err != nil {
+		t.Fatalf("NewNetworkList failed: %s", err)
+	}
+	if len(list) != 5 {
+		t.Fatalf("unexpected network count: %d", len(list))
+	}
+	if !list.hasIPv6Networks() {
+		t.Fatalf("missing IPv6 networks")
+	}
+
+	ipv4List, err := NewNetworkList([]byte("1.2.3.0\t255.255.255.0\n10.0.0.0/8\n"))
+	if err != nil {
+		t.Fatalf("NewNetworkList failed: %s", err)
+	}
+	if ipv4List.hasIPv6Networks() {
+		t.Fatalf("unexpected IPv6 networks")
+	}
+
+	testCases := []struct {
+		address  string
+		contains bool
+	}{
+		{"1.2.3.0", true},
+		{"1.2.3.255", true},
+		{"1.2.4.0", false},
+		{"1.2.2.255", false},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"192.168.10.1", true},
+		{"3.0.0.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::1", false},
+		{"2001:db9:1:ffff::1", true},
+		{"2001:db9:2::1", false},
+		{"::ffff:1.2.3.4", true},
+		{"::1", false},
+	}
+
+	for _, testCase := range testCases {
+		if list.ContainsIpAddress(net.ParseIP(testCase.address)) != testCase.contains {
+			t.Fatalf("unexpected result for %s", testCase.address)
+		}
+	}
+}
+
+func TestRoutesDomainSuffixes(t *testing.T) {
+
+	routesData := []byte(
+		"1.2.3.0\t255.255.255.0\n" +
+			"domain\texample.cn\n" +
+			"domain\t.Example.org.\n" +
+			"domain\t1.2.3.4\n")
+
+	list := NewDomainSuffixList(routesData)
+	if len(list) != 2 {
+		t.Fatalf("unexpected domain suffix count: %d", len(list))
+	}
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	classifier := NewSplitTunnelClassifier(config, nil)
+	_, err = classifier.installRoutes("", routesData)
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+
+	// With no SplitTunnelDnsServer, hostnames are classified only by the
+	// routes domain suffixes.
+
+	testCases := []struct {
+		address      string
+		isUntunneled bool
+	}{
+		{"example.cn", true},
+		{"www.EXAMPLE.cn", true},
+		{"a.b.example.org", true},
+		{"badexample.cn", false},
+		{"example.com", false},
+		{"cn", false},
+		{"1.2.3.4", true},
+		{"1.2.4.1", false},
+	}
+
+	for _, testCase := range testCases {
+		if classifier.IsUntunneled(testCase.address, 443) != testCase.isUntunneled {
+			t.Fatalf("unexpected classification for %s", testCase.address)
+		}
+	}
+
+	// Routes data with only domain suffixes is valid
+
+	_, err = classifier.installRoutes("", []byte("domain\texample.cn\n"))
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+	if !classifier.IsUntunneled("example.cn", 443) ||
+		classifier.IsUntunneled("1.2.3.4", 443) {
+		t.Fatalf("unexpected classification for domain suffixes only")
+	}
+
+	_, err = classifier.installRoutes("", []byte("invalid\n"))
+	if err == nil {
+		t.Fatalf("installRoutes unexpectedly succeeded")
+	}
+}
+
+func TestRoutesRegion(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	classifier := NewSplitTunnelClassifier(config, nil)
+	classifier.region = "CA"
+
+	installed, err := classifier.installRoutes("CA", []byte("1.2.3.0\t255.255.255.0\n"))
+	if err != nil || !installed {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+	if !classifier.IsUntunneled("1.2.3.4", 443) {
+		t.Fatalf("unexpected classification for current region routes")
+	}
+
+	// Routes fetched for a previous region aren't installed
+
+	classifier.region = "US"
+
+	installed, err = classifier.installRoutes("CA", []byte("5.6.7.0\t255.255.255.0\n"))
+	if err != nil || installed {
+		t.Fatalf("unexpected installRoutes result: %v, %s", installed, err)
+	}
+	if classifier.IsUntunneled("5.6.7.8", 443) {
+		t.Fatalf("unexpected classification for previous region routes")
+	}
+}
+
+func TestCachedRoutes(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "SplitTunnelRoutesUrlFormat" : "https://example.com/routes/%s",
+        "SplitTunnelRoutesSignaturePublicKey" : "0",
+        "SplitTunnelDnsServer" : "192.0.2.1"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	err = InitDataStore(config)
+	if err != nil {
+		t.Fatalf("InitDataStore failed: %s", err)
+	}
+	defer SetKeyValue(DATA_STORE_SPLIT_TUNNEL_REGION_KEY, "")
+
+	err = SetSplitTunnelRoutes("CA", "etag-CA", []byte("1.2.3.0/24\n"))
+	if err == nil {
+		err = SetSplitTunnelRoutes("US", "etag-US", []byte("5.6.7.0/24\n"))
+	}
+	if err == nil {
+		err = SetKeyValue(DATA_STORE_SPLIT_TUNNEL_REGION_KEY, "CA")
+	}
+	if err != nil {
+		t.Fatalf("failed to store cached routes: %s", err)
+	}
+
+	// At startup, before any tunnel is established, the cached routes for
+	// the last known region are installed.
+
+	classifier := NewSplitTunnelClassifier(config, nil)
+	if classifier.IsUntunneled("1.2.3.4", 443) {
+		t.Fatalf("unexpected classification before installing cached routes")
+	}
+
+	classifier.InstallCachedRoutes()
+
+	if !classifier.IsUntunneled("1.2.3.4", 443) ||
+		classifier.IsUntunneled("5.6.7.8", 443) {
+		t.Fatalf("unexpected classification with cached routes")
+	}
+
+	// When the tunnel reports a new region, the cached routes for that
+	// region replace the previous region's routes, the new region is
+	// stored, and fresh routes are fetched through the tunnel. The fetch
+	// fails, and the cached routes remain installed.
+
+	tunnel := newTestTunnel(
+		config,
+		&ServerEntry{IpAddress: "192.0.2.1"},
+		&DialParameters{Protocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH})
+	defer tunnel.Close(true)
+	tunnel.serverContext = &ServerContext{clientRegion: "US"}
+
+	classifier.Start(tunnel)
+
+	// Note: Shutdown isn't used to wait for the fetch, as it holds the
+	// classifier mutex which the fetch requires to install routes.
+	classifier.fetchRoutesWaitGroup.Wait()
+
+	if classifier.IsUntunneled("1.2.3.4", 443) ||
+		!classifier.IsUntunneled("5.6.7.8", 443) {
+		t.Fatalf("unexpected classification after region change")
+	}
+
+	region, err := GetKeyValue(DATA_STORE_SPLIT_TUNNEL_REGION_KEY)
+	if err != nil || region != "US" {
+		t.Fatalf("unexpected stored region: %s, %v", region, err)
+	}
+
+	sshConn := tunnel.sshClient.Conn.(*testSSHConn)
+	if atomic.LoadInt32(&sshConn.openChannels) != 1 {
+		t.Fatalf("unexpected routes fetch count: %d", sshConn.openChannels)
+	}
+
+	// A new classifier, as after a restart, installs the new region's
+	// cached routes.
+
+	classifier = NewSplitTunnelClassifier(config, nil)
+	classifier.InstallCachedRoutes()
+	if !classifier.IsUntunneled("5.6.7.8", 443) {
+		t.Fatalf("unexpected classification after restart")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// TransparentProxy is a TCP server that accepts connections redirected
+// to it by iptables REDIRECT or TPROXY rules and, for each connection,
+// establishes a port forward to the connection's original destination
+// and relays traffic through the port forward. This allows a Linux
+// gateway to route the TCP traffic of its network through the tunnel
+// without configuring a proxy on each host.
+//
+// The original destination is dialed with split tunnel classification,
+// so destinations classified as untunneled are dialed directly.
+type TransparentProxy struct {
+	tunneler               Tunneler
+	listener               net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *Conns
+	stopListeningBroadcast chan struct{}
+}
+
+var _TRANSPARENT_PROXY_TYPE = "TRANSPARENT"
+
+// NewTransparentProxy initializes a new transparent proxy. It begins
+// listening for connections, starts a goroutine that runs an accept loop,
+// and returns leaving the accept loop running.
+func NewTransparentProxy(
+	config *Config,
+	tunneler Tunneler,
+	listenIP string) (proxy *TransparentProxy, err error) {
+
+	listener, err := net.Listen(
+		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalTransparentProxyPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			NoticeTransparentProxyPortInUse(config.LocalTransparentProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	if config.LocalTransparentProxyTPROXY {
+		err = setIPTransparent(listener.(*net.TCPListener))
+		if err != nil {
+			listener.Close()
+			return nil, ContextError(err)
+		}
+	}
+
+	proxy = &TransparentProxy{
+		tunneler:               tunneler,
+		listener:               listener,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              new(Conns),
+		stopListeningBroadcast: make(chan struct{}),
+	}
+	proxy.serveWaitGroup.Add(1)
+	go proxy.serve()
+	NoticeListeningTransparentProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	return proxy, nil
+}
+
+// Close terminates the listener and waits for the accept loop
+// goroutine to complete.
+func (proxy *TransparentProxy) Close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.listener.Close()
+	proxy.serveWaitGroup.Wait()
+	proxy.openConns.CloseAll()
+}
+
+func (proxy *TransparentProxy) connectionHandler(localConn net.Conn) (err error) {
+	defer localConn.Close()
+	defer proxy.openConns.Remove(localConn)
+	proxy.openConns.Add(localConn)
+
+	tcpConn, ok := localConn.(*net.TCPConn)
+	if !ok {
+		return ContextError(errors.New("unexpected conn type"))
+	}
+
+	// For REDIRECT, the original destination is recovered from the
+	// connection tracking entry. For TPROXY, and for connections which
+	// weren't redirected, it's the conn's local address.
+	originalDestination, err := GetOriginalDestination(tcpConn)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	// A connection which wasn't redirected has the proxy itself as its
+	// original destination. Relaying such a connection would loop.
+	if proxy.isLocalListenerAddress(originalDestination) {
+		return ContextError(
+			fmt.Errorf("connection not redirected: %s", originalDestination))
+	}
+
+	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
+	// This ensures that the downstream client doesn't keep waiting on the open connection for
+	// data which will never arrive.
+	remoteConn, err := proxy.tunneler.Dial(originalDestination.String(), false, localConn)
+	if err != nil {
+		return ContextError(err)
+	}
+	defer remoteConn.Close()
+
+	LocalProxyRelay(_TRANSPARENT_PROXY_TYPE, localConn, remoteConn)
+	return nil
+}
+
+// isLocalListenerAddress checks if addr is the proxy's listening port on
+// one of the host's own addresses.
+func (proxy *TransparentProxy) isLocalListenerAddress(addr *net.TCPAddr) bool {
+
+	if addr.Port != proxy.listener.Addr().(*net.TCPAddr).Port {
+		return false
+	}
+
+	if addr.IP.IsLoopback() || addr.IP.IsUnspecified() {
+		return true
+	}
+
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Fail closed, as the destination may be the proxy.
+		return true
+	}
+	for _, interfaceAddr := range interfaceAddrs {
+		if ipNet, ok := interfaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (proxy *TransparentProxy) serve() {
+	defer proxy.listener.Close()
+	defer proxy.serveWaitGroup.Done()
+loop:
+	for {
+		// Note: will be interrupted by listener.Close() call made by proxy.Close()
+		conn, err := proxy.listener.Accept()
+		// Can't check for the exact error that Close() will cause in Accept(),
+		// (see: https://code.google.com/p/go/issues/detail?id=4373). So using an
+		// explicit stop signal to stop gracefully.
+		select {
+		case <-proxy.stopListeningBroadcast:
+			break loop
+		default:
+		}
+		if err != nil {
+			NoticeAlert("transparent proxy accept error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			break loop
+		}
+		go func() {
+			err := proxy.connectionHandler(conn)
+			if err != nil {
+				NoticeLocalProxyError(_TRANSPARENT_PROXY_TYPE, ContextError(err))
+			}
+		}()
+	}
+	NoticeInfo("transparent proxy stopped")
+}
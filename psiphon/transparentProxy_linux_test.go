@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingTestTunneler struct {
+	dialCount int32
+}
+
+func (tunneler *countingTestTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	atomic.AddInt32(&tunneler.dialCount, 1)
+	clientConn, serverConn := net.Pipe()
+	serverConn.Close()
+	return clientConn, nil
+}
+
+func (tunneler *countingTestTunneler) SignalComponentFailure() {
+}
+
+func TestTransparentProxy(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "LocalTransparentProxyPort" : 0
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	tunneler := new(countingTestTunneler)
+
+	proxy, err := NewTransparentProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewTransparentProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	listenerAddr := proxy.listener.Addr().(*net.TCPAddr)
+
+	if !proxy.isLocalListenerAddress(listenerAddr) {
+		t.Fatalf("listener address not local")
+	}
+	if proxy.isLocalListenerAddress(
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: listenerAddr.Port}) {
+		t.Fatalf("remote address is local")
+	}
+	if proxy.isLocalListenerAddress(
+		&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: listenerAddr.Port + 1}) {
+		t.Fatalf("other port is local")
+	}
+
+	// A connection which wasn't redirected is closed without dialing.
+
+	conn, err := net.Dial("tcp", listenerAddr.String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected read from transparent proxy")
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatalf("connection not closed")
+	}
+
+	if atomic.LoadInt32(&tunneler.dialCount) != 0 {
+		t.Fatalf("unexpected dial")
+	}
+}
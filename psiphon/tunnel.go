@@ -55,8 +55,13 @@ type Tunneler interface {
 // TunnerOwner specifies the interface required by Tunnel to notify its
 // owner when it has failed. The owner may, as in the case of the Controller,
 // remove the tunnel from its list of active tunnels.
+// In handover mode, Tunnel also notifies its owner when its keep alive round
+// trip time has degraded. SignalTunnelDegraded returns true when the owner is
+// replacing the tunnel, in which case the tunnel must remain open to drain
+// existing port forwards.
 type TunnelOwner interface {
 	SignalTunnelFailure(tunnel *Tunnel)
+	SignalTunnelDegraded(tunnel *Tunnel, reason string) bool
 }
 
 // Tunnel is a connection to a Psiphon server. An established
@@ -68,9 +73,13 @@ type Tunnel struct {
 	untunneledDialConfig         *DialConfig
 	isDiscarded                  bool
 	isClosed                     bool
+	isDraining                   bool
+	isFailed                     bool
 	serverEntry                  *ServerEntry
 	serverContext                *ServerContext
 	protocol                     string
+	dialParams                   *DialParameters
+	networkID                    string
 	conn                         net.Conn
 	sshClient                    *ssh.Client
 	operateWaitGroup             *sync.WaitGroup
@@ -80,6 +89,7 @@ type Tunnel struct {
 	startTime                    time.Time
 	meekStats                    *MeekStats
 	newClientVerificationPayload chan string
+	load                         *tunnelLoad
 }
 
 // EstablishTunnel first makes a network transport connection to the
@@ -88,9 +98,9 @@ type Tunnel struct {
 // key in the server entry.
 // Depending on the server's capabilities, the connection may use
 // plain SSH over TCP, obfuscated SSH over TCP, or obfuscated SSH over
-// HTTP (meek protocol).
-// When requiredProtocol is not blank, that protocol is used. Otherwise,
-// the a random supported protocol is used.
+// HTTP (meek protocol). The protocol and other dial choices are specified
+// in dialParams, which are either new, from MakeCandidateDialParameters,
+// or replayed.
 // untunneledDialConfig is used for untunneled final status requests.
 func EstablishTunnel(
 	config *Config,
@@ -98,16 +108,12 @@ func EstablishTunnel(
 	sessionId string,
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
+	dialParams *DialParameters,
 	tunnelOwner TunnelOwner) (tunnel *Tunnel, err error) {
 
-	selectedProtocol, err := selectProtocol(config, serverEntry)
-	if err != nil {
-		return nil, ContextError(err)
-	}
-
 	// Build transport layers and establish SSH connection
 	conn, sshClient, meekStats, err := dialSsh(
-		config, pendingConns, serverEntry, selectedProtocol, sessionId)
+		config, pendingConns, serverEntry, dialParams, sessionId)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -127,7 +133,8 @@ func EstablishTunnel(
 		untunneledDialConfig:     untunneledDialConfig,
 		isClosed:                 false,
 		serverEntry:              serverEntry,
-		protocol:                 selectedProtocol,
+		protocol:                 dialParams.Protocol,
+		dialParams:               dialParams,
 		conn:                     conn,
 		sshClient:                sshClient,
 		operateWaitGroup:         new(sync.WaitGroup),
@@ -139,6 +146,7 @@ func EstablishTunnel(
 		// Buffer allows SetClientVerificationPayload to submit one new payload
 		// without blocking or dropping it.
 		newClientVerificationPayload: make(chan string, 1),
+		load:                         new(tunnelLoad),
 	}
 
 	// Create a new Psiphon API server context for this tunnel. This includes
@@ -197,6 +205,45 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 	}
 }
 
+// startDraining sets the tunnel's draining flag. A draining tunnel has
+// been replaced, in handover mode, and is no longer used for new port
+// forwards.
+func (tunnel *Tunnel) startDraining() {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.isDraining = true
+}
+
+// stopDraining clears the tunnel's draining flag, when a handover doesn't
+// proceed.
+func (tunnel *Tunnel) stopDraining() {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.isDraining = false
+}
+
+// IsDraining returns the tunnel's draining flag.
+func (tunnel *Tunnel) IsDraining() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isDraining
+}
+
+// markFailed sets the tunnel's failed flag. A failed tunnel's operateTunnel
+// has stopped, and the tunnel must not be used for new port forwards.
+func (tunnel *Tunnel) markFailed() {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.isFailed = true
+}
+
+// IsFailed returns the tunnel's failed flag.
+func (tunnel *Tunnel) IsFailed() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isFailed
+}
+
 // IsDiscarded returns the tunnel's discarded flag.
 func (tunnel *Tunnel) IsDiscarded() bool {
 	tunnel.mutex.Lock()
@@ -247,6 +294,8 @@ func (tunnel *Tunnel) Dial(
 		tunnel:         tunnel,
 		downstreamConn: downstreamConn}
 
+	tunnel.load.addConn()
+
 	// Tunnel does not have a serverContext when DisableApi is set. We still use
 	// transferstats.Conn to count bytes transferred for monitoring tunnel
 	// quality.
@@ -282,10 +331,12 @@ func (tunnel *Tunnel) SetClientVerificationPayload(clientVerificationPayload str
 // report these errors back to the tunnel monitor as port forward failures.
 // TunneledConn optionally tracks a peer connection to be explictly closed
 // when the TunneledConn is closed.
+// TunneledConn is counted in the tunnel's open port forwards until closed.
 type TunneledConn struct {
 	net.Conn
 	tunnel         *Tunnel
 	downstreamConn net.Conn
+	isClosed       int32
 }
 
 func (conn *TunneledConn) Read(buffer []byte) (n int, err error) {
@@ -315,163 +366,135 @@ func (conn *TunneledConn) Write(buffer []byte) (n int, err error) {
 }
 
 func (conn *TunneledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.isClosed, 0, 1) {
+		conn.tunnel.load.removeConn()
+	}
 	if conn.downstreamConn != nil {
 		conn.downstreamConn.Close()
 	}
 	return conn.Conn.Close()
 }
 
-// selectProtocol is a helper that picks the tunnel protocol
-func selectProtocol(config *Config, serverEntry *ServerEntry) (selectedProtocol string, err error) {
+// selectProtocols returns the tunnel protocols to try for the server entry,
+// in order of preference. When config.TunnelProtocol is set, only that
+// protocol is returned.
+func selectProtocols(
+	config *Config,
+	serverEntry *ServerEntry,
+	history *ServerEntryHistory,
+	networkID string) ([]string, error) {
+
 	// TODO: properly handle protocols (e.g. FRONTED-MEEK-OSSH) vs. capabilities (e.g., {FRONTED-MEEK, OSSH})
 	// for now, the code is simply assuming that MEEK capabilities imply OSSH capability.
 	if config.TunnelProtocol != "" {
 		if !serverEntry.SupportsProtocol(config.TunnelProtocol) {
-			return "", ContextError(fmt.Errorf("server does not have required capability"))
-		}
-		selectedProtocol = config.TunnelProtocol
-	} else {
-		// Pick at random from the supported protocols. This ensures that we'll eventually
-		// try all possible protocols. Depending on network configuration, it may be the
-		// case that some protocol is only available through multi-capability servers,
-		// and a simpler ranked preference of protocols could lead to that protocol never
-		// being selected.
-
-		candidateProtocols := serverEntry.GetSupportedProtocols()
-		if len(candidateProtocols) == 0 {
-			return "", ContextError(fmt.Errorf("server does not have any supported capabilities"))
+			return nil, ContextError(fmt.Errorf("server does not have required capability"))
 		}
+		return []string{config.TunnelProtocol}, nil
+	}
 
-		index, err := MakeSecureRandomInt(len(candidateProtocols))
-		if err != nil {
-			return "", ContextError(err)
-		}
-		selectedProtocol = candidateProtocols[index]
+	// Order the supported protocols at random, weighted by the connection
+	// history, to favor protocols which recently worked on this network. Every
+	// protocol retains some weight. This ensures that we'll eventually try all
+	// possible protocols. Depending on network configuration, it may be the
+	// case that some protocol is only available through multi-capability servers,
+	// and a strictly ranked preference of protocols could lead to that protocol
+	// never being selected.
+
+	candidateProtocols := serverEntry.GetSupportedProtocols()
+	if len(candidateProtocols) == 0 {
+		return nil, ContextError(fmt.Errorf("server does not have any supported capabilities"))
 	}
-	return selectedProtocol, nil
+
+	return rankProtocols(candidateProtocols, history, networkID), nil
 }
 
-// selectFrontingParameters is a helper which selects/generates meek fronting
-// parameters where the server entry provides multiple options or patterns.
-func selectFrontingParameters(
-	serverEntry *ServerEntry) (frontingAddress, frontingHost string, err error) {
+// selectFrontingAddresses is a helper which selects/generates up to maxCount
+// distinct meek fronting addresses, in random order, where the server entry
+// provides multiple options or a pattern.
+func selectFrontingAddresses(
+	serverEntry *ServerEntry, maxCount int) ([]string, error) {
 
 	if len(serverEntry.MeekFrontingAddressesRegex) > 0 {
 
-		// Generate a front address based on the regex.
+		// Generate front addresses based on the regex. The pattern may
+		// not yield maxCount distinct addresses, so the number of
+		// generation attempts is bounded.
 
-		frontingAddress, err = regen.Generate(serverEntry.MeekFrontingAddressesRegex)
-		if err != nil {
-			return "", "", ContextError(err)
+		frontingAddresses := make([]string, 0, maxCount)
+		for i := 0; i < 2*maxCount && len(frontingAddresses) < maxCount; i++ {
+			frontingAddress, err := regen.Generate(serverEntry.MeekFrontingAddressesRegex)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			if !Contains(frontingAddresses, frontingAddress) {
+				frontingAddresses = append(frontingAddresses, frontingAddress)
+			}
 		}
-	} else {
+		return frontingAddresses, nil
+	}
 
-		// Randomly select, for this connection attempt, one front address for
-		// fronting-capable servers.
+	// Randomly order the front addresses for fronting-capable servers.
 
-		if len(serverEntry.MeekFrontingAddresses) == 0 {
-			return "", "", ContextError(errors.New("MeekFrontingAddresses is empty"))
-		}
-		index, err := MakeSecureRandomInt(len(serverEntry.MeekFrontingAddresses))
+	if len(serverEntry.MeekFrontingAddresses) == 0 {
+		return nil, ContextError(errors.New("MeekFrontingAddresses is empty"))
+	}
+	frontingAddresses := make([]string, len(serverEntry.MeekFrontingAddresses))
+	copy(frontingAddresses, serverEntry.MeekFrontingAddresses)
+	for i := len(frontingAddresses) - 1; i > 0; i-- {
+		j, err := MakeSecureRandomInt(i + 1)
 		if err != nil {
-			return "", "", ContextError(err)
+			return nil, ContextError(err)
 		}
-		frontingAddress = serverEntry.MeekFrontingAddresses[index]
+		frontingAddresses[i], frontingAddresses[j] = frontingAddresses[j], frontingAddresses[i]
 	}
+	if len(frontingAddresses) > maxCount {
+		frontingAddresses = frontingAddresses[:maxCount]
+	}
+	return frontingAddresses, nil
+}
+
+// selectFrontingHost is a helper which selects a meek fronting host, the
+// HTTP Host header value, where the server entry provides multiple options.
+func selectFrontingHost(serverEntry *ServerEntry) (string, error) {
 
 	if len(serverEntry.MeekFrontingHosts) > 0 {
 		index, err := MakeSecureRandomInt(len(serverEntry.MeekFrontingHosts))
 		if err != nil {
-			return "", "", ContextError(err)
+			return "", ContextError(err)
 		}
-		frontingHost = serverEntry.MeekFrontingHosts[index]
-	} else {
-		// Backwards compatibility case
-		frontingHost = serverEntry.MeekFrontingHost
+		return serverEntry.MeekFrontingHosts[index], nil
 	}
 
-	return
+	// Backwards compatibility case
+	return serverEntry.MeekFrontingHost, nil
 }
 
 // initMeekConfig is a helper that creates a MeekConfig suitable for the
-// selected meek tunnel protocol.
+// selected meek tunnel protocol and dial parameters.
 func initMeekConfig(
-	config *Config,
 	serverEntry *ServerEntry,
-	selectedProtocol,
+	dialParams *DialParameters,
 	sessionId string) (*MeekConfig, error) {
 
-	// The meek protocol always uses OSSH
-	psiphonServerAddress := fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
-
-	var dialAddress string
-	useHTTPS := false
-	var SNIServerName, hostHeader string
-	transformedHostName := false
-
-	switch selectedProtocol {
-	case TUNNEL_PROTOCOL_FRONTED_MEEK:
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
-		if err != nil {
-			return nil, ContextError(err)
-		}
-		dialAddress = fmt.Sprintf("%s:443", frontingAddress)
-		useHTTPS = true
-		if !serverEntry.MeekFrontingDisableSNI {
-			SNIServerName, transformedHostName =
-				config.HostNameTransformer.TransformHostName(frontingAddress)
-		}
-		hostHeader = frontingHost
-
-	case TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
-		if err != nil {
-			return nil, ContextError(err)
-		}
-		dialAddress = fmt.Sprintf("%s:80", frontingAddress)
-		hostHeader = frontingHost
-
-	case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		hostname := serverEntry.IpAddress
-		hostname, transformedHostName = config.HostNameTransformer.TransformHostName(hostname)
-		if serverEntry.MeekServerPort == 80 {
-			hostHeader = hostname
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
-		}
-
-	case TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS:
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		useHTTPS = true
-		SNIServerName, transformedHostName =
-			config.HostNameTransformer.TransformHostName(serverEntry.IpAddress)
-		if serverEntry.MeekServerPort == 443 {
-			hostHeader = serverEntry.IpAddress
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		}
-
-	default:
+	if !TunnelProtocolUsesMeek(dialParams.Protocol) {
 		return nil, ContextError(errors.New("unexpected selectedProtocol"))
 	}
 
-	// The unnderlying TLS will automatically disable SNI for IP address server name
-	// values; we have this explicit check here so we record the correct value for stats.
-	if net.ParseIP(SNIServerName) != nil {
-		SNIServerName = ""
-	}
+	// The meek protocol always uses OSSH
+	psiphonServerAddress := fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
 
 	return &MeekConfig{
-		DialAddress:                   dialAddress,
-		UseHTTPS:                      useHTTPS,
-		SNIServerName:                 SNIServerName,
-		HostHeader:                    hostHeader,
-		TransformedHostName:           transformedHostName,
+		DialAddress:                   dialParams.MeekDialAddress,
+		UseHTTPS:                      dialParams.MeekUseHTTPS,
+		SNIServerName:                 dialParams.MeekSNIServerName,
+		HostHeader:                    dialParams.MeekHostHeader,
+		TransformedHostName:           dialParams.MeekTransformedHostName,
 		PsiphonServerAddress:          psiphonServerAddress,
 		SessionID:                     sessionId,
 		MeekCookieEncryptionPublicKey: serverEntry.MeekCookieEncryptionPublicKey,
 		MeekObfuscatedKey:             serverEntry.MeekObfuscatedKey,
+		MeekCookiePaddingLength:       &dialParams.MeekCookiePaddingLength,
 	}, nil
 }
 
@@ -481,7 +504,7 @@ func dialSsh(
 	config *Config,
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
-	selectedProtocol,
+	dialParams *DialParameters,
 	sessionId string) (
 	conn net.Conn, sshClient *ssh.Client, meekStats *MeekStats, err error) {
 
@@ -492,7 +515,7 @@ func dialSsh(
 	var directTCPDialAddress string
 	var meekConfig *MeekConfig
 
-	switch selectedProtocol {
+	switch dialParams.Protocol {
 	case TUNNEL_PROTOCOL_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
 		directTCPDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
@@ -502,7 +525,7 @@ func dialSsh(
 
 	default:
 		useObfuscatedSsh = true
-		meekConfig, err = initMeekConfig(config, serverEntry, selectedProtocol, sessionId)
+		meekConfig, err = initMeekConfig(serverEntry, dialParams, sessionId)
 		if err != nil {
 			return nil, nil, nil, ContextError(err)
 		}
@@ -511,7 +534,8 @@ func dialSsh(
 	NoticeConnectingServer(
 		serverEntry.IpAddress,
 		serverEntry.Region,
-		selectedProtocol,
+		dialParams.Protocol,
+		dialParams.IsReplay,
 		directTCPDialAddress,
 		meekConfig)
 
@@ -534,7 +558,7 @@ func dialSsh(
 		PendingConns:                  pendingConns,
 		DeviceBinder:                  config.DeviceBinder,
 		DnsServerGetter:               config.DnsServerGetter,
-		UseIndistinguishableTLS:       config.UseIndistinguishableTLS,
+		UseIndistinguishableTLS:       dialParams.UseIndistinguishableTLS,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 		DeviceRegion:                  config.DeviceRegion,
 		ResolvedIPCallback:            setResolvedIPAddress,
@@ -564,7 +588,10 @@ func dialSsh(
 	sshConn = conn
 	if useObfuscatedSsh {
 		sshConn, err = NewObfuscatedSshConn(
-			OBFUSCATION_CONN_MODE_CLIENT, conn, serverEntry.SshObfuscatedKey)
+			OBFUSCATION_CONN_MODE_CLIENT,
+			conn,
+			serverEntry.SshObfuscatedKey,
+			&dialParams.ObfuscatorPaddingLength)
 		if err != nil {
 			return nil, nil, nil, ContextError(err)
 		}
@@ -772,16 +799,45 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	go func() {
 		defer requestsWaitGroup.Done()
 		for timeout := range signalSshKeepAlive {
-			err := sendSshKeepAlive(tunnel.sshClient, tunnel.conn, timeout)
+			startTime := time.Now()
+			err := sendSshKeepAlive(tunnel.sshClient, timeout)
 			if err != nil {
+				// A failed keep alive probe indicates that the tunnel is
+				// unusable, so it's closed even in handover mode; there are
+				// no port forwards which could drain. In handover mode, the
+				// owner replaces the failed tunnel with the standby tunnel.
+				tunnel.sshClient.Close()
+				tunnel.conn.Close()
 				select {
 				case sshKeepAliveError <- err:
 				default:
 				}
+			} else {
+				// In handover mode, when the owner replaces a tunnel with
+				// a degraded RTT, the tunnel isn't closed, so that existing
+				// port forwards may drain.
+				rtt := time.Since(startTime)
+				tunnel.load.recordRTT(rtt)
+				if tunnel.config.EnableTunnelHandover &&
+					rtt > time.Duration(tunnel.config.TunnelHandoverDegradedRTTMilliseconds)*time.Millisecond {
+					tunnelOwner.SignalTunnelDegraded(tunnel, "keep alive latency")
+				}
 			}
 		}
 	}()
 
+	// The LOWEST-RTT load balancing policy requires RTT measurements for
+	// each tunnel. In this case, an initial keep alive is sent immediately,
+	// and periodic keep alives are sent even when the tunnel is active.
+	// Handover mode also sends periodic keep alives when the tunnel is
+	// active, to monitor for degraded tunnels.
+	measureRTT := tunnel.config.TunnelPoolSize > 1 &&
+		tunnel.config.TunnelPoolLoadBalancingPolicy == LOAD_BALANCING_POLICY_LOWEST_RTT
+	if measureRTT {
+		signalSshKeepAlive <- time.Duration(*tunnel.config.TunnelSshKeepAliveProbeTimeoutSeconds) * time.Second
+	}
+	alwaysSendSshKeepAlive := measureRTT || tunnel.config.EnableTunnelHandover
+
 	requestsWaitGroup.Add(1)
 	signalStopClientVerificationRequests := make(chan struct{})
 	go func() {
@@ -830,8 +886,15 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			totalSent += sent
 			totalReceived += received
 
+			tunnel.load.recordBytes(sent+received, 1*time.Second)
+
 			if lastTotalBytesTransferedTime.Add(TOTAL_BYTES_TRANSFERRED_NOTICE_PERIOD).Before(time.Now()) {
 				NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+				NoticeTunnelLoad(
+					tunnel.serverEntry.IpAddress,
+					tunnel.load.getOpenConns(),
+					tunnel.load.getRTT(),
+					tunnel.load.getThroughput())
 				lastTotalBytesTransferedTime = time.Now()
 			}
 
@@ -848,7 +911,8 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			statsTimer.Reset(nextStatusRequestPeriod())
 
 		case <-sshKeepAliveTimer.C:
-			if lastBytesReceivedTime.Add(TUNNEL_SSH_KEEP_ALIVE_PERIODIC_INACTIVE_PERIOD).Before(time.Now()) {
+			if alwaysSendSshKeepAlive ||
+				lastBytesReceivedTime.Add(TUNNEL_SSH_KEEP_ALIVE_PERIODIC_INACTIVE_PERIOD).Before(time.Now()) {
 				select {
 				case signalSshKeepAlive <- time.Duration(*tunnel.config.TunnelSshKeepAlivePeriodicTimeoutSeconds) * time.Second:
 				default:
@@ -953,9 +1017,10 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 // sendSshKeepAlive is a helper which sends a keepalive@openssh.com request
 // on the specified SSH connections and returns true of the request succeeds
-// within a specified timeout.
+// within a specified timeout. The caller is responsible for closing the
+// SSH connection when the request fails.
 func sendSshKeepAlive(
-	sshClient *ssh.Client, conn net.Conn, timeout time.Duration) error {
+	sshClient *ssh.Client, timeout time.Duration) error {
 
 	errChannel := make(chan error, 2)
 	if timeout > 0 {
@@ -973,10 +1038,6 @@ func sendSshKeepAlive(
 	}()
 
 	err := <-errChannel
-	if err != nil {
-		sshClient.Close()
-		conn.Close()
-	}
 
 	return ContextError(err)
 }
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+const DNS_OVER_HTTPS_CONTENT_TYPE = "application/dns-message"
+
+// tunneledDnsResolver makes DNS queries through the tunnel. Queries are
+// sent to a DNS server, over TCP, or, when TunneledDnsOverHttpsUrl is
+// configured, to a DNS over HTTPS (RFC 8484) server.
+type tunneledDnsResolver struct {
+	tunneler         Tunneler
+	dnsServerAddress string
+	dohUrl           string
+	dohClient        *http.Client
+}
+
+// newTunneledDnsResolver returns a resolver which uses the configured DNS
+// over HTTPS server or, otherwise, the DNS server at dnsServerAddress.
+// nil is returned when neither is configured.
+func newTunneledDnsResolver(
+	config *Config, tunneler Tunneler, dnsServerAddress string) *tunneledDnsResolver {
+
+	if config.TunneledDnsOverHttpsUrl == "" {
+		if dnsServerAddress == "" {
+			return nil
+		}
+		return &tunneledDnsResolver{
+			tunneler:         tunneler,
+			dnsServerAddress: dnsServerAddress,
+		}
+	}
+
+	bootstrapIP := config.TunneledDnsOverHttpsBootstrapIP
+
+	// Dial's alwaysTunnel is set to true to ensure this connection
+	// is tunneled (also ensures this code path isn't circular).
+	// When a bootstrap IP is configured, it replaces the URL hostname
+	// in the dial address; the hostname is still used for TLS SNI and
+	// certificate verification.
+	// Keep-alives are disabled, so that each request dials a new port
+	// forward through the current tunnel, and an idle connection through
+	// a closed or replaced tunnel is never reused.
+	tunneledDialer := func(_, addr string) (net.Conn, error) {
+		if bootstrapIP != "" {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			addr = net.JoinHostPort(bootstrapIP, port)
+		}
+		return tunneler.Dial(addr, true, nil)
+	}
+
+	return &tunneledDnsResolver{
+		tunneler: tunneler,
+		dohUrl:   config.TunneledDnsOverHttpsUrl,
+		dohClient: &http.Client{
+			Transport: &http.Transport{
+				Dial:              tunneledDialer,
+				DisableKeepAlives: true,
+			},
+			Timeout: DNS_PROXY_QUERY_TIMEOUT,
+		},
+	}
+}
+
+// lookupIP resolves host with an A query and, when includeIPv6 is set, an
+// AAAA query. The A and AAAA queries are made in parallel, each with its own
+// request. IPv4 addresses are listed first. When only one of the queries
+// fails, the addresses from the other are returned.
+func (resolver *tunneledDnsResolver) lookupIP(
+	host string, includeIPv6 bool) (addrs []net.IP, ttls []time.Duration, err error) {
+
+	if !includeIPv6 {
+		addrs, ttls, err = resolver.lookupIPWithQueryType(host, dns.TypeA)
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		return addrs, ttls, nil
+	}
+
+	type lookupResult struct {
+		addrs []net.IP
+		ttls  []time.Duration
+		err   error
+	}
+	ipv6Result := make(chan *lookupResult, 1)
+	go func() {
+		addrs, ttls, err := resolver.lookupIPWithQueryType(host, dns.TypeAAAA)
+		ipv6Result <- &lookupResult{addrs: addrs, ttls: ttls, err: err}
+	}()
+
+	addrs, ttls, err = resolver.lookupIPWithQueryType(host, dns.TypeA)
+	result := <-ipv6Result
+
+	if err != nil {
+		if result.err != nil {
+			return nil, nil, ContextError(err)
+		}
+		return result.addrs, result.ttls, nil
+	}
+	if result.err == nil {
+		addrs = append(addrs, result.addrs...)
+		ttls = append(ttls, result.ttls...)
+	}
+	return addrs, ttls, nil
+}
+
+// lookupIPWithQueryType resolves host with a single DNS query of queryType.
+func (resolver *tunneledDnsResolver) lookupIPWithQueryType(
+	host string, queryType uint16) (addrs []net.IP, ttls []time.Duration, err error) {
+
+	if resolver.dohClient != nil {
+		addrs, ttls, err = resolveIPWithExchange(
+			host, resolver.exchangeDnsOverHttps, queryType)
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		return addrs, ttls, nil
+	}
+
+	// Assumes tunnel dialer conn configures timeouts and interruptibility.
+
+	conn, err := resolver.dial()
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+
+	addrs, ttls, err = resolveIP(host, conn, queryType)
+	if err != nil {
+		return nil, nil, ContextError(err)
+	}
+	return addrs, ttls, nil
+}
+
+// exchange sends the query and returns the response.
+func (resolver *tunneledDnsResolver) exchange(query *dns.Msg) (*dns.Msg, error) {
+
+	if resolver.dohClient != nil {
+		response, err := resolver.exchangeDnsOverHttps(query)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return response, nil
+	}
+
+	conn, err := resolver.dial()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer conn.Close()
+
+	// Tunneled port forwards don't support deadlines, so the query is
+	// interrupted by closing the conn.
+	timer := time.AfterFunc(DNS_PROXY_QUERY_TIMEOUT, func() { conn.Close() })
+	defer timer.Stop()
+
+	response, err := ExchangeDnsMessage(conn, query)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return response, nil
+}
+
+// dial establishes a tunneled TCP connection to the DNS server.
+func (resolver *tunneledDnsResolver) dial() (net.Conn, error) {
+
+	// dnsServerAddress must be an IP address
+	if net.ParseIP(resolver.dnsServerAddress) == nil {
+		return nil, ContextError(errors.New("invalid IP address"))
+	}
+
+	// Dial's alwaysTunnel is set to true to ensure this connection
+	// is tunneled (also ensures this code path isn't circular).
+	conn, err := resolver.tunneler.Dial(
+		net.JoinHostPort(resolver.dnsServerAddress, strconv.Itoa(DNS_PORT)), true, nil)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return conn, nil
+}
+
+// exchangeDnsOverHttps sends the query to the DNS over HTTPS server, as an
+// RFC 8484 POST request, and returns the response.
+func (resolver *tunneledDnsResolver) exchangeDnsOverHttps(query *dns.Msg) (*dns.Msg, error) {
+
+	// As recommended in RFC 8484, the DNS ID is 0, so that requests for the
+	// same question are identical and may be cached by HTTP caches.
+	dohQuery := query.Copy()
+	dohQuery.Id = 0
+	packedQuery, err := dohQuery.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	request, err := http.NewRequest("POST", resolver.dohUrl, bytes.NewReader(packedQuery))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	request.Header.Set("Content-Type", DNS_OVER_HTTPS_CONTENT_TYPE)
+	request.Header.Set("Accept", DNS_OVER_HTTPS_CONTENT_TYPE)
+
+	response, err := resolver.dohClient.Do(request)
+	if err != nil {
+		return nil, ContextError(FilterUrlError(err))
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, ContextError(
+			fmt.Errorf("unexpected DNS over HTTPS response status: %d", response.StatusCode))
+	}
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != DNS_OVER_HTTPS_CONTENT_TYPE {
+		return nil, ContextError(errors.New("unexpected DNS over HTTPS response content type"))
+	}
+
+	packedResponse, err := ioutil.ReadAll(io.LimitReader(response.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(packedResponse) > dns.MaxMsgSize {
+		return nil, ContextError(errors.New("DNS over HTTPS response too large"))
+	}
+
+	dnsResponse := new(dns.Msg)
+	err = dnsResponse.Unpack(packedResponse)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if dnsResponse.Id != dohQuery.Id {
+		return nil, ContextError(errors.New("unexpected DNS response ID"))
+	}
+	dnsResponse.Id = query.Id
+
+	// A response served from an HTTP cache has an Age, by which the record
+	// TTLs are reduced, as specified in RFC 8484.
+	age, err := strconv.ParseUint(response.Header.Get("Age"), 10, 32)
+	if err == nil {
+		decrementDnsTTLs(dnsResponse, uint32(age))
+	}
+
+	return dnsResponse, nil
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// testDohTunneler is a Tunneler which, in place of port forwards, connects
+// to a local stand-in DNS over HTTPS server, and records the dial addresses.
+type testDohTunneler struct {
+	serverAddress string
+	mutex         sync.Mutex
+	dialAddresses []string
+}
+
+func (tunneler *testDohTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if !alwaysTunnel {
+		return nil, errors.New("DNS over HTTPS dial not always tunneled")
+	}
+	tunneler.mutex.Lock()
+	tunneler.dialAddresses = append(tunneler.dialAddresses, remoteAddr)
+	tunneler.mutex.Unlock()
+	return net.Dial("tcp", tunneler.serverAddress)
+}
+
+func (tunneler *testDohTunneler) SignalComponentFailure() {
+}
+
+// testDohHandler answers A and AAAA queries, and fails queries for
+// "fail.example.org". Responses have an Age, as if served from a cache.
+func testDohHandler(responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "POST" ||
+		request.Header.Get("Content-Type") != DNS_OVER_HTTPS_CONTENT_TYPE {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(request.Body)
+	query := new(dns.Msg)
+	err := query.Unpack(body)
+	if err != nil || query.Id != 0 || len(query.Question) != 1 {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return
+	}
+	question := query.Question[0]
+	if question.Name == "fail.example.org." {
+		http.Error(responseWriter, "", http.StatusInternalServerError)
+		return
+	}
+
+	response := new(dns.Msg).SetReply(query)
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET}
+	switch question.Qtype {
+	case dns.TypeA:
+		header.Ttl = 120
+		response.Answer = append(response.Answer, &dns.A{Hdr: header, A: net.ParseIP("192.0.2.1")})
+	case dns.TypeAAAA:
+		header.Ttl = 60
+		response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: net.ParseIP("2001:db8::1")})
+	}
+	packedResponse, _ := response.Pack()
+
+	responseWriter.Header().Set("Content-Type", DNS_OVER_HTTPS_CONTENT_TYPE)
+	responseWriter.Header().Set("Age", "10")
+	responseWriter.Write(packedResponse)
+}
+
+func TestTunneledDnsOverHttps(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(testDohHandler))
+	defer server.Close()
+
+	// The test server certificate is valid for example.com
+	certificate, err := x509.ParseCertificate(server.TLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(certificate)
+
+	config, err := LoadConfig([]byte(`
+    {
+        "PropagationChannelId" : "0",
+        "SponsorId" : "0",
+        "TunneledDnsOverHttpsUrl" : "https://example.com/dns-query",
+        "TunneledDnsOverHttpsBootstrapIP" : "192.0.2.53"
+    }`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	tunneler := &testDohTunneler{serverAddress: server.Listener.Addr().String()}
+
+	resolver := newTunneledDnsResolver(config, tunneler, "")
+	resolver.dohClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+
+	// tunneledLookupIP returns the minimum TTL, reduced by the Age
+
+	addrs, ttl, err := tunneledLookupIP(resolver, "www.example.org", true)
+	if err != nil {
+		t.Fatalf("tunneledLookupIP failed: %s", err)
+	}
+	if len(addrs) != 2 ||
+		!addrs[0].Equal(net.ParseIP("192.0.2.1")) ||
+		!addrs[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected addresses: %v", addrs)
+	}
+	if ttl != 50*time.Second {
+		t.Fatalf("unexpected TTL: %s", ttl)
+	}
+
+	tunneler.mutex.Lock()
+	for _, dialAddress := range tunneler.dialAddresses {
+		if dialAddress != "192.0.2.53:443" {
+			t.Fatalf("unexpected dial address: %s", dialAddress)
+		}
+	}
+	tunneler.mutex.Unlock()
+
+	_, _, err = tunneledLookupIP(resolver, "fail.example.org", true)
+	if err == nil {
+		t.Fatalf("tunneledLookupIP unexpectedly succeeded")
+	}
+
+	// Without IPv6, only the A query is made
+
+	addrs, ttl, err = tunneledLookupIP(resolver, "www.example.org", false)
+	if err != nil {
+		t.Fatalf("tunneledLookupIP failed: %s", err)
+	}
+	if len(addrs) != 1 || !addrs[0].Equal(net.ParseIP("192.0.2.1")) || ttl != 110*time.Second {
+		t.Fatalf("unexpected IPv4 addresses: %v %s", addrs, ttl)
+	}
+
+	// Connections aren't reused, so each request dials a new port forward
+
+	tunneler.mutex.Lock()
+	dialCount := len(tunneler.dialAddresses)
+	tunneler.mutex.Unlock()
+	if dialCount != 5 {
+		t.Fatalf("unexpected dial count: %d", dialCount)
+	}
+
+	// With IPv4 routes only, the host is classified by its IPv4 address
+
+	classifier := NewSplitTunnelClassifier(config, tunneler)
+	classifier.dnsResolver.dohClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	_, err = classifier.installRoutes("", []byte("192.0.2.0/24\n"))
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+	if !classifier.IsUntunneled("www.example.org", 443) {
+		t.Fatalf("unexpected classification with IPv4 routes")
+	}
+
+	// With IPv6 routes, both addresses must be untunneled
+
+	_, err = classifier.installRoutes("", []byte("192.0.2.0/24\n2001:db9::/32\n"))
+	if err != nil {
+		t.Fatalf("installRoutes failed: %s", err)
+	}
+	if classifier.IsUntunneled("www.example.org", 443) {
+		t.Fatalf("unexpected classification with IPv6 routes")
+	}
+
+	// The local DNS proxy uses the DNS over HTTPS server
+
+	proxy, err := NewDnsProxy(config, new(DialConfig), tunneler, nil, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDnsProxy failed: %s", err)
+	}
+	defer proxy.Close()
+	proxy.resolver.dohClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+
+	conn, err := net.Dial("udp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	response := testDnsQuery(t, conn, "www.example.org", dns.TypeAAAA)
+	if len(response.Answer) != 1 ||
+		!response.Answer[0].(*dns.AAAA).AAAA.Equal(net.ParseIP("2001:db8::1")) ||
+		response.Answer[0].Header().Ttl != 50 {
+		t.Fatalf("unexpected response: %s", response)
+	}
+
+	response = testDnsQuery(t, conn, "fail.example.org", dns.TypeA)
+	if response.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("unexpected response: %s", response)
+	}
+}
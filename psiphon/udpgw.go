@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// The client side of the udpgw protocol, which multiplexes many UDP port
+// forwards over a single TCP port forward. The Psiphon server intercepts
+// TCP port forwards to its UDPInterceptUdpgwServerAddress and handles the
+// udpgw protocol directly.
+//
+// The udpgw protocol and original server implementation:
+// Copyright (c) 2009, Ambroz Bizjak <ambrop7@gmail.com>
+// https://github.com/ambrop72/badvpn
+//
+// udpgw message layout:
+//
+// | 2 byte size | 1 byte flags | 2 byte conn ID | 6 or 18 byte address | variable length packet |
+//
+// The size, conn ID and address port are little endian, as in the server
+// implementation.
+const (
+	UDPGW_PROTOCOL_FLAG_KEEPALIVE = 1 << 0
+	UDPGW_PROTOCOL_FLAG_REBIND    = 1 << 1
+	UDPGW_PROTOCOL_FLAG_DNS       = 1 << 2
+	UDPGW_PROTOCOL_FLAG_IPV6      = 1 << 3
+
+	UDPGW_PROTOCOL_MAX_PREAMBLE_SIZE = 23
+	UDPGW_PROTOCOL_MAX_PAYLOAD_SIZE  = 32768
+	UDPGW_PROTOCOL_MAX_MESSAGE_SIZE  = UDPGW_PROTOCOL_MAX_PREAMBLE_SIZE + UDPGW_PROTOCOL_MAX_PAYLOAD_SIZE
+)
+
+// udpgwMessage is a udpgw protocol message. Each distinct conn ID is a
+// distinct UDP port forward, with its own remote address.
+type udpgwMessage struct {
+	flags      byte
+	connID     uint16
+	remoteIP   net.IP
+	remotePort uint16
+	packet     []byte
+}
+
+// writeUdpgwMessage writes the message to writer in a single write.
+// buffer must be at least UDPGW_PROTOCOL_MAX_MESSAGE_SIZE bytes.
+func writeUdpgwMessage(writer io.Writer, message *udpgwMessage, buffer []byte) error {
+
+	if len(message.packet) > UDPGW_PROTOCOL_MAX_PAYLOAD_SIZE {
+		return ContextError(errors.New("udpgw packet too large"))
+	}
+
+	flags := message.flags
+	remoteIP := message.remoteIP.To4()
+	if remoteIP == nil {
+		remoteIP = message.remoteIP.To16()
+		if remoteIP == nil {
+			return ContextError(errors.New("invalid udpgw remote IP"))
+		}
+		flags |= UDPGW_PROTOCOL_FLAG_IPV6
+	}
+
+	preambleSize := 7 + len(remoteIP)
+	size := preambleSize - 2 + len(message.packet)
+
+	buffer[0] = byte(size)
+	buffer[1] = byte(size >> 8)
+	buffer[2] = flags
+	buffer[3] = byte(message.connID)
+	buffer[4] = byte(message.connID >> 8)
+	copy(buffer[5:], remoteIP)
+	buffer[5+len(remoteIP)] = byte(message.remotePort)
+	buffer[6+len(remoteIP)] = byte(message.remotePort >> 8)
+	copy(buffer[preambleSize:], message.packet)
+
+	_, err := writer.Write(buffer[0 : preambleSize+len(message.packet)])
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// readUdpgwMessage reads the next message from reader, skipping keep
+// alives. buffer must be at least UDPGW_PROTOCOL_MAX_MESSAGE_SIZE bytes.
+// The returned message.packet references memory in buffer, which is
+// overwritten by the next readUdpgwMessage call.
+func readUdpgwMessage(reader io.Reader, buffer []byte) (*udpgwMessage, error) {
+
+	for {
+		_, err := io.ReadFull(reader, buffer[0:2])
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		size := int(buffer[0]) | int(buffer[1])<<8
+		if size < 3 || size > len(buffer)-2 {
+			return nil, ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		_, err = io.ReadFull(reader, buffer[2:2+size])
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		flags := buffer[2]
+		if flags&UDPGW_PROTOCOL_FLAG_KEEPALIVE != 0 {
+			continue
+		}
+
+		ipLength := net.IPv4len
+		if flags&UDPGW_PROTOCOL_FLAG_IPV6 != 0 {
+			ipLength = net.IPv6len
+		}
+		preambleSize := 7 + ipLength
+		if size+2 < preambleSize {
+			return nil, ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		remoteIP := make(net.IP, ipLength)
+		copy(remoteIP, buffer[5:5+ipLength])
+
+		return &udpgwMessage{
+			flags:      flags,
+			connID:     uint16(buffer[3]) | uint16(buffer[4])<<8,
+			remoteIP:   remoteIP,
+			remotePort: uint16(buffer[5+ipLength]) | uint16(buffer[6+ipLength])<<8,
+			packet:     buffer[preambleSize : 2+size],
+		}, nil
+	}
+}